@@ -8,117 +8,242 @@ Contact: gianmarco.decola@studio.unibo.it
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
 	"os"
 	"os/exec"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	nest_ca "github.com/m4rkdc/nebula_est/nest_ca/pkg/logic"
+	"github.com/m4rkdc/nebula_est/nest_service/pkg/config"
+	"github.com/m4rkdc/nebula_est/nest_service/pkg/health"
+	"github.com/m4rkdc/nebula_est/nest_service/pkg/logging"
+	"github.com/m4rkdc/nebula_est/nest_service/pkg/metrics"
+	"github.com/m4rkdc/nebula_est/nest_service/pkg/models"
+	"github.com/m4rkdc/nebula_est/nest_service/pkg/rpc"
+	"github.com/m4rkdc/nebula_est/nest_service/pkg/tracing"
 	"github.com/m4rkdc/nebula_est/nest_service/pkg/utils"
 )
 
 /*
-nest_ca is a REST API server which acts as a Nebula CA service for the NEST system.
-In the main function, the proper environment is set up before starting a Gin http server over a
-Nebula network for authentication and confidentiality among the peers (NEST , NEST_CA and NEST_CONFIG services)
+startNebula checks that the Nebula certificate, key and configuration of the service are in nebula_folder, then starts and supervises
+the Nebula overlay of the service. The returned file, receiving the Nebula output, must be closed after Nebula is stopped.
 */
-func main() {
-	if val, ok := os.LookupEnv("LOG_FILE"); ok {
-		utils.Log_file = val
+func startNebula(nebula_folder string) (*utils.NebulaSupervisor, *os.File) {
+	if _, err := os.Stat(nebula_folder + "nest_ca.crt"); err != nil {
+		slog.Error("Cannot find NEST CA Nebula certificate")
+		os.Exit(5)
+	}
+	if _, err := os.Stat(nebula_folder + "nest_ca.key"); err != nil {
+		slog.Error("Cannot find NEST CA Nebula key")
+		os.Exit(6)
+	}
+	if _, err := os.Stat(nebula_folder + "nest_system_ca.crt"); err != nil {
+		slog.Error("Cannot find NEST CA ca crt")
+		os.Exit(7)
 	}
 
-	if val, ok := os.LookupEnv("SERVICE_IP"); ok {
-		utils.Ca_service_ip = val
+	if _, err := os.Stat(nebula_folder + "config.yml"); err != nil {
+		slog.Error("Cannot find NEST Nebula config")
+		os.Exit(8)
 	}
-	if val, ok := os.LookupEnv("SERVICE_PORT"); ok {
 
-		utils.Ca_service_port = val
+	nebula_log, err := os.OpenFile(nebula_folder+"nest_ca_nebula.log", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		slog.Error("There was an error creating nebula log file", "error", err)
+		os.Exit(8)
 	}
-	if val, ok := os.LookupEnv("CERTIFICATES_PATH"); ok {
-		utils.Certificates_path = val
+	nebula := utils.NewNebulaSupervisor(nebula_folder, nebula_log)
+	if err := nebula.Start(); err != nil {
+		slog.Error("There was an error setting up the Nebula tunnel", "error", err)
+		os.Exit(9)
 	}
-	if val, ok := os.LookupEnv("CA_BIN_PATH"); ok {
-		utils.Ca_bin = val
+	return nebula, nebula_log
+}
+
+/*
+reload reloads the configuration of the service when it receives a SIGHUP, from the flags, environment and configuration file it was started with.
+nebula is nil in mtls transport mode.
+The log level is applied and the Nebula configuration is reloaded. The other settings require a restart.
+*/
+func reload(nebula *utils.NebulaSupervisor) {
+	cfg := config.DefaultCa()
+	if _, err := config.Load("nest_ca", &cfg, os.Args[1:], os.LookupEnv); err != nil {
+		slog.Error("SIGHUP received: invalid configuration, keeping the previous one", "error", err)
+		return
 	}
-	if val, ok := os.LookupEnv("CA_KEYS_PATH"); ok {
-		utils.Ca_keys_path = val
+	logging.SetLevel(cfg.Log.Level)
+	if nebula != nil {
+		if err := nebula.Reload(); err != nil {
+			slog.Warn("Could not reload the Nebula configuration", "error", err)
+		}
 	}
+	slog.Info("SIGHUP received: configuration reloaded")
+}
 
-	if val, ok := os.LookupEnv("NEBULA_FOLDER"); ok {
-		utils.Nebula_folder = val
+/*
+networkConfigs returns the configurations of the NEST CA service instances: one per Nebula network in multi-tenant deployments,
+cfg itself in single network deployments.
+*/
+func networkConfigs(cfg *config.Ca) ([]config.Ca, error) {
+	if len(cfg.Networks.Names) == 0 {
+		return []config.Ca{*cfg}, nil
 	}
-	if val, ok := os.LookupEnv("CERTS_VALIDITY"); ok {
-		utils.Certs_validity = val
+	var configs []config.Ca
+	for _, name := range cfg.Networks.Names {
+		network_cfg, err := cfg.ForNetwork(name)
+		if err != nil {
+			return nil, fmt.Errorf("network %s: %v", name, err)
+		}
+		configs = append(configs, network_cfg)
 	}
+	return configs, nil
+}
 
-	fmt.Println("NEST CA service: starting setup")
-
-	if _, err := os.Stat(utils.Certificates_path); err != nil {
-		fmt.Printf("%s doesn't exist. Creating the folder\n", utils.Certificates_path)
-		if err := os.Mkdir(utils.Certificates_path, 0700); err != nil {
-			fmt.Printf("Couldn't create certificates directory: %v\n", err)
+// setupNetwork creates the certificates folder and the Nebula CA keys of the instance with configuration cfg, if they do not exist
+func setupNetwork(cfg *config.Ca) {
+	if _, err := os.Stat(cfg.CertificatesPath); err != nil {
+		slog.Info("Certificates folder doesn't exist. Creating the folder", "path", cfg.CertificatesPath)
+		if err := os.Mkdir(cfg.CertificatesPath, 0700); err != nil {
+			slog.Error("Couldn't create certificates directory", "error", err)
 			os.Exit(1)
 		}
 	}
-	info, err := os.Stat(utils.Ca_bin)
-	if err != nil {
-		fmt.Printf("%s doesn't exist. Cannot proceed. Please provide the nebula-cert bin to the service before starting it\nExiting...", utils.Ca_bin)
-		os.Exit(2)
-	}
-	if !utils.IsExecOwner(info.Mode()) {
-		os.Chmod(utils.Ca_bin, 0700)
-	}
-
-	info, err = os.Stat(utils.Ca_keys_path + "ca.key")
+	info, err := os.Stat(cfg.CaKeysPath + "ca.key")
 	if err != nil {
-		fmt.Printf("%sca.key doesn't exist. Creating Nebula CA keys...\n", utils.Ca_keys_path)
-		cmd := exec.Command(utils.Ca_bin, "ca -name ca -out-key "+utils.Ca_keys_path+"ca.key"+" -out-crt "+utils.Ca_keys_path+"ca.crt")
+		slog.Info("ca.key doesn't exist. Creating Nebula CA keys...", "path", cfg.CaKeysPath)
+		cmd := exec.Command(cfg.CaBin, "ca -name ca -out-key "+cfg.CaKeysPath+"ca.key"+" -out-crt "+cfg.CaKeysPath+"ca.crt")
 		err = cmd.Run()
 		if err != nil {
-			fmt.Println("Error creating Nebula keys. Exiting...")
+			slog.Error("Error creating Nebula keys. Exiting...", "error", err)
 			os.Exit(3)
 		}
 	}
 	if !utils.IsRWOwner(info.Mode()) {
-		os.Chmod(utils.Ca_keys_path+"ca.key", 0600)
-		os.Chmod(utils.Ca_keys_path+"ca.crt", 0600)
+		os.Chmod(cfg.CaKeysPath+"ca.key", 0600)
+		os.Chmod(cfg.CaKeysPath+"ca.crt", 0600)
 	}
+}
 
-	if _, err := os.Stat(utils.Nebula_folder + "nest_ca.crt"); err != nil {
-		fmt.Printf("Cannot find NEST CA Nebula certificate\n")
-		os.Exit(5)
+/*
+nest_ca is a REST API server which acts as a Nebula CA service for the NEST system.
+In the main function, the proper environment is set up before starting a Gin http server over a
+Nebula network for authentication and confidentiality among the peers (NEST , NEST_CA and NEST_CONFIG services)
+*/
+func main() {
+	cfg := config.DefaultCa()
+	print_config, err := config.Load("nest_ca", &cfg, os.Args[1:], os.LookupEnv)
+	if err != nil {
+		slog.Error("Invalid configuration", "error", err)
+		os.Exit(11)
 	}
-	if _, err := os.Stat(utils.Nebula_folder + "nest_ca.key"); err != nil {
-		fmt.Printf("Cannot find NEST CA Nebula key\n")
-		os.Exit(6)
+	if print_config {
+		config.Print(os.Stdout, &cfg)
+		return
 	}
-	if _, err := os.Stat(utils.Nebula_folder + "nest_system_ca.crt"); err != nil {
-		fmt.Printf("Cannot find NEST CA ca crt\n")
-		os.Exit(7)
+	log_file, err := logging.Setup(cfg.Log, "nest_ca")
+	if err != nil {
+		fmt.Printf("Could not open the log file: %v\n", err)
+		os.Exit(12)
+	}
+	defer log_file.Close()
+	shutdown_tracing, err := tracing.Setup(cfg.Tracing, "nest_ca")
+	if err != nil {
+		slog.Error("Could not set up the tracing", "error", err)
+		os.Exit(13)
 	}
 
-	if _, err := os.Stat(utils.Nebula_folder + "config.yml"); err != nil {
-		fmt.Printf("Cannot find NEST Nebula config\n")
-		os.Exit(8)
+	slog.Info("NEST CA service: starting setup")
+
+	configs, err := networkConfigs(&cfg)
+	if err != nil {
+		slog.Error("Invalid network configuration", "error", err)
+		os.Exit(11)
+	}
+	info, err := os.Stat(cfg.CaBin)
+	if err != nil {
+		slog.Error("nebula-cert bin doesn't exist. Cannot proceed. Please provide the nebula-cert bin to the service before starting it", "path", cfg.CaBin)
+		os.Exit(2)
+	}
+	if !utils.IsExecOwner(info.Mode()) {
+		os.Chmod(cfg.CaBin, 0700)
+	}
+
+	for i := range configs {
+		setupNetwork(&configs[i])
 	}
 
-	nebula_log, err := os.OpenFile(utils.Nebula_folder+"nest_ca_nebula.log", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	var nebula *utils.NebulaSupervisor
+	var transport_tls *tls.Config
+	if cfg.Transport.Mode == config.TRANSPORT_MTLS {
+		transport_tls, err = utils.MutualTLSServerConfig(cfg.Transport.Folder, "nest_ca", cfg.Transport.Peers)
+		if err != nil {
+			slog.Error("Cannot load the mutual TLS transport certificates", "error", err)
+			os.Exit(14)
+		}
+		slog.Warn("Mutual TLS transport: the NEST services communicate without the Nebula overlay")
+	} else {
+		var nebula_log *os.File
+		nebula, nebula_log = startNebula(cfg.NebulaFolder)
+		defer nebula_log.Close()
+		defer nebula.Stop()
+	}
+	// exit stops Nebula, if running, before exiting, since the deferred calls are not run by os.Exit
+	exit := func(code int) {
+		if nebula != nil {
+			nebula.Stop()
+		}
+		os.Exit(code)
+	}
+
+	lis, err := net.Listen("tcp", cfg.ServiceIP+":"+cfg.GRPCPort)
 	if err != nil {
-		fmt.Printf("There was an error creating nebula log file: %v\n", err)
-		os.Exit(8)
+		slog.Error("Cannot listen for gRPC requests", "error", err)
+		exit(10)
 	}
-	defer nebula_log.Close()
-	if err := utils.SetupNebula(utils.Nebula_folder, nebula_log); err != nil {
-		fmt.Printf("There was an error setting up the Nebula tunnel:%v\n", err)
-		os.Exit(9)
+	// One instance per Nebula network, whose REST routes are served under the network path and gRPC calls are dispatched by network
+	ca_server := &nest_ca.CaServer{}
+	var routes []models.Route
+	var checks []health.Check
+	for i := range configs {
+		service := nest_ca.New(&configs[i])
+		if network := configs[i].Network; len(network) == 0 {
+			ca_server.Service = service
+		} else {
+			if ca_server.Networks == nil {
+				ca_server.Networks = make(map[string]*nest_ca.Service)
+			}
+			ca_server.Networks[network] = service
+		}
+		routes = append(routes, models.NetworkRoutes(configs[i].Network, service.Routes())...)
+		checks = append(checks,
+			health.InNetwork(configs[i].Network, health.File("ca_key", configs[i].CaKeysPath+"ca.key")),
+			health.InNetwork(configs[i].Network, health.File("ca_cert", configs[i].CaKeysPath+"ca.crt")),
+		)
 	}
+	grpc_server := rpc.NewServer(transport_tls)
+	models.RegisterCaServiceServer(grpc_server, ca_server)
+	failed := make(chan error, 2)
+	utils.Serve(func() error { return grpc_server.Serve(lis) }, failed)
 
-	fmt.Println("NEST CA service: setup finished")
+	slog.Info("NEST CA service: setup finished")
 
-	router := gin.Default()
+	gin.SetMode(gin.ReleaseMode)
+	router := gin.New()
+	router.Use(gin.Recovery(), tracing.Middleware(), logging.Middleware())
 	router.SetTrustedProxies(nil)
-	utils.SetupLogger(router, utils.Log_file)
-	for _, r := range nest_ca.Ca_routes {
+	metrics.Setup(router)
+	checks = append(checks, health.File("nebula_cert_bin", cfg.CaBin))
+	if nebula != nil {
+		checks = append([]health.Check{health.Nebula(nebula)}, checks...)
+	}
+	health.Setup(router, checks...)
+	for _, r := range routes {
 		switch r.Method {
 		case "GET":
 			router.GET(r.Pattern, r.HandlerFunc)
@@ -127,5 +252,31 @@ func main() {
 		}
 	}
 
-	router.Run(utils.Ca_service_ip + ":" + utils.Ca_service_port)
+	srv := http.Server{
+		Addr:      cfg.ServiceIP + ":" + cfg.ServicePort,
+		Handler:   router,
+		TLSConfig: transport_tls,
+	}
+	if transport_tls != nil {
+		utils.Serve(func() error { return srv.ListenAndServeTLS("", "") }, failed)
+	} else {
+		utils.Serve(srv.ListenAndServe, failed)
+	}
+	if err := utils.WaitForShutdown(func(context.Context) { reload(nebula) }, failed); err != nil {
+		slog.Error("Error in serving requests", "error", err)
+	}
+
+	// Shutdown: the REST and gRPC requests in progress are drained, then the traces are flushed, within the shutdown timeout. Nebula is stopped last, by the deferred calls
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(cfg.ShutdownTimeout))
+	defer cancel()
+	if err := utils.ShutdownHTTP(ctx, &srv); err != nil {
+		slog.Warn("The REST requests in progress did not complete in time, their connections were closed", "error", err)
+	}
+	if err := rpc.Shutdown(ctx, grpc_server); err != nil {
+		slog.Warn("The gRPC requests in progress did not complete in time, they were canceled", "error", err)
+	}
+	if err := shutdown_tracing(ctx); err != nil {
+		slog.Warn("Could not flush the traces", "error", err)
+	}
+	slog.Info("NEST CA service: shut down")
 }
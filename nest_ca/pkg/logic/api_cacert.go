@@ -13,12 +13,11 @@ import (
 
 	"github.com/gin-gonic/gin"
 	"github.com/m4rkdc/nebula_est/nest_service/pkg/models"
-	"github.com/m4rkdc/nebula_est/nest_service/pkg/utils"
 )
 
 // The getCaCertFomFile function gets the Nebula CA certs from the Ca_cert_file and returns them.
-func getCaCertFromFile() ([]byte, error) {
-	b, err := os.ReadFile(utils.Ca_keys_path + "ca.crt")
+func (s *Service) getCaCertFromFile() ([]byte, error) {
+	b, err := os.ReadFile(s.Config.CaKeysPath + "ca.crt")
 	if err != nil {
 		return nil, err
 	}
@@ -42,12 +41,13 @@ func getCaCertFromFile() ([]byte, error) {
 }
 
 // The Cacerts REST endpoint returns the Nebula CA(s) certificates to the nest_service
-func Cacerts(c *gin.Context) {
-	ca_certs, err := getCaCertFromFile()
-	//b, err := os.ReadFile(utils.Ca_keys_path + "ca.crt")
+func (s *Service) Cacerts(c *gin.Context) {
+	ca_certs, err := s.getCaCertFromFile()
+	//b, err := os.ReadFile(s.Config.CaKeysPath + "ca.crt")
 
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, models.ApiError{Code: 500, Message: "Internal Server Error: " + err.Error()})
+		return
 	}
 	c.JSON(http.StatusOK, ca_certs)
 
@@ -7,24 +7,26 @@ import (
 	"testing"
 
 	"github.com/go-playground/assert/v2"
-	"github.com/m4rkdc/nebula_est/nest_service/pkg/utils"
+	"github.com/m4rkdc/nebula_est/nest_service/pkg/config"
 	nest_test "github.com/m4rkdc/nebula_est/nest_service/test"
 )
 
 func TestCacerts(t *testing.T) {
-	var endpoint = Ca_routes[0]
+	cfg := config.DefaultCa()
+	s := New(&cfg)
+	var endpoint = s.Routes()[0]
 	r := nest_test.MockRouterForEndpoint(&endpoint)
 
 	//First test: cannot find the ca.crt file
-	utils.Ca_keys_path = "./"
+	cfg.CaKeysPath = "./"
 	reqError, _ := http.NewRequest(endpoint.Method, endpoint.Pattern, nil)
 	resp := httptest.NewRecorder()
 	r.ServeHTTP(resp, reqError)
 	assert.Equal(t, http.StatusInternalServerError, resp.Code)
 
 	//Second test: success
-	utils.Ca_keys_path = "../../test/config/keys/"
-	certs, _ := getCaCertFromFile()
+	cfg.CaKeysPath = "../../test/config/keys/"
+	certs, _ := s.getCaCertFromFile()
 	reqOk, _ := http.NewRequest(endpoint.Method, endpoint.Pattern, nil)
 	resp = httptest.NewRecorder()
 	r.ServeHTTP(resp, reqOk)
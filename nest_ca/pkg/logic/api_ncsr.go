@@ -8,47 +8,64 @@
 package nest_ca
 
 import (
-	"fmt"
+	"context"
+	"log/slog"
 	"net/http"
 	"os"
 	"os/exec"
 	"reflect"
 	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/m4rkdc/nebula_est/nest_service/pkg/config"
+	"github.com/m4rkdc/nebula_est/nest_service/pkg/metrics"
 	"github.com/m4rkdc/nebula_est/nest_service/pkg/models"
-	"github.com/m4rkdc/nebula_est/nest_service/pkg/utils"
+	"github.com/m4rkdc/nebula_est/nest_service/pkg/tracing"
 	"github.com/slackhq/nebula/cert"
 	"google.golang.org/protobuf/proto"
 )
 
-var Ca_routes = [3]models.Route{
-	{
-		Name:        "Cacerts",
-		Method:      "GET",
-		Pattern:     "/cacerts",
-		HandlerFunc: Cacerts,
-	},
-	{
-		Name:        "CertificateSign",
-		Method:      "POST",
-		Pattern:     "/ncsr/sign",
-		HandlerFunc: CertificateSign,
-	},
-	{
-		Name:        "GenerateKeys",
-		Method:      "POST",
-		Pattern:     "/ncsr/generate",
-		HandlerFunc: GenerateKeys,
-	},
+// A NEST CA service instance. Every setting is read from its configuration, so that several instances can run in the same process
+type Service struct {
+	Config *config.Ca
 }
 
-func checkPublicKey(raw_csr *models.RawNebulaCsr) bool {
-	certificates, _ := os.ReadDir(utils.Certificates_path)
+// New creates a NEST CA service instance with the given configuration
+func New(cfg *config.Ca) *Service {
+	return &Service{Config: cfg}
+}
+
+// Routes returns the REST API routes of the NEST CA service instance
+func (s *Service) Routes() []models.Route {
+	return []models.Route{
+		{
+			Name:        "Cacerts",
+			Method:      "GET",
+			Pattern:     "/cacerts",
+			HandlerFunc: s.Cacerts,
+		},
+		{
+			Name:        "CertificateSign",
+			Method:      "POST",
+			Pattern:     "/ncsr/sign",
+			HandlerFunc: s.CertificateSign,
+		},
+		{
+			Name:        "GenerateKeys",
+			Method:      "POST",
+			Pattern:     "/ncsr/generate",
+			HandlerFunc: s.GenerateKeys,
+		},
+	}
+}
+
+func (s *Service) checkPublicKey(raw_csr *models.RawNebulaCsr) bool {
+	certificates, _ := os.ReadDir(s.Config.CertificatesPath)
 	if len(raw_csr.PublicKey) != 0 {
 		for _, f := range certificates {
 			if strings.HasSuffix(f.Name(), ".crt") {
-				b, _ := os.ReadFile(utils.Certificates_path + f.Name())
+				b, _ := os.ReadFile(s.Config.CertificatesPath + f.Name())
 
 				nc, _, _ := cert.UnmarshalNebulaCertificateFromPEM(b)
 				if reflect.DeepEqual(nc.Details.PublicKey, raw_csr.PublicKey) {
@@ -57,7 +74,7 @@ func checkPublicKey(raw_csr *models.RawNebulaCsr) bool {
 			}
 		}
 	} else if !*raw_csr.Rekey {
-		b, _ := os.ReadFile(utils.Certificates_path + raw_csr.Hostname + ".crt")
+		b, _ := os.ReadFile(s.Config.CertificatesPath + raw_csr.Hostname + ".crt")
 		nc, _, _ := cert.UnmarshalNebulaCertificateFromPEM(b)
 		raw_csr.PublicKey = nc.Details.PublicKey
 		return false
@@ -69,8 +86,8 @@ func checkPublicKey(raw_csr *models.RawNebulaCsr) bool {
 }
 
 // the readExistingCert function verifies if the given hostname has already an issued certificate. If so, fills the empty fields of its Nebula CSR.
-func readExistingCert(csr *models.RawNebulaCsr) error {
-	b, err := os.ReadFile(utils.Certificates_path + csr.Hostname + ".crt")
+func (s *Service) readExistingCert(csr *models.RawNebulaCsr) error {
+	b, err := os.ReadFile(s.Config.CertificatesPath + csr.Hostname + ".crt")
 	if err != nil {
 		return &models.ApiError{Code: 500, Message: "Internal server error: " + err.Error()}
 	}
@@ -80,7 +97,7 @@ func readExistingCert(csr *models.RawNebulaCsr) error {
 		return &models.ApiError{Code: 500, Message: "Internal server error: " + err.Error()}
 	}
 
-	err = os.Remove(utils.Certificates_path + csr.Hostname + ".crt")
+	err = os.Remove(s.Config.CertificatesPath + csr.Hostname + ".crt")
 	if err != nil {
 		return &models.ApiError{Code: 500, Message: "Internal server error: " + err.Error()}
 	}
@@ -97,8 +114,26 @@ func readExistingCert(csr *models.RawNebulaCsr) error {
 /*
  * The generateCertificate function creates a new Nebula certificate for the given Nebula CSR.
  * To do so, it either signs the client-provided public key or generates the Nebula key pair and then signs it depending on the option discriminator (ENROLL, SERVERKEYGEN))
+ * The time spent is recorded in the CA signing duration metric.
  */
-func generateCertificate(csr *models.RawNebulaCsr, option int) (*models.CaResponse, error) {
+func (s *Service) generateCertificate(ctx context.Context, csr *models.RawNebulaCsr, option int) (ca_response *models.CaResponse, err error) {
+	operation := "sign"
+	if option == models.SERVERKEYGEN {
+		operation = "generate"
+	}
+	defer func(start time.Time) {
+		result := "success"
+		if err != nil {
+			result = "error"
+		}
+		metrics.ObserveSince(metrics.CaSigningDuration.WithLabelValues(operation, result), start)
+	}(time.Now())
+
+	return s.signCertificate(ctx, csr, option)
+}
+
+// signCertificate runs nebula-cert to create the Nebula certificate (and, if needed, the key pair) for the given Nebula CSR.
+func (s *Service) signCertificate(ctx context.Context, csr *models.RawNebulaCsr, option int) (*models.CaResponse, error) {
 	var (
 		ca_response = &models.CaResponse{}
 		groups      string
@@ -111,15 +146,15 @@ func generateCertificate(csr *models.RawNebulaCsr, option int) (*models.CaRespon
 
 	ip = *csr.Ip
 	if option == models.SERVERKEYGEN {
-		out, err := exec.Command(utils.Ca_bin, "keygen", "-out-pub", utils.Certificates_path+csr.Hostname+".pub", "-out-key", utils.Certificates_path+csr.Hostname+".key").CombinedOutput()
+		out, err := tracing.CombinedOutput(ctx, "nebula-cert keygen", exec.Command(s.Config.CaBin, "keygen", "-out-pub", s.Config.CertificatesPath+csr.Hostname+".pub", "-out-key", s.Config.CertificatesPath+csr.Hostname+".key"))
 		if err != nil {
 			return nil, &models.ApiError{Code: 500, Message: "Internal server error: " + err.Error() + string(out)}
 		}
-		b, err := os.ReadFile(utils.Certificates_path + csr.Hostname + ".key")
+		b, err := os.ReadFile(s.Config.CertificatesPath + csr.Hostname + ".key")
 		if err != nil {
 			return nil, &models.ApiError{Code: 500, Message: "Internal server error: " + err.Error()}
 		}
-		err = os.Remove(utils.Certificates_path + csr.Hostname + ".key")
+		err = os.Remove(s.Config.CertificatesPath + csr.Hostname + ".key")
 		if err != nil {
 			return nil, &models.ApiError{Code: 500, Message: "Internal server error: " + err.Error()}
 		}
@@ -133,27 +168,27 @@ func generateCertificate(csr *models.RawNebulaCsr, option int) (*models.CaRespon
 
 	var out []byte
 	if len(groups) == 0 {
-		if len(utils.Certs_validity) == 0 {
-			out, err = exec.Command(utils.Ca_bin, "sign", "-ca-crt", utils.Ca_keys_path+"ca.crt", "-ca-key", utils.Ca_keys_path+"ca.key", "-in-pub", utils.Certificates_path+csr.Hostname+".pub", "-name", csr.Hostname, "-out-crt", utils.Certificates_path+csr.Hostname+".crt", "-ip", ip).CombinedOutput()
+		if s.Config.CertsValidity == 0 {
+			out, err = tracing.CombinedOutput(ctx, "nebula-cert sign", exec.Command(s.Config.CaBin, "sign", "-ca-crt", s.Config.CaKeysPath+"ca.crt", "-ca-key", s.Config.CaKeysPath+"ca.key", "-in-pub", s.Config.CertificatesPath+csr.Hostname+".pub", "-name", csr.Hostname, "-out-crt", s.Config.CertificatesPath+csr.Hostname+".crt", "-ip", ip))
 		} else {
-			out, err = exec.Command(utils.Ca_bin, "sign", "-ca-crt", utils.Ca_keys_path+"ca.crt", "-ca-key", utils.Ca_keys_path+"ca.key", "-in-pub", utils.Certificates_path+csr.Hostname+".pub", "-name", csr.Hostname, "-out-crt", utils.Certificates_path+csr.Hostname+".crt", "-ip", ip, "-duration", utils.Certs_validity).CombinedOutput()
+			out, err = tracing.CombinedOutput(ctx, "nebula-cert sign", exec.Command(s.Config.CaBin, "sign", "-ca-crt", s.Config.CaKeysPath+"ca.crt", "-ca-key", s.Config.CaKeysPath+"ca.key", "-in-pub", s.Config.CertificatesPath+csr.Hostname+".pub", "-name", csr.Hostname, "-out-crt", s.Config.CertificatesPath+csr.Hostname+".crt", "-ip", ip, "-duration", s.Config.CertsValidity.String()))
 		}
 	} else {
-		if len(utils.Certs_validity) == 0 {
-			out, err = exec.Command(utils.Ca_bin, "sign", "-ca-crt", utils.Ca_keys_path+"ca.crt", "-ca-key", utils.Ca_keys_path+"ca.key", "-in-pub", utils.Certificates_path+csr.Hostname+".pub", "-groups", groups[:len(groups)-1], "-name", csr.Hostname, "-out-crt", utils.Certificates_path+csr.Hostname+".crt", "-ip", ip).CombinedOutput()
+		if s.Config.CertsValidity == 0 {
+			out, err = tracing.CombinedOutput(ctx, "nebula-cert sign", exec.Command(s.Config.CaBin, "sign", "-ca-crt", s.Config.CaKeysPath+"ca.crt", "-ca-key", s.Config.CaKeysPath+"ca.key", "-in-pub", s.Config.CertificatesPath+csr.Hostname+".pub", "-groups", groups[:len(groups)-1], "-name", csr.Hostname, "-out-crt", s.Config.CertificatesPath+csr.Hostname+".crt", "-ip", ip))
 		} else {
-			out, err = exec.Command(utils.Ca_bin, "sign", "-ca-crt", utils.Ca_keys_path+"ca.crt", "-ca-key", utils.Ca_keys_path+"ca.key", "-in-pub", utils.Certificates_path+csr.Hostname+".pub", "-groups", groups[:len(groups)-1], "-name", csr.Hostname, "-out-crt", utils.Certificates_path+csr.Hostname+".crt", "-ip", ip, "-duration", utils.Certs_validity).CombinedOutput()
+			out, err = tracing.CombinedOutput(ctx, "nebula-cert sign", exec.Command(s.Config.CaBin, "sign", "-ca-crt", s.Config.CaKeysPath+"ca.crt", "-ca-key", s.Config.CaKeysPath+"ca.key", "-in-pub", s.Config.CertificatesPath+csr.Hostname+".pub", "-groups", groups[:len(groups)-1], "-name", csr.Hostname, "-out-crt", s.Config.CertificatesPath+csr.Hostname+".crt", "-ip", ip, "-duration", s.Config.CertsValidity.String()))
 		}
 	}
 	if err != nil {
 		return nil, &models.ApiError{Code: 500, Message: "Internal server error: " + err.Error() + string(out)}
 	}
 
-	if err = os.Remove(utils.Certificates_path + csr.Hostname + ".pub"); err != nil {
+	if err = os.Remove(s.Config.CertificatesPath + csr.Hostname + ".pub"); err != nil {
 		return nil, &models.ApiError{Code: 500, Message: "Internal server error: " + err.Error()}
 	}
 
-	b, err := os.ReadFile(utils.Certificates_path + csr.Hostname + ".crt")
+	b, err := os.ReadFile(s.Config.CertificatesPath + csr.Hostname + ".crt")
 	if err != nil {
 		return nil, &models.ApiError{Code: 500, Message: "Internal server error: " + err.Error()}
 	}
@@ -169,83 +204,111 @@ func generateCertificate(csr *models.RawNebulaCsr, option int) (*models.CaRespon
 	return ca_response, nil
 }
 
-func getRawCaResponse(ca_response *models.CaResponse) ([]byte, error) {
+// toRawCaResponse converts the CA response to its protobuf representation, sent to the NEST service
+func toRawCaResponse(ctx context.Context, ca_response *models.CaResponse) (*models.RawCaResponse, error) {
 	raw_bytes, err := ca_response.NebulaCert.Marshal()
 	if err != nil {
-		fmt.Println("Error in marshalling ca_response.NebulaCert:" + err.Error())
+		slog.ErrorContext(ctx, "Error in marshalling ca_response.NebulaCert", "error", err)
 		return nil, &models.ApiError{Code: 500, Message: "Internal Server Error: " + err.Error()}
 	}
 	raw_cert := &cert.RawNebulaCertificate{}
-	if proto.Unmarshal(raw_bytes, raw_cert) != nil {
-		fmt.Println("Error in unmarshalling RawNebulaCert:" + err.Error())
+	if err = proto.Unmarshal(raw_bytes, raw_cert); err != nil {
+		slog.ErrorContext(ctx, "Error in unmarshalling RawNebulaCert", "error", err)
 		return nil, &models.ApiError{Code: 500, Message: "Internal Server Error: " + err.Error()}
 	}
-	raw_ca_response := models.RawCaResponse{
+	raw_ca_response := &models.RawCaResponse{
 		NebulaCert: raw_cert,
 	}
 	if len(ca_response.NebulaPrivateKey) != 0 {
 		raw_ca_response.NebulaPrivateKey = ca_response.NebulaPrivateKey
 	}
-	b, err := proto.Marshal(&raw_ca_response)
+	return raw_ca_response, nil
+}
+
+// getRawCaResponse returns the proto-marshaled CA response, sent in the REST API responses
+func getRawCaResponse(ctx context.Context, raw_ca_response *models.RawCaResponse) ([]byte, error) {
+	b, err := proto.Marshal(raw_ca_response)
 	if err != nil {
-		fmt.Println("Error in marshalling RawCaResponse:" + err.Error())
+		slog.ErrorContext(ctx, "Error in marshalling RawCaResponse", "error", err)
 		return nil, &models.ApiError{Code: 500, Message: "Internal Server Error: " + err.Error()}
 	}
 	return b, nil
 }
 
 /*
- * The CertificateSign REST endpoint creates a new Nebula certificate by signing the client provided Nebula Public Key.
- * It verifies if the provided Proof of Possession is valid for the given Public key before returning the certificate back to the client.
+ * The certificateSign function creates a new Nebula certificate by signing the client provided Nebula Public Key.
+ * It verifies that the provided public key is not used by another host before signing it.
  */
-func CertificateSign(c *gin.Context) {
-	var raw_csr models.RawNebulaCsr
-
-	if err := c.ShouldBindJSON(&raw_csr); err != nil {
-		c.JSON(http.StatusBadRequest, models.ApiError{Code: 400, Message: "Bad request: no Nebula Certificate Signing Request provided"})
-		return
-	}
+func (s *Service) certificateSign(ctx context.Context, raw_csr *models.RawNebulaCsr) (*models.RawCaResponse, error) {
 	// TODO: maybe replace with a Schnorr proof of knwoledge
-
-	if invalidPublickey := checkPublicKey(&raw_csr); invalidPublickey {
-		c.JSON(http.StatusBadRequest, models.ApiError{Code: 400, Message: "Bad request: the provided public key is already used by an already enrolled host"})
-		return
+	if invalidPublickey := s.checkPublicKey(raw_csr); invalidPublickey {
+		return nil, &models.ApiError{Code: 400, Message: "Bad request: the provided public key is already used by an already enrolled host"}
 	}
 	if raw_csr.Ip == nil || len(*raw_csr.Ip) == 0 {
-		if err := readExistingCert(&raw_csr); err != nil {
-			fmt.Println("Internal server Error: " + err.Error())
-			c.JSON(http.StatusInternalServerError, err)
-			return
+		if err := s.readExistingCert(raw_csr); err != nil {
+			slog.ErrorContext(ctx, "Internal server error", "error", err)
+			return nil, err
 		}
 	} else {
-		if _, err := os.Stat(utils.Certificates_path + raw_csr.Hostname + ".crt"); err == nil || !os.IsNotExist(err) {
-			os.Remove(utils.Certificates_path + raw_csr.Hostname + ".crt")
+		if _, err := os.Stat(s.Config.CertificatesPath + raw_csr.Hostname + ".crt"); err == nil || !os.IsNotExist(err) {
+			os.Remove(s.Config.CertificatesPath + raw_csr.Hostname + ".crt")
 		}
 	}
 
-	if err := os.WriteFile(utils.Certificates_path+raw_csr.Hostname+".pub", cert.MarshalX25519PublicKey(raw_csr.PublicKey), 0600); err != nil {
-		fmt.Println("Internal server Error: " + err.Error())
-		c.JSON(http.StatusInternalServerError, models.ApiError{Code: 500, Message: err.Error()})
-		return
+	if err := os.WriteFile(s.Config.CertificatesPath+raw_csr.Hostname+".pub", cert.MarshalX25519PublicKey(raw_csr.PublicKey), 0600); err != nil {
+		slog.ErrorContext(ctx, "Internal server error", "error", err)
+		return nil, &models.ApiError{Code: 500, Message: err.Error()}
 	}
 
-	ca_response, err := generateCertificate(&raw_csr, models.ENROLL)
+	ca_response, err := s.generateCertificate(ctx, raw_csr, models.ENROLL)
 	if err != nil {
-		fmt.Println("Internal server Error: " + err.Error())
-		c.JSON(http.StatusInternalServerError, err)
-		return
+		slog.ErrorContext(ctx, "Internal server error", "error", err)
+		return nil, err
+	}
+	return toRawCaResponse(ctx, ca_response)
+}
+
+// The generateKeys function creates a new Nebula certificate by generating the Nebula private key and certificate for the given hostname.
+func (s *Service) generateKeys(ctx context.Context, raw_csr *models.RawNebulaCsr) (*models.RawCaResponse, error) {
+	if raw_csr.Ip == nil || len(*raw_csr.Ip) == 0 {
+		if err := s.readExistingCert(raw_csr); err != nil {
+			slog.ErrorContext(ctx, "Internal server error", "error", err)
+			return nil, err
+		}
+	} else {
+		if _, err := os.Stat(s.Config.CertificatesPath + raw_csr.Hostname + ".crt"); err == nil || !os.IsNotExist(err) {
+			os.Remove(s.Config.CertificatesPath + raw_csr.Hostname + ".crt")
+		}
 	}
 
-	b, err := getRawCaResponse(ca_response)
+	ca_response, err := s.generateCertificate(ctx, raw_csr, models.SERVERKEYGEN)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, err)
+		return nil, err
 	}
+	return toRawCaResponse(ctx, ca_response)
+}
 
-	c.JSON(http.StatusOK, b)
+// respondCaResponse sends the result of a CA operation as a REST response
+func respondCaResponse(c *gin.Context, raw_ca_response *models.RawCaResponse, err error) {
+	if err == nil {
+		var b []byte
+		if b, err = getRawCaResponse(c.Request.Context(), raw_ca_response); err == nil {
+			c.JSON(http.StatusOK, b)
+			return
+		}
+	}
+	if api_error, ok := err.(*models.ApiError); ok {
+		c.JSON(api_error.Code, api_error)
+		return
+	}
+	c.JSON(http.StatusInternalServerError, models.ApiError{Code: 500, Message: "Internal Server Error: " + err.Error()})
 }
 
-// The GenerateKeys REST endpoint creates a new Nebula certificate by generating the Nebula private key and certificate for the given hostname.
-func GenerateKeys(c *gin.Context) {
+/*
+ * The CertificateSign REST endpoint creates a new Nebula certificate by signing the client provided Nebula Public Key.
+ * It verifies if the provided Proof of Possession is valid for the given Public key before returning the certificate back to the client.
+ */
+func (s *Service) CertificateSign(c *gin.Context) {
 	var raw_csr models.RawNebulaCsr
 
 	if err := c.ShouldBindJSON(&raw_csr); err != nil {
@@ -253,27 +316,19 @@ func GenerateKeys(c *gin.Context) {
 		return
 	}
 
-	if raw_csr.Ip == nil || len(*raw_csr.Ip) == 0 {
-		if err := readExistingCert(&raw_csr); err != nil {
-			fmt.Println("Internal server Error: " + err.Error())
-			c.JSON(http.StatusInternalServerError, models.ApiError{Code: 500, Message: err.Error()})
-			return
-		}
-	} else {
-		if _, err := os.Stat(utils.Certificates_path + raw_csr.Hostname + ".crt"); err == nil || !os.IsNotExist(err) {
-			os.Remove(utils.Certificates_path + raw_csr.Hostname + ".crt")
-		}
-	}
+	raw_ca_response, err := s.certificateSign(c.Request.Context(), &raw_csr)
+	respondCaResponse(c, raw_ca_response, err)
+}
 
-	ca_response, err := generateCertificate(&raw_csr, models.SERVERKEYGEN)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, err)
+// The GenerateKeys REST endpoint creates a new Nebula certificate by generating the Nebula private key and certificate for the given hostname.
+func (s *Service) GenerateKeys(c *gin.Context) {
+	var raw_csr models.RawNebulaCsr
+
+	if err := c.ShouldBindJSON(&raw_csr); err != nil {
+		c.JSON(http.StatusBadRequest, models.ApiError{Code: 400, Message: "Bad request: no Nebula Certificate Signing Request provided"})
 		return
 	}
-	b, err := getRawCaResponse(ca_response)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, err)
-	}
 
-	c.JSON(http.StatusOK, b)
+	raw_ca_response, err := s.generateKeys(c.Request.Context(), &raw_csr)
+	respondCaResponse(c, raw_ca_response, err)
 }
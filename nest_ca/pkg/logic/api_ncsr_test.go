@@ -10,8 +10,8 @@ import (
 
 	"github.com/gin-gonic/gin"
 	"github.com/go-playground/assert/v2"
+	"github.com/m4rkdc/nebula_est/nest_service/pkg/config"
 	"github.com/m4rkdc/nebula_est/nest_service/pkg/models"
-	"github.com/m4rkdc/nebula_est/nest_service/pkg/utils"
 	nest_test "github.com/m4rkdc/nebula_est/nest_service/test"
 	"github.com/slackhq/nebula/cert"
 	"google.golang.org/protobuf/encoding/protojson"
@@ -40,8 +40,10 @@ func sendCertificateSign(t *testing.T, r *gin.Engine, endpoint models.Route, csr
 }
 
 func TestCertificateSign(t *testing.T) {
+	cfg := config.DefaultCa()
+	s := New(&cfg)
 	var (
-		endpoint models.Route = Ca_routes[1]
+		endpoint models.Route = s.Routes()[1]
 		err      models.ApiError
 		csr      = models.NebulaCsr{}
 	)
@@ -56,12 +58,12 @@ func TestCertificateSign(t *testing.T) {
 	assert.Equal(t, errBytes, resp.Body.Bytes())
 
 	//Second test: enroll csr success
-	utils.Certificates_path = "../../test/certificates/"
-	utils.Ca_bin = "../../test/config/bin/nebula-cert"
-	utils.Ca_keys_path = "../../test/config/keys/"
+	cfg.CertificatesPath = "../../test/certificates/"
+	cfg.CaBin = "../../test/config/bin/nebula-cert"
+	cfg.CaKeysPath = "../../test/config/keys/"
 	csr.Groups = append(csr.Groups, "all")
 	csr.Hostname = "lighthouse"
-	os.Remove(utils.Certificates_path + csr.Hostname + ".crt")
+	os.Remove(cfg.CertificatesPath + csr.Hostname + ".crt")
 	csr.Ip = "192.168.100.1/24"
 	csr.Rekey = false
 	csr.ServerKeygen = false
@@ -90,8 +92,10 @@ func TestCertificateSign(t *testing.T) {
 }
 
 func TestGenerateKeys(t *testing.T) {
+	cfg := config.DefaultCa()
+	s := New(&cfg)
 	var (
-		endpoint models.Route = Ca_routes[2]
+		endpoint models.Route = s.Routes()[2]
 		err      models.ApiError
 		csr      = models.NebulaCsr{}
 	)
@@ -106,12 +110,12 @@ func TestGenerateKeys(t *testing.T) {
 	assert.Equal(t, errBytes, resp.Body.Bytes())
 
 	//Second test: serverkeygen enroll success
-	utils.Certificates_path = "../../test/certificates/"
-	utils.Ca_bin = "../../test/config/bin/nebula-cert"
-	utils.Ca_keys_path = "../../test/config/keys/"
+	cfg.CertificatesPath = "../../test/certificates/"
+	cfg.CaBin = "../../test/config/bin/nebula-cert"
+	cfg.CaKeysPath = "../../test/config/keys/"
 	csr.Groups = append(csr.Groups, "all")
 	csr.Hostname = "lighthouse"
-	os.Remove(utils.Certificates_path + csr.Hostname + ".crt")
+	os.Remove(cfg.CertificatesPath + csr.Hostname + ".crt")
 	csr.Ip = "192.168.100.1/24"
 	csr.Rekey = false
 	csr.ServerKeygen = true
@@ -0,0 +1,75 @@
+/*
+ * NEST: Nebula Enrollment over Secure Transport - OpenAPI 3.0
+ *
+ * This package contains the NEST_CA service routes and their REST API endpoints implementation, along with some service-specific utilities.
+ * API version: 0.3.1
+ * Contact: gianmarco.decola@studio.unibo.it
+ */
+package nest_ca
+
+import (
+	"context"
+
+	"github.com/m4rkdc/nebula_est/nest_service/pkg/models"
+	"github.com/m4rkdc/nebula_est/nest_service/pkg/rpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+/*
+CaServer implements the models.CaService gRPC service, served to the NEST service alongside the REST API.
+In multi-tenant deployments, every call is served by the instance of the Nebula network given in its metadata.
+*/
+type CaServer struct {
+	models.UnimplementedCaServiceServer
+	*Service
+	//Instances serving the Nebula networks of a multi-tenant deployment, by network. nil in single network deployments
+	Networks map[string]*Service
+}
+
+// Sign creates a new Nebula certificate by signing the client provided Nebula Public Key
+func (s *CaServer) Sign(ctx context.Context, raw_csr *models.RawNebulaCsr) (*models.RawCaResponse, error) {
+	if err := checkRawCsr(raw_csr); err != nil {
+		return nil, err
+	}
+	instance, err := rpc.Instance(ctx, s.Service, s.Networks)
+	if err != nil {
+		return nil, err
+	}
+	raw_ca_response, err := instance.certificateSign(ctx, raw_csr)
+	return raw_ca_response, rpc.ToStatus(err)
+}
+
+// Generate creates a new Nebula certificate by generating the Nebula private key and certificate for the given hostname
+func (s *CaServer) Generate(ctx context.Context, raw_csr *models.RawNebulaCsr) (*models.RawCaResponse, error) {
+	if err := checkRawCsr(raw_csr); err != nil {
+		return nil, err
+	}
+	instance, err := rpc.Instance(ctx, s.Service, s.Networks)
+	if err != nil {
+		return nil, err
+	}
+	raw_ca_response, err := instance.generateKeys(ctx, raw_csr)
+	return raw_ca_response, rpc.ToStatus(err)
+}
+
+// CaCerts returns the Nebula CA(s) certificates to the nest_service
+func (s *CaServer) CaCerts(ctx context.Context, req *models.CaCertsRequest) (*models.CaCertsResponse, error) {
+	instance, err := rpc.Instance(ctx, s.Service, s.Networks)
+	if err != nil {
+		return nil, err
+	}
+	ca_certs, err := instance.getCaCertFromFile()
+	if err != nil {
+		return nil, status.Error(codes.Internal, "Internal Server Error: "+err.Error())
+	}
+	return &models.CaCertsResponse{NebulaCaCerts: ca_certs}, nil
+}
+
+// checkRawCsr verifies that the Nebula CSR received over gRPC has the fields set by the NEST service
+func checkRawCsr(raw_csr *models.RawNebulaCsr) error {
+	if len(raw_csr.Hostname) == 0 || raw_csr.Rekey == nil || raw_csr.ServerKeygen == nil {
+		return status.Error(codes.InvalidArgument, "Bad request: no Nebula Certificate Signing Request provided")
+	}
+	return nil
+}
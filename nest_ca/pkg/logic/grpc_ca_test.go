@@ -0,0 +1,44 @@
+package nest_ca
+
+import (
+	"context"
+	"testing"
+
+	"github.com/go-playground/assert/v2"
+	"github.com/m4rkdc/nebula_est/nest_service/pkg/config"
+	"github.com/m4rkdc/nebula_est/nest_service/pkg/models"
+	"github.com/m4rkdc/nebula_est/nest_service/pkg/rpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func TestCaServer(t *testing.T) {
+	cfg := config.DefaultCa()
+	s := &CaServer{Service: New(&cfg)}
+
+	//First test: cannot find the ca.crt file
+	cfg.CaKeysPath = "./"
+	_, err := s.CaCerts(context.Background(), &models.CaCertsRequest{})
+	assert.Equal(t, codes.Internal, status.Code(err))
+
+	//Second test: success
+	cfg.CaKeysPath = "../../test/config/keys/"
+	certs, _ := s.getCaCertFromFile()
+	resp, err := s.CaCerts(context.Background(), &models.CaCertsRequest{})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, certs, resp.NebulaCaCerts)
+
+	//Third test: incomplete Nebula CSR
+	_, err = s.Sign(context.Background(), &models.RawNebulaCsr{Hostname: "client1"})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	//Fourth test: in multi-tenant deployments, the calls are served by the instance of their Nebula network only
+	s = &CaServer{Networks: map[string]*Service{"ot": New(&cfg)}}
+	outgoing, _ := metadata.FromOutgoingContext(rpc.WithNetwork(context.Background(), "ot"))
+	resp, err = s.CaCerts(metadata.NewIncomingContext(context.Background(), outgoing), &models.CaCertsRequest{})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, certs, resp.NebulaCaCerts)
+	_, err = s.CaCerts(context.Background(), &models.CaCertsRequest{})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+}
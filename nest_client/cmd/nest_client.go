@@ -1,32 +1,34 @@
 package main
 
 import (
-	"fmt"
+	"errors"
+	"log/slog"
 	"os"
 	"os/exec"
 	"os/signal"
 	"regexp"
 	"runtime"
-	"strconv"
 	"strings"
 	"syscall"
 	"time"
 
 	nest_client "github.com/m4rkdc/nebula_est/nest_client/pkg/logic"
+	"github.com/m4rkdc/nebula_est/nest_service/pkg/config"
+	"github.com/m4rkdc/nebula_est/nest_service/pkg/logging"
 	"github.com/m4rkdc/nebula_est/nest_service/pkg/models"
 )
 
 func uninstall_nebula() {
-	fmt.Println("Terminating nebula service...")
+	slog.Info("Terminating nebula service...")
 	exec.Command(nest_client.Bin_folder+"nebula"+nest_client.File_extension, "-service", "stop").Run()
-	fmt.Println("Uninstalling nebula service...")
+	slog.Info("Uninstalling nebula service...")
 	exec.Command(nest_client.Bin_folder+"nebula"+nest_client.File_extension, "-service", "uninstall").Run()
 }
 
 func setupNebula(nebula_log *os.File) (*exec.Cmd, error) {
 	_, err := os.Stat(nest_client.Bin_folder + "nebula" + nest_client.File_extension)
 	if err != nil {
-		fmt.Printf("%s doesn't exist. Cannot proceed. Please provide the nebula bin to the service before starting it\nExiting...", nest_client.Bin_folder+"nebula"+nest_client.File_extension)
+		slog.Error("nebula bin doesn't exist. Cannot proceed. Please provide the nebula bin to the service before starting it", "path", nest_client.Bin_folder+"nebula"+nest_client.File_extension)
 		return nil, err
 	}
 	os.Chmod(nest_client.Bin_folder+"nebula"+nest_client.File_extension, 0700)
@@ -47,7 +49,7 @@ func setupNebula(nebula_log *os.File) (*exec.Cmd, error) {
 	interfaces, err := net.Interfaces()
 
 	if err != nil {
-		fmt.Printf("Could'nt check information about host interfaces\n")
+		slog.Error("Could not check the host interfaces", "error", err)
 		return nil, err
 	}
 
@@ -70,7 +72,7 @@ func setupNebula(nebula_log *os.File) (*exec.Cmd, error) {
 	interfaces, err := net.Interfaces()
 
 	if err != nil {
-		fmt.Printf("Could'nt check information about host interfaces\n")
+		slog.Error("Could not check the host interfaces", "error", err)
 		return err
 	}
 
@@ -88,49 +90,58 @@ func setupNebula(nebula_log *os.File) (*exec.Cmd, error) {
 	return errors.New("could not setup a nebula tunnel")
 }*/
 
+/*
+nest_client enrolls the host in its Nebula network through the NEST service, runs Nebula and keeps its certificate and configuration file up to date.
+Its settings are taken from the defaults, the configuration file given with --config or CONFIG_FILE, the environment and the command line flags.
+*/
 func main() {
-
-	if val, ok := os.LookupEnv("NEST_SERVICE_IP"); ok {
-		nest_client.Nest_service_ip = val
+	cfg := config.DefaultClient()
+	print_config, err := config.Load("nest_client", &cfg, os.Args[1:], os.LookupEnv)
+	if err != nil {
+		slog.Error("Invalid configuration", "error", err)
+		os.Exit(14)
 	}
-	if val, ok := os.LookupEnv("NEST_SERVICE_PORT"); ok {
-
-		nest_client.Nest_service_port = val
+	if print_config {
+		config.Print(os.Stdout, &cfg)
+		return
 	}
-	if val, ok := os.LookupEnv("NEST_CERT"); ok {
-		nest_client.Nest_certificate = val
+	log_file, err := logging.Setup(cfg.Log, "nest_client")
+	if err != nil {
+		slog.Error("Could not open the log file", "error", err)
+		os.Exit(13)
 	}
-	if val, ok := os.LookupEnv("BIN_FOLDER"); ok {
+	defer log_file.Close()
+	slog.Info("NEST client: starting setup")
 
-		nest_client.Bin_folder = val
-	}
-	if val, ok := os.LookupEnv("NEBULA_AUTH"); ok {
-		nest_client.Nebula_auth = val
-		nest_client.Conf_folder = strings.TrimSuffix(val, "secret.hmac")
-	}
-	if val, ok := os.LookupEnv("HOSTNAME"); ok {
-		nest_client.Hostname = val
-	}
-	if val, ok := os.LookupEnv("REKEY"); ok {
-		nest_client.Rekey, _ = strconv.ParseBool(val)
-	}
-	fmt.Println("NEST client: starting setup")
+	nest_client.Nest_service_ip = cfg.ServiceIP
+	nest_client.Nest_service_port = cfg.ServicePort
+	nest_client.Nest_network = cfg.Network
+	nest_client.Nest_certificate = cfg.NestCert
+	nest_client.Bin_folder = cfg.BinFolder
+	nest_client.Nebula_auth = cfg.NebulaAuth
+	nest_client.Conf_folder = strings.TrimSuffix(cfg.NebulaAuth, "secret.hmac")
+	nest_client.Hostname = cfg.Hostname
+	nest_client.Rekey = cfg.Rekey
+	nest_client.Config_signing_keys = cfg.ConfigSigningKeys
+	nest_client.Require_config_signature = cfg.RequireConfigSignature
+	config_poll_interval := time.Duration(cfg.ConfigPollInterval)
+	approval_retry_interval := time.Duration(cfg.ApprovalRetryInterval)
 
 	if _, err := os.Stat(nest_client.Nest_certificate); err != nil {
-		fmt.Printf("Cannot find NEST service certificate. Please provide the NEST certificate or CA certificate before starting nest_client\n")
+		slog.Error("Cannot find NEST service certificate. Please provide the NEST certificate or CA certificate before starting nest_client")
 		os.Exit(1)
 	}
 	if runtime.GOOS == "windows" {
 		nest_client.File_extension = ".exe"
 	}
 	if _, err := os.Stat(nest_client.Bin_folder + "nebula" + nest_client.File_extension); err != nil {
-		fmt.Printf("Cannot find nebula binary. Please provide the nebula binary before starting nest_client\n")
+		slog.Error("Cannot find nebula binary. Please provide the nebula binary before starting nest_client")
 		os.Exit(2)
 	}
 
 	info, err := os.Stat(nest_client.Nebula_auth)
 	if err != nil {
-		fmt.Printf("Cannot find nest_client authorization token. Please provide the authorization token before starting nest_client\n")
+		slog.Error("Cannot find nest_client authorization token. Please provide the authorization token before starting nest_client")
 		os.Exit(3)
 	}
 
@@ -141,7 +152,7 @@ func main() {
 	if len(nest_client.Hostname) == 0 {
 		hostname, err := os.Hostname()
 		if err != nil {
-			fmt.Printf("Cannot load client's hostname from environment. Please provide the hostname or set it in the os before starting nest_client\n")
+			slog.Error("Cannot load client's hostname from environment. Please provide the hostname or set it in the os before starting nest_client")
 			os.Exit(4)
 		}
 		nest_client.Hostname = hostname
@@ -149,17 +160,23 @@ func main() {
 
 	if _, err := os.Stat(nest_client.Conf_folder + "ncsr_status"); os.IsNotExist(err) {
 		if err := nest_client.GetCACerts(); err != nil {
-			fmt.Printf("There was an error getting the NEST client Nebula Network CAs: %v\n", err.Error())
+			slog.Error("There was an error getting the NEST client Nebula Network CAs", "error", err)
 			os.Exit(5)
 		}
 
-		if err := nest_client.AuthorizeHost(); err != nil {
-			fmt.Printf("There was an error authorizing the nest client: %v\n", err.Error())
+		err := nest_client.AuthorizeHost()
+		for errors.Is(err, nest_client.ErrApprovalPending) {
+			slog.Info("Waiting for the approval of the enrollment, retrying", "interval", approval_retry_interval)
+			time.Sleep(approval_retry_interval)
+			err = nest_client.AuthorizeHost()
+		}
+		if err != nil {
+			slog.Error("There was an error authorizing the nest client", "error", err)
 			os.Exit(6)
 		}
 	}
 
-	fmt.Println("NEST client: setup finished")
+	slog.Info("NEST client: setup finished")
 	//todo add error channel
 
 	b, _ := os.ReadFile(nest_client.Conf_folder + "ncsr_status")
@@ -168,36 +185,42 @@ func main() {
 		if _, err := os.Stat(nest_client.Bin_folder + "nebula-cert" + nest_client.File_extension); err != nil {
 			err := nest_client.ServerKeygen()
 			if err != nil {
-				fmt.Printf("There was an error in the enrollment request: %v\n", err)
+				slog.Error("There was an error in the enrollment request", "error", err)
 				os.Exit(10)
 			}
 		} else {
 			err := nest_client.Enroll()
 			if err != nil {
-				fmt.Printf("There was an error in the enrollment request: %v\n", err)
+				slog.Error("There was an error in the enrollment request", "error", err)
 				os.Exit(10)
 			}
 		}
-		fmt.Println("NEST client: enrollment successfull. Writing conf files and keys to " + nest_client.Nebula_conf_folder)
+		slog.Info("NEST client: enrollment successfull. Writing conf files and keys", "path", nest_client.Nebula_conf_folder)
 	} else {
 		neb_conf, err := os.ReadFile("nebula_conf.txt")
 		if err != nil {
-			fmt.Printf("Could not read nebula configuration location: %v\n", err)
+			slog.Error("Could not read nebula configuration location", "error", err)
 			os.Exit(12)
 		}
 		nest_client.Nebula_conf_folder = string(neb_conf)
 		nest_client.Reenroll()
 	}
 
+	//The certificate and configuration file installed before Nebula starts need no reload
+	select {
+	case <-nest_client.Reload_chan:
+	default:
+	}
+
 	nebula_log, err := os.OpenFile(nest_client.Nebula_conf_folder+nest_client.Hostname+"_nebula.log", os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
 	if err != nil {
-		fmt.Printf("There was an error creating nebula log file: %v\n", err)
+		slog.Error("There was an error creating nebula log file", "error", err)
 		os.Exit(8)
 	}
 	defer nebula_log.Close()
 	cmd, err := setupNebula(nebula_log)
 	if err != nil {
-		fmt.Printf("There was an error setting up the Nebula tunnel: %v\n", err)
+		slog.Error("There was an error setting up the Nebula tunnel", "error", err)
 		if runtime.GOOS == "windows" {
 			uninstall_nebula()
 		}
@@ -205,7 +228,7 @@ func main() {
 	}
 
 	/*if err = checkNebulaInterface(); err != nil {
-		fmt.Printf("There was an error setting up the Nebula tunnel: %v\n", err)
+		slog.Error("There was an error setting up the Nebula tunnel", "error", err)
 		uninstall_nebula()
 		os.Exit(7)
 	}*/
@@ -215,25 +238,29 @@ func main() {
 		signal.Notify(c, os.Interrupt, syscall.SIGTERM, syscall.SIGINT)
 		go func() {
 			for sig := range c {
-				fmt.Println("Caught signal: " + sig.String())
+				slog.Info("Caught signal", "signal", sig.String())
 				uninstall_nebula()
 			}
 		}()
 
 	}
 
+	if config_poll_interval > 0 {
+		go nest_client.WatchConfig(config_poll_interval)
+	}
+
 	for {
 		select {
 		case duration := <-nest_client.Enroll_chan:
 			if duration.Hours() < 0 {
-				fmt.Println("There was an error in the enrollment process")
+				slog.Error("There was an error in the enrollment process")
 				uninstall_nebula()
 				os.Exit(9)
 			}
-			fmt.Println("NEST client: Scheduling re-enrollment in: " + duration.String())
+			slog.Info("NEST client: Scheduling re-enrollment", "in", duration.String())
 			time.AfterFunc(duration, nest_client.Reenroll)
-			time.Sleep(duration + 1*time.Second)
-			fmt.Println("Restarting nebula after certificate renewal")
+		case <-nest_client.Reload_chan:
+			slog.Info("Reloading nebula after a certificate renewal or configuration update")
 			if runtime.GOOS == "windows" {
 				cmd := exec.Command(nest_client.Bin_folder+"nebula"+nest_client.File_extension, "-service", "restart")
 				cmd.Stdout = os.Stdout
@@ -247,14 +274,12 @@ func main() {
 				for {
 					if _, err := net.InterfaceByName("nebula"); err != nil {
 						if err = cmd.Start(); err != nil {
-							fmt.Println("Could not restart nebula: " + err.Error())
+							slog.Error("Could not restart nebula", "error", err)
 						}
 						break
 					}
 				}
 			}*/
-		default:
-			continue
 		}
 	}
 
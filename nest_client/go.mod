@@ -1,6 +1,6 @@
 module github.com/m4rkdc/nebula_est/nest_client
 
-go 1.19
+go 1.21
 
 require (
 	github.com/go-playground/assert/v2 v2.2.0
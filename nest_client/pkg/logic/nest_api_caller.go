@@ -5,16 +5,20 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/base32"
+	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
-	"fmt"
 	"io"
+	"log/slog"
+	"math/rand"
 	"net/http"
 	"os"
 	"os/exec"
+	"sync"
 	"time"
 
+	"github.com/m4rkdc/nebula_est/nest_service/pkg/logging"
 	"github.com/m4rkdc/nebula_est/nest_service/pkg/models"
 	"github.com/pquerna/otp"
 	"github.com/pquerna/otp/totp"
@@ -26,26 +30,180 @@ import (
 var (
 	Nest_service_ip    string
 	Nest_service_port  string
+	Nest_network       string // Nebula network joined by the client, in multi-tenant deployments of the NEST service
 	Bin_folder         string
 	Nebula_auth        string
 	Conf_folder        string
 	Hostname           string
 	Rekey              bool
 	Enroll_chan        = make(chan time.Duration, 2)
+	Reload_chan        = make(chan struct{}, 1) // Signaled when a new certificate or configuration file is installed, for Nebula to load it
 	Nebula_conf_folder string
 	Nest_certificate   string
 	File_extension     string = ""
+	//File of the public keys of the NEST config service pinned by the administrator. When empty, the keys sent by the NEST service with the Nebula CA certificates are used
+	Config_signing_keys string
+	//The Nebula configuration files without a valid signature are refused even if no signing keys were received
+	Require_config_signature bool
 )
 
-func reenrollAfter(crt cert.NebulaCertificate) {
+// Delay before the first retry of a failed re-enrollment, doubled at every attempt up to renewal_max_backoff
+const (
+	renewal_backoff     = 30 * time.Second
+	renewal_max_backoff = time.Hour
+)
+
+// Failed re-enrollment attempts since the last certificate renewal
+var renewal_attempt int
+
+// Serializes the re-enrollments, scheduled with time.AfterFunc, and the configuration updates of WatchConfig, which install files in Nebula_conf_folder and can move it
+var install_mu sync.Mutex
+
+// ErrApprovalPending is returned by AuthorizeHost while the client is an instance of a host template waiting for the approval of an administrator
+var ErrApprovalPending = errors.New("the enrollment is waiting for the approval of an administrator")
+
+// Files, in the configuration folder of the client, of the public keys with which the NEST config service signs the Nebula configuration files, and of the version of the installed configuration file
+const (
+	config_signing_keys = "config_signing.pem"
+	config_version      = "config_version"
+)
+
+/*
+verifyConfig checks that signature is a signature by the NEST config service of the Nebula configuration file conf of the client, installed in path with the IP address and security groups of crt, before it is installed.
+The keys are the pinned Config_signing_keys or else the ones sent by the NEST service with the Nebula CA certificates: the configuration files are installed unverified only if there are neither and Require_config_signature is false.
+*/
+func verifyConfig(conf []byte, path string, crt *cert.NebulaCertificate, signature []byte) error {
+	keys_file := Config_signing_keys
+	if len(keys_file) == 0 {
+		keys_file = Conf_folder + config_signing_keys
+	}
+	b, err := os.ReadFile(keys_file)
+	if errors.Is(err, os.ErrNotExist) && len(Config_signing_keys) == 0 && !Require_config_signature {
+		slog.Warn("No configuration signing keys: the Nebula configuration file is not verified")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	keys, err := models.UnmarshalConfigSigningKeys(b)
+	if err != nil {
+		return err
+	}
+	if len(keys) == 0 {
+		return errors.New("no configuration signing keys in " + keys_file)
+	}
+	signed := models.ConfResponse{NebulaConf: conf, NebulaPath: path, Groups: crt.Details.Groups}
+	if len(crt.Details.Ips) != 0 {
+		signed.Ip = crt.Details.Ips[0].String()
+	}
+	if len(signature) == 0 || !models.VerifyConfig(keys, Hostname, &signed, signature) {
+		return errors.New("the signature of the Nebula configuration file is missing or invalid, or it is not for the installation path, IP address and security groups of the client")
+	}
+	return nil
+}
+
+/*
+installConfig installs the verified Nebula configuration file conf, as generated by dhall-nebula, in the Nebula configuration folder, rewritten by models.InstallableConfig.
+The file is written next to the installed one and renamed over it, so that Nebula never reads a partial file, and the version of conf is recorded in the configuration folder.
+*/
+func installConfig(conf []byte) error {
+	if err := os.WriteFile(Nebula_conf_folder+"config.yml.new", models.InstallableConfig(conf), 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(Nebula_conf_folder+"config.yml.new", Nebula_conf_folder+"config.yml"); err != nil {
+		os.Remove(Nebula_conf_folder + "config.yml.new")
+		return err
+	}
+	return os.WriteFile(Conf_folder+config_version, []byte(models.ConfVersion(conf)), 0600)
+}
+
+// installedConfigVersion returns the version of the installed Nebula configuration file, the one of the file generated by dhall-nebula
+func installedConfigVersion() (string, error) {
+	if b, err := os.ReadFile(Conf_folder + config_version); err == nil {
+		return string(b), nil
+	}
+	//Installed before the versions were recorded, as sent by the NEST service
+	installed, err := os.ReadFile(Nebula_conf_folder + "config.yml")
+	if err != nil {
+		return "", err
+	}
+	return models.ConfVersion(installed), nil
+}
+
+// serviceURL returns the URL of the NEST service endpoint at path, for the Nebula network joined by the client
+func serviceURL(path string) string {
+	return "https://" + Nest_service_ip + ":" + Nest_service_port + models.NetworkPath(Nest_network) + path
+}
+
+/*
+reenrollAfter schedules the re-enrollment of the client at the start of the renewal window sent by the NEST service with its new certificate,
+or after 2/3 of the certificate lifetime if the service sent none, and signals the certificate renewal on Reload_chan.
+*/
+func reenrollAfter(csr_response *models.NebulaCsrResponse) {
+	crt := csr_response.NebulaCert
 	os.WriteFile(Conf_folder+"ncsr_status", []byte("Completed\n"+crt.Details.NotAfter.String()), 0600)
-	Enroll_chan <- time.Until(crt.Details.NotAfter)
+	renewal_attempt = 0
+	renew_after := csr_response.RenewAfter
+	if renew_after.IsZero() {
+		renew_after = crt.Details.NotBefore.Add(crt.Details.NotAfter.Sub(crt.Details.NotBefore) * 2 / 3)
+	}
+	if !csr_response.RenewBefore.IsZero() {
+		slog.Info("Certificate renewal window", "after", renew_after, "before", csr_response.RenewBefore)
+	}
+	select {
+	case Reload_chan <- struct{}{}:
+	default:
+	}
+	Enroll_chan <- time.Until(renew_after)
+}
+
+// installedCertificate returns the Nebula certificate installed in the Nebula configuration folder
+func installedCertificate() (*cert.NebulaCertificate, error) {
+	b, err := os.ReadFile(Nebula_conf_folder + Hostname + ".crt")
+	if err != nil {
+		return nil, err
+	}
+	crt, _, err := cert.UnmarshalNebulaCertificateFromPEM(b)
+	return crt, err
+}
+
+// installedNotAfter returns the expiration of the Nebula certificate installed in the Nebula configuration folder
+func installedNotAfter() (time.Time, error) {
+	crt, err := installedCertificate()
+	if err != nil {
+		return time.Time{}, err
+	}
+	return crt.Details.NotAfter, nil
+}
+
+/*
+retryReenroll schedules a new re-enrollment attempt after a failed one, with an exponential backoff of up to an hour, while the installed certificate is valid.
+The installed certificate and key are kept, so that Nebula keeps working until a new certificate is installed. Once the certificate expired, a negative duration stops the client.
+*/
+func retryReenroll(err error) {
+	not_after, cert_err := installedNotAfter()
+	if cert_err != nil || !time.Now().Before(not_after) {
+		slog.Error("Could not renew the certificate before its expiration", "error", err)
+		Enroll_chan <- -1 * time.Second
+		return
+	}
+	delay := renewal_max_backoff
+	if renewal_attempt < 7 {
+		delay = renewal_backoff << renewal_attempt
+	}
+	renewal_attempt++
+	delay += time.Duration(rand.Int63n(int64(delay / 2)))
+	if until := time.Until(not_after); delay > until {
+		delay = until
+	}
+	slog.Warn("Could not renew the certificate, retrying", "error", err, "attempt", renewal_attempt, "in", delay.String())
+	Enroll_chan <- delay
 }
 
 func setupTLSClient() *http.Client {
 	caCert, err := os.ReadFile(Nest_certificate)
 	if err != nil {
-		fmt.Println("Error in reading NEST certificate: " + err.Error())
+		slog.Error("Error in reading NEST certificate", "error", err)
 		return nil
 	}
 	caCertPool := x509.NewCertPool()
@@ -74,28 +232,33 @@ func getCSRResponse(response_bytes []byte) (*models.NebulaCsrResponse, error) {
 	var raw_csr_response_bytes []byte
 
 	if json.Unmarshal(response_bytes, &raw_csr_response_bytes) != nil {
-		fmt.Println("There was an error unmarshalling json response")
+		slog.Error("There was an error unmarshalling json response")
 		return nil, &models.ApiError{Code: 500, Message: "There was an error unmarshalling json response"}
 	}
 	if proto.Unmarshal(raw_csr_response_bytes, raw_csr_response) != nil {
-		fmt.Println("There was an error unmarshalling raw_csr_response_bytes")
+		slog.Error("There was an error unmarshalling raw_csr_response_bytes")
 		return nil, &models.ApiError{Code: 500, Message: "There was an error unmarshalling raw_csr_response_bytes"}
 	}
 	csr_response.NebulaConf = raw_csr_response.NebulaConf
 	csr_response.NebulaPrivateKey = raw_csr_response.NebulaPrivateKey
+	csr_response.ConfSignature = raw_csr_response.ConfSignature
 	if raw_csr_response.NebulaPath != nil {
 		csr_response.NebulaPath = *raw_csr_response.NebulaPath
 	}
+	if raw_csr_response.RenewAfter != nil && raw_csr_response.RenewBefore != nil {
+		csr_response.RenewAfter = time.Unix(*raw_csr_response.RenewAfter, 0)
+		csr_response.RenewBefore = time.Unix(*raw_csr_response.RenewBefore, 0)
+	}
 
 	raw_cert_bytes, err := proto.Marshal(raw_csr_response.NebulaCert)
 	if err != nil {
-		fmt.Println("There was an error marshalling raw_csr_response.NebulaCert" + err.Error())
+		slog.Error("There was an error marshalling raw_csr_response.NebulaCert", "error", err)
 		return nil, &models.ApiError{Code: 500, Message: "There was an error unmarshalling json response"}
 	}
 
 	crt, err := cert.UnmarshalNebulaCertificate(raw_cert_bytes)
 	if err != nil {
-		fmt.Println("There was an error unmarshalling raw_cert_bytes" + err.Error())
+		slog.Error("There was an error unmarshalling raw_cert_bytes", "error", err)
 		return nil, &models.ApiError{Code: 500, Message: "There was an error unmarshalling raw_cert_bytes"}
 	}
 	csr_response.NebulaCert = *crt.Copy()
@@ -107,7 +270,12 @@ func GetCACerts() error {
 	if client == nil {
 		return errors.New("error in reading nest certificate")
 	}
-	resp, err := client.Get("https://" + Nest_service_ip + ":" + Nest_service_port + "/cacerts")
+	req, err := http.NewRequest(http.MethodGet, serviceURL("/cacerts"), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", models.MIME_JSON)
+	resp, err := client.Do(req)
 	if err != nil {
 		return err
 	}
@@ -122,8 +290,17 @@ func GetCACerts() error {
 	switch {
 	case resp.StatusCode == 200:
 
-		err = json.Unmarshal(b, &response)
-		if err != nil {
+		//NEST services older than the configuration signatures send the legacy format
+		var document models.CaCertsDocument
+		if json.Unmarshal(b, &document) == nil {
+			response = []byte(document.NebulaCaCerts)
+			if len(document.ConfigSigningKeys) != 0 {
+				if _, err = models.UnmarshalConfigSigningKeys([]byte(document.ConfigSigningKeys)); err != nil {
+					return err
+				}
+				os.WriteFile(Conf_folder+config_signing_keys, []byte(document.ConfigSigningKeys), 0600)
+			}
+		} else if err = json.Unmarshal(b, &response); err != nil {
 			return err
 		}
 		os.WriteFile(Conf_folder+"ca.crt", response, 0600)
@@ -173,7 +350,7 @@ func AuthorizeHost() error {
 	if client == nil {
 		return errors.New("error in reading nest certificate")
 	}
-	resp, err := client.Post("https://"+Nest_service_ip+":"+Nest_service_port+"/ncsr", "application/json", bytes.NewReader(authBytes))
+	resp, err := client.Post(serviceURL("/ncsr"), "application/json", bytes.NewReader(authBytes))
 
 	if err != nil {
 		return err
@@ -188,12 +365,17 @@ func AuthorizeHost() error {
 	switch {
 	case resp.StatusCode == 201:
 		os.WriteFile(Conf_folder+"ncsr_status", []byte("Pending"), 0600)
+	case resp.StatusCode == 202:
+		if json.Unmarshal(b, &error_response) == nil && error_response != nil {
+			slog.Info(error_response.Message)
+		}
+		return ErrApprovalPending
 	case resp.StatusCode >= 400:
 		if json.Unmarshal(b, &error_response) == nil {
 			if error_response.Code != 0 {
 				return error_response
 			} else {
-				fmt.Println("There was an error unmarshalling the error response: " + err.Error())
+				slog.Error("There was an error unmarshalling the error response", "error", err)
 				return err
 			}
 		} else {
@@ -204,7 +386,7 @@ func AuthorizeHost() error {
 	return nil
 }
 
-func createNESTRequest(url string, csr_bytes []byte) (*http.Request, error) {
+func createNESTRequest(method string, url string, csr_bytes []byte) (*http.Request, error) {
 	b, err := os.ReadFile(Nebula_auth)
 	if err != nil {
 		return nil, err
@@ -217,12 +399,15 @@ func createNESTRequest(url string, csr_bytes []byte) (*http.Request, error) {
 	if err != nil {
 		return nil, err
 	}
-	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(csr_bytes))
+	req, err := http.NewRequest(method, url, bytes.NewReader(csr_bytes))
 	if err != nil {
 		return nil, err
 	}
 	req.Header.Add("Content-Type", "application/json")
 	req.Header.Add("NESToken", otp)
+	request_id := logging.NewRequestID()
+	req.Header.Add(logging.RequestIDHeader, request_id)
+	slog.Info("Sending request to the NEST service", "url", url, "request_id", request_id)
 	return req, nil
 }
 
@@ -233,7 +418,7 @@ func Enroll() error {
 	csr.Hostname = Hostname
 	out, err := exec.Command(Bin_folder+"nebula-cert"+File_extension, "keygen", "-out-pub", Conf_folder+csr.Hostname+".pub", "-out-key", Conf_folder+csr.Hostname+".key").CombinedOutput()
 	if err != nil {
-		fmt.Println("There was an error creating the Nebula key pair: " + string(out))
+		slog.Error("There was an error creating the Nebula key pair", "error", err, "output", string(out))
 		return err
 	}
 
@@ -260,7 +445,7 @@ func Enroll() error {
 		return errors.New("error in reading nest certificate")
 	}
 
-	req, err := createNESTRequest("https://"+Nest_service_ip+":"+Nest_service_port+"/ncsr/"+Hostname+"/enroll", csr_bytes)
+	req, err := createNESTRequest(http.MethodPost, serviceURL("/ncsr/"+Hostname+"/enroll"), csr_bytes)
 	if err != nil {
 		return err
 	}
@@ -282,6 +467,9 @@ func Enroll() error {
 		if err != nil {
 			return err
 		}
+		if err = verifyConfig(csr_response.NebulaConf, csr_response.NebulaPath, &csr_response.NebulaCert, csr_response.ConfSignature); err != nil {
+			return err
+		}
 		Nebula_conf_folder = csr_response.NebulaPath
 		os.WriteFile("nebula_conf.txt", []byte(Nebula_conf_folder), 0666)
 		os.Mkdir(Nebula_conf_folder, 0700)
@@ -291,21 +479,23 @@ func Enroll() error {
 		if err := os.Rename(Conf_folder+"ca.crt", Nebula_conf_folder+"ca.crt"); err != nil {
 			return err
 		}
-		os.WriteFile(Nebula_conf_folder+"config.yml", csr_response.NebulaConf, 0600)
+		if err := installConfig(csr_response.NebulaConf); err != nil {
+			return err
+		}
 
 		b, err = csr_response.NebulaCert.MarshalToPEM()
 		if err != nil {
 			return err
 		}
 		os.WriteFile(Nebula_conf_folder+Hostname+".crt", b, 0600)
-		reenrollAfter(csr_response.NebulaCert)
+		reenrollAfter(csr_response)
 
 	case resp.StatusCode >= 400:
 		if json.Unmarshal(b, &error_response) == nil {
 			if error_response.Code != 0 {
 				return error_response
 			} else {
-				fmt.Println("There was an error unmarshalling the error response: " + err.Error())
+				slog.Error("There was an error unmarshalling the error response", "error", err)
 				return err
 			}
 		} else {
@@ -334,7 +524,7 @@ func ServerKeygen() error {
 		return errors.New("error in reading nest certificate")
 	}
 
-	req, err := createNESTRequest("https://"+Nest_service_ip+":"+Nest_service_port+"/ncsr/"+Hostname+"/serverkeygen", csr_bytes)
+	req, err := createNESTRequest(http.MethodPost, serviceURL("/ncsr/"+Hostname+"/serverkeygen"), csr_bytes)
 	if err != nil {
 		return err
 	}
@@ -356,6 +546,9 @@ func ServerKeygen() error {
 		if err != nil {
 			return err
 		}
+		if err = verifyConfig(csr_response.NebulaConf, csr_response.NebulaPath, &csr_response.NebulaCert, csr_response.ConfSignature); err != nil {
+			return err
+		}
 		Nebula_conf_folder = csr_response.NebulaPath
 		os.WriteFile("nebula_conf.txt", []byte(Nebula_conf_folder), 0666)
 		os.Mkdir(Nebula_conf_folder, 0700)
@@ -364,20 +557,22 @@ func ServerKeygen() error {
 		if err := os.Rename(Conf_folder+"ca.crt", Nebula_conf_folder+"ca.crt"); err != nil {
 			return err
 		}
-		os.WriteFile(Nebula_conf_folder+"config.yml", csr_response.NebulaConf, 0600)
+		if err := installConfig(csr_response.NebulaConf); err != nil {
+			return err
+		}
 		b, err = csr_response.NebulaCert.MarshalToPEM()
 		if err != nil {
 			return err
 		}
 		os.WriteFile(Nebula_conf_folder+Hostname+".crt", b, 0600)
-		reenrollAfter(csr_response.NebulaCert)
+		reenrollAfter(csr_response)
 
 	case resp.StatusCode >= 400:
 		if json.Unmarshal(b, &error_response) == nil {
 			if error_response.Code != 0 {
 				return error_response
 			} else {
-				fmt.Println("There was an error unmarshalling the error response: " + err.Error())
+				slog.Error("There was an error unmarshalling the error response", "error", err)
 				return err
 			}
 		} else {
@@ -387,7 +582,17 @@ func ServerKeygen() error {
 	return nil
 }
 
+/*
+Reenroll requests a new certificate to the NEST service. With Rekey, the new key pair is generated next to the installed one and replaces it only once the new certificate is received:
+until then, the installed certificate and key are kept. A failed attempt is retried with backoff until the installed certificate expires.
+*/
 func Reenroll() {
+	install_mu.Lock()
+	defer install_mu.Unlock()
+	reenroll()
+}
+
+func reenroll() {
 	var csr models.NebulaCsr
 
 	csr.Hostname = Hostname
@@ -396,23 +601,23 @@ func Reenroll() {
 		if _, err := os.Stat(Bin_folder + "nebula-cert"); err != nil {
 			csr.ServerKeygen = true
 		} else {
-			os.Remove(Nebula_conf_folder + Hostname + ".key")
-			out, err := exec.Command(Bin_folder+"nebula-cert"+File_extension, "keygen", "-out-pub", Nebula_conf_folder+csr.Hostname+".pub", "-out-key", Nebula_conf_folder+Hostname+".key").CombinedOutput()
+			os.Remove(Nebula_conf_folder + Hostname + ".key.new")
+			out, err := exec.Command(Bin_folder+"nebula-cert"+File_extension, "keygen", "-out-pub", Nebula_conf_folder+csr.Hostname+".pub", "-out-key", Nebula_conf_folder+Hostname+".key.new").CombinedOutput()
 			if err != nil {
-				fmt.Println("There was an error creating the Nebula key pair: " + string(out))
-				Enroll_chan <- -1 * time.Second
+				slog.Error("There was an error creating the Nebula key pair", "error", err, "output", string(out))
+				retryReenroll(err)
 				return
 			}
 
 			b, err := os.ReadFile(Nebula_conf_folder + csr.Hostname + ".pub")
 			if err != nil {
-				Enroll_chan <- -1 * time.Second
+				retryReenroll(err)
 				return
 			}
 			os.Remove(Nebula_conf_folder + csr.Hostname + ".pub")
 			csr.PublicKey, _, err = cert.UnmarshalX25519PublicKey(b)
 			if err != nil {
-				Enroll_chan <- -1 * time.Second
+				retryReenroll(err)
 				return
 			}
 		}
@@ -425,31 +630,31 @@ func Reenroll() {
 	}
 	csr_bytes, err := protojson.Marshal(&raw_csr)
 	if err != nil {
-		Enroll_chan <- -1 * time.Second
+		retryReenroll(err)
 		return
 	}
 
 	client := setupTLSClient()
 	if client == nil {
-		Enroll_chan <- -1 * time.Second
+		retryReenroll(errors.New("error in reading nest certificate"))
 		return
 	}
 
-	req, err := createNESTRequest("https://"+Nest_service_ip+":"+Nest_service_port+"/ncsr/"+Hostname+"/reenroll", csr_bytes)
+	req, err := createNESTRequest(http.MethodPost, serviceURL("/ncsr/"+Hostname+"/reenroll"), csr_bytes)
 	if err != nil {
-		Enroll_chan <- -1 * time.Second
+		retryReenroll(err)
 		return
 	}
 	resp, err := client.Do(req)
 
 	if err != nil {
-		Enroll_chan <- -1 * time.Second
+		retryReenroll(err)
 		return
 	}
 
 	b, err := io.ReadAll(resp.Body)
 	if err != nil {
-		Enroll_chan <- -1 * time.Second
+		retryReenroll(err)
 		return
 	}
 	var error_response *models.ApiError
@@ -458,7 +663,17 @@ func Reenroll() {
 	case resp.StatusCode == 200:
 		csr_response, err = getCSRResponse(b)
 		if err != nil {
-			Enroll_chan <- -1 * time.Second
+			retryReenroll(err)
+			return
+		}
+		if err = verifyConfig(csr_response.NebulaConf, csr_response.NebulaPath, &csr_response.NebulaCert, csr_response.ConfSignature); err != nil {
+			os.Remove(Nebula_conf_folder + Hostname + ".key.new")
+			retryReenroll(err)
+			return
+		}
+		b, err = csr_response.NebulaCert.MarshalToPEM()
+		if err != nil {
+			retryReenroll(err)
 			return
 		}
 		if Nebula_conf_folder != csr_response.NebulaPath {
@@ -467,26 +682,103 @@ func Reenroll() {
 			os.Mkdir(Nebula_conf_folder, 0700)
 		}
 
-		os.WriteFile(Nebula_conf_folder+"config.yml", csr_response.NebulaConf, 0600)
+		if err = installConfig(csr_response.NebulaConf); err != nil {
+			os.Remove(Nebula_conf_folder + Hostname + ".key.new")
+			retryReenroll(err)
+			return
+		}
 		if csr.ServerKeygen {
 			key := cert.MarshalX25519PrivateKey(csr_response.NebulaPrivateKey)
 			os.WriteFile(Nebula_conf_folder+csr.Hostname+".key", key, 0600)
+		} else if csr.Rekey {
+			os.Rename(Nebula_conf_folder+Hostname+".key.new", Nebula_conf_folder+Hostname+".key")
 		}
+		os.WriteFile(Nebula_conf_folder+Hostname+".crt", b, 0600)
+		reenrollAfter(csr_response)
 
-		b, err = csr_response.NebulaCert.MarshalToPEM()
-		if err != nil {
-			Enroll_chan <- -1 * time.Second
+	default:
+		os.Remove(Nebula_conf_folder + Hostname + ".key.new")
+		if json.Unmarshal(b, &error_response) == nil && error_response != nil && error_response.Code != 0 {
+			retryReenroll(error_response)
 			return
 		}
-		os.WriteFile(Nebula_conf_folder+Hostname+".crt", b, 0600)
-		reenrollAfter(csr_response.NebulaCert)
+		retryReenroll(errors.New("unexpected response from the NEST service: " + resp.Status))
+	}
+}
 
-	case resp.StatusCode >= 400:
-		if json.Unmarshal(b, error_response) != nil {
-			if error_response != nil {
-				Enroll_chan <- -1 * time.Second
-				return
-			}
+/*
+UpdateConfig downloads the current Nebula configuration file of the client from the NEST service, sending the version of the installed one as If-None-Match.
+A changed configuration file is verified for the installation path, IP address and security groups of the installed certificate, installed by installConfig and signaled on Reload_chan.
+*/
+func UpdateConfig() error {
+	install_mu.Lock()
+	defer install_mu.Unlock()
+	version, err := installedConfigVersion()
+	if err != nil {
+		return err
+	}
+	client := setupTLSClient()
+	if client == nil {
+		return errors.New("error in reading nest certificate")
+	}
+
+	req, err := createNESTRequest(http.MethodGet, serviceURL("/ncsr/"+Hostname+"/config"), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("If-None-Match", "\""+version+"\"")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	var error_response *models.ApiError
+	switch {
+	case resp.StatusCode == http.StatusNotModified:
+		return nil
+	case resp.StatusCode == http.StatusOK:
+		if models.ConfVersion(b) == version {
+			return nil
+		}
+		signature, err := base64.StdEncoding.DecodeString(resp.Header.Get(models.CONF_SIGNATURE_HEADER))
+		if err != nil {
+			return errors.New("invalid signature of the Nebula configuration file: " + err.Error())
+		}
+		crt, err := installedCertificate()
+		if err != nil {
+			return err
+		}
+		if err = verifyConfig(b, Nebula_conf_folder, crt, signature); err != nil {
+			return err
+		}
+		if err = installConfig(b); err != nil {
+			return err
+		}
+		slog.Info("Installed a new version of the Nebula configuration file", "version", models.ConfVersion(b))
+		select {
+		case Reload_chan <- struct{}{}:
+		default:
+		}
+	case json.Unmarshal(b, &error_response) == nil && error_response != nil && error_response.Code != 0:
+		return error_response
+	default:
+		return errors.New("unexpected response of the NEST service: " + resp.Status)
+	}
+	return nil
+}
+
+// WatchConfig checks for a new version of the Nebula configuration file of the client every interval
+func WatchConfig(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := UpdateConfig(); err != nil {
+			slog.Warn("Could not update the Nebula configuration file", "error", err)
 		}
 	}
 }
@@ -1,38 +1,57 @@
 package logic
 
 import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/pem"
 	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"regexp"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/go-playground/assert/v2"
 	nest_ca "github.com/m4rkdc/nebula_est/nest_ca/pkg/logic"
 	nest_config "github.com/m4rkdc/nebula_est/nest_config/pkg/logic"
+	"github.com/m4rkdc/nebula_est/nest_service/pkg/client"
+	"github.com/m4rkdc/nebula_est/nest_service/pkg/config"
 	nest_service "github.com/m4rkdc/nebula_est/nest_service/pkg/logic"
 	"github.com/m4rkdc/nebula_est/nest_service/pkg/models"
-	"github.com/m4rkdc/nebula_est/nest_service/pkg/utils"
 	nest_test "github.com/m4rkdc/nebula_est/nest_service/test"
 	"github.com/slackhq/nebula/cert"
 )
 
+// connect recreates the clients of the NEST CA and NEST config services of service after their endpoints have changed
+func connect(service *nest_service.Service) {
+	settings := client.SettingsFrom(service.Config.Downstream)
+	service.Ca = client.NewCaClient(service.Config.Ca, settings)
+	service.Conf = client.NewConfClient(service.Config.Conf, settings)
+}
+
 func TestGetCACerts(t *testing.T) {
+	service_cfg := config.DefaultService()
+	service_cfg.Downstream.Protocol = client.REST
+	service := nest_service.New(&service_cfg, nil)
 	var (
-		endpoint models.Route = nest_service.Service_routes[0]
+		endpoint models.Route = service.Routes()[0]
 	)
 
 	r := nest_test.MockRouterForEndpoint(&endpoint)
-	utils.Ca_cert_file = "../../../nest_service/test/config/ca.crt"
-	utils.Service_ip = "localhost"
-	utils.Service_port = "8087"
-	Nest_service_ip = utils.Service_ip
-	Nest_service_port = utils.Service_port
+	service_cfg.CaCertFile = "../../../nest_service/test/config/ca.crt"
+	service_cfg.ServiceIP = "localhost"
+	service_cfg.ServicePort = "8087"
+	Nest_service_ip = service_cfg.ServiceIP
+	Nest_service_port = service_cfg.ServicePort
 	Nest_certificate = "../../../nest_service/test/config/tls/nest_service-crt.pem"
-	go r.RunTLS(utils.Service_ip+":"+utils.Service_port, "../../../nest_service/test/config/tls/nest_service-crt.pem", "../../../nest_service/test/config/tls/nest_service-key.pem")
+	go r.RunTLS(service_cfg.ServiceIP+":"+service_cfg.ServicePort, "../../../nest_service/test/config/tls/nest_service-crt.pem", "../../../nest_service/test/config/tls/nest_service-key.pem")
 	err := GetCACerts()
 	assert.Equal(t, err, nil)
-	b, _ := os.ReadFile(utils.Ca_cert_file)
+	b, _ := os.ReadFile(service_cfg.CaCertFile)
 	var ca_certs []cert.NebulaCertificate
 	for {
 		cert, b, _ := cert.UnmarshalNebulaCertificateFromPEM(b)
@@ -51,60 +70,72 @@ func TestGetCACerts(t *testing.T) {
 }
 
 func TestAutorizeHost(t *testing.T) {
+	service_cfg := config.DefaultService()
+	service_cfg.Downstream.Protocol = client.REST
+	service := nest_service.New(&service_cfg, nil)
 	var (
-		endpoint models.Route = nest_service.Service_routes[1]
+		endpoint models.Route = service.Routes()[1]
 	)
 
 	r := nest_test.MockRouterForEndpoint(&endpoint)
-	utils.Hostnames_file = "../../../nest_service/test/config/hostnames"
-	utils.Service_ip = "localhost"
-	utils.Service_port = "8088"
-	Nest_service_ip = utils.Service_ip
-	Nest_service_port = utils.Service_port
+	service_cfg.HostnamesFile = "../../../nest_service/test/config/hostnames"
+	service_cfg.ServiceIP = "localhost"
+	service_cfg.ServicePort = "8088"
+	Nest_service_ip = service_cfg.ServiceIP
+	Nest_service_port = service_cfg.ServicePort
 	Nest_certificate = "../../../nest_service/test/config/tls/nest_service-crt.pem"
-	utils.HMAC_key = "../../../nest_service/test/config/hmac.key"
-	utils.Ncsr_folder = "../../../nest_service/test/ncsr/"
+	service_cfg.HMACKey = "../../../nest_service/test/config/hmac.key"
+	service_cfg.NcsrFolder = "../../../nest_service/test/ncsr/"
 	Nebula_auth = "../../test/secret.hmac"
 	Hostname = "lighthouse"
-	os.Remove(utils.Ncsr_folder + Hostname)
-	go r.RunTLS(utils.Service_ip+":"+utils.Service_port, "../../../nest_service/test/config/tls/nest_service-crt.pem", "../../../nest_service/test/config/tls/nest_service-key.pem")
+	os.Remove(service_cfg.NcsrFolder + Hostname)
+	go r.RunTLS(service_cfg.ServiceIP+":"+service_cfg.ServicePort, "../../../nest_service/test/config/tls/nest_service-crt.pem", "../../../nest_service/test/config/tls/nest_service-key.pem")
 
 	err := AuthorizeHost()
 	assert.Equal(t, err, nil)
 }
 
 func TestEnroll(t *testing.T) {
+	service_cfg := config.DefaultService()
+	service_cfg.Downstream.Protocol = client.REST
+	service := nest_service.New(&service_cfg, nil)
+	ca_cfg := config.DefaultCa()
+	ca := nest_ca.New(&ca_cfg)
+	conf_cfg := config.DefaultConf()
+	conf := nest_config.New(&conf_cfg)
 	var (
-		service_endpoint models.Route = nest_service.Service_routes[2]
-		ca_endpoint      models.Route = nest_ca.Ca_routes[1]
-		config_endpoint  models.Route = nest_config.Conf_routes[1]
+		service_endpoint models.Route = service.Routes()[2]
+		ca_endpoint      models.Route = ca.Routes()[1]
+		config_endpoint  models.Route = conf.Routes()[1]
 	)
 	r := nest_test.MockRouterForEndpoint(&service_endpoint)
 	r2 := nest_test.MockRouterForEndpoint(&ca_endpoint)
 	r3 := nest_test.MockRouterForEndpoint(&config_endpoint)
-	utils.Hostnames_file = "../../../nest_service/test/config/hostnames"
-	utils.Service_ip = "localhost"
-	utils.Service_port = "8089"
-	utils.Ca_service_ip = "localhost"
-	utils.Ca_service_port = "8090"
-	utils.Conf_service_ip = "localhost"
-	utils.Conf_service_port = "8091"
-	Nest_service_ip = utils.Service_ip
-	Nest_service_port = utils.Service_port
+	service_cfg.HostnamesFile = "../../../nest_service/test/config/hostnames"
+	service_cfg.ServiceIP = "localhost"
+	service_cfg.ServicePort = "8089"
+	service_cfg.Ca.IP = "localhost"
+	service_cfg.Ca.Port = "8090"
+	service_cfg.Conf.IP = "localhost"
+	service_cfg.Conf.Port = "8091"
+	Nest_service_ip = service_cfg.ServiceIP
+	Nest_service_port = service_cfg.ServicePort
 	Bin_folder = "../../test/"
 	Nest_certificate = "../../../nest_service/test/config/tls/nest_service-crt.pem"
-	utils.Ncsr_folder = "../../../nest_service/test/ncsr/"
-	go r.RunTLS(utils.Service_ip+":"+utils.Service_port, "../../../nest_service/test/config/tls/nest_service-crt.pem", "../../../nest_service/test/config/tls/nest_service-key.pem")
+	service_cfg.NcsrFolder = "../../../nest_service/test/ncsr/"
+	go r.RunTLS(service_cfg.ServiceIP+":"+service_cfg.ServicePort, "../../../nest_service/test/config/tls/nest_service-crt.pem", "../../../nest_service/test/config/tls/nest_service-key.pem")
 	Hostname = "lighthouse"
-	utils.Certificates_path = "../../../nest_ca/test/certificates/"
-	os.Remove(utils.Certificates_path + Hostname + ".crt")
-	utils.Ca_bin = "../../../nest_ca/test/config/bin/nebula-cert"
-	utils.Ca_keys_path = "../../../nest_ca/test/config/keys/"
-	go r2.Run(utils.Ca_service_ip + ":" + utils.Ca_service_port)
-	utils.Dhall_dir = "../../../nest_config/test/dhall/"
-	utils.Dhall_configuration = utils.Dhall_dir + "nebula/nebula_conf.dhall"
+	ca_cfg.CertificatesPath = "../../../nest_ca/test/certificates/"
+	os.Remove(ca_cfg.CertificatesPath + Hostname + ".crt")
+	ca_cfg.CaBin = "../../../nest_ca/test/config/bin/nebula-cert"
+	ca_cfg.CaKeysPath = "../../../nest_ca/test/config/keys/"
+	go r2.Run(service_cfg.Ca.IP + ":" + service_cfg.Ca.Port)
+	connect(service)
+	conf_cfg.DhallDir = "../../../nest_config/test/dhall/"
+	conf_cfg.DhallConfiguration = conf_cfg.DhallDir + "nebula/nebula_conf.dhall"
 
-	go r3.Run(utils.Conf_service_ip + ":" + utils.Conf_service_port)
+	go r3.Run(service_cfg.Conf.IP + ":" + service_cfg.Conf.Port)
+	connect(service)
 	go Enroll()
 	var br bool
 	for !br {
@@ -133,37 +164,46 @@ func TestEnroll(t *testing.T) {
 }
 
 func TestServerKeygen(t *testing.T) {
+	service_cfg := config.DefaultService()
+	service_cfg.Downstream.Protocol = client.REST
+	service := nest_service.New(&service_cfg, nil)
+	ca_cfg := config.DefaultCa()
+	ca := nest_ca.New(&ca_cfg)
+	conf_cfg := config.DefaultConf()
+	conf := nest_config.New(&conf_cfg)
 	var (
-		service_endpoint models.Route = nest_service.Service_routes[5]
-		ca_endpoint      models.Route = nest_ca.Ca_routes[2]
-		config_endpoint  models.Route = nest_config.Conf_routes[1]
+		service_endpoint models.Route = service.Routes()[5]
+		ca_endpoint      models.Route = ca.Routes()[2]
+		config_endpoint  models.Route = conf.Routes()[1]
 	)
 	r := nest_test.MockRouterForEndpoint(&service_endpoint)
 	r2 := nest_test.MockRouterForEndpoint(&ca_endpoint)
 	r3 := nest_test.MockRouterForEndpoint(&config_endpoint)
-	utils.Hostnames_file = "../../../nest_service/test/config/hostnames"
-	utils.Service_ip = "localhost"
-	utils.Service_port = "8092"
-	utils.Ca_service_ip = "localhost"
-	utils.Ca_service_port = "8093"
-	utils.Conf_service_ip = "localhost"
-	utils.Conf_service_port = "8094"
-	Nest_service_ip = utils.Service_ip
-	Nest_service_port = utils.Service_port
+	service_cfg.HostnamesFile = "../../../nest_service/test/config/hostnames"
+	service_cfg.ServiceIP = "localhost"
+	service_cfg.ServicePort = "8092"
+	service_cfg.Ca.IP = "localhost"
+	service_cfg.Ca.Port = "8093"
+	service_cfg.Conf.IP = "localhost"
+	service_cfg.Conf.Port = "8094"
+	Nest_service_ip = service_cfg.ServiceIP
+	Nest_service_port = service_cfg.ServicePort
 	Bin_folder = "../../test/"
 	Nest_certificate = "../../../nest_service/test/config/tls/nest_service-crt.pem"
-	utils.Ncsr_folder = "../../../nest_service/test/ncsr/"
-	go r.RunTLS(utils.Service_ip+":"+utils.Service_port, "../../../nest_service/test/config/tls/nest_service-crt.pem", "../../../nest_service/test/config/tls/nest_service-key.pem")
+	service_cfg.NcsrFolder = "../../../nest_service/test/ncsr/"
+	go r.RunTLS(service_cfg.ServiceIP+":"+service_cfg.ServicePort, "../../../nest_service/test/config/tls/nest_service-crt.pem", "../../../nest_service/test/config/tls/nest_service-key.pem")
 	Hostname = "lighthouse"
-	os.WriteFile(utils.Ncsr_folder+Hostname, []byte("Pending"), 0600)
-	utils.Certificates_path = "../../../nest_ca/test/certificates/"
-	os.Remove(utils.Certificates_path + Hostname + ".crt")
-	utils.Ca_bin = "../../../nest_ca/test/config/bin/nebula-cert"
-	utils.Ca_keys_path = "../../../nest_ca/test/config/keys/"
-	go r2.Run(utils.Ca_service_ip + ":" + utils.Ca_service_port)
-	utils.Dhall_dir = "../../../nest_config/test/dhall/"
-	utils.Dhall_configuration = utils.Dhall_dir + "nebula/nebula_conf.dhall"
-	go r3.Run(utils.Conf_service_ip + ":" + utils.Conf_service_port)
+	os.WriteFile(service_cfg.NcsrFolder+Hostname, []byte("Pending"), 0600)
+	ca_cfg.CertificatesPath = "../../../nest_ca/test/certificates/"
+	os.Remove(ca_cfg.CertificatesPath + Hostname + ".crt")
+	ca_cfg.CaBin = "../../../nest_ca/test/config/bin/nebula-cert"
+	ca_cfg.CaKeysPath = "../../../nest_ca/test/config/keys/"
+	go r2.Run(service_cfg.Ca.IP + ":" + service_cfg.Ca.Port)
+	connect(service)
+	conf_cfg.DhallDir = "../../../nest_config/test/dhall/"
+	conf_cfg.DhallConfiguration = conf_cfg.DhallDir + "nebula/nebula_conf.dhall"
+	go r3.Run(service_cfg.Conf.IP + ":" + service_cfg.Conf.Port)
+	connect(service)
 	go ServerKeygen()
 	var br bool
 	for !br {
@@ -192,28 +232,34 @@ func TestServerKeygen(t *testing.T) {
 }
 
 func TestReenroll(t *testing.T) {
+	service_cfg := config.DefaultService()
+	service_cfg.Downstream.Protocol = client.REST
+	service := nest_service.New(&service_cfg, nil)
+	ca_cfg := config.DefaultCa()
+	ca := nest_ca.New(&ca_cfg)
 	var (
-		service_endpoint models.Route = nest_service.Service_routes[4]
-		ca_endpoint      models.Route = nest_ca.Ca_routes[1]
+		service_endpoint models.Route = service.Routes()[4]
+		ca_endpoint      models.Route = ca.Routes()[1]
 	)
 	r := nest_test.MockRouterForEndpoint(&service_endpoint)
 	r2 := nest_test.MockRouterForEndpoint(&ca_endpoint)
-	utils.Hostnames_file = "../../../nest_service/test/config/hostnames"
-	utils.Service_ip = "localhost"
-	utils.Service_port = "8095"
-	utils.Ca_service_ip = "localhost"
-	utils.Ca_service_port = "8096"
-	Nest_service_ip = utils.Service_ip
-	Nest_service_port = utils.Service_port
+	service_cfg.HostnamesFile = "../../../nest_service/test/config/hostnames"
+	service_cfg.ServiceIP = "localhost"
+	service_cfg.ServicePort = "8095"
+	service_cfg.Ca.IP = "localhost"
+	service_cfg.Ca.Port = "8096"
+	Nest_service_ip = service_cfg.ServiceIP
+	Nest_service_port = service_cfg.ServicePort
 	Bin_folder = "../../test/"
 	Nest_certificate = "../../../nest_service/test/config/tls/nest_service-crt.pem"
-	utils.Ncsr_folder = "../../../nest_service/test/ncsr/"
-	go r.RunTLS(utils.Service_ip+":"+utils.Service_port, "../../../nest_service/test/config/tls/nest_service-crt.pem", "../../../nest_service/test/config/tls/nest_service-key.pem")
+	service_cfg.NcsrFolder = "../../../nest_service/test/ncsr/"
+	go r.RunTLS(service_cfg.ServiceIP+":"+service_cfg.ServicePort, "../../../nest_service/test/config/tls/nest_service-crt.pem", "../../../nest_service/test/config/tls/nest_service-key.pem")
 	Hostname = "lighthouse"
-	utils.Certificates_path = "../../../nest_ca/test/certificates/"
-	utils.Ca_bin = "../../../nest_ca/test/config/bin/nebula-cert"
-	utils.Ca_keys_path = "../../../nest_ca/test/config/keys/"
-	go r2.Run(utils.Ca_service_ip + ":" + utils.Ca_service_port)
+	ca_cfg.CertificatesPath = "../../../nest_ca/test/certificates/"
+	ca_cfg.CaBin = "../../../nest_ca/test/config/bin/nebula-cert"
+	ca_cfg.CaKeysPath = "../../../nest_ca/test/config/keys/"
+	go r2.Run(service_cfg.Ca.IP + ":" + service_cfg.Ca.Port)
+	connect(service)
 	Nebula_conf_folder = "../../test/"
 	info, _ := os.Stat(Nebula_conf_folder + Hostname + ".crt")
 	last_time := info.ModTime()
@@ -268,12 +314,13 @@ func TestReenroll(t *testing.T) {
 	last_time_key = info.ModTime()
 
 	Bin_folder = "./"
-	ca_endpoint = nest_ca.Ca_routes[2]
+	ca_endpoint = ca.Routes()[2]
 	r2 = nest_test.MockRouterForEndpoint(&ca_endpoint)
-	utils.Ca_service_port = "8097"
-	go r2.Run(utils.Ca_service_ip + ":" + utils.Ca_service_port)
+	service_cfg.Ca.Port = "8097"
+	go r2.Run(service_cfg.Ca.IP + ":" + service_cfg.Ca.Port)
+	connect(service)
 	Nebula_conf_folder = "../../test/"
-	utils.Certs_validity = "3s"
+	ca_cfg.CertsValidity = config.Duration(3 * time.Second)
 	go Reenroll()
 	br = false
 	for !br {
@@ -281,8 +328,9 @@ func TestReenroll(t *testing.T) {
 		case duration := <-Enroll_chan:
 			fmt.Println("waiting for" + string(rune(duration)) + "seconds")
 			Rekey = false
-			utils.Certs_validity = ""
-			utils.Ca_service_port = "8096"
+			ca_cfg.CertsValidity = 0
+			service_cfg.Ca.Port = "8096"
+			connect(service)
 			info, _ = os.Stat(Nebula_conf_folder + Hostname + ".crt")
 			assert.NotEqual(t, info.ModTime(), last_time)
 			last_time = info.ModTime()
@@ -315,8 +363,8 @@ func TestReenroll(t *testing.T) {
 	os.Remove(Nebula_conf_folder + "lighthouse.crt")
 	os.Remove(Nebula_conf_folder + "lighthouse.key")
 	os.Remove(Nebula_conf_folder + "lighthouse.yml")
-	os.Remove(utils.Certificates_path + "lighthouse.crt")
-	os.Remove(utils.Ncsr_folder + "lighthouse")
+	os.Remove(ca_cfg.CertificatesPath + "lighthouse.crt")
+	os.Remove(service_cfg.NcsrFolder + "lighthouse")
 	os.Remove("ncsr_status")
 }
 
@@ -325,3 +373,128 @@ func sendDuration() {
 	Enroll_chan <- 2 * time.Millisecond
 }
 */
+
+func TestRetryReenroll(t *testing.T) {
+	Nebula_conf_folder = t.TempDir() + "/"
+	Hostname = "retry"
+	renewal_attempt = 0
+	_, ca_key, _ := ed25519.GenerateKey(rand.Reader)
+	crt := cert.NebulaCertificate{Details: cert.NebulaCertificateDetails{Name: Hostname, NotBefore: time.Now().Add(-time.Hour), NotAfter: time.Now().Add(time.Hour), PublicKey: make([]byte, 32)}}
+	crt.Sign(ca_key)
+	b, _ := crt.MarshalToPEM()
+	os.WriteFile(Nebula_conf_folder+Hostname+".crt", b, 0600)
+
+	//First test: while the installed certificate is valid, the attempts are retried with a growing backoff
+	retryReenroll(fmt.Errorf("unavailable"))
+	first := <-Enroll_chan
+	assert.Equal(t, true, first >= renewal_backoff && first < 2*renewal_backoff)
+	retryReenroll(fmt.Errorf("unavailable"))
+	second := <-Enroll_chan
+	assert.Equal(t, true, second >= 2*renewal_backoff && second < 4*renewal_backoff)
+
+	//Second test: once the installed certificate expired, the client stops
+	crt.Details.NotAfter = time.Now().Add(-time.Minute)
+	crt.Sign(ca_key)
+	b, _ = crt.MarshalToPEM()
+	os.WriteFile(Nebula_conf_folder+Hostname+".crt", b, 0600)
+	retryReenroll(fmt.Errorf("unavailable"))
+	assert.Equal(t, true, <-Enroll_chan < 0)
+}
+
+func TestUpdateConfig(t *testing.T) {
+	Nebula_conf_folder = t.TempDir() + "/"
+	Conf_folder = Nebula_conf_folder
+	Hostname = "lighthouse"
+	Nebula_auth = Nebula_conf_folder + "secret.hmac"
+	os.WriteFile(Nebula_auth, []byte("0123456789abcdef"), 0600)
+	conf := []byte("pki:\n  ca: ca.crt\n")
+	var signature []byte
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") == "\""+models.ConfVersion(conf)+"\"" {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		if signature != nil {
+			w.Header().Set(models.CONF_SIGNATURE_HEADER, base64.StdEncoding.EncodeToString(signature))
+		}
+		w.Write(conf)
+	}))
+	defer server.Close()
+	Nest_service_ip, Nest_service_port, _ = net.SplitHostPort(strings.TrimPrefix(server.URL, "https://"))
+	Nest_certificate = Nebula_conf_folder + "nest_service-crt.pem"
+	os.WriteFile(Nest_certificate, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0600)
+	os.WriteFile(Nebula_conf_folder+"config.yml", []byte("pki:\n"), 0600)
+	_, ca_key, _ := ed25519.GenerateKey(rand.Reader)
+	crt := cert.NebulaCertificate{Details: cert.NebulaCertificateDetails{Name: Hostname, Ips: []*net.IPNet{{IP: net.IPv4(192, 168, 100, 1).To4(), Mask: net.CIDRMask(24, 32)}}, Groups: []string{"lighthouse", "all"}, NotBefore: time.Now().Add(-time.Hour), NotAfter: time.Now().Add(time.Hour), PublicKey: make([]byte, 32)}}
+	crt.Sign(ca_key)
+	b, _ := crt.MarshalToPEM()
+	os.WriteFile(Nebula_conf_folder+Hostname+".crt", b, 0600)
+	select {
+	case <-Reload_chan:
+	default:
+	}
+
+	//First test: a changed configuration file is installed and Nebula is reloaded
+	assert.Equal(t, nil, UpdateConfig())
+	b, _ = os.ReadFile(Nebula_conf_folder + "config.yml")
+	assert.Equal(t, conf, b)
+	assert.Equal(t, 1, len(Reload_chan))
+	<-Reload_chan
+
+	//Second test: the installed configuration file is the current one
+	assert.Equal(t, nil, UpdateConfig())
+	assert.Equal(t, 0, len(Reload_chan))
+	_, err := os.Stat(Nebula_conf_folder + "config.yml.new")
+	assert.Equal(t, true, os.IsNotExist(err))
+
+	//Third test: once the signing keys of the NEST config service are installed, only the configuration files signed for the host, its installation path, IP address and security groups are installed
+	public_key, private_key, _ := ed25519.GenerateKey(rand.Reader)
+	keys, _ := models.MarshalConfigSigningKey(public_key)
+	os.WriteFile(Conf_folder+config_signing_keys, keys, 0600)
+	conf = []byte("pki:\n  ca: ca.crt\nlighthouse:\n  am_lighthouse: true\n")
+	assert.NotEqual(t, nil, UpdateConfig())
+	signed := models.ConfResponse{NebulaConf: conf, NebulaPath: Nebula_conf_folder, Ip: "192.168.100.1/24", Groups: []string{"all", "lighthouse"}}
+	signature = models.SignConfig(private_key, "laptop", &signed)
+	assert.NotEqual(t, nil, UpdateConfig())
+	signed.NebulaPath = "/tmp/"
+	signature = models.SignConfig(private_key, Hostname, &signed)
+	assert.NotEqual(t, nil, UpdateConfig())
+	signed.NebulaPath, signed.Ip = Nebula_conf_folder, "192.168.100.2/24"
+	signature = models.SignConfig(private_key, Hostname, &signed)
+	assert.NotEqual(t, nil, UpdateConfig())
+	b, _ = os.ReadFile(Nebula_conf_folder + "config.yml")
+	assert.Equal(t, "pki:\n  ca: ca.crt\n", string(b))
+	assert.Equal(t, 0, len(Reload_chan))
+	signed.Ip = "192.168.100.1/24"
+	signature = models.SignConfig(private_key, Hostname, &signed)
+	assert.Equal(t, nil, UpdateConfig())
+	b, _ = os.ReadFile(Nebula_conf_folder + "config.yml")
+	assert.Equal(t, conf, b)
+	<-Reload_chan
+
+	//Fourth test: a configuration file with Windows paths is verified as generated, and installed with its paths rewritten
+	conf = []byte("pki:\n  ca: \"C:\\\\nebula/ca.crt\"\n")
+	signed.NebulaConf = conf
+	signature = models.SignConfig(private_key, Hostname, &signed)
+	assert.Equal(t, nil, UpdateConfig())
+	b, _ = os.ReadFile(Nebula_conf_folder + "config.yml")
+	assert.Equal(t, models.InstallableConfig(conf), b)
+	<-Reload_chan
+	assert.Equal(t, nil, UpdateConfig())
+	assert.Equal(t, 0, len(Reload_chan))
+
+	//Fifth test: with the signatures required, or the signing keys pinned, the configuration files are not installed unverified when no signing keys were received
+	os.Remove(Conf_folder + config_signing_keys)
+	conf, signature = []byte("pki:\n  ca: /etc/nebula/ca.crt\n"), nil
+	Require_config_signature = true
+	assert.NotEqual(t, nil, UpdateConfig())
+	Require_config_signature = false
+	Config_signing_keys = Conf_folder + "pinned.pem"
+	assert.NotEqual(t, nil, UpdateConfig())
+	os.WriteFile(Config_signing_keys, keys, 0600)
+	signed.NebulaConf = conf
+	signature = models.SignConfig(private_key, Hostname, &signed)
+	assert.Equal(t, nil, UpdateConfig())
+	<-Reload_chan
+	Config_signing_keys = ""
+}
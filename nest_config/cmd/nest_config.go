@@ -8,113 +8,275 @@ Contact: gianmarco.decola@studio.unibo.it
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
 	"os"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	nest_config "github.com/m4rkdc/nebula_est/nest_config/pkg/logic"
+	"github.com/m4rkdc/nebula_est/nest_service/pkg/config"
+	"github.com/m4rkdc/nebula_est/nest_service/pkg/health"
+	"github.com/m4rkdc/nebula_est/nest_service/pkg/logging"
+	"github.com/m4rkdc/nebula_est/nest_service/pkg/metrics"
+	"github.com/m4rkdc/nebula_est/nest_service/pkg/models"
+	"github.com/m4rkdc/nebula_est/nest_service/pkg/rpc"
+	"github.com/m4rkdc/nebula_est/nest_service/pkg/tracing"
 	"github.com/m4rkdc/nebula_est/nest_service/pkg/utils"
 )
 
 /*
-nest_config is a REST API server which acts as a Nebula Config service for the NEST system.
-In the main function, the proper environment is set up before starting a Gin http server over a
-Nebula network for authentication and confidentiality among the peers (NEST , NEST_CA and NEST_CONFIG services)
+startNebula checks that the Nebula certificate, key and configuration of the service are in nebula_folder, then starts and supervises
+the Nebula overlay of the service. The returned file, receiving the Nebula output, must be closed after Nebula is stopped.
 */
-func main() {
-	if val, ok := os.LookupEnv("LOG_FILE"); ok {
-		utils.Log_file = val
+func startNebula(nebula_folder string) (*utils.NebulaSupervisor, *os.File) {
+	if _, err := os.Stat(nebula_folder + "nest_config.crt"); err != nil {
+		slog.Error("Cannot find NEST config Nebula certificate")
+		os.Exit(5)
+	}
+	if _, err := os.Stat(nebula_folder + "nest_config.key"); err != nil {
+		slog.Error("Cannot find NEST config Nebula key")
+		os.Exit(6)
+	}
+	if _, err := os.Stat(nebula_folder + "nest_system_ca.crt"); err != nil {
+		slog.Error("Cannot find NEST config ca crt")
+		os.Exit(7)
 	}
 
-	if val, ok := os.LookupEnv("SERVICE_IP"); ok {
-		utils.Conf_service_ip = val
+	if _, err := os.Stat(nebula_folder + "config.yml"); err != nil {
+		slog.Error("Cannot find NEST Nebula config")
+		os.Exit(8)
 	}
-	if val, ok := os.LookupEnv("SERVICE_PORT"); ok {
 
-		utils.Conf_service_port = val
+	nebula_log, err := os.OpenFile(nebula_folder+"nest_config_nebula.log", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		slog.Error("There was an error creating nebula log file", "error", err)
+		os.Exit(8)
 	}
-	if val, ok := os.LookupEnv("DHALL_DIR"); ok {
-		utils.Dhall_dir = val
+	nebula := utils.NewNebulaSupervisor(nebula_folder, nebula_log)
+	if err := nebula.Start(); err != nil {
+		slog.Error("There was an error setting up the Nebula tunnel", "error", err)
+		os.Exit(9)
 	}
-	if val, ok := os.LookupEnv("DHALL_CONFIGURATION"); ok {
-		utils.Dhall_configuration = val
+	return nebula, nebula_log
+}
+
+/*
+reload reloads the configuration of the service when it receives a SIGHUP, from the flags, environment and configuration file it was started with.
+nebula is nil in mtls transport mode.
+The log level is applied and the Nebula configuration is reloaded. The other settings require a restart.
+*/
+func reload(nebula *utils.NebulaSupervisor) {
+	cfg := config.DefaultConf()
+	if _, err := config.Load("nest_config", &cfg, os.Args[1:], os.LookupEnv); err != nil {
+		slog.Error("SIGHUP received: invalid configuration, keeping the previous one", "error", err)
+		return
 	}
-	if val, ok := os.LookupEnv("CONF_GEN_DIR"); ok {
-		utils.Conf_gen_dir = val
+	logging.SetLevel(cfg.Log.Level)
+	if nebula != nil {
+		if err := nebula.Reload(); err != nil {
+			slog.Warn("Could not reload the Nebula configuration", "error", err)
+		}
 	}
+	slog.Info("SIGHUP received: configuration reloaded")
+}
 
-	if val, ok := os.LookupEnv("NEBULA_FOLDER"); ok {
-		utils.Nebula_folder = val
+/*
+networkConfigs returns the configurations of the NEST config service instances: one per Nebula network in multi-tenant deployments,
+cfg itself in single network deployments.
+*/
+func networkConfigs(cfg *config.Conf) ([]config.Conf, error) {
+	if len(cfg.Networks.Names) == 0 {
+		return []config.Conf{*cfg}, nil
 	}
+	var configs []config.Conf
+	for _, name := range cfg.Networks.Names {
+		network_cfg, err := cfg.ForNetwork(name)
+		if err != nil {
+			return nil, fmt.Errorf("network %s: %v", name, err)
+		}
+		configs = append(configs, network_cfg)
+	}
+	return configs, nil
+}
 
-	fmt.Println("NEST config service: starting setup")
-
-	info, err := os.Stat(utils.Dhall_dir + "bin/dhall-nebula")
+// setupNetwork checks that the dhall-nebula binary and the network description of the instance with configuration cfg exist
+func setupNetwork(cfg *config.Conf) {
+	info, err := os.Stat(cfg.DhallDir + "bin/dhall-nebula")
 	if err != nil {
-		fmt.Printf("%s doesn't exist. Cannot proceed. Please provide the dhall-nebula bin to the service before starting it\nExiting...", utils.Dhall_dir+"dhall-nebula")
+		slog.Error("dhall-nebula bin doesn't exist. Cannot proceed. Please provide the dhall-nebula bin to the service before starting it", "path", cfg.DhallDir+"bin/dhall-nebula")
 		os.Exit(1)
 	}
 	if !utils.IsExecOwner(info.Mode()) {
-		os.Chmod(utils.Dhall_dir+"bin/dhall-nebula", 0700)
+		os.Chmod(cfg.DhallDir+"bin/dhall-nebula", 0700)
 	}
-	info, err = os.Stat(utils.Dhall_dir + utils.Dhall_configuration)
+	info, err = os.Stat(cfg.DhallDir + cfg.DhallConfiguration)
 	if err != nil {
-		fmt.Printf("%s doesn't exist. Cannot proceed. Please provide the dhall-nebula network configuration to the service before starting it\nExiting...", utils.Dhall_dir+utils.Dhall_configuration)
+		slog.Error("dhall-nebula network configuration doesn't exist. Cannot proceed. Please provide the dhall-nebula network configuration to the service before starting it", "path", cfg.DhallDir+cfg.DhallConfiguration)
 		os.Exit(2)
 	}
 	if !utils.IsRWOwner(info.Mode()) {
-		os.Chmod(utils.Dhall_dir+utils.Dhall_configuration, 0600)
+		os.Chmod(cfg.DhallDir+cfg.DhallConfiguration, 0600)
 	}
-	utils.Dhall_last_modified = info.ModTime()
+}
 
-	if _, err := os.Stat(utils.Nebula_folder + "nest_config.crt"); err != nil {
-		fmt.Printf("Cannot find NEST config Nebula certificate\n")
-		os.Exit(5)
+/*
+nest_config is a REST API server which acts as a Nebula Config service for the NEST system.
+In the main function, the proper environment is set up before starting a Gin http server over a
+Nebula network for authentication and confidentiality among the peers (NEST , NEST_CA and NEST_CONFIG services)
+*/
+func main() {
+	cfg := config.DefaultConf()
+	print_config, err := config.Load("nest_config", &cfg, os.Args[1:], os.LookupEnv)
+	if err != nil {
+		slog.Error("Invalid configuration", "error", err)
+		os.Exit(11)
 	}
-	if _, err := os.Stat(utils.Nebula_folder + "nest_config.key"); err != nil {
-		fmt.Printf("Cannot find NEST config Nebula key\n")
-		os.Exit(6)
+	if print_config {
+		config.Print(os.Stdout, &cfg)
+		return
 	}
-	if _, err := os.Stat(utils.Nebula_folder + "nest_system_ca.crt"); err != nil {
-		fmt.Printf("Cannot find NEST config ca crt\n")
-		os.Exit(7)
+	log_file, err := logging.Setup(cfg.Log, "nest_config")
+	if err != nil {
+		fmt.Printf("Could not open the log file: %v\n", err)
+		os.Exit(12)
 	}
-
-	if _, err := os.Stat(utils.Nebula_folder + "config.yml"); err != nil {
-		fmt.Printf("Cannot find NEST Nebula config\n")
-		os.Exit(8)
+	defer log_file.Close()
+	shutdown_tracing, err := tracing.Setup(cfg.Tracing, "nest_config")
+	if err != nil {
+		slog.Error("Could not set up the tracing", "error", err)
+		os.Exit(13)
 	}
 
-	nebula_log, err := os.OpenFile(utils.Nebula_folder+"nest_config_nebula.log", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	slog.Info("NEST config service: starting setup")
+
+	configs, err := networkConfigs(&cfg)
 	if err != nil {
-		fmt.Printf("There was an error creating nebula log file: %v\n", err)
-		os.Exit(8)
+		slog.Error("Invalid network configuration", "error", err)
+		os.Exit(11)
 	}
-	defer nebula_log.Close()
-	if err := utils.SetupNebula(utils.Nebula_folder, nebula_log); err != nil {
-		fmt.Printf("There was an error setting up the Nebula tunnel:%v\n", err)
-		os.Exit(9)
+	for i := range configs {
+		setupNetwork(&configs[i])
 	}
-	if dir, _ := os.ReadDir(utils.Dhall_dir + utils.Conf_gen_dir); len(dir) == 0 {
-		if err = nest_config.GenerateAllNebulaConfigs(); err != nil {
-			fmt.Println("Could not generate Nebula configuration files: " + err.Error())
-			os.Exit(3)
+
+	var nebula *utils.NebulaSupervisor
+	var transport_tls *tls.Config
+	if cfg.Transport.Mode == config.TRANSPORT_MTLS {
+		transport_tls, err = utils.MutualTLSServerConfig(cfg.Transport.Folder, "nest_config", cfg.Transport.Peers)
+		if err != nil {
+			slog.Error("Cannot load the mutual TLS transport certificates", "error", err)
+			os.Exit(14)
+		}
+		slog.Warn("Mutual TLS transport: the NEST services communicate without the Nebula overlay")
+	} else {
+		var nebula_log *os.File
+		nebula, nebula_log = startNebula(cfg.NebulaFolder)
+		defer nebula_log.Close()
+		defer nebula.Stop()
+	}
+	// exit stops Nebula, if running, before exiting, since the deferred calls are not run by os.Exit
+	exit := func(code int) {
+		if nebula != nil {
+			nebula.Stop()
+		}
+		os.Exit(code)
+	}
+	// One instance per Nebula network, whose REST routes are served under the network path and gRPC calls are dispatched by network
+	config_server := &nest_config.ConfigServer{}
+	var routes []models.Route
+	var checks []health.Check
+	for i := range configs {
+		service := nest_config.New(&configs[i])
+		if err = service.LoadSigningKey(); err != nil {
+			slog.Error("Could not load the configuration signing key", "network", configs[i].Network, "error", err)
+			exit(15)
+		}
+		// With IP address management, the configurations are always regenerated since the host files may have changed while the service was stopped
+		if dir, _ := os.ReadDir(configs[i].DhallDir + configs[i].ConfGenDir); len(dir) == 0 || service.IPAM != nil {
+			if err = service.GenerateAllNebulaConfigs(context.Background()); err != nil {
+				slog.Error("Could not generate Nebula configuration files", "network", configs[i].Network, "error", err)
+				exit(3)
+			}
+		}
+		if network := configs[i].Network; len(network) == 0 {
+			config_server.Service = service
+		} else {
+			if config_server.Networks == nil {
+				config_server.Networks = make(map[string]*nest_config.Service)
+			}
+			config_server.Networks[network] = service
+		}
+		routes = append(routes, models.NetworkRoutes(configs[i].Network, service.Routes())...)
+		checks = append(checks,
+			health.InNetwork(configs[i].Network, health.File("dhall_configuration", configs[i].DhallDir+configs[i].DhallConfiguration)),
+			health.InNetwork(configs[i].Network, health.File("dhall_nebula_bin", configs[i].DhallDir+"bin/dhall-nebula")),
+		)
+		if service.IPAM != nil {
+			checks = append(checks, health.InNetwork(configs[i].Network, health.Check{Name: "ipam", Run: service.CheckAddresses}))
 		}
 	}
 
-	fmt.Println("NEST config service: setup finished")
+	lis, err := net.Listen("tcp", cfg.ServiceIP+":"+cfg.GRPCPort)
+	if err != nil {
+		slog.Error("Cannot listen for gRPC requests", "error", err)
+		exit(10)
+	}
+	grpc_server := rpc.NewServer(transport_tls)
+	models.RegisterConfigServiceServer(grpc_server, config_server)
+	failed := make(chan error, 2)
+	utils.Serve(func() error { return grpc_server.Serve(lis) }, failed)
 
-	router := gin.Default()
+	slog.Info("NEST config service: setup finished")
+
+	gin.SetMode(gin.ReleaseMode)
+	router := gin.New()
+	router.Use(gin.Recovery(), tracing.Middleware(), logging.Middleware())
 	router.SetTrustedProxies(nil)
-	utils.SetupLogger(router, utils.Log_file)
-	for _, r := range nest_config.Conf_routes {
+	metrics.Setup(router)
+	if nebula != nil {
+		checks = append([]health.Check{health.Nebula(nebula)}, checks...)
+	}
+	health.Setup(router, checks...)
+	for _, r := range routes {
 		switch r.Method {
 		case "GET":
 			router.GET(r.Pattern, r.HandlerFunc)
 		case "POST":
 			router.POST(r.Pattern, r.HandlerFunc)
+		case "DELETE":
+			router.DELETE(r.Pattern, r.HandlerFunc)
 		}
 	}
 
-	router.Run(utils.Conf_service_ip + ":" + utils.Conf_service_port)
+	srv := http.Server{
+		Addr:      cfg.ServiceIP + ":" + cfg.ServicePort,
+		Handler:   router,
+		TLSConfig: transport_tls,
+	}
+	if transport_tls != nil {
+		utils.Serve(func() error { return srv.ListenAndServeTLS("", "") }, failed)
+	} else {
+		utils.Serve(srv.ListenAndServe, failed)
+	}
+	if err := utils.WaitForShutdown(func(context.Context) { reload(nebula) }, failed); err != nil {
+		slog.Error("Error in serving requests", "error", err)
+	}
+
+	// Shutdown: the REST and gRPC requests in progress are drained, then the traces are flushed, within the shutdown timeout. Nebula is stopped last, by the deferred calls
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(cfg.ShutdownTimeout))
+	defer cancel()
+	if err := utils.ShutdownHTTP(ctx, &srv); err != nil {
+		slog.Warn("The REST requests in progress did not complete in time, their connections were closed", "error", err)
+	}
+	if err := rpc.Shutdown(ctx, grpc_server); err != nil {
+		slog.Warn("The gRPC requests in progress did not complete in time, they were canceled", "error", err)
+	}
+	if err := shutdown_tracing(ctx); err != nil {
+		slog.Warn("Could not flush the traces", "error", err)
+	}
+	slog.Info("NEST config service: shut down")
 }
@@ -1,14 +1,19 @@
 module github.com/m4rkdc/nebula_est/nest_config
 
-go 1.19
+go 1.21
 
 require (
 	github.com/gin-gonic/gin v1.8.2
 	github.com/go-playground/assert/v2 v2.2.0
 	github.com/m4rkdc/nebula_est/nest_service v0.0.0-20230206141902-79aed3e86e20
+	github.com/philandstuff/dhall-golang/v6 v6.0.2
+	github.com/pmezard/go-difflib v1.0.0
+	github.com/prometheus/client_golang v1.12.1
+	google.golang.org/grpc v1.53.0
 )
 
 require (
+	github.com/fxamacker/cbor/v2 v2.2.1-0.20200511212021-28e39be4a84f // indirect
 	github.com/gin-contrib/sse v0.1.0 // indirect
 	github.com/go-playground/locales v0.14.1 // indirect
 	github.com/go-playground/universal-translator v0.18.1 // indirect
@@ -23,6 +28,7 @@ require (
 	github.com/pelletier/go-toml/v2 v2.0.6 // indirect
 	github.com/slackhq/nebula v1.6.1 // indirect
 	github.com/ugorji/go/codec v1.2.9 // indirect
+	github.com/x448/float16 v0.8.4 // indirect
 	golang.org/x/crypto v0.5.0 // indirect
 	golang.org/x/net v0.5.0 // indirect
 	golang.org/x/sys v0.4.0 // indirect
@@ -1,177 +1,271 @@
 package nest_config
 
 import (
-	"bufio"
-	"bytes"
-	"fmt"
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"log/slog"
 	"net/http"
 	"os"
 	"os/exec"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/m4rkdc/nebula_est/nest_service/pkg/config"
+	"github.com/m4rkdc/nebula_est/nest_service/pkg/ipam"
+	"github.com/m4rkdc/nebula_est/nest_service/pkg/metrics"
 	"github.com/m4rkdc/nebula_est/nest_service/pkg/models"
-	"github.com/m4rkdc/nebula_est/nest_service/pkg/utils"
+	"github.com/m4rkdc/nebula_est/nest_service/pkg/store"
+	"github.com/m4rkdc/nebula_est/nest_service/pkg/tracing"
+	"github.com/philandstuff/dhall-golang/v6/term"
 )
 
-var Conf_routes = [3]models.Route{
-	{
-		Name:        "GetValidHostnames",
-		Method:      "GET",
-		Pattern:     "/hostnames",
-		HandlerFunc: GetValidHostnames,
-	},
-	{
-		Name:        "GetConfig",
-		Method:      "GET",
-		Pattern:     "/configs/:hostname",
-		HandlerFunc: GetConfig,
-	},
-	/*
+// A NEST config service instance. Every setting is read from its configuration, so that several instances can run in the same process
+type Service struct {
+	Config *config.Conf
+	//Last update of the dhall configuration file, guarded by generation
+	dhall_last_modified time.Time
+	generation          sync.Mutex
+	//IP address management of the hosts without a static address, nil if it has no pools
+	IPAM *ipam.IPAM
+	//Registry of the instances of the host templates, by hostname, and the leases on their registrations, shared by the NEST config instances sharing the registry
+	instances       store.Store
+	instance_leases *store.Leases
+	//Recorded versions of the Nebula configuration files, by identifier, and the configuration files of the hosts they are made of, by content. Written under history
+	versions store.Store
+	configs  store.Store
+	history  sync.Mutex
+	//Key with which the Nebula configuration files are signed, nil until loaded by LoadSigningKey
+	signing_key ed25519.PrivateKey
+	//Last evaluation of the network description and the revision it was made of, guarded by evaluation
+	network          *dhallNetwork
+	network_revision string
+	//Type checked Dhall files of the network description, by file, guarded by evaluation
+	checked    map[term.LocalFile][]checkedFile
+	evaluation sync.Mutex
+}
+
+// New creates a NEST config service instance with the given configuration
+func New(cfg *config.Conf) *Service {
+	replica, _ := os.Hostname()
+	s := &Service{
+		Config:          cfg,
+		instances:       store.NewFile(cfg.Templates.InstancesFolder),
+		instance_leases: store.NewLeases(store.NewFile(cfg.Templates.InstancesFolder+".leases/"), replica),
+		versions:        store.NewFile(cfg.History.Folder + "versions/"),
+		configs:         store.NewFile(cfg.History.Folder + "configs/"),
+		checked:         make(map[term.LocalFile][]checkedFile),
+	}
+	if info, err := os.Stat(cfg.DhallDir + cfg.DhallConfiguration); err == nil {
+		s.dhall_last_modified = info.ModTime()
+	}
+	if len(cfg.IPAM.Pools) != 0 {
+		s.IPAM = ipam.New(cfg.IPAM, store.NewFile(cfg.IPAM.LeasesFolder), store.NewLeases(store.NewFile(cfg.IPAM.LeasesFolder+".allocations/"), replica))
+	}
+	return s
+}
+
+// Routes returns the REST API routes of the NEST config service instance
+func (s *Service) Routes() []models.Route {
+	return []models.Route{
+		{
+			Name:        "GetValidHostnames",
+			Method:      "GET",
+			Pattern:     "/hostnames",
+			HandlerFunc: s.GetValidHostnames,
+		},
+		{
+			Name:        "GetConfig",
+			Method:      "GET",
+			Pattern:     "/configs/:hostname",
+			HandlerFunc: s.GetConfig,
+		},
+		{
+			Name:        "GetTemplates",
+			Method:      "GET",
+			Pattern:     "/templates",
+			HandlerFunc: s.GetTemplates,
+		},
+		{
+			Name:        "GetInstances",
+			Method:      "GET",
+			Pattern:     "/instances",
+			HandlerFunc: s.GetInstances,
+		},
+		{
+			Name:        "RegisterInstance",
+			Method:      "POST",
+			Pattern:     "/instances",
+			HandlerFunc: s.RegisterInstance,
+		},
+		{
+			Name:        "ApproveInstance",
+			Method:      "POST",
+			Pattern:     "/instances/:hostname/approve",
+			HandlerFunc: s.ApproveInstance,
+		},
+		{
+			Name:        "RemoveInstance",
+			Method:      "DELETE",
+			Pattern:     "/instances/:hostname",
+			HandlerFunc: s.RemoveInstance,
+		},
 		{
-			Name:        "ValidateCertificate",
+			Name:        "GetVersions",
+			Method:      "GET",
+			Pattern:     "/versions",
+			HandlerFunc: s.GetVersions,
+		},
+		{
+			Name:        "GetVersion",
+			Method:      "GET",
+			Pattern:     "/versions/:version",
+			HandlerFunc: s.GetVersion,
+		},
+		{
+			Name:        "GetVersionDiff",
+			Method:      "GET",
+			Pattern:     "/versions/:version/diff",
+			HandlerFunc: s.GetVersionDiff,
+		},
+		{
+			Name:        "RollbackVersion",
 			Method:      "POST",
-			Pattern:     "/validate",
-			HandlerFunc: ValidateCertificate,
-		},*/
+			Pattern:     "/versions/:version/rollback",
+			HandlerFunc: s.RollbackVersion,
+		},
+		{
+			Name:        "GetSigningKeys",
+			Method:      "GET",
+			Pattern:     "/signing_keys",
+			HandlerFunc: s.GetSigningKeys,
+		},
+		/*
+			{
+				Name:        "ValidateCertificate",
+				Method:      "POST",
+				Pattern:     "/validate",
+				HandlerFunc: s.ValidateCertificate,
+			},*/
+	}
 }
 
-// generateAllNebulaConfigs generates Nebula configuration files for every client using the dhall-nebula tool
-func GenerateAllNebulaConfigs() error {
+/*
+generateAllNebulaConfigs generates Nebula configuration files for every client using the dhall-nebula tool.
+The host files of the approved instances of the host templates are written first and, with IP address management, the addresses of the hosts are allocated and released.
+The generated files are then recorded as a new version of the configuration files, if they changed.
+*/
+func (s *Service) GenerateAllNebulaConfigs(ctx context.Context) error {
+	defer metrics.ObserveSince(metrics.ConfigRegenerationDuration, time.Now())
+	if err := s.syncInstances(ctx); err != nil {
+		slog.ErrorContext(ctx, "Error writing the host template instances", "error", err)
+		metrics.ConfigRegenerationFailures.Inc()
+		return err
+	}
+	if s.IPAM != nil {
+		if err := s.syncAddresses(ctx); err != nil {
+			slog.ErrorContext(ctx, "Error in the IP address management", "error", err)
+			metrics.ConfigRegenerationFailures.Inc()
+			return err
+		}
+	}
 	pwd, _ := os.Getwd()
 	pwd += "/"
-	fmt.Println("Generating nebula configuration files...")
-	out, err := exec.Command(pwd+utils.Dhall_dir+"bin/dhall-nebula", "--dhallDir", pwd+utils.Dhall_dir, "--configFileName", utils.Dhall_configuration, "config", "--configsPath", pwd+utils.Dhall_dir+utils.Conf_gen_dir).CombinedOutput()
+	slog.InfoContext(ctx, "Generating nebula configuration files...")
+	out, err := tracing.CombinedOutput(ctx, "dhall-nebula config", exec.Command(pwd+s.Config.DhallDir+"bin/dhall-nebula", "--dhallDir", pwd+s.Config.DhallDir, "--configFileName", s.Config.DhallConfiguration, "config", "--configsPath", pwd+s.Config.DhallDir+s.Config.ConfGenDir))
 	if err != nil {
-		fmt.Println("Error in dhall-nebula: " + string(out))
+		slog.ErrorContext(ctx, "Error in dhall-nebula", "error", err, "output", string(out))
+		metrics.ConfigRegenerationFailures.Inc()
 		return err
 	}
-
-	return nil
-}
-
-func parseDhallFiles(b []byte, hostname string) ([]string, string, string, error) {
-	var (
-		ip      string
-		ip_mask []rune
-		group   []rune
-		groups  []string
-		path    string
-	)
-
-	start := "key: "
-	end := ".key"
-	b = bytes.ReplaceAll(b, []byte("\""), []byte(""))
-	low := bytes.Index(b, []byte(start))
-	high := bytes.Index(b, []byte(end))
-	/*if low == -1 && high == -1 {
-		start = "key: "
-		end = ".key"
-	}*/
-	path = string(b[low+len(start) : high-len(hostname)])
-
-	b, err := os.ReadFile(utils.Dhall_dir + "nebula/hosts/" + hostname + ".dhall")
-	if err != nil {
-		return nil, "", "", &models.ApiError{Code: 500, Message: "Internal Server Error: " + err.Error()}
-	}
-	start = "mkIPv4 "
-	end = "\n"
-	low = bytes.Index(b, []byte(start))
-	high = bytes.Index(b[low:], []byte(end)) + low
-
-	ip = strings.ReplaceAll(string(b[low+len(start):high]), " ", ".")
-
-	file, _ := os.Open(utils.Dhall_dir + utils.Dhall_configuration)
-	scanner := bufio.NewScanner(file)
-	scanner.Split(bufio.ScanLines)
-
-	start = "group_name = \""
-	end = "\","
-	for scanner.Scan() {
-		line := scanner.Text()
-		if strings.Contains(line, "ip_mask") {
-			low = strings.Index(line, "ip_mask = ")
-			for n, v := range line {
-				if n < low+len("ip_mask = ") {
-					continue
-				}
-				if v == '\n' {
-					break
-				}
-				ip_mask = append(ip_mask, v)
-			}
-			if len(ip_mask) != 0 {
-				ip += "/" + string(ip_mask)
-			}
-		}
-		if strings.Contains(line, "group_name") {
-			if strings.Contains(line, hostname) || strings.Contains(line, "hosts_list") {
-				low = strings.Index(line, start)
-				high = strings.Index(line[low:], end) + low
-
-				for n, v := range line {
-					if n < low+len(start) {
-						continue
-					}
-					if n == high {
-						break
-					}
-					group = append(group, v)
-				}
-				if len(group) != 0 {
-					groups = append(groups, string(group))
-					group = []rune{}
-				}
-			}
-		}
+	if err = s.recordVersion(ctx); err != nil {
+		slog.ErrorContext(ctx, "Error recording the configuration version", "error", err)
+		metrics.ConfigRegenerationFailures.Inc()
+		return err
 	}
-	return groups, ip, path, nil
+	return nil
 }
 
 /*
-The GetConfig REST endpoint reads the already generated Nebula config file for the given hostname and returns it.
+getConfig reads the already generated Nebula config file for the given hostname and returns it, regenerating all the config files first if the dhall configuration changed.
+If version is not empty, the config file is the one of hostname in that recorded version of the config files instead. The config file is signed with the signing key, if loaded,
+together with the installation path, IP and security groups of the client.
 The ConfResponse also contains the path in which all the keys and configs have to be installed on the client and the IP and Security groups of the client
 */
-func GetConfig(c *gin.Context) {
+func (s *Service) getConfig(ctx context.Context, hostname string, version string) (*models.ConfResponse, error) {
 	var conf_resp models.ConfResponse
 
-	hostname := c.Param("hostname")
 	if len(strings.TrimSpace(hostname)) == 0 {
-		c.JSON(http.StatusBadRequest, models.ApiError{Code: 400, Message: "Bad request: no hostname provided"})
-		return
+		return nil, &models.ApiError{Code: 400, Message: "Bad request: no hostname provided"}
 	}
 
-	info, err := os.Stat(utils.Dhall_dir + utils.Dhall_configuration)
+	info, err := os.Stat(s.Config.DhallDir + s.Config.DhallConfiguration)
 	if err != nil {
-		fmt.Println("Internal server Error: " + err.Error())
-		c.JSON(http.StatusInternalServerError, models.ApiError{Code: 500, Message: "Internal Server Error: " + err.Error()})
-		return
+		slog.ErrorContext(ctx, "Internal server error", "error", err)
+		return nil, &models.ApiError{Code: 500, Message: "Internal Server Error: " + err.Error()}
 	}
 
 	//TODO: move the regeneration on another goroutine to not block the requests. maybe add request information on if this is a renerollment
 	current_dhall_date := info.ModTime()
 
-	if current_dhall_date.After(utils.Dhall_last_modified) {
-		fmt.Println("Dhall configuration has been modified...")
-		GenerateAllNebulaConfigs()
+	s.generation.Lock()
+	if current_dhall_date.After(s.dhall_last_modified) {
+		slog.InfoContext(ctx, "Dhall configuration has been modified...")
+		if s.GenerateAllNebulaConfigs(ctx) == nil {
+			s.dhall_last_modified = current_dhall_date
+		}
+	}
+	s.generation.Unlock()
+	var b []byte
+	if len(version) != 0 {
+		b, err = s.readVersionConfig(ctx, version, hostname)
+		if errors.Is(err, store.ErrNotFound) {
+			return nil, &models.ApiError{Code: 404, Message: "Not found: there is no config file of " + hostname + " in the configuration version " + version}
+		}
+	} else {
+		//Read the whole generated yaml file and return it in conf_resp
+		b, err = os.ReadFile(s.Config.DhallDir + "nebula/generated/" + hostname + ".yaml")
 	}
-	//Read the whole generated yaml file and return it in conf_resp
-	b, err := os.ReadFile(utils.Dhall_dir + "nebula/generated/" + hostname + ".yaml")
 	if err != nil {
-		fmt.Println("Internal server Error: " + err.Error())
-		c.JSON(http.StatusInternalServerError, models.ApiError{Code: 500, Message: "Internal Server Error: " + err.Error()})
-		return
+		slog.ErrorContext(ctx, "Internal server error", "error", err)
+		return nil, &models.ApiError{Code: 500, Message: "Internal Server Error: " + err.Error()}
 	}
-	if bytes.Contains(b, []byte("\\")) {
-		b = bytes.ReplaceAll(b, []byte("/"), []byte("\\\\"))
-		conf_resp.NebulaConf = b
+	//Sent as generated by dhall-nebula: the clients rewrite the Windows paths once the signature is verified, see models.InstallableConfig
+	conf_resp.NebulaConf = b
+
+	if conf_resp.Groups, conf_resp.Ip, conf_resp.NebulaPath, err = s.describeHost(ctx, hostname); err != nil {
+		return nil, err
 	}
-	if len(conf_resp.NebulaConf) == 0 {
-		conf_resp.NebulaConf = b
+	conf_resp.Version = models.ConfVersion(conf_resp.NebulaConf)
+	if s.signing_key != nil {
+		conf_resp.Signature = models.SignConfig(s.signing_key, hostname, &conf_resp)
 	}
+	return &conf_resp, nil
+}
 
-	if conf_resp.Groups, conf_resp.Ip, conf_resp.NebulaPath, err = parseDhallFiles(b, hostname); err != nil {
-		c.JSON(http.StatusInternalServerError, err)
+/*
+The GetConfig REST endpoint reads the already generated Nebula config file for the given hostname and returns it.
+The ConfResponse also contains the path in which all the keys and configs have to be installed on the client and the IP and Security groups of the client.
+The version of the config file is sent as ETag: a request whose If-None-Match header holds the current version gets a 304 with no content.
+The version query parameter asks for the config file of a recorded version of the config files instead of the current one.
+*/
+func (s *Service) GetConfig(c *gin.Context) {
+	conf_resp, err := s.getConfig(c.Request.Context(), c.Param("hostname"), c.Query("version"))
+	if err != nil {
+		if api_error, ok := err.(*models.ApiError); ok {
+			c.JSON(api_error.Code, api_error)
+			return
+		}
+		c.JSON(http.StatusInternalServerError, models.ApiError{Code: 500, Message: "Internal Server Error: " + err.Error()})
+		return
+	}
+	etag := "\"" + conf_resp.Version + "\""
+	c.Header("ETag", etag)
+	if c.GetHeader("If-None-Match") == etag {
+		c.Status(http.StatusNotModified)
+		return
 	}
 	c.JSON(http.StatusOK, conf_resp)
 }
@@ -2,6 +2,7 @@ package nest_config
 
 import (
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"os"
@@ -10,8 +11,8 @@ import (
 
 	"github.com/gin-gonic/gin"
 	"github.com/go-playground/assert/v2"
+	"github.com/m4rkdc/nebula_est/nest_service/pkg/config"
 	"github.com/m4rkdc/nebula_est/nest_service/pkg/models"
-	"github.com/m4rkdc/nebula_est/nest_service/pkg/utils"
 	nest_test "github.com/m4rkdc/nebula_est/nest_service/test"
 )
 
@@ -24,9 +25,58 @@ func sendGetConfig(t *testing.T, r *gin.Engine, endpoint models.Route, hostname
 	return resp
 }
 
+// A stand-in for the dhall-nebula package, with the types and functions used by the host files written by writeHost
+const dhallPackage = `let IPv4 = { i1 : Natural, i2 : Natural, i3 : Natural, i4 : Natural }
+
+let PkiInfo = { ca : Text, cert : Text, key : Text }
+
+let Host = { name : Text, ip : IPv4, pki : PkiInfo, am_relay : Bool }
+
+in  { IPv4 = IPv4
+    , PkiInfo = PkiInfo
+    , Host = Host
+    , mkIPv4 =
+        \(i1 : Natural) ->
+        \(i2 : Natural) ->
+        \(i3 : Natural) ->
+        \(i4 : Natural) ->
+          { i1 = i1, i2 = i2, i3 = i3, i4 = i4 }
+    , mkPkiInfo =
+        \(dir : Text) ->
+        \(ca : Text) ->
+        \(name : Text) ->
+          { ca = dir ++ "/" ++ ca ++ ".crt"
+          , cert = dir ++ "/" ++ name ++ ".crt"
+          , key = dir ++ "/" ++ name ++ ".key"
+          }
+    }
+`
+
+// writeHost writes in the Dhall folder dir the host file of hostname, whose IP address is the Dhall expression ip
+func writeHost(dir string, hostname string, ip string) {
+	os.MkdirAll(dir+"nebula/hosts", 0700)
+	os.WriteFile(dir+"nebula/hosts/"+hostname+".dhall", []byte(fmt.Sprintf("let nebula = ../../package.dhall\n\nin  { name = \"%s\"\n    , ip = %s\n    , pki = nebula.mkPkiInfo \"/etc/nebula\" \"ca\" \"%s\"\n    , am_relay = False\n    }\n", hostname, ip, hostname)), 0600)
+}
+
+// writeDescription writes in the Dhall folder dir the package and the network description of the host files of hosts, with the security group home of the host files of home
+func writeDescription(dir string, hosts []string, home []string) {
+	os.MkdirAll(dir+"nebula", 0700)
+	os.WriteFile(dir+"package.dhall", []byte(dhallPackage), 0600)
+	imports := func(hostnames []string) string {
+		var files []string
+		for _, hostname := range hostnames {
+			files = append(files, "./hosts/"+hostname+".dhall")
+		}
+		return "[ " + strings.Join(files, ", ") + " ] : List nebula.Host"
+	}
+	os.WriteFile(dir+"nebula/nebula_conf.dhall", []byte("let nebula = ../package.dhall\n\nin  { hosts = "+imports(hosts)+"\n    , groups = [ { group_name = \"home\", group_hosts = "+imports(home)+" } ]\n    , blocklist = [] : List Text\n    , ip_mask = 24\n    }\n"), 0600)
+}
+
 func TestGetConfig(t *testing.T) {
+	cfg := config.DefaultConf()
+	s := New(&cfg)
 	var (
-		endpoint  models.Route = Conf_routes[1]
+		endpoint  models.Route = s.Routes()[1]
 		err       models.ApiError
 		hostname  string
 		conf_resp models.ConfResponse
@@ -48,18 +98,28 @@ func TestGetConfig(t *testing.T) {
 	assert.Equal(t, http.StatusInternalServerError, resp.Code)
 
 	//Third test: success
-	utils.Dhall_dir = "../../test/dhall/"
-	utils.Dhall_configuration = utils.Dhall_dir + "nebula/nebula_conf.dhall"
+	cfg.DhallDir = "../../test/dhall/"
+	cfg.DhallConfiguration = cfg.DhallDir + "nebula/nebula_conf.dhall"
 	resp = sendGetConfig(t, r, endpoint, hostname)
 	assert.Equal(t, http.StatusOK, resp.Code)
 
 	conf_resp.Ip = "192.168.100.1/24"
-	conf_resp.NebulaPath = "/mnt/d/Uni/Tesi/Magistrale/nebula_est/nest_client/test/"
+	conf_resp.NebulaPath = "/etc/nebula/"
 	conf_resp.Groups = append(conf_resp.Groups, "all")
-	b, _ := os.ReadFile(utils.Dhall_dir + "nebula/generated/" + hostname + ".yaml")
+	b, _ := os.ReadFile(cfg.DhallDir + "nebula/generated/" + hostname + ".yaml")
 	conf_resp.NebulaConf = b
+	conf_resp.Version = models.ConfVersion(b)
 	conf_resp_bytes, _ := json.Marshal(conf_resp)
 	assert.Equal(t, conf_resp_bytes, resp.Body.Bytes())
+	assert.Equal(t, "\""+conf_resp.Version+"\"", resp.Header().Get("ETag"))
+
+	//Fourth test: the client already has the current version of the config file
+	req, _ := http.NewRequest(endpoint.Method, strings.ReplaceAll(endpoint.Pattern, ":hostname", hostname), http.NoBody)
+	req.Header.Set("If-None-Match", "\""+conf_resp.Version+"\"")
+	resp = httptest.NewRecorder()
+	r.ServeHTTP(resp, req)
+	assert.Equal(t, http.StatusNotModified, resp.Code)
+	assert.Equal(t, 0, resp.Body.Len())
 }
 
 /*func TestVerify(t *testing.T) {}*/
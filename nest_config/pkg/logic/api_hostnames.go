@@ -7,20 +7,28 @@ import (
 
 	"github.com/gin-gonic/gin"
 	"github.com/m4rkdc/nebula_est/nest_service/pkg/models"
-	"github.com/m4rkdc/nebula_est/nest_service/pkg/utils"
 )
 
-// The GetValidHostnames REST endpoint inspects the dhall configuration file for the expected valid hostnames for the future Nebula network and returns them
-func GetValidHostnames(c *gin.Context) {
-	dir, err := os.ReadDir(utils.Dhall_dir + "nebula/hosts/")
+// getValidHostnames inspects the dhall configuration file for the expected valid hostnames for the future Nebula network
+func (s *Service) getValidHostnames() ([]string, error) {
+	dir, err := os.ReadDir(s.Config.DhallDir + "nebula/hosts/")
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, models.ApiError{Code: 500, Message: "Internal Server Error. Ther was an error reading the Dhall configuration files"})
-		return
+		return nil, &models.ApiError{Code: 500, Message: "Internal Server Error. Ther was an error reading the Dhall configuration files"}
 	}
 
 	var hostnames []string
 	for _, d := range dir {
 		hostnames = append(hostnames, strings.TrimSuffix(d.Name(), ".dhall"))
 	}
+	return hostnames, nil
+}
+
+// The GetValidHostnames REST endpoint inspects the dhall configuration file for the expected valid hostnames for the future Nebula network and returns them
+func (s *Service) GetValidHostnames(c *gin.Context) {
+	hostnames, err := s.getValidHostnames()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, err)
+		return
+	}
 	c.JSON(http.StatusOK, hostnames)
 }
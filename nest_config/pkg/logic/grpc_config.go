@@ -0,0 +1,82 @@
+package nest_config
+
+import (
+	"context"
+
+	"github.com/m4rkdc/nebula_est/nest_service/pkg/models"
+	"github.com/m4rkdc/nebula_est/nest_service/pkg/rpc"
+)
+
+/*
+ConfigServer implements the models.ConfigService gRPC service, served to the NEST service alongside the REST API.
+In multi-tenant deployments, every call is served by the instance of the Nebula network given in its metadata.
+*/
+type ConfigServer struct {
+	models.UnimplementedConfigServiceServer
+	*Service
+	//Instances serving the Nebula networks of a multi-tenant deployment, by network. nil in single network deployments
+	Networks map[string]*Service
+}
+
+// GetConfig returns the Nebula config file and its version, IP, security groups and installation path of the given hostname, from the requested version of the config files if any
+func (s *ConfigServer) GetConfig(ctx context.Context, req *models.ConfigRequest) (*models.RawConfResponse, error) {
+	instance, err := rpc.Instance(ctx, s.Service, s.Networks)
+	if err != nil {
+		return nil, err
+	}
+	conf_resp, err := instance.getConfig(ctx, req.Hostname, req.Version)
+	if err != nil {
+		return nil, rpc.ToStatus(err)
+	}
+	return &models.RawConfResponse{
+		NebulaConf: conf_resp.NebulaConf,
+		Groups:     conf_resp.Groups,
+		Ip:         conf_resp.Ip,
+		NebulaPath: conf_resp.NebulaPath,
+		Version:    conf_resp.Version,
+		Signature:  conf_resp.Signature,
+	}, nil
+}
+
+// ListHostnames returns the expected valid hostnames for the future Nebula network, and the hostname patterns of its host templates
+func (s *ConfigServer) ListHostnames(ctx context.Context, req *models.HostnamesRequest) (*models.HostnamesResponse, error) {
+	instance, err := rpc.Instance(ctx, s.Service, s.Networks)
+	if err != nil {
+		return nil, err
+	}
+	hostnames, err := instance.getValidHostnames()
+	if err != nil {
+		return nil, rpc.ToStatus(err)
+	}
+	patterns, err := instance.templatePatterns()
+	if err != nil {
+		return nil, rpc.ToStatus(&models.ApiError{Code: 500, Message: "Internal Server Error: " + err.Error()})
+	}
+	return &models.HostnamesResponse{Hostnames: hostnames, Patterns: patterns}, nil
+}
+
+// RegisterInstance registers the given hostname as an instance of the host template it matches, and tells if it can enroll or waits for an approval
+func (s *ConfigServer) RegisterInstance(ctx context.Context, req *models.InstanceRequest) (*models.InstanceResponse, error) {
+	instance, err := rpc.Instance(ctx, s.Service, s.Networks)
+	if err != nil {
+		return nil, err
+	}
+	registered, err := instance.registerInstance(ctx, req.Hostname)
+	if err != nil {
+		return nil, rpc.ToStatus(err)
+	}
+	return &models.InstanceResponse{Template: registered.Template, Approved: registered.Approved}, nil
+}
+
+// SigningKeys returns the PEM encoded public keys with which the Nebula configuration files are signed
+func (s *ConfigServer) SigningKeys(ctx context.Context, req *models.SigningKeysRequest) (*models.SigningKeysResponse, error) {
+	instance, err := rpc.Instance(ctx, s.Service, s.Networks)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := instance.signingKeys()
+	if err != nil {
+		return nil, rpc.ToStatus(&models.ApiError{Code: 500, Message: "Internal Server Error: " + err.Error()})
+	}
+	return &models.SigningKeysResponse{ConfigSigningKeys: keys}, nil
+}
@@ -0,0 +1,37 @@
+package nest_config
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/go-playground/assert/v2"
+	"github.com/m4rkdc/nebula_est/nest_service/pkg/config"
+	"github.com/m4rkdc/nebula_est/nest_service/pkg/models"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestConfigServer(t *testing.T) {
+	cfg := config.DefaultConf()
+	s := &ConfigServer{Service: New(&cfg)}
+
+	//First test: cannot read the dhall configuration files
+	cfg.DhallDir = "./"
+	_, err := s.ListHostnames(context.Background(), &models.HostnamesRequest{})
+	assert.Equal(t, codes.Internal, status.Code(err))
+	_, err = s.GetConfig(context.Background(), &models.ConfigRequest{Hostname: " "})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	//Second test: success
+	cfg.DhallDir = "../../test/dhall/"
+	var hostnames []string
+	dir, _ := os.ReadDir(cfg.DhallDir + "nebula/hosts/")
+	for _, d := range dir {
+		hostnames = append(hostnames, strings.TrimSuffix(d.Name(), ".dhall"))
+	}
+	resp, err := s.ListHostnames(context.Background(), &models.HostnamesRequest{})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, hostnames, resp.Hostnames)
+}
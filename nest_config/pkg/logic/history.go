@@ -0,0 +1,444 @@
+package nest_config
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/m4rkdc/nebula_est/nest_service/pkg/models"
+	"github.com/m4rkdc/nebula_est/nest_service/pkg/store"
+	"github.com/pmezard/go-difflib/difflib"
+)
+
+// Key of the current version in the versions store, which can't be the identifier of a version
+const current_key = "current"
+
+/*
+The current version of the Nebula configuration files. After a rollback, the generated files are the ones of the version rolled back to
+until the network description changes: Revision is the revision of the network description when the version became current.
+*/
+type configHead struct {
+	Version  string `json:"version"`
+	Revision string `json:"revision"`
+	Rollback bool   `json:"rollback,omitempty"`
+}
+
+// descriptionRevision returns the revision of the network description: the hex encoded SHA256 of the names and contents of the files of its nebula folder, but the generated ones
+func (s *Service) descriptionRevision() (string, error) {
+	root := s.Config.DhallDir + "nebula"
+	generated := filepath.Clean(s.Config.DhallDir + s.Config.ConfGenDir)
+	h := sha256.New()
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if filepath.Clean(path) == generated {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if strings.HasSuffix(path, ".tmp") {
+			return nil
+		}
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		name, _ := filepath.Rel(root, path)
+		h.Write([]byte(filepath.ToSlash(name) + "\x00"))
+		h.Write(b)
+		h.Write([]byte{0})
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// versionID returns the identifier of the version made of the given configuration files versions, by hostname
+func versionID(hosts map[string]string) string {
+	hostnames := make([]string, 0, len(hosts))
+	for hostname := range hosts {
+		hostnames = append(hostnames, hostname)
+	}
+	sort.Strings(hostnames)
+	h := sha256.New()
+	for _, hostname := range hostnames {
+		h.Write([]byte(hostname + " " + hosts[hostname] + "\n"))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// changedHosts returns the hostnames whose configuration file was added, changed or removed between the from and to versions, sorted
+func changedHosts(from map[string]string, to map[string]string) []string {
+	var changed []string
+	for hostname, version := range to {
+		if from[hostname] != version {
+			changed = append(changed, hostname)
+		}
+	}
+	for hostname := range from {
+		if _, ok := to[hostname]; !ok {
+			changed = append(changed, hostname)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+// readHead returns the current version of the configuration files and its version in the versions store, nil if no version was recorded yet
+func (s *Service) readHead(ctx context.Context) (*configHead, string, error) {
+	b, version, err := s.versions.Get(ctx, current_key)
+	if errors.Is(err, store.ErrNotFound) {
+		return nil, "", nil
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	var head configHead
+	if err = json.Unmarshal(b, &head); err != nil {
+		return nil, "", err
+	}
+	return &head, version, nil
+}
+
+// writeHead writes head to the versions store, replacing the one with the given version
+func (s *Service) writeHead(ctx context.Context, head *configHead, version string) error {
+	b, err := json.Marshal(head)
+	if err != nil {
+		return err
+	}
+	_, err = s.versions.Put(ctx, current_key, b, version)
+	return err
+}
+
+// readVersion returns the version of the configuration files with the given identifier
+func (s *Service) readVersion(ctx context.Context, id string) (*models.ConfigVersion, error) {
+	if id == current_key {
+		return nil, store.ErrNotFound
+	}
+	b, _, err := s.versions.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	var version models.ConfigVersion
+	if err = json.Unmarshal(b, &version); err != nil {
+		return nil, err
+	}
+	return &version, nil
+}
+
+// readVersionConfig returns the configuration file of hostname in the version of the configuration files with the given identifier
+func (s *Service) readVersionConfig(ctx context.Context, id string, hostname string) ([]byte, error) {
+	version, err := s.readVersion(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	conf_version, ok := version.Hosts[hostname]
+	if !ok {
+		return nil, store.ErrNotFound
+	}
+	b, _, err := s.configs.Get(ctx, conf_version)
+	return b, err
+}
+
+/*
+recordVersion stores the generated configuration files as a new version, made current, unless they are the current version already.
+The configuration files are stored once by content, so that the versions sharing them take no more space.
+If the current version was rolled back to and the network description did not change since, its configuration files are installed again in place of the generated ones.
+*/
+func (s *Service) recordVersion(ctx context.Context) error {
+	s.history.Lock()
+	defer s.history.Unlock()
+	revision, err := s.descriptionRevision()
+	if err != nil {
+		return err
+	}
+	head, head_version, err := s.readHead(ctx)
+	if err != nil {
+		return err
+	}
+	if head != nil && head.Rollback && head.Revision == revision {
+		return s.installVersion(ctx, head.Version)
+	}
+
+	generated := s.Config.DhallDir + s.Config.ConfGenDir
+	entries, err := os.ReadDir(generated)
+	if err != nil {
+		return err
+	}
+	hosts := make(map[string]string)
+	for _, e := range entries {
+		hostname, ok := strings.CutSuffix(e.Name(), ".yaml")
+		if e.IsDir() || !ok {
+			continue
+		}
+		b, err := os.ReadFile(generated + e.Name())
+		if err != nil {
+			return err
+		}
+		conf_version := models.ConfVersion(b)
+		if _, err = s.configs.Put(ctx, conf_version, b, ""); err != nil && !errors.Is(err, store.ErrConflict) {
+			return err
+		}
+		hosts[hostname] = conf_version
+	}
+
+	version := &models.ConfigVersion{Id: versionID(hosts), Revision: revision, Created: time.Now().UTC(), Hosts: hosts}
+	if head != nil && head.Version == version.Id && !head.Rollback {
+		return nil
+	}
+	if head != nil {
+		version.Parent = head.Version
+		if parent, err := s.readVersion(ctx, head.Version); err == nil {
+			version.Changed = changedHosts(parent.Hosts, hosts)
+		}
+	}
+	b, err := json.Marshal(version)
+	if err != nil {
+		return err
+	}
+	//The same configuration files may have been produced before, by an earlier revision of the network description
+	if _, err = s.versions.Put(ctx, version.Id, b, ""); err != nil && !errors.Is(err, store.ErrConflict) {
+		return err
+	}
+	if err = s.writeHead(ctx, &configHead{Version: version.Id, Revision: revision}, head_version); err != nil {
+		return err
+	}
+	slog.InfoContext(ctx, "Configuration version recorded", "version", version.Id, "revision", revision, "changed", version.Changed)
+	return nil
+}
+
+// installVersion writes the configuration files of the version with the given identifier in place of the generated ones, removing the configuration files of the hosts it does not have
+func (s *Service) installVersion(ctx context.Context, id string) error {
+	version, err := s.readVersion(ctx, id)
+	if err != nil {
+		return err
+	}
+	generated := s.Config.DhallDir + s.Config.ConfGenDir
+	if err = os.MkdirAll(generated, 0700); err != nil {
+		return err
+	}
+	for hostname, conf_version := range version.Hosts {
+		b, _, err := s.configs.Get(ctx, conf_version)
+		if err != nil {
+			return err
+		}
+		path := generated + hostname + ".yaml"
+		if current, err := os.ReadFile(path); err == nil && models.ConfVersion(current) == conf_version {
+			continue
+		}
+		if err = os.WriteFile(path+".tmp", b, 0600); err != nil {
+			return err
+		}
+		if err = os.Rename(path+".tmp", path); err != nil {
+			return err
+		}
+	}
+	entries, err := os.ReadDir(generated)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if hostname, ok := strings.CutSuffix(e.Name(), ".yaml"); ok {
+			if _, ok = version.Hosts[hostname]; !ok {
+				os.Remove(generated + e.Name())
+			}
+		}
+	}
+	return nil
+}
+
+// listVersions returns the recorded versions of the configuration files, the most recent first
+func (s *Service) listVersions(ctx context.Context) ([]models.ConfigVersion, error) {
+	ids, err := s.versions.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	head, _, err := s.readHead(ctx)
+	if err != nil {
+		return nil, err
+	}
+	versions := []models.ConfigVersion{}
+	for _, id := range ids {
+		version, err := s.readVersion(ctx, id)
+		if errors.Is(err, store.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		version.Current = head != nil && head.Version == id
+		versions = append(versions, *version)
+	}
+	sort.SliceStable(versions, func(i, j int) bool { return versions[i].Created.After(versions[j].Created) })
+	return versions, nil
+}
+
+/*
+versionDiff returns the changes of the configuration files of the hosts between the from version and the version with the given identifier, as unified diffs.
+If from is empty, the changes are the ones since the parent version. Only the change of hostname is returned if it is not empty.
+*/
+func (s *Service) versionDiff(ctx context.Context, id string, from string, hostname string) ([]models.ConfigDiff, error) {
+	version, err := s.readVersion(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if len(from) == 0 {
+		from = version.Parent
+	}
+	from_hosts := map[string]string{}
+	if len(from) != 0 {
+		from_version, err := s.readVersion(ctx, from)
+		if err != nil {
+			return nil, err
+		}
+		from_hosts = from_version.Hosts
+	}
+
+	diffs := []models.ConfigDiff{}
+	for _, changed := range changedHosts(from_hosts, version.Hosts) {
+		if len(hostname) != 0 && changed != hostname {
+			continue
+		}
+		diff := models.ConfigDiff{Hostname: changed, From: from_hosts[changed], To: version.Hosts[changed]}
+		var a, b []byte
+		if len(diff.From) != 0 {
+			if a, _, err = s.configs.Get(ctx, diff.From); err != nil {
+				return nil, err
+			}
+		}
+		if len(diff.To) != 0 {
+			if b, _, err = s.configs.Get(ctx, diff.To); err != nil {
+				return nil, err
+			}
+		}
+		diff.Diff, err = difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+			A:        difflib.SplitLines(string(a)),
+			B:        difflib.SplitLines(string(b)),
+			FromFile: changed + ".yaml@" + shortVersion(from),
+			ToFile:   changed + ".yaml@" + shortVersion(id),
+			Context:  3,
+		})
+		if err != nil {
+			return nil, err
+		}
+		diffs = append(diffs, diff)
+	}
+	return diffs, nil
+}
+
+// shortVersion returns the first 12 characters of a version identifier, as shown in the diffs
+func shortVersion(id string) string {
+	if len(id) > 12 {
+		return id[:12]
+	}
+	return id
+}
+
+/*
+rollback makes the version with the given identifier current, installing its configuration files in place of the generated ones.
+The clients get them at their next configuration update, and they stay current until the network description changes.
+*/
+func (s *Service) rollback(ctx context.Context, id string) (*models.ConfigVersion, error) {
+	s.generation.Lock()
+	defer s.generation.Unlock()
+	s.history.Lock()
+	defer s.history.Unlock()
+	version, err := s.readVersion(ctx, id)
+	if errors.Is(err, store.ErrNotFound) {
+		return nil, &models.ApiError{Code: 404, Message: "Not found: there is no configuration version " + id}
+	}
+	if err != nil {
+		return nil, &models.ApiError{Code: 500, Message: "Internal Server Error: " + err.Error()}
+	}
+	revision, err := s.descriptionRevision()
+	if err != nil {
+		return nil, &models.ApiError{Code: 500, Message: "Internal Server Error: " + err.Error()}
+	}
+	_, head_version, err := s.readHead(ctx)
+	if err != nil {
+		return nil, &models.ApiError{Code: 500, Message: "Internal Server Error: " + err.Error()}
+	}
+	if err = s.installVersion(ctx, id); err != nil {
+		return nil, &models.ApiError{Code: 500, Message: "Internal Server Error: " + err.Error()}
+	}
+	if err = s.writeHead(ctx, &configHead{Version: id, Revision: revision, Rollback: true}, head_version); errors.Is(err, store.ErrConflict) {
+		return nil, &models.ApiError{Code: 409, Message: "Conflict: the current configuration version changed meanwhile, please retry"}
+	} else if err != nil {
+		return nil, &models.ApiError{Code: 500, Message: "Internal Server Error: " + err.Error()}
+	}
+	slog.InfoContext(ctx, "Configuration rolled back", "version", id, "revision", revision)
+	version.Current = true
+	return version, nil
+}
+
+// The GetVersions REST endpoint returns the recorded versions of the Nebula configuration files, the most recent first
+func (s *Service) GetVersions(c *gin.Context) {
+	versions, err := s.listVersions(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ApiError{Code: 500, Message: "Internal Server Error: " + err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, versions)
+}
+
+// The GetVersion REST endpoint returns the version of the Nebula configuration files with the given identifier
+func (s *Service) GetVersion(c *gin.Context) {
+	id := c.Param("version")
+	version, err := s.readVersion(c.Request.Context(), id)
+	if errors.Is(err, store.ErrNotFound) {
+		c.JSON(http.StatusNotFound, models.ApiError{Code: 404, Message: "Not found: there is no configuration version " + id})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ApiError{Code: 500, Message: "Internal Server Error: " + err.Error()})
+		return
+	}
+	if head, _, err := s.readHead(c.Request.Context()); err == nil && head != nil {
+		version.Current = head.Version == id
+	}
+	c.JSON(http.StatusOK, version)
+}
+
+/*
+The GetVersionDiff REST endpoint returns the changes of the Nebula configuration files of the hosts in the version with the given identifier, as unified diffs:
+since its parent version, or since the version in the from query parameter. The host query parameter restricts them to the change of one host.
+*/
+func (s *Service) GetVersionDiff(c *gin.Context) {
+	id := c.Param("version")
+	diffs, err := s.versionDiff(c.Request.Context(), id, c.Query("from"), c.Query("host"))
+	if errors.Is(err, store.ErrNotFound) {
+		c.JSON(http.StatusNotFound, models.ApiError{Code: 404, Message: "Not found: there is no configuration version " + id + " or " + c.Query("from")})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ApiError{Code: 500, Message: "Internal Server Error: " + err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, diffs)
+}
+
+// The RollbackVersion REST endpoint lets an administrator make a previous version of the Nebula configuration files current again
+func (s *Service) RollbackVersion(c *gin.Context) {
+	version, err := s.rollback(c.Request.Context(), c.Param("version"))
+	if err != nil {
+		api_error := err.(*models.ApiError)
+		c.JSON(api_error.Code, api_error)
+		return
+	}
+	c.JSON(http.StatusOK, version)
+}
@@ -0,0 +1,81 @@
+package nest_config
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/go-playground/assert/v2"
+	"github.com/m4rkdc/nebula_est/nest_service/pkg/config"
+	"github.com/m4rkdc/nebula_est/nest_service/pkg/models"
+)
+
+func TestRecordVersion(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir() + "/"
+	os.MkdirAll(dir+"nebula/generated", 0700)
+	os.WriteFile(dir+"nebula/nebula_conf.dhall", []byte("{ ip_mask = 24 }\n"), 0600)
+	os.WriteFile(dir+"nebula/generated/lighthouse.yaml", []byte("lighthouse:\n  am_lighthouse: true\n"), 0600)
+	os.WriteFile(dir+"nebula/generated/laptop.yaml", []byte("firewall:\n  inbound: []\n"), 0600)
+
+	cfg := config.DefaultConf()
+	cfg.DhallDir = dir
+	cfg.History.Folder = dir + "history/"
+	s := New(&cfg)
+
+	//First test: the generated files are recorded as the first version, and recording them again changes nothing
+	assert.Equal(t, nil, s.recordVersion(ctx))
+	versions, err := s.listVersions(ctx)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 1, len(versions))
+	first := versions[0]
+	assert.Equal(t, true, first.Current)
+	assert.Equal(t, "", first.Parent)
+	assert.Equal(t, nil, s.recordVersion(ctx))
+	versions, _ = s.listVersions(ctx)
+	assert.Equal(t, 1, len(versions))
+
+	//Second test: a regeneration changing a config file records a new version, with the changed host and its diff
+	os.WriteFile(dir+"nebula/nebula_conf.dhall", []byte("{ ip_mask = 24, inbound = [ \"ssh\" ] }\n"), 0600)
+	os.WriteFile(dir+"nebula/generated/laptop.yaml", []byte("firewall:\n  inbound:\n  - port: 22\n"), 0600)
+	assert.Equal(t, nil, s.recordVersion(ctx))
+	head, _, _ := s.readHead(ctx)
+	second, err := s.readVersion(ctx, head.Version)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, first.Id, second.Parent)
+	assert.Equal(t, []string{"laptop"}, second.Changed)
+	assert.NotEqual(t, first.Revision, second.Revision)
+	diffs, err := s.versionDiff(ctx, second.Id, "", "")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 1, len(diffs))
+	assert.Equal(t, true, strings.Contains(diffs[0].Diff, "-  inbound: []\n+  inbound:\n+  - port: 22\n"))
+
+	//Third test: GetConfig returns the config file of a recorded version
+	b, err := s.readVersionConfig(ctx, first.Id, "laptop")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "firewall:\n  inbound: []\n", string(b))
+	_, err = s.getConfig(ctx, "laptop", "unknown")
+	assert.Equal(t, 404, err.(*models.ApiError).Code)
+
+	//Fourth test: the rolled back version is installed, and stays installed by the regenerations until the network description changes
+	_, err = s.rollback(ctx, first.Id)
+	assert.Equal(t, nil, err)
+	b, _ = os.ReadFile(dir + "nebula/generated/laptop.yaml")
+	assert.Equal(t, "firewall:\n  inbound: []\n", string(b))
+	os.WriteFile(dir+"nebula/generated/laptop.yaml", []byte("firewall:\n  inbound:\n  - port: 22\n"), 0600)
+	assert.Equal(t, nil, s.recordVersion(ctx))
+	b, _ = os.ReadFile(dir + "nebula/generated/laptop.yaml")
+	assert.Equal(t, "firewall:\n  inbound: []\n", string(b))
+	os.WriteFile(dir+"nebula/nebula_conf.dhall", []byte("{ ip_mask = 24, inbound = [ \"ssh\", \"http\" ] }\n"), 0600)
+	os.WriteFile(dir+"nebula/generated/laptop.yaml", []byte("firewall:\n  inbound:\n  - port: 22\n  - port: 80\n"), 0600)
+	assert.Equal(t, nil, s.recordVersion(ctx))
+	head, _, _ = s.readHead(ctx)
+	assert.Equal(t, false, head.Rollback)
+	third, _ := s.readVersion(ctx, head.Version)
+	assert.Equal(t, first.Id, third.Parent)
+
+	//Fifth test: rolling back to an unknown version fails
+	_, err = s.rollback(ctx, "unknown")
+	assert.Equal(t, 404, err.(*models.ApiError).Code)
+}
@@ -0,0 +1,126 @@
+package nest_config
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/m4rkdc/nebula_est/nest_service/pkg/ipam"
+)
+
+/*
+syncAddresses reads the static addresses of the hosts from the network description, releases the leases of the hosts that were decommissioned or given a static address,
+and allocates an address to every host without one. The leases are then written to the nebula/ipam.dhall file, from which the host files
+without a static address take their IP address (e.g., ip = (../ipam.dhall).sensor1), and the conflicts found are logged.
+The network description is evaluated with an ipam.dhall giving the unspecified address 0.0.0.0 to every host, in place of the one on the disk, so that the hosts taking their address from ipam.dhall are told apart from the ones with a static address.
+*/
+func (s *Service) syncAddresses(ctx context.Context) error {
+	hostnames, err := s.getValidHostnames()
+	if err != nil {
+		return err
+	}
+	placeholders := make([]ipam.Lease, 0, len(hostnames))
+	for _, hostname := range hostnames {
+		placeholders = append(placeholders, ipam.Lease{Hostname: hostname, IP: netip.IPv4Unspecified()})
+	}
+	s.evaluation.Lock()
+	defer s.evaluation.Unlock()
+	network, err := s.evaluateNetwork(ctx, map[string][]byte{"nebula/ipam.dhall": leasesFile(placeholders)})
+	if err != nil {
+		//The hosts keep their previous addresses until the next regeneration
+		return err
+	}
+	leases, err := s.allocateAddresses(ctx, network)
+	if err != nil {
+		return err
+	}
+	return s.writeLeases(leases)
+}
+
+// allocateAddresses registers the static addresses of the hosts of network and allocates an address to its hosts without one, which have the unspecified address
+func (s *Service) allocateAddresses(ctx context.Context, network *dhallNetwork) ([]ipam.Lease, error) {
+	static := make(map[string]netip.Addr)
+	var managed []string
+	for _, host := range network.Hosts {
+		address := host.Ip.addr()
+		if !address.IsUnspecified() {
+			static[host.Name] = address
+		} else if !slices.Contains(managed, host.Name) {
+			managed = append(managed, host.Name)
+		}
+	}
+	slices.Sort(managed)
+	s.IPAM.SetStatic(static)
+
+	released, err := s.IPAM.Sync(ctx, managed)
+	if err != nil {
+		return nil, err
+	}
+	for _, lease := range released {
+		slog.InfoContext(ctx, "Address released", "hostname", lease.Hostname, "ip", lease.IP.String())
+	}
+	var leases []ipam.Lease
+	for _, hostname := range managed {
+		lease, err := s.IPAM.Allocate(ctx, hostname, s.hostGroups(network, hostname))
+		if err != nil {
+			return nil, fmt.Errorf("could not allocate an address to %s: %v", hostname, err)
+		}
+		leases = append(leases, lease)
+	}
+
+	conflicts, err := s.IPAM.Conflicts(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, conflict := range conflicts {
+		slog.WarnContext(ctx, "Address conflict", "conflict", conflict)
+	}
+	return leases, nil
+}
+
+// leasesFile returns the nebula/ipam.dhall file of leases, a record of the addresses leased to the hosts by hostname
+func leasesFile(leases []ipam.Lease) []byte {
+	var b strings.Builder
+	b.WriteString("-- Generated by the NEST config service: the Nebula IP addresses leased to the hosts without a static address\nlet nebula = ../package.dhall\n\nin  ")
+	if len(leases) == 0 {
+		b.WriteString("{=}\n")
+	}
+	for n, lease := range leases {
+		separator := "    , "
+		if n == 0 {
+			separator = "{ "
+		}
+		ip := lease.IP.As4()
+		fmt.Fprintf(&b, "%s`%s` = nebula.mkIPv4 %d %d %d %d\n", separator, lease.Hostname, ip[0], ip[1], ip[2], ip[3])
+	}
+	if len(leases) != 0 {
+		b.WriteString("    }\n")
+	}
+	return []byte(b.String())
+}
+
+// writeLeases writes the nebula/ipam.dhall file of leases
+func (s *Service) writeLeases(leases []ipam.Lease) error {
+	path := s.Config.DhallDir + "nebula/ipam.dhall"
+	if err := os.WriteFile(path+".tmp", leasesFile(leases), 0600); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// CheckAddresses returns an error listing the address conflicts between the static addresses, the reserved addresses and the leases
+func (s *Service) CheckAddresses(ctx context.Context) error {
+	conflicts, err := s.IPAM.Conflicts(ctx)
+	if err != nil {
+		return err
+	}
+	if len(conflicts) != 0 {
+		return errors.New(strings.Join(conflicts, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+package nest_config
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/go-playground/assert/v2"
+	"github.com/m4rkdc/nebula_est/nest_service/pkg/config"
+)
+
+func TestSyncAddresses(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir() + "/"
+	writeHost(dir, "lighthouse", "nebula.mkIPv4 192 168 100 1")
+	writeHost(dir, "sensor1", "(../ipam.dhall).sensor1")
+	writeHost(dir, "laptop1", "(../ipam.dhall).laptop1")
+	writeDescription(dir, []string{"lighthouse", "sensor1", "laptop1"}, []string{"laptop1"})
+
+	cfg := config.DefaultConf()
+	cfg.DhallDir = dir
+	cfg.IPAM = config.IPAM{Pools: []string{"192.168.100.0/24", "home=192.168.101.0/24"}, LeasesFolder: dir + "ipam/"}
+	s := New(&cfg)
+
+	//First test: the hosts without a static address get one from the pool of their groups, written in ipam.dhall
+	assert.Equal(t, nil, s.syncAddresses(ctx))
+	b, _ := os.ReadFile(dir + "nebula/ipam.dhall")
+	assert.Equal(t, "-- Generated by the NEST config service: the Nebula IP addresses leased to the hosts without a static address\nlet nebula = ../package.dhall\n\nin  { `laptop1` = nebula.mkIPv4 192 168 101 1\n    , `sensor1` = nebula.mkIPv4 192 168 100 2\n    }\n", string(b))
+	assert.Equal(t, nil, s.CheckAddresses(ctx))
+	network, err := s.evaluateNetwork(ctx, nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "192.168.101.1", network.host("laptop1").Ip.addr().String())
+
+	//Second test: a failed evaluation of the network description leaves the leases written in ipam.dhall
+	writeDescription(dir, []string{"lighthouse", "sensor1", "laptop1", "sensor2"}, []string{"laptop1"})
+	assert.NotEqual(t, nil, s.syncAddresses(ctx))
+	after, _ := os.ReadFile(dir + "nebula/ipam.dhall")
+	assert.Equal(t, b, after)
+
+	//Third test: the lease of a decommissioned host is released
+	os.Remove(dir + "nebula/hosts/sensor1.dhall")
+	writeDescription(dir, []string{"lighthouse", "laptop1"}, []string{"laptop1"})
+	assert.Equal(t, nil, s.syncAddresses(ctx))
+	leases, err := s.IPAM.Leases(ctx)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 1, len(leases))
+	assert.Equal(t, "laptop1", leases[0].Hostname)
+
+	//Fourth test: a static address given to a leased host is reported as a conflict
+	writeHost(dir, "lighthouse", "nebula.mkIPv4 192 168 101 1")
+	assert.Equal(t, nil, s.syncAddresses(ctx))
+	assert.NotEqual(t, nil, s.CheckAddresses(ctx))
+}
@@ -0,0 +1,326 @@
+package nest_config
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/m4rkdc/nebula_est/nest_service/pkg/models"
+	"github.com/m4rkdc/nebula_est/nest_service/pkg/tracing"
+	"github.com/philandstuff/dhall-golang/v6"
+	"github.com/philandstuff/dhall-golang/v6/core"
+	"github.com/philandstuff/dhall-golang/v6/imports"
+	"github.com/philandstuff/dhall-golang/v6/parser"
+	"github.com/philandstuff/dhall-golang/v6/term"
+)
+
+/*
+The Nebula network described by the Dhall configuration (the Network type of dhall-nebula), as evaluated by dhall-golang.
+Only the fields read by the NEST config service are decoded: every host and group is evaluated, however it is defined in the Dhall files.
+*/
+type dhallNetwork struct {
+	Hosts     []dhallHost  `dhall:"hosts"`
+	Groups    []dhallGroup `dhall:"groups"`
+	Blocklist []string     `dhall:"blocklist"`
+	IpMask    uint         `dhall:"ip_mask"`
+}
+
+// A host of the network (the Host type of dhall-nebula)
+type dhallHost struct {
+	Name    string    `dhall:"name"`
+	Ip      dhallIPv4 `dhall:"ip"`
+	Pki     dhallPki  `dhall:"pki"`
+	AmRelay bool      `dhall:"am_relay"`
+}
+
+// An IPv4 address (the IPv4 type of dhall-nebula)
+type dhallIPv4 struct {
+	I1 uint8 `dhall:"i1"`
+	I2 uint8 `dhall:"i2"`
+	I3 uint8 `dhall:"i3"`
+	I4 uint8 `dhall:"i4"`
+}
+
+// The paths of the Nebula CA certificate, certificate and key of a host on the host (the PkiInfo type of dhall-nebula)
+type dhallPki struct {
+	Ca   string `dhall:"ca"`
+	Cert string `dhall:"cert"`
+	Key  string `dhall:"key"`
+}
+
+// A security group of the network (the Group type of dhall-nebula)
+type dhallGroup struct {
+	GroupName  string      `dhall:"group_name"`
+	GroupHosts []dhallHost `dhall:"group_hosts"`
+}
+
+// addr returns the address ip
+func (ip dhallIPv4) addr() netip.Addr {
+	return netip.AddrFrom4([4]byte{ip.I1, ip.I2, ip.I3, ip.I4})
+}
+
+// folder returns the folder of the host in which the Nebula key is installed, with its trailing separator. The key path must contain a folder
+func (pki dhallPki) folder() (string, error) {
+	separator := strings.LastIndexAny(pki.Key, "/\\")
+	if separator < 0 {
+		return "", errors.New("the key path \"" + pki.Key + "\" has no folder")
+	}
+	return pki.Key[:separator+1], nil
+}
+
+// host returns the host of the network named hostname, nil if it is not a host of the network
+func (n *dhallNetwork) host(hostname string) *dhallHost {
+	for i := range n.Hosts {
+		if n.Hosts[i].Name == hostname {
+			return &n.Hosts[i]
+		}
+	}
+	return nil
+}
+
+// groupsOf returns the names of the security groups of the network that hostname is part of
+func (n *dhallNetwork) groupsOf(hostname string) []string {
+	var groups []string
+	for _, group := range n.Groups {
+		if slices.ContainsFunc(group.GroupHosts, func(h dhallHost) bool { return h.Name == hostname }) && !slices.Contains(groups, group.GroupName) {
+			groups = append(groups, group.GroupName)
+		}
+	}
+	return groups
+}
+
+// The folder, in the Dhall folder, of the hash protected imports of the network description in the Dhall cache format (e.g., the Dhall Prelude functions), searched before the Dhall cache of the user
+const dhallCacheDir = "cache/"
+
+// A Dhall file of the network description, type checked and normalized, with the digest of its content and of the imports it was made of
+type checkedFile struct {
+	digest [sha256.Size]byte
+	expr   term.Term
+	//The file has imports that can change without their importing files changing (e.g., the environment variables and the remote imports without hash)
+	volatile bool
+}
+
+/*
+evaluateNetwork evaluates the network description of the Dhall folder with dhall-golang. The files of the Dhall folder in overrides, by path in the Dhall folder,
+are evaluated with the given content in place of the one on the disk (e.g., the placeholder leases of nebula/ipam.dhall), which is left untouched.
+Every file is type checked, the errors being returned, once as long as it and its imports don't change: the type checking of dhall-golang can take minutes on the dhall-nebula package.
+*/
+func (s *Service) evaluateNetwork(ctx context.Context, overrides map[string][]byte) (*dhallNetwork, error) {
+	_, span := tracing.Start(ctx, "dhall evaluation")
+	caches := dhallCaches{imports.NewLocalCache(path.Join(s.Config.DhallDir, dhallCacheDir))}
+	if standard, err := imports.StandardCache(); err == nil {
+		caches = append(caches, standard)
+	} else {
+		caches = append(caches, imports.NoCache{})
+	}
+	loader := dhallLoader{overrides: make(map[term.LocalFile][]byte, len(overrides)), cache: caches, checked: s.checked, loaded: make(map[term.LocalFile]checkedFile)}
+	for name, b := range overrides {
+		loader.overrides[term.LocalFile(path.Join(s.Config.DhallDir, name))] = b
+	}
+	description, err := loader.loadFile(term.LocalFile(path.Join(s.Config.DhallDir, s.Config.DhallConfiguration)), term.Code, nil)
+	network := &dhallNetwork{}
+	if err == nil {
+		err = dhall.Decode(core.Eval(description.expr), network)
+	}
+	if err != nil {
+		network, err = nil, fmt.Errorf("could not evaluate the network description: %v", err)
+	}
+	tracing.End(span, err)
+	return network, err
+}
+
+// dhallCaches fetches the hash protected imports from the first of its caches holding them, and saves the fetched ones in the last one
+type dhallCaches []imports.DhallCache
+
+func (c dhallCaches) Fetch(hash []byte) term.Term {
+	for _, cache := range c {
+		if expr := cache.Fetch(hash); expr != nil {
+			return expr
+		}
+	}
+	return nil
+}
+
+func (c dhallCaches) Save(hash []byte, expr term.Term) {
+	c[len(c)-1].Save(hash, expr)
+}
+
+/*
+A dhallLoader resolves the imports of the network description as imports.LoadWith does, but reading the local files from overrides when they are there,
+loading every local file once, and taking the local files from checked, by file, when they were already type checked with the same content and imports.
+checked keeps the last two versions of every file, the network description being evaluated both with the leases of nebula/ipam.dhall and with their placeholders.
+*/
+type dhallLoader struct {
+	overrides map[term.LocalFile][]byte
+	cache     imports.DhallCache
+	checked   map[term.LocalFile][]checkedFile
+	loaded    map[term.LocalFile]checkedFile
+}
+
+// The digests of the imports of a Dhall file, by import
+type dhallImports struct {
+	digests  map[string][sha256.Size]byte
+	volatile bool
+}
+
+// digest returns the digest of file, made of source and of the imports i
+func (i *dhallImports) digest(file term.LocalFile, source []byte) [sha256.Size]byte {
+	h := sha256.New()
+	h.Write([]byte(string(file) + "\x00"))
+	h.Write(source)
+	names := make([]string, 0, len(i.digests))
+	for name := range i.digests {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		digest := i.digests[name]
+		h.Write([]byte("\x00" + name + "\x00"))
+		h.Write(digest[:])
+	}
+	var digest [sha256.Size]byte
+	h.Sum(digest[:0])
+	return digest
+}
+
+/*
+loadFile reads file and returns it as a Dhall term according to mode, with its imports resolved, type checked and normalized.
+ancestors are the local files importing file, to detect the import cycles.
+*/
+func (l *dhallLoader) loadFile(file term.LocalFile, mode term.ImportMode, ancestors []term.LocalFile) (checkedFile, error) {
+	if slices.Contains(ancestors, file) {
+		return checkedFile{}, fmt.Errorf("detected import cycle in %s", file)
+	}
+	if loaded, ok := l.loaded[file]; ok && mode == term.Code {
+		return loaded, nil
+	}
+	b, ok := l.overrides[file]
+	if !ok {
+		var err error
+		if b, err = os.ReadFile(string(file)); err != nil {
+			return checkedFile{}, err
+		}
+	}
+	if mode == term.RawText {
+		return checkedFile{digest: sha256.Sum256(b), expr: term.PlainText(string(b))}, nil
+	}
+	parsed, err := parser.Parse(file.String(), b)
+	if err != nil {
+		return checkedFile{}, err
+	}
+	deps := dhallImports{digests: make(map[string][sha256.Size]byte)}
+	expr, err := l.loadImports(parsed, file, append(slices.Clip(ancestors), file), &deps)
+	if err != nil {
+		return checkedFile{}, err
+	}
+	loaded := checkedFile{digest: deps.digest(file, b), volatile: deps.volatile}
+	if i := slices.IndexFunc(l.checked[file], func(c checkedFile) bool { return c.digest == loaded.digest && !c.volatile }); i >= 0 {
+		loaded = l.checked[file][i]
+	} else {
+		if _, err = core.TypeOf(expr); err != nil {
+			return checkedFile{}, fmt.Errorf("%s: %v", file, err)
+		}
+		loaded.expr = core.Quote(core.Eval(expr))
+		if !loaded.volatile {
+			l.checked[file] = append([]checkedFile{loaded}, l.checked[file][:min(len(l.checked[file]), 1)]...)
+		}
+	}
+	l.loaded[file] = loaded
+	return loaded, nil
+}
+
+/*
+loadImports resolves the imports of e, a term of file, imported by ancestors (file included), recording their digests in deps.
+The remote, environment and hash protected imports are resolved by imports.LoadWith, since they can't import the local files of the Dhall folder but their own.
+*/
+func (l *dhallLoader) loadImports(e term.Term, file term.LocalFile, ancestors []term.LocalFile, deps *dhallImports) (term.Term, error) {
+	switch e := e.(type) {
+	case term.Import:
+		local, ok := e.Fetchable.(term.LocalFile)
+		if !ok || e.Hash != nil {
+			if e.Hash != nil {
+				deps.digests["sha256:"+hex.EncodeToString(e.Hash[2:])] = [sha256.Size]byte(e.Hash[2:])
+			} else if e.ImportMode != term.Location {
+				deps.volatile = true
+			}
+			return imports.LoadWith(l.cache, e, file)
+		}
+		here, err := local.ChainOnto(file)
+		if err != nil {
+			return nil, err
+		}
+		if e.ImportMode == term.Location {
+			return here.AsLocation(), nil
+		}
+		loaded, err := l.loadFile(here.(term.LocalFile), e.ImportMode, ancestors)
+		if err != nil {
+			return nil, err
+		}
+		deps.digests[here.String()] = loaded.digest
+		deps.volatile = deps.volatile || loaded.volatile
+		return loaded.expr, nil
+	case term.Op:
+		if e.OpCode == term.ImportAltOp {
+			if resolved, err := l.loadImports(e.L, file, ancestors, deps); err == nil {
+				return resolved, nil
+			}
+			return l.loadImports(e.R, file, ancestors, deps)
+		}
+	}
+	return term.MaybeTransformSubexprs(e, func(t term.Term) (term.Term, error) {
+		return l.loadImports(t, file, ancestors, deps)
+	})
+}
+
+// currentNetwork returns the evaluation of the network description, evaluated again only when the description changed since the last one
+func (s *Service) currentNetwork(ctx context.Context) (*dhallNetwork, error) {
+	s.evaluation.Lock()
+	defer s.evaluation.Unlock()
+	revision, err := s.descriptionRevision()
+	if err != nil {
+		return nil, err
+	}
+	if s.network != nil && s.network_revision == revision {
+		return s.network, nil
+	}
+	network, err := s.evaluateNetwork(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	s.network, s.network_revision = network, revision
+	return network, nil
+}
+
+// hostGroups returns the security groups of hostname in network, and the group of its host template if it has one
+func (s *Service) hostGroups(network *dhallNetwork, hostname string) []string {
+	groups := network.groupsOf(hostname)
+	if template, _ := s.matchTemplate(hostname); template != nil && !slices.Contains(groups, template.Group) {
+		groups = append(groups, template.Group)
+	}
+	return groups
+}
+
+// describeHost returns the security groups, the IP address with the network mask and the installation path of hostname, from the evaluation of the network description
+func (s *Service) describeHost(ctx context.Context, hostname string) ([]string, string, string, error) {
+	network, err := s.currentNetwork(ctx)
+	if err != nil {
+		return nil, "", "", &models.ApiError{Code: 500, Message: "Internal Server Error: " + err.Error()}
+	}
+	host := network.host(hostname)
+	if host == nil {
+		return nil, "", "", &models.ApiError{Code: 500, Message: "Internal Server Error: " + hostname + " is not a host of the network description"}
+	}
+	path, err := host.Pki.folder()
+	if err != nil {
+		return nil, "", "", &models.ApiError{Code: 500, Message: "Internal Server Error: cannot find the installation path of " + hostname + ": " + err.Error()}
+	}
+	return s.hostGroups(network, hostname), host.Ip.addr().String() + "/" + strconv.FormatUint(uint64(network.IpMask), 10), path, nil
+}
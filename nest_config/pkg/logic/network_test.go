@@ -0,0 +1,69 @@
+package nest_config
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/go-playground/assert/v2"
+	"github.com/m4rkdc/nebula_est/nest_service/pkg/config"
+	"github.com/m4rkdc/nebula_est/nest_service/pkg/models"
+)
+
+func TestEvaluateNetwork(t *testing.T) {
+	ctx := context.Background()
+	cfg := config.DefaultConf()
+	cfg.DhallDir = "../../test/dhall/"
+	s := New(&cfg)
+
+	//First test: the hosts and groups of the network description are decoded into the network, the all group being defined by the list of the hosts
+	network, err := s.evaluateNetwork(ctx, nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 3, len(network.Hosts))
+	assert.Equal(t, "192.168.100.2", network.host("client1").Ip.addr().String())
+	assert.Equal(t, "/home/gio/tesi/client2.key", network.host("client2").Pki.Key)
+	assert.Equal(t, true, network.host("lighthouse").AmRelay)
+	assert.Equal(t, false, network.host("client1").AmRelay)
+	assert.Equal(t, (*dhallHost)(nil), network.host("client3"))
+	assert.Equal(t, []string{"all", "home"}, network.groupsOf("client1"))
+	assert.Equal(t, []string{"all"}, network.groupsOf("client2"))
+	assert.Equal(t, []string{"all"}, network.groupsOf("lighthouse"))
+	assert.Equal(t, uint(24), network.IpMask)
+
+	//Second test: the installation path is the folder of the key, on Windows hosts too
+	groups, ip, path, err := s.describeHost(ctx, "client1")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []string{"all", "home"}, groups)
+	assert.Equal(t, "192.168.100.2/24", ip)
+	assert.Equal(t, "C:\\Users\\Giorgia\\Documents\\Universita\\Magistrale-Ingegneria_informatica\\Tesi\\nebula-windows-amd64/", path)
+	_, _, _, err = s.describeHost(ctx, "client3")
+	assert.Equal(t, 500, err.(*models.ApiError).Code)
+
+	//Third test: a key path without a folder has no installation path
+	_, err = dhallPki{Key: "client1.key"}.folder()
+	assert.NotEqual(t, nil, err)
+	dir := t.TempDir() + "/"
+	writeHost(dir, "lighthouse", "nebula.mkIPv4 192 168 100 1")
+	os.WriteFile(dir+"nebula/hosts/client1.dhall", []byte("let nebula = ../../package.dhall\n\nin  { name = \"client1\"\n    , ip = nebula.mkIPv4 192 168 100 2\n    , pki = { ca = \"ca.crt\", cert = \"client1.crt\", key = \"client1.key\" }\n    , am_relay = False\n    }\n"), 0600)
+	writeDescription(dir, []string{"lighthouse", "client1"}, []string{"client1"})
+	cfg.DhallDir = dir
+	_, _, path, err = s.describeHost(ctx, "lighthouse")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "/etc/nebula/", path)
+	_, _, _, err = s.describeHost(ctx, "client1")
+	assert.Equal(t, 500, err.(*models.ApiError).Code)
+
+	//Fourth test: the network description that cannot be evaluated is reported with the error of the evaluation
+	writeDescription(dir, []string{"lighthouse", "client3"}, nil)
+	_, err = s.evaluateNetwork(ctx, nil)
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, true, strings.HasPrefix(err.Error(), "could not evaluate the network description: "))
+
+	//Fifth test: the ill-typed network description is reported with the type error, instead of being evaluated
+	writeHost(dir, "client3", "nebula.mkIPv4 192 168 100 \"3\"")
+	writeDescription(dir, []string{"lighthouse", "client3"}, nil)
+	_, err = s.evaluateNetwork(ctx, nil)
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, true, strings.Contains(err.Error(), "client3.dhall"))
+}
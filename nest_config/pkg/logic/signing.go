@@ -0,0 +1,82 @@
+package nest_config
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/gin-gonic/gin"
+	"github.com/m4rkdc/nebula_est/nest_service/pkg/models"
+)
+
+/*
+LoadSigningKey reads the ed25519 private key with which the Nebula configuration files are signed from the signing key file.
+If the file does not exist, a new key is generated and written to it. Until it is loaded, the configuration files are not signed.
+*/
+func (s *Service) LoadSigningKey() error {
+	b, err := os.ReadFile(s.Config.SigningKeyFile)
+	if errors.Is(err, os.ErrNotExist) {
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return err
+		}
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return err
+		}
+		if err = os.MkdirAll(filepath.Dir(s.Config.SigningKeyFile), 0700); err != nil {
+			return err
+		}
+		if err = os.WriteFile(s.Config.SigningKeyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+			return err
+		}
+		slog.Info("Configuration signing key generated", "file", s.Config.SigningKeyFile)
+		s.signing_key = key
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	block, _ := pem.Decode(b)
+	if block == nil || block.Type != "PRIVATE KEY" {
+		return errors.New("invalid signing key file: no PEM private key found")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return err
+	}
+	ed25519_key, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return errors.New("invalid signing key file: the signing key must be an ed25519 key")
+	}
+	s.signing_key = ed25519_key
+	return nil
+}
+
+// signingKeys returns the PEM encoded public key with which the Nebula configuration files are signed, nil if they are not signed
+func (s *Service) signingKeys() ([]byte, error) {
+	if s.signing_key == nil {
+		return nil, nil
+	}
+	return models.MarshalConfigSigningKey(s.signing_key.Public().(ed25519.PublicKey))
+}
+
+// The GetSigningKeys REST endpoint returns the PEM encoded public keys with which the Nebula configuration files are signed
+func (s *Service) GetSigningKeys(c *gin.Context) {
+	keys, err := s.signingKeys()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ApiError{Code: 500, Message: "Internal Server Error: " + err.Error()})
+		return
+	}
+	if keys == nil {
+		c.JSON(http.StatusNotFound, models.ApiError{Code: 404, Message: "Not found: the configuration files are not signed"})
+		return
+	}
+	c.JSON(http.StatusOK, keys)
+}
@@ -0,0 +1,53 @@
+package nest_config
+
+import (
+	"os"
+	"testing"
+
+	"github.com/go-playground/assert/v2"
+	"github.com/m4rkdc/nebula_est/nest_service/pkg/config"
+	"github.com/m4rkdc/nebula_est/nest_service/pkg/models"
+)
+
+func TestLoadSigningKey(t *testing.T) {
+	cfg := config.DefaultConf()
+	cfg.SigningKeyFile = t.TempDir() + "/keys/signing.key"
+	s := New(&cfg)
+
+	//First test: the configuration files are not signed until the signing key is loaded
+	keys, err := s.signingKeys()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 0, len(keys))
+
+	//Second test: a missing signing key is generated, and loaded again by the next instances
+	assert.Equal(t, nil, s.LoadSigningKey())
+	_, err = os.Stat(cfg.SigningKeyFile)
+	assert.Equal(t, nil, err)
+	again := New(&cfg)
+	assert.Equal(t, nil, again.LoadSigningKey())
+	assert.Equal(t, s.signing_key, again.signing_key)
+
+	//Third test: the signatures are verified with the distributed public key, for the signed hostname, installation path, IP address and security groups only
+	keys, _ = s.signingKeys()
+	public_keys, err := models.UnmarshalConfigSigningKeys(keys)
+	assert.Equal(t, nil, err)
+	conf_resp := models.ConfResponse{NebulaConf: []byte("pki:\n  ca: /etc/nebula/ca.crt\n"), NebulaPath: "/etc/nebula/", Ip: "192.168.100.1/24", Groups: []string{"lighthouse", "all"}}
+	signature := models.SignConfig(s.signing_key, "lighthouse", &conf_resp)
+	assert.Equal(t, true, models.VerifyConfig(public_keys, "lighthouse", &conf_resp, signature))
+	assert.Equal(t, false, models.VerifyConfig(public_keys, "laptop", &conf_resp, signature))
+	reordered := conf_resp
+	reordered.Groups = []string{"all", "lighthouse"}
+	assert.Equal(t, true, models.VerifyConfig(public_keys, "lighthouse", &reordered, signature))
+	for _, tampered := range []models.ConfResponse{
+		{NebulaConf: append(conf_resp.NebulaConf, '\n'), NebulaPath: conf_resp.NebulaPath, Ip: conf_resp.Ip, Groups: conf_resp.Groups},
+		{NebulaConf: conf_resp.NebulaConf, NebulaPath: "/tmp/", Ip: conf_resp.Ip, Groups: conf_resp.Groups},
+		{NebulaConf: conf_resp.NebulaConf, NebulaPath: conf_resp.NebulaPath, Ip: "192.168.100.2/24", Groups: conf_resp.Groups},
+		{NebulaConf: conf_resp.NebulaConf, NebulaPath: conf_resp.NebulaPath, Ip: conf_resp.Ip, Groups: []string{"all"}},
+	} {
+		assert.Equal(t, false, models.VerifyConfig(public_keys, "lighthouse", &tampered, signature))
+	}
+
+	//Fourth test: an invalid signing key file is refused
+	os.WriteFile(cfg.SigningKeyFile, []byte("not a key"), 0600)
+	assert.NotEqual(t, nil, New(&cfg).LoadSigningKey())
+}
@@ -0,0 +1,448 @@
+package nest_config
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/m4rkdc/nebula_est/nest_service/pkg/models"
+	"github.com/m4rkdc/nebula_est/nest_service/pkg/store"
+	"gopkg.in/yaml.v3"
+)
+
+// How long a NEST config instance can hold the lease on the registrations of the instances of a host template
+const instance_registration_ttl = 30 * time.Second
+
+// First line of the host files generated for the instances of the host templates
+const instance_header = "-- Generated by the NEST config service: instance of the "
+
+// Hostnames that can be instances of a host template, so that they can be used in the Dhall files and as file names
+var instance_hostname = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// templates returns the host templates described in the nebula/templates.yml file of the Dhall folder, none if it does not exist
+func (s *Service) templates() ([]models.Template, error) {
+	b, err := os.ReadFile(s.Config.DhallDir + "nebula/templates.yml")
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var templates []models.Template
+	decoder := yaml.NewDecoder(bytes.NewReader(b))
+	decoder.KnownFields(true)
+	if err = decoder.Decode(&templates); err != nil {
+		return nil, fmt.Errorf("invalid templates file: %v", err)
+	}
+	for _, t := range templates {
+		if !instance_hostname.MatchString(t.Name) || len(t.Group) == 0 {
+			return nil, fmt.Errorf("invalid templates file: the template %q needs a name made of letters, digits, dots, dashes and underscores, and a group", t.Name)
+		}
+		if _, err = path.Match(t.Pattern, ""); err != nil || len(t.Pattern) == 0 {
+			return nil, fmt.Errorf("invalid templates file: invalid pattern %q of the template %s", t.Pattern, t.Name)
+		}
+	}
+	return templates, nil
+}
+
+// matchTemplate returns the first host template whose pattern hostname matches, nil if none does
+func (s *Service) matchTemplate(hostname string) (*models.Template, error) {
+	templates, err := s.templates()
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range templates {
+		if matched, _ := path.Match(t.Pattern, hostname); matched {
+			return &t, nil
+		}
+	}
+	return nil, nil
+}
+
+// templatePatterns returns the patterns of the host templates
+func (s *Service) templatePatterns() ([]string, error) {
+	templates, err := s.templates()
+	if err != nil {
+		return nil, err
+	}
+	var patterns []string
+	for _, t := range templates {
+		patterns = append(patterns, t.Pattern)
+	}
+	return patterns, nil
+}
+
+// readInstance returns the instance registered with hostname and its version in the instances store
+func (s *Service) readInstance(ctx context.Context, hostname string) (*models.Instance, string, error) {
+	b, version, err := s.instances.Get(ctx, hostname)
+	if err != nil {
+		return nil, "", err
+	}
+	var instance models.Instance
+	if err = json.Unmarshal(b, &instance); err != nil {
+		return nil, "", err
+	}
+	return &instance, version, nil
+}
+
+// writeInstance writes instance to the instances store, replacing the one with the given version
+func (s *Service) writeInstance(ctx context.Context, instance *models.Instance, version string) error {
+	b, err := json.Marshal(instance)
+	if err != nil {
+		return err
+	}
+	_, err = s.instances.Put(ctx, instance.Hostname, b, version)
+	return err
+}
+
+// listInstances returns the registered instances of the host templates, sorted by hostname
+func (s *Service) listInstances(ctx context.Context) ([]models.Instance, error) {
+	hostnames, err := s.instances.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	instances := []models.Instance{}
+	for _, hostname := range hostnames {
+		instance, _, err := s.readInstance(ctx, hostname)
+		if errors.Is(err, store.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		instances = append(instances, *instance)
+	}
+	return instances, nil
+}
+
+/*
+registerInstance registers hostname as an instance of the host template it matches, and returns it. If the template does not require an approval,
+the instance is added to the Nebula network description right away and can enroll. Registering an instance again returns it unchanged, retrying a failed regeneration.
+The instances of a template, pending approval or not, can't exceed its maximum number of instances.
+*/
+func (s *Service) registerInstance(ctx context.Context, hostname string) (*models.Instance, error) {
+	if instance, _, err := s.readInstance(ctx, hostname); err == nil {
+		if err = s.generateInstance(ctx, instance); err != nil {
+			return nil, err
+		}
+		return instance, nil
+	} else if !errors.Is(err, store.ErrNotFound) {
+		return nil, &models.ApiError{Code: 500, Message: "Internal Server Error: " + err.Error()}
+	}
+	if !instance_hostname.MatchString(hostname) {
+		return nil, &models.ApiError{Code: 400, Message: "Bad request: the hostname of an instance can only contain letters, digits, dots, dashes and underscores"}
+	}
+	if _, err := os.Stat(s.Config.DhallDir + "nebula/hosts/" + hostname + ".dhall"); err == nil {
+		return nil, &models.ApiError{Code: 409, Message: "Conflict: " + hostname + " is already a host of the Nebula network"}
+	}
+	template, err := s.matchTemplate(hostname)
+	if err != nil {
+		return nil, &models.ApiError{Code: 500, Message: "Internal Server Error: " + err.Error()}
+	}
+	if template == nil {
+		return nil, &models.ApiError{Code: 404, Message: "Not found: no host template matches " + hostname}
+	}
+	if s.IPAM == nil {
+		return nil, &models.ApiError{Code: 500, Message: "Internal Server Error: the host templates require the IP address management"}
+	}
+
+	instance, created, err := s.createInstance(ctx, hostname, template)
+	if err != nil {
+		if _, ok := err.(*models.ApiError); ok {
+			return nil, err
+		}
+		return nil, &models.ApiError{Code: 500, Message: "Internal Server Error: " + err.Error()}
+	}
+	if created {
+		slog.InfoContext(ctx, "Host template instance registered", "hostname", hostname, "template", template.Name, "approved", instance.Approved)
+	}
+	if err = s.generateInstance(ctx, instance); err != nil {
+		return nil, err
+	}
+	return instance, nil
+}
+
+/*
+generateInstance regenerates the Nebula configuration files if instance is approved but has no configuration file yet: the instance is written before the regeneration,
+so that a regeneration that failed when it was registered or approved is retried by registering or approving it again.
+*/
+func (s *Service) generateInstance(ctx context.Context, instance *models.Instance) error {
+	if !instance.Approved {
+		return nil
+	}
+	if _, err := os.Stat(s.Config.DhallDir + s.Config.ConfGenDir + instance.Hostname + ".yaml"); err == nil {
+		return nil
+	}
+	if err := s.GenerateAllNebulaConfigs(ctx); err != nil {
+		return &models.ApiError{Code: 500, Message: "Internal Server Error: " + err.Error()}
+	}
+	return nil
+}
+
+// leaseTemplate acquires the lease on the registrations of the instances of template, waiting for the other NEST config instances holding it. The returned function releases the lease
+func (s *Service) leaseTemplate(ctx context.Context, template string) (func(), error) {
+	for {
+		lease, err := s.instance_leases.Acquire(ctx, "template-"+template, instance_registration_ttl)
+		if err == nil {
+			return func() {
+				if err := s.instance_leases.Release(context.WithoutCancel(ctx), lease); err != nil {
+					slog.WarnContext(ctx, "Could not release the host template lease", "template", template, "error", err)
+				}
+			}, nil
+		}
+		if !errors.Is(err, store.ErrLeased) {
+			return nil, err
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+/*
+createInstance writes the instance hostname of template to the instances store, and returns it and if it was created. An instance registered concurrently is returned as it is.
+The instances of the template are counted and the instance written under the lease of the template, so that the NEST config instances sharing the instances
+store can't exceed its maximum number of instances.
+*/
+func (s *Service) createInstance(ctx context.Context, hostname string, template *models.Template) (*models.Instance, bool, error) {
+	release, err := s.leaseTemplate(ctx, template.Name)
+	if err != nil {
+		return nil, false, err
+	}
+	defer release()
+
+	instances, err := s.listInstances(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+	count := 0
+	for i := range instances {
+		if instances[i].Hostname == hostname {
+			//Registered concurrently by another NEST config instance
+			return &instances[i], false, nil
+		}
+		if instances[i].Template == template.Name {
+			count++
+		}
+	}
+	if template.MaxInstances > 0 && count >= template.MaxInstances {
+		return nil, false, &models.ApiError{Code: 403, Message: "Forbidden: the host template " + template.Name + " reached its maximum number of instances"}
+	}
+
+	instance := &models.Instance{Hostname: hostname, Template: template.Name, Approved: !template.Approval, Registered: time.Now().UTC()}
+	if err = s.writeInstance(ctx, instance, ""); errors.Is(err, store.ErrConflict) {
+		//Registered concurrently by another NEST config instance
+		instance, _, err = s.readInstance(ctx, hostname)
+		return instance, false, err
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return instance, true, nil
+}
+
+// approveInstance approves the instance hostname, which is added to the Nebula network description and can then enroll. Approving it again retries a failed regeneration
+func (s *Service) approveInstance(ctx context.Context, hostname string) (*models.Instance, error) {
+	for {
+		instance, version, err := s.readInstance(ctx, hostname)
+		if errors.Is(err, store.ErrNotFound) {
+			return nil, &models.ApiError{Code: 404, Message: "Not found: " + hostname + " is not an instance of a host template"}
+		}
+		if err != nil {
+			return nil, &models.ApiError{Code: 500, Message: "Internal Server Error: " + err.Error()}
+		}
+		if instance.Approved {
+			if err = s.generateInstance(ctx, instance); err != nil {
+				return nil, err
+			}
+			return instance, nil
+		}
+		instance.Approved = true
+		err = s.writeInstance(ctx, instance, version)
+		if errors.Is(err, store.ErrConflict) {
+			continue
+		}
+		if err != nil {
+			return nil, &models.ApiError{Code: 500, Message: "Internal Server Error: " + err.Error()}
+		}
+		slog.InfoContext(ctx, "Host template instance approved", "hostname", hostname, "template", instance.Template)
+		if err = s.generateInstance(ctx, instance); err != nil {
+			return nil, err
+		}
+		return instance, nil
+	}
+}
+
+// removeInstance removes the instance hostname from the Nebula network description. Its address is released and it can no longer enroll
+func (s *Service) removeInstance(ctx context.Context, hostname string) error {
+	_, version, err := s.readInstance(ctx, hostname)
+	if errors.Is(err, store.ErrNotFound) {
+		return &models.ApiError{Code: 404, Message: "Not found: " + hostname + " is not an instance of a host template"}
+	}
+	if err == nil {
+		err = s.instances.Delete(ctx, hostname, version)
+	}
+	if err != nil {
+		return &models.ApiError{Code: 500, Message: "Internal Server Error: " + err.Error()}
+	}
+	slog.InfoContext(ctx, "Host template instance removed", "hostname", hostname)
+	if err = s.GenerateAllNebulaConfigs(ctx); err != nil {
+		return &models.ApiError{Code: 500, Message: "Internal Server Error: " + err.Error()}
+	}
+	return nil
+}
+
+/*
+syncInstances writes the host files of the approved instances, applying the Dhall function of their template (nebula/templates/<name>.dhall) to their hostname
+and leased IP address, and removes the host files of the instances removed. The nebula/instances.dhall file then lists the approved instances by template,
+for the network description to add them to its hosts and to the groups of their templates (e.g., group_hosts = instances.sensor).
+*/
+func (s *Service) syncInstances(ctx context.Context) error {
+	templates, err := s.templates()
+	if err != nil || len(templates) == 0 {
+		return err
+	}
+	instances, err := s.listInstances(ctx)
+	if err != nil {
+		return err
+	}
+
+	hosts_dir := s.Config.DhallDir + "nebula/hosts/"
+	by_template := make(map[string][]string, len(templates))
+	approved := make(map[string]bool, len(instances))
+	for _, instance := range instances {
+		if !instance.Approved {
+			continue
+		}
+		if _, found := by_template[instance.Template]; !found && !hasTemplate(templates, instance.Template) {
+			slog.WarnContext(ctx, "Instance of a removed host template", "hostname", instance.Hostname, "template", instance.Template)
+			continue
+		}
+		host_file := fmt.Sprintf("%s%s host template\nlet ipam = ../ipam.dhall\n\nin  ../templates/%s.dhall \"%s\" ipam.`%s`\n", instance_header, instance.Template, instance.Template, instance.Hostname, instance.Hostname)
+		if b, _ := os.ReadFile(hosts_dir + instance.Hostname + ".dhall"); string(b) != host_file {
+			if err = os.WriteFile(hosts_dir+instance.Hostname+".dhall", []byte(host_file), 0600); err != nil {
+				return err
+			}
+		}
+		by_template[instance.Template] = append(by_template[instance.Template], instance.Hostname)
+		approved[instance.Hostname] = true
+	}
+
+	dir, err := os.ReadDir(hosts_dir)
+	if err != nil {
+		return err
+	}
+	for _, d := range dir {
+		hostname := strings.TrimSuffix(d.Name(), ".dhall")
+		if approved[hostname] {
+			continue
+		}
+		if b, _ := os.ReadFile(hosts_dir + d.Name()); bytes.HasPrefix(b, []byte(instance_header)) {
+			if err = os.Remove(hosts_dir + d.Name()); err != nil {
+				return err
+			}
+		}
+	}
+
+	var b strings.Builder
+	b.WriteString("-- Generated by the NEST config service: the approved instances of the host templates, by template\nlet nebula = ../package.dhall\n\nin  ")
+	for n, t := range templates {
+		separator := "    , "
+		if n == 0 {
+			separator = "{ "
+		}
+		hosts := "[]"
+		if len(by_template[t.Name]) != 0 {
+			hosts = "[ ./hosts/" + strings.Join(by_template[t.Name], ".dhall, ./hosts/") + ".dhall ]"
+		}
+		fmt.Fprintf(&b, "%s`%s` = %s : List nebula.Host.Type\n", separator, t.Name, hosts)
+	}
+	b.WriteString("    }\n")
+	path := s.Config.DhallDir + "nebula/instances.dhall"
+	if err = os.WriteFile(path+".tmp", []byte(b.String()), 0600); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// hasTemplate tells if a template named name is in templates
+func hasTemplate(templates []models.Template, name string) bool {
+	for _, t := range templates {
+		if t.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// The GetTemplates REST endpoint returns the host templates of the Nebula network description
+func (s *Service) GetTemplates(c *gin.Context) {
+	templates, err := s.templates()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ApiError{Code: 500, Message: "Internal Server Error: " + err.Error()})
+		return
+	}
+	if templates == nil {
+		templates = []models.Template{}
+	}
+	c.JSON(http.StatusOK, templates)
+}
+
+// The GetInstances REST endpoint returns the registered instances of the host templates, approved or waiting for approval
+func (s *Service) GetInstances(c *gin.Context) {
+	instances, err := s.listInstances(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ApiError{Code: 500, Message: "Internal Server Error: " + err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, instances)
+}
+
+// The RegisterInstance REST endpoint registers the hostname of the request as an instance of the host template it matches
+func (s *Service) RegisterInstance(c *gin.Context) {
+	var req models.Instance
+	if err := c.ShouldBindJSON(&req); err != nil || len(strings.TrimSpace(req.Hostname)) == 0 {
+		c.JSON(http.StatusBadRequest, models.ApiError{Code: 400, Message: "Bad request: no hostname provided"})
+		return
+	}
+	instance, err := s.registerInstance(c.Request.Context(), req.Hostname)
+	if err != nil {
+		api_error := err.(*models.ApiError)
+		c.JSON(api_error.Code, api_error)
+		return
+	}
+	c.JSON(http.StatusOK, instance)
+}
+
+// The ApproveInstance REST endpoint lets an administrator approve an instance of a host template, which can then enroll
+func (s *Service) ApproveInstance(c *gin.Context) {
+	instance, err := s.approveInstance(c.Request.Context(), c.Param("hostname"))
+	if err != nil {
+		api_error := err.(*models.ApiError)
+		c.JSON(api_error.Code, api_error)
+		return
+	}
+	c.JSON(http.StatusOK, instance)
+}
+
+// The RemoveInstance REST endpoint lets an administrator remove an instance of a host template, which can no longer enroll
+func (s *Service) RemoveInstance(c *gin.Context) {
+	if err := s.removeInstance(c.Request.Context(), c.Param("hostname")); err != nil {
+		api_error := err.(*models.ApiError)
+		c.JSON(api_error.Code, api_error)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,108 @@
+package nest_config
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/go-playground/assert/v2"
+	"github.com/m4rkdc/nebula_est/nest_service/pkg/config"
+	"github.com/m4rkdc/nebula_est/nest_service/pkg/models"
+)
+
+func TestRegisterInstance(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir() + "/"
+	writeHost(dir, "lighthouse", "nebula.mkIPv4 192 168 100 1")
+	os.WriteFile(dir+"nebula/templates.yml", []byte("- name: sensor\n  pattern: sensor-*\n  group: sensors\n  max_instances: 2\n  approval: true\n"), 0600)
+
+	cfg := config.DefaultConf()
+	cfg.DhallDir = dir
+	cfg.Templates.InstancesFolder = dir + "instances/"
+	cfg.IPAM = config.IPAM{Pools: []string{"192.168.100.0/24", "sensors=192.168.110.0/24"}, LeasesFolder: dir + "ipam/"}
+	s := New(&cfg)
+
+	//First test: a hostname matching a template is registered, waiting for an approval, and registering it again returns it unchanged
+	instance, err := s.registerInstance(ctx, "sensor-1")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "sensor", instance.Template)
+	assert.Equal(t, false, instance.Approved)
+	again, err := s.registerInstance(ctx, "sensor-1")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, instance.Registered, again.Registered)
+
+	//Second test: the hostnames matching no template, the hosts of the network and the instances over the maximum are refused
+	_, err = s.registerInstance(ctx, "camera-1")
+	assert.Equal(t, 404, err.(*models.ApiError).Code)
+	_, err = s.registerInstance(ctx, "lighthouse")
+	assert.Equal(t, 409, err.(*models.ApiError).Code)
+	_, err = s.registerInstance(ctx, "sensor-2")
+	assert.Equal(t, nil, err)
+	_, err = s.registerInstance(ctx, "sensor-3")
+	assert.Equal(t, 403, err.(*models.ApiError).Code)
+
+	//Third test: an approved instance gets a host file applying the template, and is listed in instances.dhall
+	instance.Approved = true
+	_, version, _ := s.readInstance(ctx, "sensor-1")
+	assert.Equal(t, nil, s.writeInstance(ctx, instance, version))
+	assert.Equal(t, nil, s.syncInstances(ctx))
+	b, _ := os.ReadFile(dir + "nebula/hosts/sensor-1.dhall")
+	assert.Equal(t, "-- Generated by the NEST config service: instance of the sensor host template\nlet ipam = ../ipam.dhall\n\nin  ../templates/sensor.dhall \"sensor-1\" ipam.`sensor-1`\n", string(b))
+	b, _ = os.ReadFile(dir + "nebula/instances.dhall")
+	assert.Equal(t, "-- Generated by the NEST config service: the approved instances of the host templates, by template\nlet nebula = ../package.dhall\n\nin  { `sensor` = [ ./hosts/sensor-1.dhall ] : List nebula.Host.Type\n    }\n", string(b))
+	_, err = os.Stat(dir + "nebula/hosts/sensor-2.dhall")
+	assert.Equal(t, true, os.IsNotExist(err))
+
+	//Fourth test: the instance gets its address from the pool of the template group
+	os.MkdirAll(dir+"nebula/templates", 0700)
+	os.WriteFile(dir+"nebula/templates/sensor.dhall", []byte("let nebula = ../../package.dhall\n\nin  \\(name : Text) ->\n    \\(ip : nebula.IPv4) ->\n      { name = name, ip = ip, pki = nebula.mkPkiInfo \"/etc/nebula\" \"ca\" name, am_relay = False }\n"), 0600)
+	writeDescription(dir, []string{"lighthouse", "sensor-1"}, nil)
+	assert.Equal(t, nil, s.syncAddresses(ctx))
+	leases, _ := s.IPAM.Leases(ctx)
+	assert.Equal(t, 1, len(leases))
+	assert.Equal(t, "192.168.110.1", leases[0].IP.String())
+	groups, ip, path, err := s.describeHost(ctx, "sensor-1")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []string{"sensors"}, groups)
+	assert.Equal(t, "192.168.110.1/24", ip)
+	assert.Equal(t, "/etc/nebula/", path)
+
+	//Fifth test: registering an approved instance again retries the regeneration until it has a configuration file
+	_, err = s.registerInstance(ctx, "sensor-1")
+	assert.Equal(t, 500, err.(*models.ApiError).Code)
+	os.MkdirAll(dir+cfg.ConfGenDir, 0700)
+	os.WriteFile(dir+cfg.ConfGenDir+"sensor-1.yaml", []byte("pki: {}\n"), 0600)
+	_, err = s.registerInstance(ctx, "sensor-1")
+	assert.Equal(t, nil, err)
+
+	//Sixth test: the host file of a removed instance is removed
+	_, version, _ = s.readInstance(ctx, "sensor-1")
+	assert.Equal(t, nil, s.instances.Delete(ctx, "sensor-1", version))
+	assert.Equal(t, nil, s.syncInstances(ctx))
+	_, err = os.Stat(dir + "nebula/hosts/sensor-1.dhall")
+	assert.Equal(t, true, os.IsNotExist(err))
+	_, err = os.Stat(dir + "nebula/hosts/lighthouse.dhall")
+	assert.Equal(t, nil, err)
+
+	//Seventh test: a registration waits for another NEST config instance sharing the registry to release the lease on the template, and counts its instances
+	other := New(&cfg)
+	release, err := other.leaseTemplate(ctx, "sensor")
+	assert.Equal(t, nil, err)
+	done := make(chan error, 1)
+	go func() {
+		_, err := s.registerInstance(ctx, "sensor-3")
+		done <- err
+	}()
+	waited := true
+	select {
+	case <-done:
+		waited = false
+	case <-time.After(300 * time.Millisecond):
+	}
+	assert.Equal(t, true, waited)
+	assert.Equal(t, nil, other.writeInstance(ctx, &models.Instance{Hostname: "sensor-4", Template: "sensor"}, ""))
+	release()
+	err = <-done
+	assert.Equal(t, 403, err.(*models.ApiError).Code)
+}
@@ -13,82 +13,47 @@ Contact: gianmarco.decola@studio.unibo.it
 package main
 
 import (
+	"context"
 	"crypto/tls"
-	"encoding/json"
 	"fmt"
-	"io"
+	"log/slog"
 	"net/http"
-	"net/url"
 	"os"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/m4rkdc/nebula_est/nest_service/pkg/config"
+	"github.com/m4rkdc/nebula_est/nest_service/pkg/events"
+	"github.com/m4rkdc/nebula_est/nest_service/pkg/health"
+	"github.com/m4rkdc/nebula_est/nest_service/pkg/logging"
 	nest_service "github.com/m4rkdc/nebula_est/nest_service/pkg/logic"
+	"github.com/m4rkdc/nebula_est/nest_service/pkg/metrics"
 	"github.com/m4rkdc/nebula_est/nest_service/pkg/models"
+	"github.com/m4rkdc/nebula_est/nest_service/pkg/tracing"
 	"github.com/m4rkdc/nebula_est/nest_service/pkg/utils"
 )
 
-// getHostnames sends an http request to the nest_config service over a Nebula network to get the valid hostnames.
-func getHostnames() ([]string, error) {
-	var resp *http.Response
-	var err error
-	var error_response *models.ApiError
-	for {
-		resp, err = http.Get("http://" + utils.Conf_service_ip + ":" + utils.Conf_service_port + "/hostnames")
-		if err != nil {
-			urlErr := err.(*url.Error)
-			if urlErr.Timeout() {
-				fmt.Println("NEST config is not ready, waiting and retrying in 1 second")
-				time.Sleep(1 * time.Second)
-				continue
-			} else {
-				if resp != nil {
-					b, err := io.ReadAll(resp.Body)
-					if err != nil {
-						return nil, err
-					}
-					if json.Unmarshal(b, error_response) != nil {
-						if error_response != nil {
-							return nil, error_response
-						}
-					}
-				}
-			}
-		} else {
-			break
-		}
-	}
-
-	b, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, err
-	}
-
-	var response []string
-	err = json.Unmarshal(b, &response)
-	if err != nil {
-		return nil, err
-	}
-
-	return response, nil
-}
-
 /*
 checkHostnamesFile checks if the file containing all the valid hostnames already exists.
-If not, it creates it and populates it by sending a request to the nest_config service
+If not, it creates it and populates it by sending a request to the nest_config service. The request follows the policy of every idempotent request to nest_config:
+at most downstream.retries retries with backoff, every attempt bounded by downstream.timeout, and no attempt at all while the circuit breaker of nest_config is open.
+The valid hostnames are then loaded in memory
 */
-func checkHostnamesFile() error {
-	if _, err := os.Stat(utils.Hostnames_file); err != nil {
-		fmt.Printf("%s doesn't exist. Creating it and requesting the valid hostnames from Nebula conf service\n", utils.Hostnames_file)
-		hostnames, err := getHostnames()
+func checkHostnamesFile(service *nest_service.Service) error {
+	hostnames_file := service.Config.HostnamesFile
+	if _, err := os.Stat(hostnames_file); err != nil {
+		slog.Info("Hostnames file doesn't exist. Creating it and requesting the valid hostnames from Nebula conf service", "file", hostnames_file)
+		hostnames, err := service.Conf.ListHostnames(context.Background())
 		if err != nil {
-			fmt.Printf("There has been an error with the hostnames request: %v", err.Error())
+			slog.Error("There has been an error with the hostnames request", "error", err)
 			return err
 		}
 
-		file, err := os.OpenFile(utils.Hostnames_file, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+		file, err := os.OpenFile(hostnames_file, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
 		if err != nil {
-			fmt.Printf("Could not write to file: %v", err)
+			slog.Error("Could not write to file", "error", err)
 			return err
 		}
 		defer file.Close()
@@ -97,161 +62,348 @@ func checkHostnamesFile() error {
 			file.WriteString(h + "\n")
 		}
 	}
-	return nil
+	return service.LoadHostnames()
 }
 
-// SetupTLS sets up the tls configuration for the nest_service server
-func setupTLS() *tls.Config {
-	var tls_config = tls.Config{
-		MinVersion:               tls.VersionTLS12,
-		MaxVersion:               tls.VersionTLS13,
-		PreferServerCipherSuites: true,
-		//CurvePreferences:         []tls.CurveID{tls.X25519, tls.CurveP256},
-		CipherSuites: []uint16{
-			tls.TLS_AES_256_GCM_SHA384,
-			tls.TLS_CHACHA20_POLY1305_SHA256,
-			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
-		},
-	}
-	return &tls_config
+/*
+setupTLS sets up the tls configuration for the nest_service server from the TLS settings.
+The server key pair is served by a utils.CertReloader, so that a renewed certificate is picked up without restarting the service.
+*/
+func setupTLS(cfg config.TLS, reloader *utils.CertReloader) (*tls.Config, error) {
+	tls_config, err := utils.BuildTLSConfig(cfg.MinVersion, cfg.MaxVersion, strings.Join(cfg.CipherSuites, ","), strings.Join(cfg.Curves, ","), cfg.ClientCAs, cfg.ClientAuth)
+	if err != nil {
+		return nil, err
+	}
+	tls_config.GetCertificate = reloader.GetCertificate
+	return tls_config, nil
 }
 
 /*
-nest_service is a REST API server which acts a facade between NEST clients and the inner Nebula CA and configuration services.
-In the main function, the proper environment is set up before starting a Gin https server rechable by the clients and an http client over a
-Nebula network for authentication and confidentiality among the peers (NEST , NEST_CA and NEST_CONFIG services)
+startNebula checks that the Nebula certificate, key and configuration of the service are in nebula_folder, then starts and supervises
+the Nebula overlay of the service. The returned file, receiving the Nebula output, must be closed after Nebula is stopped.
 */
-func main() {
-	if val, ok := os.LookupEnv("LOG_FILE"); ok {
-		utils.Log_file = val
+func startNebula(nebula_folder string) (*utils.NebulaSupervisor, *os.File) {
+	if _, err := os.Stat(nebula_folder + "nest_service.crt"); err != nil {
+		slog.Error("Cannot find NEST service Nebula certificate", "error", err)
+		os.Exit(5)
 	}
-
-	if val, ok := os.LookupEnv("SERVICE_IP"); ok {
-		utils.Service_ip = val
+	if _, err := os.Stat(nebula_folder + "nest_service.key"); err != nil {
+		slog.Error("Cannot find NEST service Nebula key", "error", err)
+		os.Exit(6)
 	}
-	if val, ok := os.LookupEnv("SERVICE_PORT"); ok {
 
-		utils.Service_port = val
+	if _, err := os.Stat(nebula_folder + "nest_system_ca.crt"); err != nil {
+		slog.Error("Cannot find NEST Nebula CA crt", "error", err)
+		os.Exit(7)
 	}
-	if val, ok := os.LookupEnv("HOSTNAMES_FILE"); ok {
-		utils.Hostnames_file = val
+
+	if _, err := os.Stat(nebula_folder + "config.yml"); err != nil {
+		slog.Error("Cannot find NEST Nebula config", "error", err)
+		os.Exit(8)
 	}
-	if val, ok := os.LookupEnv("CA_CERT_FILE"); ok {
-		utils.Ca_cert_file = val
+
+	nebula_log, err := os.OpenFile(nebula_folder+"nest_service_nebula.log", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		slog.Error("There was an error creating nebula log file", "error", err)
+		os.Exit(8)
 	}
-	if val, ok := os.LookupEnv("NEBULA_FOLDER"); ok {
-		utils.Nebula_folder = val
+	nebula := utils.NewNebulaSupervisor(nebula_folder, nebula_log)
+	if err := nebula.Start(); err != nil {
+		slog.Error("There was an error setting up the Nebula tunnel", "error", err)
+		os.Exit(9)
 	}
-	if val, ok := os.LookupEnv("HMAC_KEY"); ok {
-		utils.HMAC_key = val
+	return nebula, nebula_log
+}
+
+/*
+reload reloads the configuration of the service when it receives a SIGHUP, from the flags, environment and configuration file it was started with.
+nebula is nil in mtls transport mode, and ctx is canceled when the service shuts down.
+The log level is applied, the TLS key pair, the Nebula configuration and the valid hostnames of every network are reloaded. The other settings require a restart.
+*/
+func reload(ctx context.Context, services []*nest_service.Service, reloader *utils.CertReloader, nebula *utils.NebulaSupervisor) {
+	cfg := config.DefaultService()
+	if _, err := config.Load("nest_service", &cfg, os.Args[1:], os.LookupEnv); err != nil {
+		slog.Error("SIGHUP received: invalid configuration, keeping the previous one", "error", err)
+		return
+	}
+	logging.SetLevel(cfg.Log.Level)
+	if err := reloader.Reload(); err != nil {
+		slog.Error("Could not reload the TLS key pair, keeping the previous one", "error", err)
+	}
+	if nebula != nil {
+		if err := nebula.Reload(); err != nil {
+			slog.Warn("Could not reload the Nebula configuration", "error", err)
+		}
 	}
-	if val, ok := os.LookupEnv("CA_SERVICE_IP"); ok {
-		utils.Ca_service_ip = val
+	for _, service := range services {
+		if err := service.RefreshHostnames(ctx); err != nil {
+			slog.Warn("Could not refresh the valid hostnames, keeping the previous ones", "network", service.Config.Network, "error", err)
+		}
 	}
-	if val, ok := os.LookupEnv("CA_SERVICE_PORT"); ok {
-		utils.Ca_service_port = val
+	slog.Info("SIGHUP received: configuration reloaded")
+}
+
+/*
+setupWebhooks starts delivering the enrollment lifecycle events of services to the configured webhook URLs, signing them with the webhook secret key.
+The deliveries run, as a member of workers, until stop is closed.
+*/
+func setupWebhooks(services []*nest_service.Service, cfg config.Webhooks, stop <-chan struct{}, workers *sync.WaitGroup) error {
+	secret, err := os.ReadFile(cfg.Secret)
+	if err != nil {
+		return err
 	}
-	if val, ok := os.LookupEnv("CONF_SERVICE_IP"); ok {
-		utils.Conf_service_ip = val
+	dispatcher, err := events.NewDispatcher(cfg.URLs, secret, cfg.QueueFolder, cfg.MaxAttempts)
+	if err != nil {
+		return err
 	}
-	if val, ok := os.LookupEnv("CONF_SERVICE_PORT"); ok {
-		utils.Conf_service_port = val
+	for _, service := range services {
+		service.Events = dispatcher
 	}
-	if val, ok := os.LookupEnv("NCSR_FOLDER"); ok {
-		utils.Ncsr_folder = val
+	workers.Add(1)
+	go func() {
+		defer workers.Done()
+		dispatcher.Run(stop)
+	}()
+	return nil
+}
+
+/*
+networkConfigs returns the configurations of the NEST service instances: one per Nebula network in multi-tenant deployments,
+cfg itself in single network deployments.
+*/
+func networkConfigs(cfg *config.Service) ([]config.Service, error) {
+	if len(cfg.Networks.Names) == 0 {
+		return []config.Service{*cfg}, nil
 	}
-	if val, ok := os.LookupEnv("TLS_FOLDER"); ok {
-		utils.TLS_folder = val
+	var configs []config.Service
+	for _, name := range cfg.Networks.Names {
+		network_cfg, err := cfg.ForNetwork(name)
+		if err != nil {
+			return nil, fmt.Errorf("network %s: %v", name, err)
+		}
+		configs = append(configs, network_cfg)
 	}
-	fmt.Println("NEST service: starting setup")
+	return configs, nil
+}
 
-	if _, err := os.Stat(utils.Ncsr_folder); err != nil {
-		if err := os.Mkdir(utils.Ncsr_folder, 0700); err != nil {
-			fmt.Printf("Couldn't create /ncsr directory: %v\n", err)
-			os.Exit(4)
-		}
+// restAddresses returns the REST API addresses (ip:port) of all the instances of a downstream service
+func restAddresses(endpoint config.Endpoint) []string {
+	var addresses []string
+	for _, ip := range endpoint.Addresses() {
+		addresses = append(addresses, ip+":"+endpoint.Port)
 	}
+	return addresses
+}
 
-	if _, err := os.Stat(utils.Nebula_folder + "nest_service.crt"); err != nil {
-		fmt.Printf("Cannot find NEST service Nebula certificate: %v\n", err)
-		os.Exit(5)
+/*
+nest_service is a REST API server which acts a facade between NEST clients and the inner Nebula CA and configuration services.
+In the main function, the proper environment is set up before starting a Gin https server rechable by the clients and an http client over a
+Nebula network for authentication and confidentiality among the peers (NEST , NEST_CA and NEST_CONFIG services)
+*/
+func main() {
+	cfg := config.DefaultService()
+	print_config, err := config.Load("nest_service", &cfg, os.Args[1:], os.LookupEnv)
+	if err != nil {
+		slog.Error("Invalid configuration", "error", err)
+		os.Exit(15)
 	}
-	if _, err := os.Stat(utils.Nebula_folder + "nest_service.key"); err != nil {
-		fmt.Printf("Cannot find NEST service Nebula key: %v\n", err)
-		os.Exit(6)
+	if print_config {
+		config.Print(os.Stdout, &cfg)
+		return
 	}
-
-	if _, err := os.Stat(utils.Nebula_folder + "nest_system_ca.crt"); err != nil {
-		fmt.Printf("Cannot find NEST Nebula CA crt: %v\n", err)
-		os.Exit(7)
+	log_file, err := logging.Setup(cfg.Log, "nest_service")
+	if err != nil {
+		fmt.Printf("Could not open the log file: %v\n", err)
+		os.Exit(16)
 	}
-
-	if _, err := os.Stat(utils.Nebula_folder + "config.yml"); err != nil {
-		fmt.Printf("Cannot find NEST Nebula config: %v\n", err)
-		os.Exit(8)
+	defer log_file.Close()
+	shutdown_tracing, err := tracing.Setup(cfg.Tracing, "nest_service")
+	if err != nil {
+		slog.Error("Could not set up the tracing", "error", err)
+		os.Exit(17)
 	}
+	slog.Info("NEST service: starting setup")
 
-	nebula_log, err := os.OpenFile(utils.Nebula_folder+"nest_service_nebula.log", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	configs, err := networkConfigs(&cfg)
 	if err != nil {
-		fmt.Printf("There was an error creating nebula log file: %v\n", err)
-		os.Exit(8)
+		slog.Error("Invalid network configuration", "error", err)
+		os.Exit(15)
+	}
+	for _, network_cfg := range configs {
+		if _, err := os.Stat(network_cfg.NcsrFolder); err != nil {
+			if err := os.Mkdir(network_cfg.NcsrFolder, 0700); err != nil {
+				slog.Error("Couldn't create /ncsr directory", "network", network_cfg.Network, "error", err)
+				os.Exit(4)
+			}
+		}
 	}
-	defer nebula_log.Close()
-	if err := utils.SetupNebula(utils.Nebula_folder, nebula_log); err != nil {
-		fmt.Printf("There was an error setting up the Nebula tunnel:%v\n", err)
-		os.Exit(9)
+
+	var nebula *utils.NebulaSupervisor
+	var transport_tls *tls.Config
+	if cfg.Transport.Mode == config.TRANSPORT_MTLS {
+		transport_tls, err = utils.MutualTLSClientConfig(cfg.Transport.Folder, "nest_service")
+		if err != nil {
+			slog.Error("Cannot load the mutual TLS transport certificates", "error", err)
+			os.Exit(18)
+		}
+		slog.Warn("Mutual TLS transport: the NEST services communicate without the Nebula overlay")
+	} else {
+		var nebula_log *os.File
+		nebula, nebula_log = startNebula(cfg.NebulaFolder)
+		defer nebula_log.Close()
+		defer nebula.Stop()
+	}
+	// exit stops Nebula, if running, before exiting, since the deferred calls are not run by os.Exit
+	exit := func(code int) {
+		if nebula != nil {
+			nebula.Stop()
+		}
+		os.Exit(code)
 	}
 
-	if err := nest_service.CheckCaCertFile(); err != nil {
-		fmt.Printf("Could not contact the CA service: %v\n", err)
-		os.Exit(2)
+	// stop is closed at shutdown to stop the background workers of the service
+	stop := make(chan struct{})
+	var workers sync.WaitGroup
+
+	// One instance per Nebula network, each with its own NEST CA certificate, hostnames, NCSR statuses and HMAC key
+	var services []*nest_service.Service
+	for i := range configs {
+		service := nest_service.New(&configs[i], transport_tls)
+		if err := service.CheckCaCertFile(); err != nil {
+			slog.Error("Could not contact the CA service", "network", configs[i].Network, "error", err)
+			exit(2)
+		}
+		if err := checkHostnamesFile(service); err != nil {
+			slog.Error("Could not contact the Conf service", "network", configs[i].Network, "error", err)
+			exit(3)
+		}
+		go service.WatchHostnames(time.Duration(configs[i].HostnamesRefreshInterval), stop)
+		services = append(services, service)
 	}
-	if err := checkHostnamesFile(); err != nil {
-		fmt.Printf("Could not contact the Conf service: %v\n", err)
-		os.Exit(3)
+
+	if _, err := os.Stat(cfg.TLS.Folder + "nest_service-key.pem"); err != nil {
+		slog.Error("Cannot find NEST service TLS key")
+		exit(10)
 	}
 
-	if _, err := os.Stat(utils.TLS_folder + "nest_service-key.pem"); err != nil {
-		fmt.Printf("Cannot find NEST service TLS key\n")
-		os.Exit(10)
+	if _, err := os.Stat(cfg.TLS.Folder + "nest_service-crt.pem"); err != nil {
+		slog.Error("Cannot find NEST TLS crt")
+		exit(11)
 	}
 
-	if _, err := os.Stat(utils.TLS_folder + "nest_service-crt.pem"); err != nil {
-		fmt.Printf("Cannot find NEST TLS crt\n")
-		os.Exit(11)
+	for _, service := range services {
+		info, err := os.Stat(service.Config.HMACKey)
+		if err != nil {
+			slog.Error("Cannot find HMAC key", "network", service.Config.Network)
+			exit(12)
+		}
+
+		if !utils.IsRWOwner(info.Mode()) {
+			os.Chmod(service.Config.HMACKey, 0600)
+		}
 	}
 
-	info, err := os.Stat(utils.HMAC_key)
-	if err != nil {
-		fmt.Printf("Cannot find HMAC key\n")
-		os.Exit(12)
+	if len(cfg.Webhooks.URLs) != 0 {
+		if err := setupWebhooks(services, cfg.Webhooks, stop, &workers); err != nil {
+			slog.Error("Could not set up the webhooks", "error", err)
+			exit(14)
+		}
 	}
 
-	if !utils.IsRWOwner(info.Mode()) {
-		os.Chmod(utils.HMAC_key, 0600)
+	for _, service := range services {
+		go service.WatchCertificatesExpiry(time.Duration(service.Config.CertsExpiryWarning), time.Hour, stop)
+		go service.WatchApplications(time.Duration(service.Config.Sweeper.Interval), stop)
 	}
 
-	tls_config := setupTLS()
-	fmt.Println("NEST service: setup finished")
-	router := gin.Default()
+	reloader, err := utils.NewCertReloader(cfg.TLS.Folder+"nest_service-crt.pem", cfg.TLS.Folder+"nest_service-key.pem")
+	if err != nil {
+		slog.Error("Cannot load NEST service TLS key pair", "error", err)
+		exit(13)
+	}
+	tls_config, err := setupTLS(cfg.TLS, reloader)
+	if err != nil {
+		slog.Error("Invalid TLS configuration", "error", err)
+		exit(13)
+	}
+	go reloader.Watch(time.Duration(cfg.TLS.ReloadInterval), stop)
+	slog.Info("NEST service: setup finished")
+	gin.SetMode(gin.ReleaseMode)
+	router := gin.New()
+	router.Use(gin.Recovery(), tracing.Middleware(), logging.Middleware())
 	router.SetTrustedProxies(nil)
-	utils.SetupLogger(router, utils.Log_file)
-
-	for _, r := range nest_service.Service_routes {
-		switch r.Method {
-		case "GET":
-			router.GET(r.Pattern, r.HandlerFunc)
-		case "POST":
-			router.POST(r.Pattern, r.HandlerFunc)
+	router.Use(metrics.Middleware())
+	//The metrics and the detailed readiness report are only served on the internal monitoring listener, not to the NEST clients
+	internal := gin.New()
+	internal.Use(gin.Recovery())
+	metrics.Expose(internal)
+	checks := []health.Check{
+		health.Service("nest_ca", restAddresses(cfg.Ca), transport_tls),
+		health.Service("nest_config", restAddresses(cfg.Conf), transport_tls),
+	}
+	for _, service := range services {
+		checks = append(checks,
+			health.InNetwork(service.Config.Network, health.File("ca_cert", service.Config.CaCertFile)),
+			health.InNetwork(service.Config.Network, health.File("hostnames", service.Config.HostnamesFile)),
+			health.InNetwork(service.Config.Network, health.File("hmac_key", service.Config.HMACKey)),
+		)
+	}
+	if nebula != nil {
+		checks = append([]health.Check{health.Nebula(nebula)}, checks...)
+	}
+	health.SetupPublic(router, checks...)
+	health.Setup(internal, checks...)
+
+	for _, service := range services {
+		for _, r := range models.NetworkRoutes(service.Config.Network, service.Routes()) {
+			switch r.Method {
+			case "GET":
+				router.GET(r.Pattern, r.HandlerFunc)
+			case "POST":
+				router.POST(r.Pattern, r.HandlerFunc)
+			}
 		}
 	}
 
 	srv := http.Server{
-		Addr:      utils.Service_ip + ":" + utils.Service_port,
+		Addr:      cfg.ServiceIP + ":" + cfg.ServicePort,
 		Handler:   router,
 		TLSConfig: tls_config,
 	}
 
-	err = srv.ListenAndServeTLS(utils.TLS_folder+"nest_service-crt.pem", utils.TLS_folder+"nest_service-key.pem")
-	fmt.Println("Error in Setting up TLS server: " + err.Error())
+	internal_srv := http.Server{
+		Addr:    cfg.Monitoring.Address,
+		Handler: internal,
+	}
+
+	failed := make(chan error, 1)
+	utils.Serve(func() error { return srv.ListenAndServeTLS("", "") }, failed)
+	if len(cfg.Monitoring.Address) != 0 {
+		utils.Serve(internal_srv.ListenAndServe, failed)
+	}
+	if err := utils.WaitForShutdown(func(ctx context.Context) { reload(ctx, services, reloader, nebula) }, failed); err != nil {
+		slog.Error("Error in Setting up TLS server", "error", err)
+	}
+
+	/*
+		Shutdown: no new request is accepted and the enrollments in progress are drained, the background workers are stopped and the pending
+		webhook deliveries flushed, then the traces are flushed. Everything must complete within the shutdown timeout. Nebula is stopped last, by the deferred calls.
+	*/
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(cfg.ShutdownTimeout))
+	defer cancel()
+	if err := utils.ShutdownHTTP(ctx, &srv); err != nil {
+		slog.Warn("The requests in progress did not complete in time, their connections were closed", "error", err)
+	}
+	utils.ShutdownHTTP(ctx, &internal_srv)
+	close(stop)
+	if err := utils.WaitGroup(ctx, &workers); err != nil {
+		slog.Warn("The webhook deliveries were not flushed in time, they stay queued", "error", err)
+	}
+	for _, service := range services {
+		service.Ca.Close()
+		service.Conf.Close()
+	}
+	if err := shutdown_tracing(ctx); err != nil {
+		slog.Warn("Could not flush the traces", "error", err)
+	}
+	slog.Info("NEST service: shut down")
 }
@@ -0,0 +1,414 @@
+/*
+NEST: Nebula Enrollment over Secure Transport - OpenAPI 3.0
+
+This package contains the clients used by the NEST service to contact the NEST CA and NEST config services, over gRPC or, in compatibility mode, over REST.
+API version: 0.3.1
+Contact: gianmarco.decola@studio.unibo.it
+*/
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/m4rkdc/nebula_est/nest_service/pkg/config"
+	"github.com/m4rkdc/nebula_est/nest_service/pkg/logging"
+	"github.com/m4rkdc/nebula_est/nest_service/pkg/models"
+	"github.com/m4rkdc/nebula_est/nest_service/pkg/rpc"
+	"github.com/m4rkdc/nebula_est/nest_service/pkg/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+// Protocols with which the downstream services can be contacted
+const (
+	GRPC = "grpc"
+	//Compatibility mode, using the REST API of the downstream services
+	REST = "rest"
+)
+
+// Settings of the requests sent to a downstream service
+type Settings struct {
+	//Protocol used to contact the downstream service: GRPC or REST
+	Protocol string
+	//Deadline of every single attempt
+	Timeout time.Duration
+	//Maximum number of retries of an idempotent (GET) request. Other requests are never retried
+	Retries int
+	//Base waiting time before the first retry. It doubles at every retry and is randomized by ±50%
+	Backoff time.Duration
+	//Consecutive failures after which the circuit breaker opens. 0 disables the circuit breaker
+	FailureThreshold int
+	//How long the circuit breaker stays open before letting a trial request through
+	Cooldown time.Duration
+	//Nebula network of the requests in multi-tenant deployments, empty otherwise. It prefixes the REST paths and is sent in the gRPC calls metadata
+	Network string
+	//TLS configuration of the mtls transport mode, whose ServerName is set to the name of the downstream service. If nil, the downstream
+	//service is contacted without TLS, over the NEST system Nebula network
+	TLS *tls.Config
+}
+
+var Default_settings = Settings{
+	Protocol:         GRPC,
+	Timeout:          10 * time.Second,
+	Retries:          3,
+	Backoff:          200 * time.Millisecond,
+	FailureThreshold: 5,
+	Cooldown:         30 * time.Second,
+}
+
+// An instance of a downstream NEST service
+type Target struct {
+	//Base URL of its REST API
+	BaseURL string
+	//Address (ip:port) of its gRPC API
+	GRPCAddress string
+}
+
+// An instance of the downstream service, with its own circuit breaker and gRPC connection
+type instance struct {
+	Target
+	breaker *breaker
+	conn    *grpc.ClientConn
+}
+
+/*
+A client of a downstream NEST service, which can have several instances: the requests are sent to the current instance and fail over
+to the following ones, in order, when it can't be reached, is unavailable or its circuit breaker is open.
+*/
+type Client struct {
+	name      string
+	instances []*instance
+	http      *http.Client
+	tls       *tls.Config
+	settings  Settings
+
+	mu      sync.Mutex
+	current int
+}
+
+/*
+New creates a client of the downstream service name, whose instances are the given targets, the primary one first.
+If the settings have a TLS configuration, the downstream service must present a certificate with name as identity.
+*/
+func New(name string, targets []Target, settings Settings) *Client {
+	c := &Client{
+		name:     name,
+		http:     &http.Client{},
+		settings: settings,
+	}
+	for _, target := range targets {
+		c.instances = append(c.instances, &instance{Target: target, breaker: &breaker{threshold: settings.FailureThreshold, cooldown: settings.Cooldown}})
+	}
+	if settings.TLS != nil {
+		c.tls = settings.TLS.Clone()
+		c.tls.ServerName = name
+		c.http.Transport = &http.Transport{TLSClientConfig: c.tls}
+	}
+	return c
+}
+
+// SettingsFrom returns the client settings corresponding to the downstream settings of the NEST service configuration
+func SettingsFrom(downstream config.Downstream) Settings {
+	settings := Default_settings
+	settings.Protocol = downstream.Protocol
+	settings.Timeout = time.Duration(downstream.Timeout)
+	settings.Retries = downstream.Retries
+	settings.FailureThreshold = downstream.BreakerFailures
+	settings.Cooldown = time.Duration(downstream.BreakerCooldown)
+	return settings
+}
+
+// Close closes the gRPC connections of the client, if any
+func (c *Client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var err error
+	for _, target := range c.instances {
+		if target.conn == nil {
+			continue
+		}
+		if close_err := target.conn.Close(); close_err != nil {
+			err = close_err
+		}
+		target.conn = nil
+	}
+	return err
+}
+
+// pick returns the instance to send a request to: the current one or, if its circuit breaker is open, the first following one whose breaker is closed. nil if all the breakers are open
+func (c *Client) pick(now time.Time) *instance {
+	c.mu.Lock()
+	start := c.current
+	c.mu.Unlock()
+	for i := range c.instances {
+		if target := c.instances[(start+i)%len(c.instances)]; target.breaker.allow(now) {
+			return target
+		}
+	}
+	return nil
+}
+
+// failover makes the instance following target the current one, unless a concurrent request already failed over
+func (c *Client) failover(target *instance) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.instances[c.current] != target {
+		return
+	}
+	c.current = (c.current + 1) % len(c.instances)
+	slog.Warn("Failing over to another instance", "service", c.name, "from", target.Target, "to", c.instances[c.current].Target)
+}
+
+// Get sends a GET request for path to the downstream service and decodes its JSON response in out. Failed attempts are retried
+func (c *Client) Get(ctx context.Context, path string, out interface{}) error {
+	return c.do(ctx, http.MethodGet, path, nil, out, c.settings.Retries)
+}
+
+// Post sends body as a JSON POST request for path to the downstream service and decodes its JSON response in out. It is never retried
+func (c *Client) Post(ctx context.Context, path string, body []byte, out interface{}) error {
+	return c.do(ctx, http.MethodPost, path, body, out, 0)
+}
+
+/*
+call runs attempt on an instance of the downstream service, retrying it at most retries times while it fails with a retryable error. Every attempt is bounded by the client timeout.
+attempt returns the error occurred, if the attempt can be retried and if the error is a failure of the downstream service, counted by the circuit breaker of the instance.
+An attempt failing because the instance can't be reached or is unavailable (503), and so did not handle the request, is sent right away to the next instance, once per instance.
+*/
+func (c *Client) call(ctx context.Context, retries int, attempt func(ctx context.Context, target *instance) (api_error *models.ApiError, retry bool, failure bool)) error {
+	failovers := 0
+	for n := 0; ; n++ {
+		target := c.pick(time.Now())
+		if target == nil {
+			return &models.ApiError{Code: http.StatusServiceUnavailable, Message: "Service Unavailable: " + c.name + " is failing, circuit breaker open"}
+		}
+
+		attempt_ctx, cancel := context.WithTimeout(ctx, c.settings.Timeout)
+		api_error, retry, failure := attempt(attempt_ctx, target)
+		cancel()
+		target.breaker.record(!failure, time.Now())
+		if api_error == nil {
+			return nil
+		}
+
+		if failure && api_error.Code == http.StatusServiceUnavailable && failovers < len(c.instances)-1 && ctx.Err() == nil {
+			failovers++
+			c.failover(target)
+			n--
+			continue
+		}
+		if n >= retries || !retry {
+			return api_error
+		}
+		select {
+		case <-ctx.Done():
+			return api_error
+		case <-time.After(backoff(c.settings.Backoff, n)):
+		}
+	}
+}
+
+/*
+do sends the REST request, retrying at most retries times after a transport error, a timeout or a 429, 502, 503 or 504 response.
+Every error returned is a *models.ApiError: the one sent by the downstream service if its response can be decoded,
+one built from the response status code otherwise, a 503 if the service could not be reached and a 504 if it did not respond in time.
+*/
+func (c *Client) do(ctx context.Context, method string, path string, body []byte, out interface{}, retries int) error {
+	return c.call(ctx, retries, func(ctx context.Context, target *instance) (*models.ApiError, bool, bool) {
+		status, b, err := c.send(ctx, target, method, path, body)
+		switch {
+		case err != nil:
+			return c.transportError(err), !errors.Is(err, context.Canceled), true
+		case status >= 300:
+			return c.decodeError(status, b), retryable(status), status >= 500
+		}
+		if out == nil {
+			return nil, false, false
+		}
+		if err := json.Unmarshal(b, out); err != nil {
+			return &models.ApiError{Code: http.StatusBadGateway, Message: "Bad Gateway: invalid response from " + c.name + ": " + err.Error()}, false, false
+		}
+		return nil, false, false
+	})
+}
+
+// send makes a single attempt of the REST request to the target instance and returns the response status code and body
+func (c *Client) send(ctx context.Context, target *instance, method string, path string, body []byte) (int, []byte, error) {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, target.BaseURL+models.NetworkPath(c.settings.Network)+path, reader)
+	if err != nil {
+		return 0, nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if request_id := logging.RequestID(ctx); len(request_id) != 0 {
+		req.Header.Set(logging.RequestIDHeader, request_id)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req, span := tracing.InjectHTTP(req)
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		tracing.End(span, err)
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+	span.SetAttributes(attribute.Int("http.status_code", resp.StatusCode))
+	b, err := io.ReadAll(resp.Body)
+	tracing.End(span, err)
+	if err != nil {
+		return 0, nil, err
+	}
+	return resp.StatusCode, b, nil
+}
+
+// grpcConn returns the gRPC connection to the target instance, dialing it at the first call. The request IDs and trace contexts are forwarded in the calls metadata
+func (c *Client) grpcConn(target *instance) (*grpc.ClientConn, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if target.conn != nil {
+		return target.conn, nil
+	}
+	transport_credentials := insecure.NewCredentials()
+	if c.tls != nil {
+		transport_credentials = credentials.NewTLS(c.tls)
+	}
+	conn, err := grpc.Dial(target.GRPCAddress, grpc.WithTransportCredentials(transport_credentials), grpc.WithChainUnaryInterceptor(logging.UnaryClientInterceptor, tracing.UnaryClientInterceptor))
+	if err != nil {
+		return nil, err
+	}
+	target.conn = conn
+	return conn, nil
+}
+
+/*
+invoke runs a gRPC call to the downstream service. Idempotent calls are retried after an Unavailable, DeadlineExceeded or ResourceExhausted status.
+As for REST requests, every error returned is a *models.ApiError.
+*/
+func (c *Client) invoke(ctx context.Context, idempotent bool, rpc_call func(ctx context.Context, conn *grpc.ClientConn) error) error {
+	retries := 0
+	if idempotent {
+		retries = c.settings.Retries
+	}
+	return c.call(ctx, retries, func(ctx context.Context, target *instance) (*models.ApiError, bool, bool) {
+		conn, err := c.grpcConn(target)
+		if err != nil {
+			return c.transportError(err), false, true
+		}
+		err = rpc_call(rpc.WithNetwork(ctx, c.settings.Network), conn)
+		if err == nil {
+			return nil, false, false
+		}
+
+		switch status.Code(err) {
+		case codes.Unavailable:
+			return &models.ApiError{Code: http.StatusServiceUnavailable, Message: "Service Unavailable: could not contact " + c.name + ": " + status.Convert(err).Message()}, true, true
+		case codes.DeadlineExceeded:
+			return &models.ApiError{Code: http.StatusGatewayTimeout, Message: "Gateway Timeout: " + c.name + " did not respond in time"}, true, true
+		case codes.ResourceExhausted:
+			return rpc.FromStatus(err), true, false
+		case codes.Internal, codes.Unknown:
+			return rpc.FromStatus(err), false, true
+		}
+		return rpc.FromStatus(err), false, false
+	})
+}
+
+// decodeError returns the models.ApiError sent by the downstream service, or builds one from the response status code
+func (c *Client) decodeError(status int, b []byte) *models.ApiError {
+	var api_error models.ApiError
+	if json.Unmarshal(b, &api_error) == nil && api_error.Code != 0 {
+		return &api_error
+	}
+	message := http.StatusText(status) + ": " + c.name + " responded with status " + strconv.Itoa(status)
+	if body := strings.TrimSpace(string(b)); len(body) != 0 && len(body) <= 256 {
+		message += ": " + body
+	}
+	return &models.ApiError{Code: status, Message: message}
+}
+
+// transportError converts an error occurred while contacting the downstream service to a models.ApiError
+func (c *Client) transportError(err error) *models.ApiError {
+	var net_error net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &net_error) && net_error.Timeout()) {
+		return &models.ApiError{Code: http.StatusGatewayTimeout, Message: "Gateway Timeout: " + c.name + " did not respond in time"}
+	}
+	return &models.ApiError{Code: http.StatusServiceUnavailable, Message: "Service Unavailable: could not contact " + c.name + ": " + err.Error()}
+}
+
+// retryable tells if a REST request that failed with the given status code is worth retrying
+func retryable(status int) bool {
+	switch status {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// backoff returns the waiting time before the retry following the given attempt: base doubled at every attempt, randomized by ±50%
+func backoff(base time.Duration, attempt int) time.Duration {
+	d := base << attempt
+	return d/2 + time.Duration(rand.Int63n(int64(d)+1))
+}
+
+/*
+breaker is a circuit breaker: after threshold consecutive failures it rejects the requests for cooldown,
+then lets a single trial request through, closing again if it succeeds and reopening if it fails.
+*/
+type breaker struct {
+	mu         sync.Mutex
+	threshold  int
+	cooldown   time.Duration
+	failures   int
+	open_until time.Time
+	probing    bool
+}
+
+// allow tells if a request can be sent to the downstream service
+func (b *breaker) allow(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.threshold <= 0 || b.failures < b.threshold {
+		return true
+	}
+	if now.Before(b.open_until) || b.probing {
+		return false
+	}
+	b.probing = true
+	return true
+}
+
+// record updates the breaker with the outcome of a request
+func (b *breaker) record(success bool, now time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+	if success {
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.threshold > 0 && b.failures >= b.threshold {
+		b.open_until = now.Add(b.cooldown)
+	}
+}
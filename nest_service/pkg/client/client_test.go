@@ -0,0 +1,188 @@
+package client
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-playground/assert/v2"
+	"github.com/m4rkdc/nebula_est/nest_service/pkg/models"
+	"github.com/m4rkdc/nebula_est/nest_service/pkg/rpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var test_settings = Settings{Protocol: REST, Timeout: 100 * time.Millisecond, Retries: 2, Backoff: time.Millisecond, FailureThreshold: 3, Cooldown: time.Hour}
+
+func TestGet(t *testing.T) {
+	var attempts int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/hostnames":
+			//The first attempt fails to test the retries
+			if atomic.AddInt32(&attempts, 1) == 1 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			w.Write([]byte(`["client1","client2"]`))
+		case "/configs/unknown":
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"code":400,"message":"Bad request: invalid hostname"}`))
+		case "/networks/ot/hostnames":
+			w.Write([]byte(`["plc1"]`))
+		case "/slow":
+			time.Sleep(200 * time.Millisecond)
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{}`))
+		}
+	}))
+	defer server.Close()
+	c := New("nest_config", []Target{{BaseURL: server.URL}}, test_settings)
+
+	//First test: a failed attempt is retried
+	var hostnames []string
+	assert.Equal(t, nil, c.Get(context.Background(), "/hostnames", &hostnames))
+	assert.Equal(t, []string{"client1", "client2"}, hostnames)
+	assert.Equal(t, int32(2), attempts)
+
+	//Second test: the ApiError sent by the service is returned
+	err := c.Get(context.Background(), "/configs/unknown", nil)
+	assert.Equal(t, &models.ApiError{Code: 400, Message: "Bad request: invalid hostname"}, err)
+
+	//Third test: an undecodable error is converted to an ApiError
+	err = c.Get(context.Background(), "/cacerts", nil)
+	assert.Equal(t, http.StatusInternalServerError, err.(*models.ApiError).Code)
+
+	//Fourth test: a slow service times out
+	c = New("nest_config", []Target{{BaseURL: server.URL}}, test_settings)
+	err = c.Get(context.Background(), "/slow", nil)
+	assert.Equal(t, http.StatusGatewayTimeout, err.(*models.ApiError).Code)
+
+	//Fifth test: the requests for a Nebula network are sent under its path
+	settings := test_settings
+	settings.Network = "ot"
+	c = New("nest_config", []Target{{BaseURL: server.URL}}, settings)
+	assert.Equal(t, nil, c.Get(context.Background(), "/hostnames", &hostnames))
+	assert.Equal(t, []string{"plc1"}, hostnames)
+}
+
+func TestPost(t *testing.T) {
+	var attempts int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&attempts, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+	c := New("nest_ca", []Target{{BaseURL: server.URL}}, test_settings)
+
+	//A POST is not idempotent, hence it is never retried
+	err := c.Post(context.Background(), "/ncsr/sign", []byte("{}"), nil)
+	assert.Equal(t, http.StatusServiceUnavailable, err.(*models.ApiError).Code)
+	assert.Equal(t, int32(1), attempts)
+}
+
+func TestBreaker(t *testing.T) {
+	var attempts int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&attempts, 1)
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer server.Close()
+	c := New("nest_ca", []Target{{BaseURL: server.URL}}, test_settings)
+
+	//First test: the breaker opens after 3 consecutive failures, rejecting the following requests
+	c.Get(context.Background(), "/cacerts", nil)
+	assert.Equal(t, int32(3), attempts)
+	err := c.Get(context.Background(), "/cacerts", nil)
+	assert.Equal(t, int32(3), attempts)
+	assert.Equal(t, http.StatusServiceUnavailable, err.(*models.ApiError).Code)
+
+	//Second test: after the cooldown a single trial request goes through, and a success closes the breaker
+	now := time.Now()
+	assert.Equal(t, false, c.instances[0].breaker.allow(now))
+	assert.Equal(t, true, c.instances[0].breaker.allow(now.Add(2*time.Hour)))
+	assert.Equal(t, false, c.instances[0].breaker.allow(now.Add(2*time.Hour)))
+	c.instances[0].breaker.record(true, now.Add(2*time.Hour))
+	assert.Equal(t, true, c.instances[0].breaker.allow(now.Add(2*time.Hour)))
+}
+
+func TestFailover(t *testing.T) {
+	var attempts int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&attempts, 1)
+		w.Write([]byte(`{}`))
+	}))
+	defer server.Close()
+	//The primary instance is not listening
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+	c := New("nest_ca", []Target{{BaseURL: down.URL}, {BaseURL: server.URL}}, test_settings)
+
+	//First test: a POST the primary instance could not receive is sent to the next instance
+	assert.Equal(t, nil, c.Post(context.Background(), "/ncsr/sign", []byte("{}"), nil))
+	assert.Equal(t, int32(1), attempts)
+
+	//Second test: the next requests go to the instance that responded
+	assert.Equal(t, nil, c.Get(context.Background(), "/cacerts", nil))
+	assert.Equal(t, int32(2), attempts)
+	assert.Equal(t, 1, c.current)
+}
+
+// fakeCaServer is a NEST CA gRPC service whose CaCerts call fails unavailable times before succeeding
+type fakeCaServer struct {
+	models.UnimplementedCaServiceServer
+	unavailable int32
+	calls       int32
+	//Nebula network of the last call
+	network string
+}
+
+func (s *fakeCaServer) Sign(ctx context.Context, raw_csr *models.RawNebulaCsr) (*models.RawCaResponse, error) {
+	atomic.AddInt32(&s.calls, 1)
+	return nil, rpc.ToStatus(&models.ApiError{Code: 400, Message: "Bad request: the provided public key is already used by an already enrolled host"})
+}
+
+func (s *fakeCaServer) CaCerts(ctx context.Context, req *models.CaCertsRequest) (*models.CaCertsResponse, error) {
+	s.network = rpc.Network(ctx)
+	if atomic.AddInt32(&s.calls, 1) <= s.unavailable {
+		return nil, status.Error(codes.Unavailable, "not ready")
+	}
+	return &models.CaCertsResponse{NebulaCaCerts: []byte("ca")}, nil
+}
+
+func TestGRPC(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Equal(t, nil, err)
+	server := rpc.NewServer(nil)
+	fake := &fakeCaServer{unavailable: 1}
+	models.RegisterCaServiceServer(server, fake)
+	go server.Serve(lis)
+	defer server.Stop()
+
+	settings := test_settings
+	settings.Protocol = GRPC
+	c := &CaClient{New("nest_ca", []Target{{GRPCAddress: lis.Addr().String()}}, settings)}
+
+	//First test: an idempotent call is retried
+	ca_certs, err := c.CaCerts(context.Background())
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []byte("ca"), ca_certs)
+	assert.Equal(t, int32(2), fake.calls)
+
+	//Second test: the error returned by the service is converted back to an ApiError, without retrying
+	_, err = c.Sign(context.Background(), &models.RawNebulaCsr{Hostname: "client1"}, false)
+	assert.Equal(t, &models.ApiError{Code: 400, Message: "Bad request: the provided public key is already used by an already enrolled host"}, err)
+	assert.Equal(t, int32(3), fake.calls)
+
+	//Third test: the Nebula network is sent in the calls metadata
+	settings.Network = "ot"
+	c = &CaClient{New("nest_ca", []Target{{GRPCAddress: lis.Addr().String()}}, settings)}
+	_, err = c.CaCerts(context.Background())
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "ot", fake.network)
+}
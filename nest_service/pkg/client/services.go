@@ -0,0 +1,213 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/m4rkdc/nebula_est/nest_service/pkg/config"
+	"github.com/m4rkdc/nebula_est/nest_service/pkg/models"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+// Client of the NEST CA service
+type CaClient struct {
+	*Client
+}
+
+// Client of the NEST config service
+type ConfClient struct {
+	*Client
+}
+
+// targets returns the instances of the downstream service at endpoint, whose REST API is over https in the mtls transport mode
+func targets(endpoint config.Endpoint, settings Settings) []Target {
+	scheme := "http://"
+	if settings.TLS != nil {
+		scheme = "https://"
+	}
+	var targets []Target
+	for _, ip := range endpoint.Addresses() {
+		targets = append(targets, Target{BaseURL: scheme + ip + ":" + endpoint.Port, GRPCAddress: ip + ":" + endpoint.GRPCPort})
+	}
+	return targets
+}
+
+// NewCaClient creates a client of the NEST CA service reachable at the given endpoint, failing over to its other instances
+func NewCaClient(endpoint config.Endpoint, settings Settings) *CaClient {
+	return &CaClient{New("nest_ca", targets(endpoint, settings), settings)}
+}
+
+// NewConfClient creates a client of the NEST config service reachable at the given endpoint, failing over to its other instances
+func NewConfClient(endpoint config.Endpoint, settings Settings) *ConfClient {
+	return &ConfClient{New("nest_config", targets(endpoint, settings), settings)}
+}
+
+// Sign requests a Nebula certificate for the given Nebula CSR. If generate is true, the NEST CA also generates the Nebula key pair of the client
+func (c *CaClient) Sign(ctx context.Context, raw_csr *models.RawNebulaCsr, generate bool) (*models.RawCaResponse, error) {
+	if c.settings.Protocol == REST {
+		path := "/ncsr/sign"
+		if generate {
+			path = "/ncsr/generate"
+		}
+		b, err := protojson.Marshal(raw_csr)
+		if err != nil {
+			return nil, err
+		}
+		var raw_ca_response_bytes []byte
+		if err = c.Post(ctx, path, b, &raw_ca_response_bytes); err != nil {
+			return nil, err
+		}
+		raw_ca_response := &models.RawCaResponse{}
+		if err = proto.Unmarshal(raw_ca_response_bytes, raw_ca_response); err != nil {
+			return nil, err
+		}
+		return raw_ca_response, nil
+	}
+
+	var raw_ca_response *models.RawCaResponse
+	err := c.invoke(ctx, false, func(ctx context.Context, conn *grpc.ClientConn) (err error) {
+		if generate {
+			raw_ca_response, err = models.NewCaServiceClient(conn).Generate(ctx, raw_csr)
+		} else {
+			raw_ca_response, err = models.NewCaServiceClient(conn).Sign(ctx, raw_csr)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return raw_ca_response, nil
+}
+
+// CaCerts returns the PEM encoded Nebula CA certificates
+func (c *CaClient) CaCerts(ctx context.Context) ([]byte, error) {
+	var ca_certs []byte
+	if c.settings.Protocol == REST {
+		if err := c.Get(ctx, "/cacerts", &ca_certs); err != nil {
+			return nil, err
+		}
+		return ca_certs, nil
+	}
+
+	err := c.invoke(ctx, true, func(ctx context.Context, conn *grpc.ClientConn) error {
+		resp, err := models.NewCaServiceClient(conn).CaCerts(ctx, &models.CaCertsRequest{})
+		if err != nil {
+			return err
+		}
+		ca_certs = resp.NebulaCaCerts
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ca_certs, nil
+}
+
+// GetConfig returns the Nebula configuration file, its version and signature, IP, groups and installation path of the given client
+func (c *ConfClient) GetConfig(ctx context.Context, hostname string) (*models.ConfResponse, error) {
+	var conf_resp models.ConfResponse
+	if c.settings.Protocol == REST {
+		if err := c.Get(ctx, "/configs/"+hostname, &conf_resp); err != nil {
+			return nil, err
+		}
+		return &conf_resp, nil
+	}
+
+	err := c.invoke(ctx, true, func(ctx context.Context, conn *grpc.ClientConn) error {
+		resp, err := models.NewConfigServiceClient(conn).GetConfig(ctx, &models.ConfigRequest{Hostname: hostname})
+		if err != nil {
+			return err
+		}
+		conf_resp = models.ConfResponse{NebulaConf: resp.NebulaConf, Groups: resp.Groups, Ip: resp.Ip, NebulaPath: resp.NebulaPath, Version: resp.Version, Signature: resp.Signature}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &conf_resp, nil
+}
+
+// ListHostnames returns the valid hostnames of the Nebula network, followed by the hostname patterns of its host templates (e.g., sensor-*)
+func (c *ConfClient) ListHostnames(ctx context.Context) ([]string, error) {
+	var hostnames []string
+	if c.settings.Protocol == REST {
+		if err := c.Get(ctx, "/hostnames", &hostnames); err != nil {
+			return nil, err
+		}
+		var templates []models.Template
+		if err := c.Get(ctx, "/templates", &templates); err != nil {
+			return nil, err
+		}
+		for _, t := range templates {
+			hostnames = append(hostnames, t.Pattern)
+		}
+		return hostnames, nil
+	}
+
+	err := c.invoke(ctx, true, func(ctx context.Context, conn *grpc.ClientConn) error {
+		resp, err := models.NewConfigServiceClient(conn).ListHostnames(ctx, &models.HostnamesRequest{})
+		if err != nil {
+			return err
+		}
+		hostnames = append(resp.Hostnames, resp.Patterns...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return hostnames, nil
+}
+
+// RegisterInstance registers hostname as an instance of the host template it matches, and returns it. Registering an instance again returns it unchanged
+func (c *ConfClient) RegisterInstance(ctx context.Context, hostname string) (*models.Instance, error) {
+	var instance models.Instance
+	if c.settings.Protocol == REST {
+		b, err := json.Marshal(models.Instance{Hostname: hostname})
+		if err != nil {
+			return nil, err
+		}
+		if err = c.Post(ctx, "/instances", b, &instance); err != nil {
+			return nil, err
+		}
+		return &instance, nil
+	}
+
+	err := c.invoke(ctx, true, func(ctx context.Context, conn *grpc.ClientConn) error {
+		resp, err := models.NewConfigServiceClient(conn).RegisterInstance(ctx, &models.InstanceRequest{Hostname: hostname})
+		if err != nil {
+			return err
+		}
+		instance = models.Instance{Hostname: hostname, Template: resp.Template, Approved: resp.Approved}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &instance, nil
+}
+
+// SigningKeys returns the PEM encoded public keys with which the NEST config service signs the Nebula configuration files, empty if it signs none
+func (c *ConfClient) SigningKeys(ctx context.Context) ([]byte, error) {
+	var keys []byte
+	if c.settings.Protocol == REST {
+		if err := c.Get(ctx, "/signing_keys", &keys); err != nil {
+			return nil, err
+		}
+		return keys, nil
+	}
+
+	err := c.invoke(ctx, true, func(ctx context.Context, conn *grpc.ClientConn) error {
+		resp, err := models.NewConfigServiceClient(conn).SigningKeys(ctx, &models.SigningKeysRequest{})
+		if err != nil {
+			return err
+		}
+		keys = resp.ConfigSigningKeys
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
@@ -0,0 +1,218 @@
+/*
+NEST: Nebula Enrollment over Secure Transport - OpenAPI 3.0
+
+This package contains the typed configurations of the NEST services and their loading from a YAML or TOML file, the environment and the command line.
+API version: 0.3.1
+Contact: gianmarco.decola@studio.unibo.it
+*/
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pelletier/go-toml/v2"
+	"gopkg.in/yaml.v3"
+)
+
+// A time.Duration written as a Go duration string (e.g., "30s", "5m", "72h") in the configuration files, the environment and the command line
+type Duration time.Duration
+
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+func (d *Duration) UnmarshalText(b []byte) error {
+	if len(b) == 0 {
+		*d = 0
+		return nil
+	}
+	v, err := time.ParseDuration(string(b))
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// A service configuration, checked after being loaded
+type Validator interface {
+	Validate() error
+}
+
+// A configuration setting, bound to an environment variable and to a command line flag
+type setting struct {
+	env   string
+	flag  string
+	usage string
+	value reflect.Value
+}
+
+var duration_type = reflect.TypeOf(Duration(0))
+
+/*
+settings returns the settings of the given configuration struct. The name of the environment variable of a setting is the env tag of its field,
+prefixed by the env tags of the structs containing it. The fields tagged env:"-" are not settings. The flag name is the environment variable name, lowercase and with dashes.
+*/
+func settings(v reflect.Value, prefix string) []setting {
+	var s []setting
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.Tag.Get("env") == "-" {
+			continue
+		}
+		env := prefix + field.Tag.Get("env")
+		if field.Type.Kind() == reflect.Struct {
+			s = append(s, settings(v.Field(i), env)...)
+			continue
+		}
+		s = append(s, setting{
+			env:   env,
+			flag:  strings.ReplaceAll(strings.ToLower(env), "_", "-"),
+			usage: field.Tag.Get("usage"),
+			value: v.Field(i),
+		})
+	}
+	return s
+}
+
+// set parses val in the setting value. Lists are comma separated
+func (s setting) set(val string) error {
+	switch {
+	case s.value.Type() == duration_type:
+		var d Duration
+		if err := d.UnmarshalText([]byte(val)); err != nil {
+			return err
+		}
+		s.value.Set(reflect.ValueOf(d))
+	case s.value.Kind() == reflect.String:
+		s.value.SetString(val)
+	case s.value.Kind() == reflect.Int:
+		n, err := strconv.Atoi(val)
+		if err != nil {
+			return err
+		}
+		s.value.SetInt(int64(n))
+	case s.value.Kind() == reflect.Bool:
+		b, err := strconv.ParseBool(val)
+		if err != nil {
+			return err
+		}
+		s.value.SetBool(b)
+	case s.value.Kind() == reflect.Slice && s.value.Type().Elem().Kind() == reflect.String:
+		list := []string{}
+		for _, item := range strings.Split(val, ",") {
+			if item = strings.TrimSpace(item); len(item) != 0 {
+				list = append(list, item)
+			}
+		}
+		s.value.Set(reflect.ValueOf(list))
+	default:
+		return errors.New("unsupported setting type " + s.value.Type().String())
+	}
+	return nil
+}
+
+// readFile decodes the YAML (.yml, .yaml) or TOML (.toml) configuration file in cfg. Unknown settings are rejected
+func readFile(path string, cfg interface{}) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yml", ".yaml":
+		dec := yaml.NewDecoder(f)
+		dec.KnownFields(true)
+		if err := dec.Decode(cfg); err != nil && err != io.EOF {
+			return err
+		}
+	case ".toml":
+		dec := toml.NewDecoder(f)
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(cfg); err != nil {
+			return err
+		}
+	default:
+		return errors.New("unknown configuration file format " + filepath.Ext(path) + ": use .yml, .yaml or .toml")
+	}
+	return nil
+}
+
+/*
+Load fills cfg, which has to point to a configuration struct holding its defaults, and validates it.
+The settings are taken, in increasing order of precedence, from the configuration file given by the --config flag or the CONFIG_FILE environment variable,
+from the environment variables (read with lookup) and from the command line flags in args.
+It returns true if the --print-config flag is given, in which case the caller should print the configuration and exit.
+*/
+func Load(name string, cfg Validator, args []string, lookup func(string) (string, bool)) (bool, error) {
+	s := settings(reflect.ValueOf(cfg).Elem(), "")
+
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	config_file := fs.String("config", "", "YAML (.yml, .yaml) or TOML (.toml) configuration file. Environment variable: CONFIG_FILE")
+	print_config := fs.Bool("print-config", false, "print the configuration in YAML and exit")
+	flags := make(map[string]*string, len(s))
+	for _, setting := range s {
+		flags[setting.flag] = fs.String(setting.flag, "", setting.usage+". Environment variable: "+setting.env)
+	}
+	if err := fs.Parse(args); err != nil {
+		return false, err
+	}
+
+	if len(*config_file) == 0 {
+		*config_file, _ = lookup("CONFIG_FILE")
+	}
+	if len(*config_file) != 0 {
+		if err := readFile(*config_file, cfg); err != nil {
+			return false, fmt.Errorf("invalid configuration file %s: %v", *config_file, err)
+		}
+	}
+
+	for _, setting := range s {
+		if val, ok := lookup(setting.env); ok {
+			if err := setting.set(val); err != nil {
+				return false, fmt.Errorf("invalid %s: %v", setting.env, err)
+			}
+		}
+	}
+
+	var err error
+	fs.Visit(func(f *flag.Flag) {
+		for _, setting := range s {
+			if setting.flag == f.Name && err == nil {
+				if set_err := setting.set(*flags[f.Name]); set_err != nil {
+					err = fmt.Errorf("invalid --%s: %v", f.Name, set_err)
+				}
+			}
+		}
+	})
+	if err != nil {
+		return false, err
+	}
+
+	return *print_config, cfg.Validate()
+}
+
+// Print writes the configuration cfg in YAML to w
+func Print(w io.Writer, cfg interface{}) error {
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(cfg); err != nil {
+		return err
+	}
+	return enc.Close()
+}
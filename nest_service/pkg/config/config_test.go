@@ -0,0 +1,139 @@
+package config
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-playground/assert/v2"
+)
+
+func env(vars map[string]string) func(string) (string, bool) {
+	return func(key string) (string, bool) {
+		val, ok := vars[key]
+		return val, ok
+	}
+}
+
+func TestLoad(t *testing.T) {
+	dir := t.TempDir()
+	yaml_file := dir + "/nest_service.yml"
+	os.WriteFile(yaml_file, []byte("service_port: \"8443\"\nhostnames_refresh_interval: 1m\nca:\n  ip: 10.0.0.1\ndownstream:\n  retries: 5\ntls:\n  curves: [X25519]\n"), 0600)
+	toml_file := dir + "/nest_ca.toml"
+	os.WriteFile(toml_file, []byte("service_port = \"9000\"\ncerts_validity = \"24h\"\n"), 0600)
+
+	//First test: the file settings override the defaults, the environment overrides the file and the flags override the environment
+	cfg := DefaultService()
+	print_config, err := Load("nest_service", &cfg, []string{"--config", yaml_file, "--downstream-retries", "7"}, env(map[string]string{"CA_SERVICE_IP": "10.0.0.2", "DOWNSTREAM_RETRIES": "6", "WEBHOOK_URLS": "http://a, http://b"}))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, false, print_config)
+	assert.Equal(t, "8443", cfg.ServicePort)
+	assert.Equal(t, Duration(time.Minute), cfg.HostnamesRefreshInterval)
+	assert.Equal(t, "10.0.0.2", cfg.Ca.IP)
+	assert.Equal(t, "53536", cfg.Ca.GRPCPort)
+	assert.Equal(t, 7, cfg.Downstream.Retries)
+	assert.Equal(t, []string{"X25519"}, cfg.TLS.Curves)
+	assert.Equal(t, []string{"http://a", "http://b"}, cfg.Webhooks.URLs)
+
+	//Second test: TOML files and the CONFIG_FILE environment variable
+	ca := DefaultCa()
+	print_config, err = Load("nest_ca", &ca, []string{"--print-config"}, env(map[string]string{"CONFIG_FILE": toml_file}))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, true, print_config)
+	assert.Equal(t, "9000", ca.ServicePort)
+	assert.Equal(t, Duration(24*time.Hour), ca.CertsValidity)
+
+	//Third test: invalid settings are rejected
+	cfg = DefaultService()
+	_, err = Load("nest_service", &cfg, nil, env(map[string]string{"DOWNSTREAM_PROTOCOL": "http"}))
+	assert.NotEqual(t, nil, err)
+	_, err = Load("nest_service", &cfg, []string{"--service-port", "none"}, env(nil))
+	assert.NotEqual(t, nil, err)
+	_, err = Load("nest_service", &cfg, []string{"--transport-mode", "wireguard"}, env(nil))
+	assert.NotEqual(t, nil, err)
+	_, err = Load("nest_service", &cfg, []string{"--store-backend", "etcd"}, env(nil))
+	assert.NotEqual(t, nil, err)
+	cfg = DefaultService()
+	_, err = Load("nest_service", &cfg, nil, env(map[string]string{"MONITORING_ADDRESS": "8081"}))
+	assert.NotEqual(t, nil, err)
+	conf := DefaultConf()
+	_, err = Load("nest_config", &conf, nil, env(map[string]string{"IPAM_POOLS": "192.168.100.0/24,home=192.168.100.128/25"}))
+	assert.NotEqual(t, nil, err)
+	_, err = Load("nest_config", &conf, []string{"--ipam-pools", "home=fd00::/64"}, env(nil))
+	assert.NotEqual(t, nil, err)
+	os.WriteFile(yaml_file, []byte("unknown: 1\n"), 0600)
+	_, err = Load("nest_service", &cfg, []string{"--config", yaml_file}, env(nil))
+	assert.NotEqual(t, nil, err)
+
+	//Fourth test: the failover instances are listed after the primary one
+	cfg = DefaultService()
+	_, err = Load("nest_service", &cfg, nil, env(map[string]string{"CA_FAILOVER": "192.168.80.4,192.168.80.5"}))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []string{cfg.Ca.IP, "192.168.80.4", "192.168.80.5"}, cfg.Ca.Addresses())
+
+	//Fifth test: the printed configuration can be loaded back
+	var buf bytes.Buffer
+	assert.Equal(t, nil, Print(&buf, &ca))
+	assert.Equal(t, true, strings.Contains(buf.String(), "certs_validity: 24h0m0s"))
+	os.WriteFile(yaml_file, buf.Bytes(), 0600)
+	loaded := DefaultCa()
+	_, err = Load("nest_ca", &loaded, []string{"--config", yaml_file}, env(nil))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, ca, loaded)
+
+	//Sixth test: the client settings, with an invalid interval rejected instead of ignored
+	client := DefaultClient()
+	_, err = Load("nest_client", &client, []string{"--rekey", "true"}, env(map[string]string{"NEST_NETWORK": "corp", "CONFIG_POLL_INTERVAL": "0", "REQUIRE_CONFIG_SIGNATURE": "true"}))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "corp", client.Network)
+	assert.Equal(t, true, client.Rekey)
+	assert.Equal(t, Duration(0), client.ConfigPollInterval)
+	assert.Equal(t, true, client.RequireConfigSignature)
+	assert.Equal(t, "text", client.Log.Format)
+	client = DefaultClient()
+	_, err = Load("nest_client", &client, nil, env(map[string]string{"APPROVAL_RETRY_INTERVAL": "0"}))
+	assert.NotEqual(t, nil, err)
+	client = DefaultClient()
+	_, err = Load("nest_client", &client, nil, env(map[string]string{"REQUIRE_CONFIG_SIGNATURE": "maybe"}))
+	assert.NotEqual(t, nil, err)
+}
+
+func TestForNetwork(t *testing.T) {
+	dir := t.TempDir()
+	os.MkdirAll(dir+"/corp", 0700)
+	os.WriteFile(dir+"/corp/network.yml", []byte("certs_expiry_warning: 48h\ncerts_validity: 72h\n"), 0600)
+
+	//First test: the files of a network are taken in its folder and its network.yml file overrides the settings it holds
+	cfg := DefaultService()
+	_, err := Load("nest_service", &cfg, nil, env(map[string]string{"NETWORKS_NAMES": "corp,lab", "NETWORKS_FOLDER": dir + "/"}))
+	assert.Equal(t, nil, err)
+	corp, err := cfg.ForNetwork("corp")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "corp", corp.Network)
+	assert.Equal(t, dir+"/corp/"+cfg.HostnamesFile, corp.HostnamesFile)
+	assert.Equal(t, dir+"/corp/"+cfg.HMACKey, corp.HMACKey)
+	assert.Equal(t, Duration(48*time.Hour), corp.CertsExpiryWarning)
+	assert.Equal(t, cfg.HostnamesRefreshInterval, corp.HostnamesRefreshInterval)
+	ca := DefaultCa()
+	ca.Networks = cfg.Networks
+	corp_ca, err := ca.ForNetwork("corp")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, dir+"/corp/"+ca.CaKeysPath, corp_ca.CaKeysPath)
+	assert.Equal(t, Duration(72*time.Hour), corp_ca.CertsValidity)
+
+	//Second test: a network without network.yml file keeps the settings of the deployment
+	lab, err := cfg.ForNetwork("lab")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, cfg.CertsExpiryWarning, lab.CertsExpiryWarning)
+
+	//Third test: invalid network names and network files are rejected
+	_, err = Load("nest_service", &cfg, nil, env(map[string]string{"NETWORKS_NAMES": "corp,../lab"}))
+	assert.NotEqual(t, nil, err)
+	_, err = Load("nest_service", &cfg, nil, env(map[string]string{"NETWORKS_NAMES": "corp,corp"}))
+	assert.NotEqual(t, nil, err)
+	os.WriteFile(dir+"/corp/network.yml", []byte("service_port: 8443\n"), 0600)
+	_, err = cfg.ForNetwork("corp")
+	assert.NotEqual(t, nil, err)
+}
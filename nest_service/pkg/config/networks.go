@@ -0,0 +1,117 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Settings that can be set per network in its network.yml file, shared by the NEST services: each of them only reads its own
+type networkFile struct {
+	HostnamesRefreshInterval Duration `yaml:"hostnames_refresh_interval"`
+	CertsExpiryWarning       Duration `yaml:"certs_expiry_warning"`
+	CertsValidity            Duration `yaml:"certs_validity"`
+	DhallConfiguration       string   `yaml:"dhall_configuration"`
+	IPAM                     struct {
+		Pools    []string `yaml:"pools"`
+		Reserved []string `yaml:"reserved"`
+	} `yaml:"ipam"`
+}
+
+func (n *Networks) validate() error {
+	seen := make(map[string]bool, len(n.Names))
+	for _, name := range n.Names {
+		switch {
+		case len(name) == 0 || strings.HasPrefix(name, ".") || strings.ContainsAny(name, "/\\ "):
+			return errors.New("networks.names can't contain \"" + name + "\": a network name can't be empty, start with a dot or contain slashes and spaces")
+		case seen[name]:
+			return errors.New("networks.names contains \"" + name + "\" twice")
+		}
+		seen[name] = true
+	}
+	if len(n.Names) != 0 && len(n.Folder) == 0 {
+		return errors.New("networks.folder is required with networks.names")
+	}
+	return nil
+}
+
+// folder returns the folder of the network name, in which its files are laid out as in a single network deployment
+func (n *Networks) folder(name string) string {
+	return n.Folder + name + "/"
+}
+
+// readNetworkFile decodes the network.yml file of the network name, if any, in settings
+func (n *Networks) readNetworkFile(name string, settings *networkFile) error {
+	path := n.folder(name) + "network.yml"
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil
+	}
+	if err := readFile(path, settings); err != nil {
+		return fmt.Errorf("invalid network file %s: %v", path, err)
+	}
+	return nil
+}
+
+/*
+ForNetwork returns the configuration of the NEST service for the network name: its hostnames file, NCSR folder, NEST CA certificate file and HMAC key
+are taken in the folder of the network, and its network.yml file can override the hostnames refresh interval and the certificates expiry warning.
+*/
+func (s *Service) ForNetwork(name string) (Service, error) {
+	n := *s
+	folder := s.Networks.folder(name)
+	n.Network = name
+	n.HostnamesFile = folder + s.HostnamesFile
+	n.NcsrFolder = folder + s.NcsrFolder
+	n.CaCertFile = folder + s.CaCertFile
+	n.HMACKey = folder + s.HMACKey
+
+	settings := networkFile{HostnamesRefreshInterval: s.HostnamesRefreshInterval, CertsExpiryWarning: s.CertsExpiryWarning}
+	if err := s.Networks.readNetworkFile(name, &settings); err != nil {
+		return n, err
+	}
+	n.HostnamesRefreshInterval = settings.HostnamesRefreshInterval
+	n.CertsExpiryWarning = settings.CertsExpiryWarning
+	return n, n.Validate()
+}
+
+/*
+ForNetwork returns the configuration of the NEST CA service for the network name: its Nebula CA keys and issued certificates are kept in the folder of the network,
+and its network.yml file can override the certificates validity.
+*/
+func (c *Ca) ForNetwork(name string) (Ca, error) {
+	n := *c
+	folder := c.Networks.folder(name)
+	n.Network = name
+	n.CertificatesPath = folder + c.CertificatesPath
+	n.CaKeysPath = folder + c.CaKeysPath
+
+	settings := networkFile{CertsValidity: c.CertsValidity}
+	if err := c.Networks.readNetworkFile(name, &settings); err != nil {
+		return n, err
+	}
+	n.CertsValidity = settings.CertsValidity
+	return n, n.Validate()
+}
+
+/*
+ForNetwork returns the configuration of the NEST config service for the network name: its Dhall folder, holding the dhall-nebula binary and the network description,
+its address leases, template instances and configuration history are taken in the folder of the network, and its network.yml file can override the Dhall configuration file and the address pools.
+*/
+func (c *Conf) ForNetwork(name string) (Conf, error) {
+	n := *c
+	n.Network = name
+	n.DhallDir = c.Networks.folder(name) + c.DhallDir
+	n.IPAM.LeasesFolder = c.Networks.folder(name) + c.IPAM.LeasesFolder
+	n.Templates.InstancesFolder = c.Networks.folder(name) + c.Templates.InstancesFolder
+	n.History.Folder = c.Networks.folder(name) + c.History.Folder
+
+	settings := networkFile{DhallConfiguration: c.DhallConfiguration}
+	settings.IPAM.Pools, settings.IPAM.Reserved = c.IPAM.Pools, c.IPAM.Reserved
+	if err := c.Networks.readNetworkFile(name, &settings); err != nil {
+		return n, err
+	}
+	n.DhallConfiguration = settings.DhallConfiguration
+	n.IPAM.Pools, n.IPAM.Reserved = settings.IPAM.Pools, settings.IPAM.Reserved
+	return n, n.Validate()
+}
@@ -0,0 +1,590 @@
+package config
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Settings shared by all the NEST services
+type Common struct {
+	ServiceIP    string    `yaml:"service_ip" toml:"service_ip" env:"SERVICE_IP" usage:"IP address on which the service listens"`
+	ServicePort  string    `yaml:"service_port" toml:"service_port" env:"SERVICE_PORT" usage:"port on which the service listens"`
+	NebulaFolder string    `yaml:"nebula_folder" toml:"nebula_folder" env:"NEBULA_FOLDER" usage:"folder containing the NEST system Nebula network keys, certificates, configuration and binary of the service"`
+	Log          Logging   `yaml:"log" toml:"log" env:"LOG_"`
+	Tracing      Tracing   `yaml:"tracing" toml:"tracing" env:"TRACING_"`
+	Transport    Transport `yaml:"transport" toml:"transport" env:"TRANSPORT_"`
+	//Maximum time given to the requests in progress to complete when the service is shut down
+	ShutdownTimeout Duration `yaml:"shutdown_timeout" toml:"shutdown_timeout" env:"SHUTDOWN_TIMEOUT" usage:"maximum time given to the requests in progress to complete when the service receives a SIGTERM or a SIGINT"`
+	Networks        Networks `yaml:"networks" toml:"networks" env:"NETWORKS_"`
+	//Nebula network served with this configuration, as returned by ForNetwork. Empty in single network deployments
+	Network string `yaml:"-" toml:"-" env:"-"`
+}
+
+// Nebula networks served by a multi-tenant deployment
+type Networks struct {
+	Names  []string `yaml:"names,omitempty" toml:"names,omitempty" env:"NAMES" usage:"identifiers of the Nebula networks served, under /networks/<name>/, each isolated with its own files and settings. A single network, without identifier, if empty"`
+	Folder string   `yaml:"folder" toml:"folder" env:"FOLDER" usage:"folder containing a subfolder per network, named after it, with the files of the network and an optional network.yml overriding its settings"`
+}
+
+// Logging settings of a NEST service or client
+type Logging struct {
+	File       string `yaml:"file" toml:"file" env:"FILE" usage:"log file, rotated when it reaches the maximum size. Logs are only written to the standard output if empty"`
+	Level      string `yaml:"level" toml:"level" env:"LEVEL" usage:"minimum level of the logged records: debug, info, warn or error"`
+	Format     string `yaml:"format" toml:"format" env:"FORMAT" usage:"format of the logged records: json or text"`
+	MaxSize    int    `yaml:"max_size" toml:"max_size" env:"MAX_SIZE" usage:"size in megabytes after which the log file is rotated, 0 disables the rotation"`
+	MaxBackups int    `yaml:"max_backups" toml:"max_backups" env:"MAX_BACKUPS" usage:"number of rotated log files kept"`
+}
+
+// OpenTelemetry tracing settings of a NEST service
+type Tracing struct {
+	Exporter      string `yaml:"exporter" toml:"exporter" env:"EXPORTER" usage:"exporter of the spans: none, stdout, file or otlp (OTLP over HTTP)"`
+	File          string `yaml:"file" toml:"file" env:"FILE" usage:"file to which the file exporter appends the spans"`
+	Endpoint      string `yaml:"endpoint" toml:"endpoint" env:"ENDPOINT" usage:"host:port of the OpenTelemetry collector to which the otlp exporter sends the spans"`
+	Insecure      bool   `yaml:"insecure" toml:"insecure" env:"INSECURE" usage:"send the spans to the OpenTelemetry collector over plain HTTP instead of HTTPS"`
+	SamplePercent int    `yaml:"sample_percent" toml:"sample_percent" env:"SAMPLE_PERCENT" usage:"percentage of the traces started by the service that are sampled"`
+}
+
+// Transport modes between the NEST services
+const (
+	//The NEST services communicate over the NEST system Nebula network. Hardened default
+	TRANSPORT_NEBULA = "nebula"
+	//The NEST services communicate directly over mutual TLS, e.g. in single-host deployments and development
+	TRANSPORT_MTLS = "mtls"
+)
+
+// Settings of the transport between the NEST services
+type Transport struct {
+	Mode   string   `yaml:"mode" toml:"mode" env:"MODE" usage:"how the NEST services reach each other: nebula (over the NEST system Nebula network) or mtls (mutual TLS with an internal x509 CA, without Nebula)"`
+	Folder string   `yaml:"folder" toml:"folder" env:"FOLDER" usage:"folder containing the internal x509 CA certificate (ca.crt) and the certificate (<service>.crt) and key (<service>.key) of the service, used in mtls mode"`
+	Peers  []string `yaml:"peers" toml:"peers" env:"PEERS" usage:"identities (DNS names of their certificates) of the services allowed to call this service in mtls mode"`
+}
+
+// Address of a NEST service on the NEST system Nebula network
+type Endpoint struct {
+	IP       string `yaml:"ip" toml:"ip" env:"SERVICE_IP" usage:"IP address on the NEST system Nebula network, or host name in mtls mode"`
+	Port     string `yaml:"port" toml:"port" env:"SERVICE_PORT" usage:"REST API port"`
+	GRPCPort string `yaml:"grpc_port" toml:"grpc_port" env:"GRPC_PORT" usage:"gRPC port"`
+	//Other instances of the service, tried in order when the previous ones are unavailable
+	Failover []string `yaml:"failover" toml:"failover" env:"FAILOVER" usage:"IP addresses (or host names in mtls mode) of other instances of the service, listening on the same ports, to fail over to when it is unavailable"`
+}
+
+// Addresses returns the IP addresses of all the instances of the service, the primary one first
+func (e *Endpoint) Addresses() []string {
+	return append([]string{e.IP}, e.Failover...)
+}
+
+// Store backends of the enrollment state
+const (
+	//Files in the NCSR folder, which can be shared by several replicas on a shared volume
+	STORE_FILE = "file"
+	//Memory of a single replica, lost when it stops
+	STORE_MEMORY = "memory"
+)
+
+// Settings of the store in which the NEST service replicas share the enrollment state
+type Store struct {
+	Backend   string   `yaml:"backend" toml:"backend" env:"BACKEND" usage:"where the enrollment state is stored: file (in ncsr_folder, which the replicas can share on a shared volume) or memory (single replica, lost when it stops)"`
+	LeaseTTL  Duration `yaml:"lease_ttl" toml:"lease_ttl" env:"LEASE_TTL" usage:"duration of the lease of a replica on the enrollment of a hostname, renewed while the enrollment is in progress: the other replicas can enroll the hostname once it expires, if the replica crashed"`
+	ReplicaID string   `yaml:"replica_id" toml:"replica_id" env:"REPLICA_ID" usage:"identity of the replica in the leases, its host name if empty"`
+}
+
+// Settings of the requests sent by the NEST service to the NEST CA and NEST config services
+type Downstream struct {
+	Protocol        string   `yaml:"protocol" toml:"protocol" env:"PROTOCOL" usage:"protocol used to contact the NEST CA and NEST config services: grpc, or rest (compatibility mode)"`
+	Timeout         Duration `yaml:"timeout" toml:"timeout" env:"TIMEOUT" usage:"deadline of every request"`
+	Retries         int      `yaml:"retries" toml:"retries" env:"RETRIES" usage:"maximum number of retries of the idempotent requests"`
+	BreakerFailures int      `yaml:"breaker_failures" toml:"breaker_failures" env:"BREAKER_FAILURES" usage:"consecutive failed requests after which a service is not contacted for the breaker cooldown, 0 disables it"`
+	BreakerCooldown Duration `yaml:"breaker_cooldown" toml:"breaker_cooldown" env:"BREAKER_COOLDOWN" usage:"how long a failing service is not contacted before trying again"`
+}
+
+// TLS settings of the NEST service
+type TLS struct {
+	Folder         string   `yaml:"folder" toml:"folder" env:"FOLDER" usage:"folder containing the TLS certificate (nest_service-crt.pem) and key (nest_service-key.pem)"`
+	MinVersion     string   `yaml:"min_version" toml:"min_version" env:"MIN_VERSION" usage:"minimum TLS version accepted (1.0, 1.1, 1.2, 1.3)"`
+	MaxVersion     string   `yaml:"max_version" toml:"max_version" env:"MAX_VERSION" usage:"maximum TLS version accepted (1.0, 1.1, 1.2, 1.3)"`
+	CipherSuites   []string `yaml:"cipher_suites" toml:"cipher_suites" env:"CIPHER_SUITES" usage:"TLS cipher suites (IANA names) accepted, TLS 1.3 suites are not configurable in Go"`
+	Curves         []string `yaml:"curves" toml:"curves" env:"CURVES" usage:"elliptic curves used in the key exchanges (X25519, P256, P384, P521), Go defaults if empty"`
+	ClientCAs      string   `yaml:"client_cas" toml:"client_cas" env:"CLIENT_CAS" usage:"optional file containing the PEM CA certificates used to verify the client certificates"`
+	ClientAuth     string   `yaml:"client_auth" toml:"client_auth" env:"CLIENT_AUTH" usage:"client authentication policy: none, request, require, verify_if_given, require_verify. verify_if_given if empty and client_cas is set"`
+	ReloadInterval Duration `yaml:"reload_interval" toml:"reload_interval" env:"RELOAD_INTERVAL" usage:"interval between two checks for TLS certificate and key changes on disk"`
+}
+
+// Enrollment lifecycle events webhooks settings
+type Webhooks struct {
+	URLs        []string `yaml:"urls" toml:"urls" env:"URLS" usage:"URLs to which the enrollment lifecycle events are delivered, webhooks are disabled if empty"`
+	Secret      string   `yaml:"secret" toml:"secret" env:"SECRET" usage:"file containing the key used to sign the deliveries"`
+	QueueFolder string   `yaml:"queue_folder" toml:"queue_folder" env:"QUEUE_FOLDER" usage:"folder in which the deliveries are queued until they succeed"`
+	MaxAttempts int      `yaml:"max_attempts" toml:"max_attempts" env:"MAX_ATTEMPTS" usage:"number of attempts after which a delivery is abandoned"`
+}
+
+// Sweeper of the abandoned enrollment applications and of the stale hosts
+type Sweeper struct {
+	Interval   Duration `yaml:"interval" toml:"interval" env:"INTERVAL" usage:"interval between two sweeps of the enrollment applications"`
+	PendingTTL Duration `yaml:"pending_ttl" toml:"pending_ttl" env:"PENDING_TTL" usage:"how long an enrollment application can stay pending before it expires and the hostname can apply again"`
+	StaleAfter Duration `yaml:"stale_after" toml:"stale_after" env:"STALE_AFTER" usage:"how long after the expiration of its certificate a host is flagged as stale for an administrator to review, never if 0"`
+}
+
+// Internal listener of the NEST service, exposing its metrics and detailed readiness report to the monitoring system only
+type Monitoring struct {
+	Address string `yaml:"address" toml:"address" env:"ADDRESS" usage:"ip:port on which /metrics and the detailed /readyz report are served, apart from the public REST API. Not served if empty"`
+}
+
+// Configuration of the NEST service
+type Service struct {
+	Common                   `yaml:",inline"`
+	HostnamesFile            string     `yaml:"hostnames_file" toml:"hostnames_file" env:"HOSTNAMES_FILE" usage:"file in which the valid hostnames of the Nebula network are stored"`
+	HostnamesRefreshInterval Duration   `yaml:"hostnames_refresh_interval" toml:"hostnames_refresh_interval" env:"HOSTNAMES_REFRESH_INTERVAL" usage:"interval between two refreshes of the valid hostnames from the NEST config service"`
+	NcsrFolder               string     `yaml:"ncsr_folder" toml:"ncsr_folder" env:"NCSR_FOLDER" usage:"folder in which the Nebula certificate signing request statuses are stored"`
+	CaCertFile               string     `yaml:"ca_cert_file" toml:"ca_cert_file" env:"CA_CERT_FILE" usage:"file in which the Nebula certificates of the NEST CA are stored"`
+	HMACKey                  string     `yaml:"hmac_key" toml:"hmac_key" env:"HMAC_KEY" usage:"file containing the key used to sign HMACs"`
+	CertsExpiryWarning       Duration   `yaml:"certs_expiry_warning" toml:"certs_expiry_warning" env:"CERTS_EXPIRY_WARNING" usage:"how long before their expiration the client certificates are reported as expiring soon"`
+	Ca                       Endpoint   `yaml:"ca" toml:"ca" env:"CA_"`
+	Conf                     Endpoint   `yaml:"conf" toml:"conf" env:"CONF_"`
+	Downstream               Downstream `yaml:"downstream" toml:"downstream" env:"DOWNSTREAM_"`
+	TLS                      TLS        `yaml:"tls" toml:"tls" env:"TLS_"`
+	Webhooks                 Webhooks   `yaml:"webhooks" toml:"webhooks" env:"WEBHOOK_"`
+	Store                    Store      `yaml:"store" toml:"store" env:"STORE_"`
+	Sweeper                  Sweeper    `yaml:"sweeper" toml:"sweeper" env:"SWEEPER_"`
+	Monitoring               Monitoring `yaml:"monitoring" toml:"monitoring" env:"MONITORING_"`
+}
+
+// Configuration of the NEST CA service
+type Ca struct {
+	Common           `yaml:",inline"`
+	GRPCPort         string   `yaml:"grpc_port" toml:"grpc_port" env:"GRPC_PORT" usage:"port on which the gRPC service listens"`
+	CertificatesPath string   `yaml:"certificates_path" toml:"certificates_path" env:"CERTIFICATES_PATH" usage:"folder in which the client certificates are stored"`
+	CaBin            string   `yaml:"ca_bin" toml:"ca_bin" env:"CA_BIN_PATH" usage:"the nebula-cert binary"`
+	CaKeysPath       string   `yaml:"ca_keys_path" toml:"ca_keys_path" env:"CA_KEYS_PATH" usage:"folder containing the Nebula CA certificate and private key used to sign the client certificates"`
+	CertsValidity    Duration `yaml:"certs_validity" toml:"certs_validity" env:"CERTS_VALIDITY" usage:"validity of the generated certificates, nebula-cert default if 0"`
+}
+
+// Configuration of the NEST config service
+type Conf struct {
+	Common             `yaml:",inline"`
+	GRPCPort           string    `yaml:"grpc_port" toml:"grpc_port" env:"GRPC_PORT" usage:"port on which the gRPC service listens"`
+	DhallDir           string    `yaml:"dhall_dir" toml:"dhall_dir" env:"DHALL_DIR" usage:"folder containing the dhall-nebula binary and the Dhall files"`
+	DhallConfiguration string    `yaml:"dhall_configuration" toml:"dhall_configuration" env:"DHALL_CONFIGURATION" usage:"file, in the Dhall folder, containing the Nebula network description"`
+	ConfGenDir         string    `yaml:"conf_gen_dir" toml:"conf_gen_dir" env:"CONF_GEN_DIR" usage:"folder, in the Dhall folder, in which the client Nebula configurations are generated"`
+	IPAM               IPAM      `yaml:"ipam" toml:"ipam" env:"IPAM_"`
+	Templates          Templates `yaml:"templates" toml:"templates" env:"TEMPLATES_"`
+	History            History   `yaml:"history" toml:"history" env:"HISTORY_"`
+	SigningKeyFile     string    `yaml:"signing_key_file" toml:"signing_key_file" env:"SIGNING_KEY_FILE" usage:"PEM ed25519 private key with which the Nebula configuration files are signed, generated at startup if it does not exist"`
+}
+
+// Host templates settings of the NEST config service. The templates are described in the nebula/templates.yml file of the Dhall folder
+type Templates struct {
+	InstancesFolder string `yaml:"instances_folder" toml:"instances_folder" env:"INSTANCES_FOLDER" usage:"folder in which the instances of the host templates are registered, which the NEST config instances can share on a shared volume"`
+}
+
+// Settings of the history of the Nebula configuration files generated by the NEST config service
+type History struct {
+	Folder string `yaml:"folder" toml:"folder" env:"FOLDER" usage:"folder in which every version of the generated Nebula configuration files is stored, which the NEST config instances can share on a shared volume"`
+}
+
+// IP address management settings of the NEST config service
+type IPAM struct {
+	Pools        []string `yaml:"pools,omitempty" toml:"pools,omitempty" env:"POOLS" usage:"CIDR pools from which the Nebula IP addresses of the hosts without a static address are allocated: <group>=<CIDR> for the hosts of a group, <CIDR> for the other hosts. IP address management is disabled if empty"`
+	Reserved     []string `yaml:"reserved,omitempty" toml:"reserved,omitempty" env:"RESERVED" usage:"addresses never allocated, besides the static addresses of the host files (e.g., the hosts defined in the network description itself)"`
+	LeasesFolder string   `yaml:"leases_folder" toml:"leases_folder" env:"LEASES_FOLDER" usage:"folder in which the address leases are stored, which the NEST config instances can share on a shared volume"`
+}
+
+// Configuration of the NEST client
+type Client struct {
+	ServiceIP              string   `yaml:"nest_service_ip" toml:"nest_service_ip" env:"NEST_SERVICE_IP" usage:"IP address or host name of the NEST service"`
+	ServicePort            string   `yaml:"nest_service_port" toml:"nest_service_port" env:"NEST_SERVICE_PORT" usage:"port of the NEST service"`
+	Network                string   `yaml:"nest_network" toml:"nest_network" env:"NEST_NETWORK" usage:"Nebula network joined by the client, in multi-tenant deployments of the NEST service. A single network if empty"`
+	NestCert               string   `yaml:"nest_cert" toml:"nest_cert" env:"NEST_CERT" usage:"TLS certificate of the NEST service, or of the CA that signed it"`
+	BinFolder              string   `yaml:"bin_folder" toml:"bin_folder" env:"BIN_FOLDER" usage:"folder containing the nebula binary and, for the client to generate its own key pair, the nebula-cert binary. The working directory if empty"`
+	NebulaAuth             string   `yaml:"nebula_auth" toml:"nebula_auth" env:"NEBULA_AUTH" usage:"file containing the authorization token (secret.hmac) of the client, in its configuration folder"`
+	Hostname               string   `yaml:"hostname" toml:"hostname" env:"HOSTNAME" usage:"Nebula hostname of the client, the host name of the machine if empty"`
+	Rekey                  bool     `yaml:"rekey" toml:"rekey" env:"REKEY" usage:"generate a new Nebula key pair at every re-enrollment"`
+	ConfigPollInterval     Duration `yaml:"config_poll_interval" toml:"config_poll_interval" env:"CONFIG_POLL_INTERVAL" usage:"interval between two checks for a new version of the Nebula configuration file, never if 0"`
+	ApprovalRetryInterval  Duration `yaml:"approval_retry_interval" toml:"approval_retry_interval" env:"APPROVAL_RETRY_INTERVAL" usage:"interval between two enrollment applications while the enrollment waits for the approval of an administrator"`
+	ConfigSigningKeys      string   `yaml:"config_signing_keys" toml:"config_signing_keys" env:"CONFIG_SIGNING_KEYS" usage:"PEM file of the public keys of the NEST config service with which the Nebula configuration files are verified. The keys sent by the NEST service with the Nebula CA certificates if empty"`
+	RequireConfigSignature bool     `yaml:"require_config_signature" toml:"require_config_signature" env:"REQUIRE_CONFIG_SIGNATURE" usage:"refuse the Nebula configuration files without a valid signature, even if no signing keys were received"`
+	Log                    Logging  `yaml:"log" toml:"log" env:"LOG_"`
+}
+
+// DefaultLogging returns the default logging settings, writing to the given log file
+func DefaultLogging(file string) Logging {
+	return Logging{
+		File:       file,
+		Level:      "info",
+		Format:     "json",
+		MaxSize:    100,
+		MaxBackups: 5,
+	}
+}
+
+// DefaultTracing returns the default tracing settings, with the spans not exported. The file exporter writes to the given file
+func DefaultTracing(file string) Tracing {
+	return Tracing{
+		Exporter:      "none",
+		File:          file,
+		Endpoint:      "localhost:4318",
+		SamplePercent: 100,
+	}
+}
+
+// DefaultTransport returns the default transport settings, over the NEST system Nebula network. In mtls mode, only the given peers can call the service
+func DefaultTransport(peers ...string) Transport {
+	return Transport{
+		Mode:   TRANSPORT_NEBULA,
+		Folder: "config/mtls/",
+		Peers:  peers,
+	}
+}
+
+// DefaultService returns the default configuration of the NEST service
+func DefaultService() Service {
+	return Service{
+		Common: Common{
+			ServiceIP:       "localhost",
+			ServicePort:     "8080",
+			NebulaFolder:    "config/nebula/",
+			Log:             DefaultLogging("log/nest_service.log"),
+			Tracing:         DefaultTracing("log/nest_service_traces.json"),
+			Transport:       DefaultTransport(),
+			ShutdownTimeout: Duration(30 * time.Second),
+			Networks:        Networks{Folder: "networks/"},
+		},
+		HostnamesFile:            "config/hostnames",
+		HostnamesRefreshInterval: Duration(5 * time.Minute),
+		NcsrFolder:               "ncsr/",
+		CaCertFile:               "config/ca.crt",
+		HMACKey:                  "config/hmac.key",
+		CertsExpiryWarning:       Duration(72 * time.Hour),
+		Ca:                       Endpoint{IP: "192.168.80.1", Port: "53535", GRPCPort: "53536"},
+		Conf:                     Endpoint{IP: "192.168.80.2", Port: "61616", GRPCPort: "61617"},
+		Downstream: Downstream{
+			Protocol:        "grpc",
+			Timeout:         Duration(10 * time.Second),
+			Retries:         3,
+			BreakerFailures: 5,
+			BreakerCooldown: Duration(30 * time.Second),
+		},
+		TLS: TLS{
+			Folder:         "config/tls/",
+			MinVersion:     "1.2",
+			MaxVersion:     "1.3",
+			CipherSuites:   []string{"TLS_AES_256_GCM_SHA384", "TLS_CHACHA20_POLY1305_SHA256", "TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256"},
+			ReloadInterval: Duration(time.Minute),
+		},
+		Webhooks: Webhooks{
+			Secret:      "config/webhook.key",
+			QueueFolder: "webhooks/",
+			MaxAttempts: 10,
+		},
+		Store: Store{
+			Backend:  STORE_FILE,
+			LeaseTTL: Duration(2 * time.Minute),
+		},
+		Sweeper: Sweeper{
+			Interval:   Duration(time.Hour),
+			PendingTTL: Duration(7 * 24 * time.Hour),
+			StaleAfter: Duration(30 * 24 * time.Hour),
+		},
+		Monitoring: Monitoring{Address: "127.0.0.1:8081"},
+	}
+}
+
+// DefaultCa returns the default configuration of the NEST CA service
+func DefaultCa() Ca {
+	return Ca{
+		Common: Common{
+			ServiceIP:       "192.168.80.1",
+			ServicePort:     "53535",
+			NebulaFolder:    "config/nebula/",
+			Log:             DefaultLogging("log/nest_ca.log"),
+			Tracing:         DefaultTracing("log/nest_ca_traces.json"),
+			Transport:       DefaultTransport("nest_service"),
+			ShutdownTimeout: Duration(30 * time.Second),
+			Networks:        Networks{Folder: "networks/"},
+		},
+		GRPCPort:         "53536",
+		CertificatesPath: "certificates/",
+		CaBin:            "config/bin/nebula-cert",
+		CaKeysPath:       "config/keys/",
+	}
+}
+
+// DefaultConf returns the default configuration of the NEST config service
+func DefaultConf() Conf {
+	return Conf{
+		Common: Common{
+			ServiceIP:       "192.168.80.2",
+			ServicePort:     "61616",
+			NebulaFolder:    "config/nebula/",
+			Log:             DefaultLogging("log/nest_config.log"),
+			Tracing:         DefaultTracing("log/nest_config_traces.json"),
+			Transport:       DefaultTransport("nest_service"),
+			ShutdownTimeout: Duration(30 * time.Second),
+			Networks:        Networks{Folder: "networks/"},
+		},
+		GRPCPort:           "61617",
+		DhallDir:           "dhall/",
+		DhallConfiguration: "nebula/nebula_conf.dhall",
+		ConfGenDir:         "nebula/generated/",
+		IPAM:               IPAM{LeasesFolder: "ipam/"},
+		Templates:          Templates{InstancesFolder: "instances/"},
+		History:            History{Folder: "history/"},
+		SigningKeyFile:     "config/keys/nest_config-signing.key",
+	}
+}
+
+// DefaultClient returns the default configuration of the NEST client, logging text records to the standard output only
+func DefaultClient() Client {
+	log := DefaultLogging("")
+	log.Format = "text"
+	return Client{
+		ServiceIP:             "localhost",
+		ServicePort:           "8080",
+		NestCert:              "config/tls/nest_service-crt.pem",
+		NebulaAuth:            "config/secret.hmac",
+		ConfigPollInterval:    Duration(5 * time.Minute),
+		ApprovalRetryInterval: Duration(time.Minute),
+		Log:                   log,
+	}
+}
+
+// checkPort returns an error if port is not a valid TCP port
+func checkPort(name string, port string) error {
+	if p, err := strconv.Atoi(port); err != nil || p <= 0 || p > 65535 {
+		return errors.New(name + " must be a port number between 1 and 65535, not \"" + port + "\"")
+	}
+	return nil
+}
+
+func (c *Common) validate() error {
+	if len(c.ServiceIP) == 0 {
+		return errors.New("service_ip is required")
+	}
+	if err := c.Log.Validate(); err != nil {
+		return err
+	}
+	if err := c.Tracing.validate(); err != nil {
+		return err
+	}
+	if err := c.Transport.validate(); err != nil {
+		return err
+	}
+	if c.ShutdownTimeout <= 0 {
+		return errors.New("shutdown_timeout must be positive")
+	}
+	if err := c.Networks.validate(); err != nil {
+		return err
+	}
+	return checkPort("service_port", c.ServicePort)
+}
+
+// Validate checks the logging settings
+func (l *Logging) Validate() error {
+	switch {
+	case l.Level != "debug" && l.Level != "info" && l.Level != "warn" && l.Level != "error":
+		return errors.New("log.level must be debug, info, warn or error, not \"" + l.Level + "\"")
+	case l.Format != "json" && l.Format != "text":
+		return errors.New("log.format must be json or text, not \"" + l.Format + "\"")
+	case l.MaxSize < 0:
+		return errors.New("log.max_size can't be negative")
+	case l.MaxBackups < 0:
+		return errors.New("log.max_backups can't be negative")
+	}
+	return nil
+}
+
+func (t *Tracing) validate() error {
+	switch {
+	case t.Exporter != "none" && t.Exporter != "stdout" && t.Exporter != "file" && t.Exporter != "otlp":
+		return errors.New("tracing.exporter must be none, stdout, file or otlp, not \"" + t.Exporter + "\"")
+	case t.Exporter == "file" && len(t.File) == 0:
+		return errors.New("tracing.file is required by the file exporter")
+	case t.Exporter == "otlp" && len(t.Endpoint) == 0:
+		return errors.New("tracing.endpoint is required by the otlp exporter")
+	case t.SamplePercent < 0 || t.SamplePercent > 100:
+		return errors.New("tracing.sample_percent must be between 0 and 100")
+	}
+	return nil
+}
+
+func (t *Transport) validate() error {
+	switch {
+	case t.Mode != TRANSPORT_NEBULA && t.Mode != TRANSPORT_MTLS:
+		return errors.New("transport.mode must be nebula or mtls, not \"" + t.Mode + "\"")
+	case t.Mode == TRANSPORT_MTLS && len(t.Folder) == 0:
+		return errors.New("transport.folder is required in mtls mode")
+	}
+	return nil
+}
+
+func (e *Endpoint) validate(name string) error {
+	if len(e.IP) == 0 {
+		return errors.New(name + ".ip is required")
+	}
+	for _, ip := range e.Failover {
+		if len(ip) == 0 {
+			return errors.New(name + ".failover can't contain empty addresses")
+		}
+	}
+	if err := checkPort(name+".port", e.Port); err != nil {
+		return err
+	}
+	return checkPort(name+".grpc_port", e.GRPCPort)
+}
+
+// Validate checks the NEST service configuration
+func (s *Service) Validate() error {
+	if err := s.Common.validate(); err != nil {
+		return err
+	}
+	if err := s.Ca.validate("ca"); err != nil {
+		return err
+	}
+	if err := s.Conf.validate("conf"); err != nil {
+		return err
+	}
+	switch {
+	case s.Downstream.Protocol != "grpc" && s.Downstream.Protocol != "rest":
+		return errors.New("downstream.protocol must be grpc or rest, not \"" + s.Downstream.Protocol + "\"")
+	case s.Downstream.Timeout <= 0:
+		return errors.New("downstream.timeout must be positive")
+	case s.Downstream.Retries < 0:
+		return errors.New("downstream.retries can't be negative")
+	case s.Downstream.BreakerFailures < 0:
+		return errors.New("downstream.breaker_failures can't be negative")
+	case s.Downstream.BreakerFailures > 0 && s.Downstream.BreakerCooldown <= 0:
+		return errors.New("downstream.breaker_cooldown must be positive")
+	case s.HostnamesRefreshInterval <= 0:
+		return errors.New("hostnames_refresh_interval must be positive")
+	case s.CertsExpiryWarning <= 0:
+		return errors.New("certs_expiry_warning must be positive")
+	case s.TLS.ReloadInterval <= 0:
+		return errors.New("tls.reload_interval must be positive")
+	case len(s.Webhooks.URLs) != 0 && s.Webhooks.MaxAttempts <= 0:
+		return errors.New("webhooks.max_attempts must be positive")
+	case s.Store.Backend != STORE_FILE && s.Store.Backend != STORE_MEMORY:
+		return errors.New("store.backend must be file or memory, not \"" + s.Store.Backend + "\"")
+	case s.Store.LeaseTTL <= 0:
+		return errors.New("store.lease_ttl must be positive")
+	case s.Sweeper.Interval <= 0:
+		return errors.New("sweeper.interval must be positive")
+	case s.Sweeper.PendingTTL <= 0:
+		return errors.New("sweeper.pending_ttl must be positive")
+	case s.Sweeper.StaleAfter < 0:
+		return errors.New("sweeper.stale_after can't be negative")
+	}
+	if len(s.Monitoring.Address) != 0 {
+		_, port, err := net.SplitHostPort(s.Monitoring.Address)
+		if err != nil {
+			return errors.New("monitoring.address must be ip:port, not \"" + s.Monitoring.Address + "\"")
+		}
+		return checkPort("monitoring.address", port)
+	}
+	return nil
+}
+
+// Validate checks the NEST CA service configuration
+func (c *Ca) Validate() error {
+	if err := c.Common.validate(); err != nil {
+		return err
+	}
+	if err := checkPort("grpc_port", c.GRPCPort); err != nil {
+		return err
+	}
+	if c.CertsValidity < 0 {
+		return errors.New("certs_validity can't be negative")
+	}
+	return nil
+}
+
+// Validate checks the NEST config service configuration
+func (c *Conf) Validate() error {
+	if err := c.Common.validate(); err != nil {
+		return err
+	}
+	if len(c.DhallDir) == 0 || len(c.DhallConfiguration) == 0 {
+		return errors.New("dhall_dir and dhall_configuration are required")
+	}
+	if err := c.IPAM.validate(); err != nil {
+		return err
+	}
+	if len(c.Templates.InstancesFolder) == 0 {
+		return errors.New("templates.instances_folder is required")
+	}
+	if len(c.History.Folder) == 0 {
+		return errors.New("history.folder is required")
+	}
+	if len(c.SigningKeyFile) == 0 {
+		return errors.New("signing_key_file is required")
+	}
+	return checkPort("grpc_port", c.GRPCPort)
+}
+
+// Validate checks the NEST client configuration
+func (c *Client) Validate() error {
+	switch {
+	case len(c.ServiceIP) == 0:
+		return errors.New("nest_service_ip is required")
+	case len(c.NestCert) == 0:
+		return errors.New("nest_cert is required")
+	case len(c.NebulaAuth) == 0:
+		return errors.New("nebula_auth is required")
+	case c.ConfigPollInterval < 0:
+		return errors.New("config_poll_interval can't be negative")
+	case c.ApprovalRetryInterval <= 0:
+		return errors.New("approval_retry_interval must be positive")
+	}
+	if err := c.Log.Validate(); err != nil {
+		return err
+	}
+	return checkPort("nest_service_port", c.ServicePort)
+}
+
+/*
+ParsePool parses an IP address management pool, written as <group>=<CIDR> for the hosts of a group or <CIDR> for the other hosts,
+and returns its group, empty for the other hosts, and its prefix. Nebula addresses are IPv4.
+*/
+func ParsePool(pool string) (string, netip.Prefix, error) {
+	group, cidr, found := strings.Cut(pool, "=")
+	if !found {
+		group, cidr = "", pool
+	}
+	prefix, err := netip.ParsePrefix(strings.TrimSpace(cidr))
+	if err != nil || !prefix.Addr().Is4() || prefix.Bits() > 30 {
+		return "", netip.Prefix{}, errors.New("ipam.pools can't contain \"" + pool + "\": a pool must be <group>=<CIDR> or <CIDR>, with an IPv4 CIDR of at most 30 bits")
+	}
+	return strings.TrimSpace(group), prefix.Masked(), nil
+}
+
+func (i *IPAM) validate() error {
+	groups := make(map[string]bool, len(i.Pools))
+	var prefixes []netip.Prefix
+	for _, pool := range i.Pools {
+		group, prefix, err := ParsePool(pool)
+		if err != nil {
+			return err
+		}
+		if groups[group] {
+			return errors.New("ipam.pools contains two pools for group \"" + group + "\"")
+		}
+		for _, p := range prefixes {
+			if p.Overlaps(prefix) {
+				return errors.New("ipam.pools contains the overlapping pools " + p.String() + " and " + prefix.String())
+			}
+		}
+		groups[group] = true
+		prefixes = append(prefixes, prefix)
+	}
+	for _, address := range i.Reserved {
+		if _, err := netip.ParseAddr(address); err != nil {
+			return errors.New("ipam.reserved can't contain \"" + address + "\": it is not an IP address")
+		}
+	}
+	if len(i.Pools) != 0 && len(i.LeasesFolder) == 0 {
+		return errors.New("ipam.leases_folder is required with ipam.pools")
+	}
+	return nil
+}
@@ -0,0 +1,281 @@
+/*
+NEST: Nebula Enrollment over Secure Transport - OpenAPI 3.0
+
+This package delivers the NEST service enrollment lifecycle events to the configured webhooks.
+API version: 0.3.1
+Contact: gianmarco.decola@studio.unibo.it
+*/
+package events
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	mrand "math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/m4rkdc/nebula_est/nest_service/pkg/models"
+)
+
+// HTTP headers added to every webhook delivery
+const (
+	EventHeader     = "X-Nest-Event"
+	DeliveryHeader  = "X-Nest-Delivery"
+	TimestampHeader = "X-Nest-Timestamp"
+	SignatureHeader = "X-Nest-Signature"
+)
+
+// A delivery of an event to a webhook, persisted in the queue folder until it succeeds or runs out of attempts
+type delivery struct {
+	Id          string       `json:"id"`
+	Url         string       `json:"url"`
+	Event       models.Event `json:"event"`
+	Attempts    int          `json:"attempts"`
+	NextAttempt time.Time    `json:"nextAttempt"`
+	LastError   string       `json:"lastError,omitempty"`
+}
+
+/*
+Dispatcher delivers events to a set of webhook URLs. Each delivery is first written to the queue folder, so that pending deliveries survive a restart,
+and then sent by the Run loop, which retries failed deliveries with an exponential backoff. Deliveries failing max_attempts times are moved to the
+dead/ subfolder of the queue, for an operator to inspect.
+*/
+type Dispatcher struct {
+	urls        []string
+	secret      []byte
+	queueFolder string
+	client      *http.Client
+	maxAttempts int
+	baseBackoff time.Duration
+	maxBackoff  time.Duration
+	pollPeriod  time.Duration
+
+	mu   sync.Mutex
+	wake chan struct{}
+}
+
+// NewDispatcher creates a Dispatcher for the given webhook URLs, signing the deliveries with secret and persisting them in queue_folder
+func NewDispatcher(urls []string, secret []byte, queue_folder string, max_attempts int) (*Dispatcher, error) {
+	if len(secret) == 0 {
+		return nil, errors.New("a webhook signing secret is required")
+	}
+	if max_attempts <= 0 {
+		return nil, errors.New("the maximum number of webhook delivery attempts has to be positive")
+	}
+	if err := os.MkdirAll(filepath.Join(queue_folder, "dead"), 0700); err != nil {
+		return nil, err
+	}
+	return &Dispatcher{
+		urls:        urls,
+		secret:      secret,
+		queueFolder: queue_folder,
+		client:      &http.Client{Timeout: 10 * time.Second},
+		maxAttempts: max_attempts,
+		baseBackoff: 5 * time.Second,
+		maxBackoff:  time.Hour,
+		pollPeriod:  5 * time.Second,
+		wake:        make(chan struct{}, 1),
+	}, nil
+}
+
+// newId returns a random identifier for events and deliveries
+func newId() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Sign returns the signature of a delivery body sent at the given unix timestamp: the hex encoded HMAC-SHA256 of "<timestamp>.<body>"
+func Sign(secret []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify checks the signature of a delivery received by a webhook. It can be used by receivers written in Go.
+func Verify(secret []byte, timestamp string, body []byte, signature string) bool {
+	return hmac.Equal([]byte(Sign(secret, timestamp, body)), []byte(signature))
+}
+
+// path returns the queue file of a delivery. Files are named after their next attempt, so that the queue can be scanned in order
+func (d *Dispatcher) path(dl *delivery) string {
+	return filepath.Join(d.queueFolder, strconv.FormatInt(dl.NextAttempt.UnixNano(), 10)+"-"+dl.Id+".json")
+}
+
+// store writes a delivery to the queue folder, atomically
+func (d *Dispatcher) store(dl *delivery, path string) error {
+	b, err := json.Marshal(dl)
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(d.queueFolder, "."+dl.Id+".tmp")
+	if err = os.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Emit queues the delivery of the given event to every configured webhook
+func (d *Dispatcher) Emit(e models.Event) error {
+	if len(e.Id) == 0 {
+		e.Id = newId()
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, url := range d.urls {
+		dl := &delivery{Id: newId(), Url: url, Event: e, NextAttempt: e.Time}
+		if err := d.store(dl, d.path(dl)); err != nil {
+			return err
+		}
+	}
+
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// backoff returns the delay before the next attempt of a delivery that already failed attempts times, with a +-20% jitter
+func (d *Dispatcher) backoff(attempts int) time.Duration {
+	delay := d.baseBackoff
+	for i := 1; i < attempts && delay < d.maxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > d.maxBackoff {
+		delay = d.maxBackoff
+	}
+	jitter := time.Duration(mrand.Int63n(int64(delay)/5*2+1)) - delay/5
+	return delay + jitter
+}
+
+// send performs a single delivery attempt
+func (d *Dispatcher) send(dl *delivery) error {
+	body, err := json.Marshal(dl.Event)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, dl.Url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(EventHeader, string(dl.Event.Type))
+	req.Header.Set(DeliveryHeader, dl.Id)
+	req.Header.Set(TimestampHeader, timestamp)
+	req.Header.Set(SignatureHeader, Sign(d.secret, timestamp, body))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook responded with status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+/*
+flush attempts every delivery which is due at the given time.
+It returns the time of the next scheduled attempt, or the zero time if the queue is empty.
+*/
+func (d *Dispatcher) flush(now time.Time) time.Time {
+	entries, err := os.ReadDir(d.queueFolder)
+	if err != nil {
+		slog.Error("Could not read the webhook queue", "error", err)
+		return time.Time{}
+	}
+
+	var names []string
+	for _, e := range entries {
+		if !e.IsDir() && strings.HasSuffix(e.Name(), ".json") {
+			names = append(names, e.Name())
+		}
+	}
+	sort.Strings(names)
+
+	var next time.Time
+	for _, name := range names {
+		path := filepath.Join(d.queueFolder, name)
+		b, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		var dl delivery
+		if err = json.Unmarshal(b, &dl); err != nil {
+			slog.Warn("Discarding corrupted webhook delivery", "delivery", name, "error", err)
+			os.Rename(path, filepath.Join(d.queueFolder, "dead", name))
+			continue
+		}
+		if dl.NextAttempt.After(now) {
+			if next.IsZero() || dl.NextAttempt.Before(next) {
+				next = dl.NextAttempt
+			}
+			break
+		}
+
+		err = d.send(&dl)
+		if err == nil {
+			os.Remove(path)
+			continue
+		}
+
+		dl.Attempts++
+		dl.LastError = err.Error()
+		if dl.Attempts >= d.maxAttempts {
+			slog.Error("Giving up the webhook delivery", "event", dl.Event.Type, "hostname", dl.Event.Hostname, "url", dl.Url, "attempts", dl.Attempts, "error", err)
+			d.store(&dl, filepath.Join(d.queueFolder, "dead", name))
+			os.Remove(path)
+			continue
+		}
+		dl.NextAttempt = now.Add(d.backoff(dl.Attempts))
+		if err = d.store(&dl, d.path(&dl)); err == nil {
+			os.Remove(path)
+		}
+		if next.IsZero() || dl.NextAttempt.Before(next) {
+			next = dl.NextAttempt
+		}
+	}
+	return next
+}
+
+// Run delivers the queued events until stop is closed. The due deliveries are then attempted one last time: those failing stay queued for the next run.
+func (d *Dispatcher) Run(stop <-chan struct{}) {
+	for {
+		wait := d.pollPeriod
+		if next := d.flush(time.Now()); !next.IsZero() && time.Until(next) < wait {
+			wait = time.Until(next)
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-stop:
+			timer.Stop()
+			d.flush(time.Now())
+			return
+		case <-d.wake:
+			timer.Stop()
+		case <-timer.C:
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package events
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-playground/assert/v2"
+	"github.com/m4rkdc/nebula_est/nest_service/pkg/models"
+)
+
+// queued returns the number of deliveries in the given folder
+func queued(t *testing.T, folder string) int {
+	entries, err := os.ReadDir(folder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var n int
+	for _, e := range entries {
+		if !e.IsDir() && filepath.Ext(e.Name()) == ".json" {
+			n++
+		}
+	}
+	return n
+}
+
+func TestSign(t *testing.T) {
+	signature := Sign([]byte("key"), "1700000000", []byte("{}"))
+	assert.Equal(t, true, Verify([]byte("key"), "1700000000", []byte("{}"), signature))
+	assert.Equal(t, false, Verify([]byte("other key"), "1700000000", []byte("{}"), signature))
+	assert.Equal(t, false, Verify([]byte("key"), "1700000001", []byte("{}"), signature))
+}
+
+func TestDispatcher(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		attempts int
+		received []models.Event
+		secret   = []byte("webhook secret")
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		attempts++
+		body, _ := io.ReadAll(r.Body)
+		if !Verify(secret, r.Header.Get(TimestampHeader), body, r.Header.Get(SignatureHeader)) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		//The first attempt fails to test the retries
+		if attempts == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var e models.Event
+		json.Unmarshal(body, &e)
+		received = append(received, e)
+	}))
+	defer server.Close()
+
+	//First test: invalid settings
+	_, err := NewDispatcher([]string{server.URL}, nil, t.TempDir(), 3)
+	assert.NotEqual(t, nil, err)
+	_, err = NewDispatcher([]string{server.URL}, secret, t.TempDir(), 0)
+	assert.NotEqual(t, nil, err)
+
+	//Second test: the failed delivery is kept in the queue and retried
+	folder := t.TempDir()
+	d, err := NewDispatcher([]string{server.URL}, secret, folder, 3)
+	assert.Equal(t, nil, err)
+	d.baseBackoff = time.Millisecond
+	d.maxBackoff = time.Millisecond
+
+	now := time.Now()
+	assert.Equal(t, nil, d.Emit(models.Event{Type: models.HOST_ENROLLED, Hostname: "client1", Time: now}))
+	assert.Equal(t, 1, queued(t, folder))
+	next := d.flush(now)
+	assert.Equal(t, 1, queued(t, folder))
+	assert.Equal(t, true, next.After(now))
+
+	d.flush(now.Add(time.Second))
+	assert.Equal(t, 0, queued(t, folder))
+	assert.Equal(t, 1, len(received))
+	assert.Equal(t, models.HOST_ENROLLED, received[0].Type)
+	assert.Equal(t, "client1", received[0].Hostname)
+	assert.NotEqual(t, "", received[0].Id)
+
+	//Third test: the delivery is abandoned after the maximum number of attempts
+	d.urls = []string{server.URL + "/unreachable\x7f"}
+	assert.Equal(t, nil, d.Emit(models.Event{Type: models.HOST_REKEYED, Hostname: "client2", Time: now}))
+	for i := 1; i <= 3; i++ {
+		d.flush(now.Add(time.Duration(i) * time.Second))
+	}
+	assert.Equal(t, 0, queued(t, folder))
+	assert.Equal(t, 1, queued(t, filepath.Join(folder, "dead")))
+}
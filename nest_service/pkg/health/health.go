@@ -0,0 +1,190 @@
+/*
+NEST: Nebula Enrollment over Secure Transport - OpenAPI 3.0
+
+This package contains the liveness and readiness endpoints of the NEST services, with their dependency checks.
+API version: 0.3.1
+Contact: gianmarco.decola@studio.unibo.it
+*/
+package health
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/m4rkdc/nebula_est/nest_service/pkg/models"
+	"github.com/m4rkdc/nebula_est/nest_service/pkg/utils"
+)
+
+// Maximum time given to all the readiness checks of a /readyz request
+var Check_timeout = 5 * time.Second
+
+// A named dependency check. Run returns nil if the dependency is available
+type Check struct {
+	Name string
+	Run  func(ctx context.Context) error
+}
+
+/*
+Run executes all the checks concurrently, giving them at most timeout to complete, and returns their results in the given order.
+A check still running when the timeout expires is reported as failed.
+*/
+func Run(checks []Check, timeout time.Duration) models.HealthReport {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	report := models.HealthReport{Status: models.HEALTH_PASS, Checks: make([]models.HealthCheck, len(checks))}
+	var wg sync.WaitGroup
+	for i, check := range checks {
+		wg.Add(1)
+		go func(i int, check Check) {
+			defer wg.Done()
+			start := time.Now()
+			done := make(chan error, 1)
+			go func() { done <- check.Run(ctx) }()
+
+			var err error
+			select {
+			case err = <-done:
+			case <-ctx.Done():
+				err = ctx.Err()
+			}
+			result := models.HealthCheck{Name: check.Name, Status: models.HEALTH_PASS, DurationMs: time.Since(start).Milliseconds()}
+			if err != nil {
+				result.Status = models.HEALTH_FAIL
+				result.Error = err.Error()
+			}
+			report.Checks[i] = result
+		}(i, check)
+	}
+	wg.Wait()
+
+	for _, c := range report.Checks {
+		if c.Status == models.HEALTH_FAIL {
+			report.Status = models.HEALTH_FAIL
+			break
+		}
+	}
+	return report
+}
+
+/*
+Setup exposes the liveness (/healthz) and readiness (/readyz) endpoints on the given router.
+/healthz only reports that the service process is serving requests, while /readyz runs the given dependency checks.
+Both respond 200 if the service is healthy (or ready) and 503 otherwise, with a models.HealthReport body.
+*/
+func Setup(router *gin.Engine, checks ...Check) {
+	setup(router, checks, func(report models.HealthReport) models.HealthReport { return report })
+}
+
+// SetupPublic is Setup for a router exposed to untrusted clients: the /readyz report only tells whether each check passed or failed
+func SetupPublic(router *gin.Engine, checks ...Check) {
+	setup(router, checks, Summary)
+}
+
+// Summary returns the given report without the errors and durations of its checks, which can reveal internal addresses and paths
+func Summary(report models.HealthReport) models.HealthReport {
+	summary := models.HealthReport{Status: report.Status, Checks: make([]models.HealthCheck, len(report.Checks))}
+	for i, check := range report.Checks {
+		summary.Checks[i] = models.HealthCheck{Name: check.Name, Status: check.Status}
+	}
+	return summary
+}
+
+func setup(router *gin.Engine, checks []Check, view func(models.HealthReport) models.HealthReport) {
+	router.GET("/healthz", func(c *gin.Context) {
+		c.JSON(http.StatusOK, models.HealthReport{Status: models.HEALTH_PASS, Checks: []models.HealthCheck{}})
+	})
+	router.GET("/readyz", func(c *gin.Context) {
+		report := view(Run(checks, Check_timeout))
+		if report.Status != models.HEALTH_PASS {
+			c.JSON(http.StatusServiceUnavailable, report)
+			return
+		}
+		c.JSON(http.StatusOK, report)
+	})
+}
+
+// Nebula checks that the Nebula overlay process of this service, run by the given supervisor, is running and that its interface is up
+func Nebula(supervisor *utils.NebulaSupervisor) Check {
+	return Check{Name: "nebula", Run: func(ctx context.Context) error {
+		if status := supervisor.Status(); status.State != utils.NEBULA_RUNNING {
+			if len(status.LastError) != 0 {
+				return fmt.Errorf("nebula is %s: %s", status.State, status.LastError)
+			}
+			return fmt.Errorf("nebula is %s", status.State)
+		}
+		found, err := utils.NebulaInterfaceUp()
+		if err != nil {
+			return err
+		}
+		if !found {
+			return errors.New("no Nebula interface is up")
+		}
+		return nil
+	}}
+}
+
+// File checks that the given file exists and can be read by this service
+func File(name string, path string) Check {
+	return Check{Name: name, Run: func(ctx context.Context) error {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		return f.Close()
+	}}
+}
+
+// InNetwork returns check named after the Nebula network it checks (e.g., corp/ca_key) in multi-tenant deployments, check itself otherwise
+func InNetwork(network string, check Check) Check {
+	if len(network) != 0 {
+		check.Name = network + "/" + check.Name
+	}
+	return check
+}
+
+/*
+Service checks that the NEST service name is reachable and alive at one of its instance addresses (ip:port), by requesting their /healthz endpoint in order.
+In mtls transport mode, tls_config is the TLS configuration with which the NEST services are called, nil otherwise.
+*/
+func Service(name string, addresses []string, tls_config *tls.Config) Check {
+	scheme, client := "http://", http.DefaultClient
+	if tls_config != nil {
+		tls_config = tls_config.Clone()
+		tls_config.ServerName = name
+		scheme, client = "https://", &http.Client{Transport: &http.Transport{TLSClientConfig: tls_config}}
+	}
+	alive := func(ctx context.Context, address string) error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, scheme+address+"/healthz", nil)
+		if err != nil {
+			return err
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("%s responded with status %d", address, resp.StatusCode)
+		}
+		return nil
+	}
+	return Check{Name: name, Run: func(ctx context.Context) error {
+		var errs []error
+		for _, address := range addresses {
+			err := alive(ctx, address)
+			if err == nil {
+				return nil
+			}
+			errs = append(errs, err)
+		}
+		return errors.Join(errs...)
+	}}
+}
@@ -0,0 +1,105 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/assert/v2"
+	"github.com/m4rkdc/nebula_est/nest_service/pkg/models"
+)
+
+func TestRun(t *testing.T) {
+	passing := Check{Name: "passing", Run: func(ctx context.Context) error { return nil }}
+	failing := Check{Name: "failing", Run: func(ctx context.Context) error { return errors.New("unavailable") }}
+	hanging := Check{Name: "hanging", Run: func(ctx context.Context) error {
+		time.Sleep(time.Second)
+		return nil
+	}}
+
+	//First test: all the checks pass
+	report := Run([]Check{passing}, time.Second)
+	assert.Equal(t, models.HEALTH_PASS, report.Status)
+	assert.Equal(t, 1, len(report.Checks))
+
+	//Second test: a failed check fails the report, keeping the checks order
+	report = Run([]Check{passing, failing}, time.Second)
+	assert.Equal(t, models.HEALTH_FAIL, report.Status)
+	assert.Equal(t, "passing", report.Checks[0].Name)
+	assert.Equal(t, models.HEALTH_FAIL, report.Checks[1].Status)
+	assert.Equal(t, "unavailable", report.Checks[1].Error)
+
+	//Third test: a check exceeding the timeout fails
+	report = Run([]Check{hanging}, 10*time.Millisecond)
+	assert.Equal(t, models.HEALTH_FAIL, report.Status)
+	assert.Equal(t, context.DeadlineExceeded.Error(), report.Checks[0].Error)
+}
+
+func TestChecks(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "ca.key")
+	os.WriteFile(file, []byte("key"), 0600)
+	assert.Equal(t, nil, File("ca_key", file).Run(context.Background()))
+	assert.NotEqual(t, nil, File("ca_key", file+".missing").Run(context.Background()))
+
+	router := gin.New()
+	Setup(router)
+	server := httptest.NewServer(router)
+	defer server.Close()
+	address := strings.TrimPrefix(server.URL, "http://")
+	assert.Equal(t, nil, Service("nest_ca", []string{address}, nil).Run(context.Background()))
+	server.Close()
+	assert.NotEqual(t, nil, Service("nest_ca", []string{address}, nil).Run(context.Background()))
+}
+
+func TestSetup(t *testing.T) {
+	ready := true
+	router := gin.New()
+	Setup(router, Check{Name: "dependency", Run: func(ctx context.Context) error {
+		if !ready {
+			return errors.New("not ready")
+		}
+		return nil
+	}})
+
+	//First test: the service is ready
+	req, _ := http.NewRequest(http.MethodGet, "/readyz", nil)
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+	assert.Equal(t, http.StatusOK, resp.Code)
+
+	//Second test: a failed dependency makes the service not ready, but still alive
+	ready = false
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+	assert.Equal(t, http.StatusServiceUnavailable, resp.Code)
+	var report models.HealthReport
+	assert.Equal(t, nil, json.Unmarshal(resp.Body.Bytes(), &report))
+	assert.Equal(t, "dependency", report.Checks[0].Name)
+	assert.Equal(t, "not ready", report.Checks[0].Error)
+
+	req, _ = http.NewRequest(http.MethodGet, "/healthz", nil)
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+	assert.Equal(t, http.StatusOK, resp.Code)
+
+	//Third test: the public report only tells which checks failed
+	public := gin.New()
+	SetupPublic(public, Check{Name: "dependency", Run: func(ctx context.Context) error { return errors.New("dial tcp 192.168.80.1:53535: connection refused") }})
+	req, _ = http.NewRequest(http.MethodGet, "/readyz", nil)
+	resp = httptest.NewRecorder()
+	public.ServeHTTP(resp, req)
+	assert.Equal(t, http.StatusServiceUnavailable, resp.Code)
+	assert.Equal(t, false, strings.Contains(resp.Body.String(), "192.168.80.1"))
+	report = models.HealthReport{}
+	assert.Equal(t, nil, json.Unmarshal(resp.Body.Bytes(), &report))
+	assert.Equal(t, models.HEALTH_FAIL, report.Checks[0].Status)
+	assert.Equal(t, "", report.Checks[0].Error)
+}
@@ -0,0 +1,308 @@
+/*
+NEST: Nebula Enrollment over Secure Transport - OpenAPI 3.0
+
+This package contains the IP address management of the NEST config service, which allocates the Nebula IP addresses of the hosts from CIDR pools and persists their leases.
+API version: 0.3.1
+Contact: gianmarco.decola@studio.unibo.it
+*/
+package ipam
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/netip"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/m4rkdc/nebula_est/nest_service/pkg/config"
+	"github.com/m4rkdc/nebula_est/nest_service/pkg/store"
+)
+
+var (
+	// ErrNoPool is returned when no pool serves the groups of a host, and there is no pool for the other hosts
+	ErrNoPool = errors.New("no address pool for the groups of the host")
+	// ErrExhausted is returned when every address of the pool of a host is in use
+	ErrExhausted = errors.New("no address left in the pool")
+)
+
+// The lease of a Nebula IP address to a host, stored under the address so that an address is never leased twice
+type Lease struct {
+	Hostname  string       `json:"hostname"`
+	IP        netip.Addr   `json:"ip"`
+	Pool      netip.Prefix `json:"pool"`
+	Allocated time.Time    `json:"allocated"`
+}
+
+// A CIDR pool, serving the hosts of a group or the other hosts if group is empty
+type pool struct {
+	group  string
+	prefix netip.Prefix
+}
+
+// Maximum duration of an allocation, after which the allocation lease of a NEST config instance that crashed meanwhile expires
+const allocation_ttl = 30 * time.Second
+
+/*
+IPAM allocates the Nebula IP addresses of the hosts from its pools, and keeps their leases in a Store that the NEST config instances can share.
+The static addresses of the hosts, written in the network description, and the reserved addresses are never allocated.
+*/
+type IPAM struct {
+	pools    []pool
+	reserved map[netip.Addr]bool
+	store    store.Store
+	//Serialize the allocations of the NEST config instances sharing the store, as mutex does within an instance
+	allocations *store.Leases
+	mutex       sync.Mutex
+	//Static addresses of the hosts, by hostname, as last given to SetStatic
+	static map[string]netip.Addr
+}
+
+// New creates the IP address management of the given valid settings, keeping the leases in s. The allocations are serialized by the leases in allocations, shared as s
+func New(cfg config.IPAM, s store.Store, allocations *store.Leases) *IPAM {
+	i := &IPAM{reserved: make(map[netip.Addr]bool, len(cfg.Reserved)), store: s, allocations: allocations}
+	for _, p := range cfg.Pools {
+		if group, prefix, err := config.ParsePool(p); err == nil {
+			i.pools = append(i.pools, pool{group: group, prefix: prefix})
+		}
+	}
+	for _, r := range cfg.Reserved {
+		if address, err := netip.ParseAddr(r); err == nil {
+			i.reserved[address] = true
+		}
+	}
+	return i
+}
+
+// SetStatic records the static addresses of the hosts, by hostname, which are never allocated
+func (i *IPAM) SetStatic(static map[string]netip.Addr) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	i.static = static
+}
+
+// Leases returns the leases, sorted by address
+func (i *IPAM) Leases(ctx context.Context) ([]Lease, error) {
+	keys, err := i.store.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var leases []Lease
+	for _, key := range keys {
+		b, _, err := i.store.Get(ctx, key)
+		if errors.Is(err, store.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		var lease Lease
+		if err = json.Unmarshal(b, &lease); err != nil {
+			return nil, fmt.Errorf("invalid lease %s: %v", key, err)
+		}
+		leases = append(leases, lease)
+	}
+	sort.Slice(leases, func(a, b int) bool { return leases[a].IP.Less(leases[b].IP) })
+	return leases, nil
+}
+
+// poolFor returns the pool of a host in the given groups: the first pool of one of its groups, or else the pool of the other hosts
+func (i *IPAM) poolFor(groups []string) (pool, error) {
+	for _, p := range i.pools {
+		for _, g := range groups {
+			if len(p.group) != 0 && p.group == g {
+				return p, nil
+			}
+		}
+	}
+	for _, p := range i.pools {
+		if len(p.group) == 0 {
+			return p, nil
+		}
+	}
+	return pool{}, ErrNoPool
+}
+
+// lease acquires the allocation lease, waiting for the other NEST config instances holding it. The returned function releases it
+func (i *IPAM) lease(ctx context.Context) (func(), error) {
+	for {
+		lease, err := i.allocations.Acquire(ctx, "allocation", allocation_ttl)
+		if err == nil {
+			return func() { i.allocations.Release(context.WithoutCancel(ctx), lease) }, nil
+		}
+		if !errors.Is(err, store.ErrLeased) {
+			return nil, err
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+}
+
+/*
+Allocate returns the lease of hostname, allocating it the first free address of the pool of its groups if it has none.
+The network and broadcast addresses of the pools are never allocated. The allocations of the NEST config instances sharing the store are serialized
+by the allocation lease, so that a host never gets two addresses. An address leased meanwhile all the same, e.g. after the allocation lease expired, is skipped.
+*/
+func (i *IPAM) Allocate(ctx context.Context, hostname string, groups []string) (Lease, error) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	release, err := i.lease(ctx)
+	if err != nil {
+		return Lease{}, err
+	}
+	defer release()
+
+	leases, err := i.Leases(ctx)
+	if err != nil {
+		return Lease{}, err
+	}
+	used := make(map[netip.Addr]bool, len(leases)+len(i.static))
+	for _, lease := range leases {
+		if lease.Hostname == hostname {
+			return lease, nil
+		}
+		used[lease.IP] = true
+	}
+	for _, address := range i.static {
+		used[address] = true
+	}
+	p, err := i.poolFor(groups)
+	if err != nil {
+		return Lease{}, err
+	}
+
+	last := lastAddr(p.prefix)
+	for address := p.prefix.Addr().Next(); address.IsValid() && address.Less(last); address = address.Next() {
+		if used[address] || i.reserved[address] {
+			continue
+		}
+		lease := Lease{Hostname: hostname, IP: address, Pool: p.prefix, Allocated: time.Now().UTC()}
+		b, err := json.Marshal(lease)
+		if err != nil {
+			return Lease{}, err
+		}
+		if _, err = i.store.Put(ctx, address.String(), b, ""); errors.Is(err, store.ErrConflict) {
+			continue
+		} else if err != nil {
+			return Lease{}, err
+		}
+		return lease, nil
+	}
+	return Lease{}, fmt.Errorf("%w %s", ErrExhausted, p.prefix)
+}
+
+// lastAddr returns the last address of prefix, its broadcast address
+func lastAddr(prefix netip.Prefix) netip.Addr {
+	b := prefix.Addr().As4()
+	for n := prefix.Bits(); n < 32; n++ {
+		b[n/8] |= 1 << (7 - n%8)
+	}
+	return netip.AddrFrom4(b)
+}
+
+/*
+Sync releases the leases of the hosts that are not in hostnames, which have been decommissioned, and returns the released leases.
+The addresses released can be allocated again to other hosts.
+*/
+func (i *IPAM) Sync(ctx context.Context, hostnames []string) ([]Lease, error) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	release, err := i.lease(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	hosts := make(map[string]bool, len(hostnames))
+	for _, h := range hostnames {
+		hosts[h] = true
+	}
+	leases, err := i.Leases(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var released []Lease
+	for _, lease := range leases {
+		if hosts[lease.Hostname] {
+			continue
+		}
+		_, version, err := i.store.Get(ctx, lease.IP.String())
+		if errors.Is(err, store.ErrNotFound) {
+			continue
+		}
+		if err == nil {
+			err = i.store.Delete(ctx, lease.IP.String(), version)
+		}
+		if err != nil && !errors.Is(err, store.ErrConflict) {
+			return released, err
+		}
+		if err == nil {
+			released = append(released, lease)
+		}
+	}
+	return released, nil
+}
+
+/*
+Conflicts returns the address conflicts found between the static addresses, the reserved addresses and the leases: the hosts sharing a static address,
+the leases of static or reserved addresses or of addresses out of the pools, and the hosts holding several leases.
+*/
+func (i *IPAM) Conflicts(ctx context.Context) ([]string, error) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	leases, err := i.Leases(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var conflicts []string
+	owners := make(map[netip.Addr]string, len(i.static))
+	hostnames := make([]string, 0, len(i.static))
+	for h := range i.static {
+		hostnames = append(hostnames, h)
+	}
+	sort.Strings(hostnames)
+	for _, h := range hostnames {
+		address := i.static[h]
+		if owner, found := owners[address]; found {
+			conflicts = append(conflicts, fmt.Sprintf("%s and %s have the same static address %s", owner, h, address))
+			continue
+		}
+		owners[address] = h
+	}
+
+	leased := make(map[string]netip.Addr, len(leases))
+	for _, lease := range leases {
+		switch owner, found := owners[lease.IP]; {
+		case found:
+			conflicts = append(conflicts, fmt.Sprintf("%s is leased to %s but is the static address of %s", lease.IP, lease.Hostname, owner))
+		case i.reserved[lease.IP]:
+			conflicts = append(conflicts, fmt.Sprintf("%s is leased to %s but is reserved", lease.IP, lease.Hostname))
+		case !i.inPools(lease.IP):
+			conflicts = append(conflicts, fmt.Sprintf("%s is leased to %s but is out of the pools", lease.IP, lease.Hostname))
+		}
+		if address, found := leased[lease.Hostname]; found {
+			conflicts = append(conflicts, fmt.Sprintf("%s holds the leases of %s and %s", lease.Hostname, address, lease.IP))
+		}
+		if address, found := i.static[lease.Hostname]; found {
+			conflicts = append(conflicts, fmt.Sprintf("%s has the static address %s and the lease of %s", lease.Hostname, address, lease.IP))
+		}
+		leased[lease.Hostname] = lease.IP
+	}
+	return conflicts, nil
+}
+
+// inPools returns true if address belongs to a pool
+func (i *IPAM) inPools(address netip.Addr) bool {
+	for _, p := range i.pools {
+		if p.prefix.Contains(address) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,104 @@
+package ipam
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"testing"
+
+	"github.com/go-playground/assert/v2"
+	"github.com/m4rkdc/nebula_est/nest_service/pkg/config"
+	"github.com/m4rkdc/nebula_est/nest_service/pkg/store"
+)
+
+func TestAllocate(t *testing.T) {
+	ctx := context.Background()
+	s := store.NewMemory()
+	allocations := store.NewLeases(store.NewMemory(), "nest_config")
+	i := New(config.IPAM{Pools: []string{"192.168.100.0/29", "home=192.168.101.0/30"}, Reserved: []string{"192.168.100.2"}}, s, allocations)
+	i.SetStatic(map[string]netip.Addr{"lighthouse": netip.MustParseAddr("192.168.100.1")})
+
+	//First test: the static, reserved and network addresses are skipped, and a host keeps its lease
+	lease, err := i.Allocate(ctx, "client1", []string{"all"})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, netip.MustParseAddr("192.168.100.3"), lease.IP)
+	assert.Equal(t, netip.MustParsePrefix("192.168.100.0/29"), lease.Pool)
+	again, err := i.Allocate(ctx, "client1", nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, lease.IP, again.IP)
+
+	//Second test: the hosts of a group with a pool get their addresses from it, until it is exhausted
+	lease, err = i.Allocate(ctx, "laptop1", []string{"all", "home"})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, netip.MustParseAddr("192.168.101.1"), lease.IP)
+	_, err = i.Allocate(ctx, "laptop2", []string{"home"})
+	assert.Equal(t, nil, err)
+	_, err = i.Allocate(ctx, "laptop3", []string{"home"})
+	assert.Equal(t, true, errors.Is(err, ErrExhausted))
+
+	//Third test: the leases of the decommissioned hosts are released, and their addresses allocated again
+	released, err := i.Sync(ctx, []string{"lighthouse", "client1", "laptop2"})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 1, len(released))
+	assert.Equal(t, "laptop1", released[0].Hostname)
+	lease, err = i.Allocate(ctx, "laptop3", []string{"home"})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, netip.MustParseAddr("192.168.101.1"), lease.IP)
+
+	//Fourth test: a host without a pool for its groups is refused when there is no pool for the other hosts
+	_, err = New(config.IPAM{Pools: []string{"home=192.168.101.0/30"}}, s, allocations).Allocate(ctx, "client2", []string{"all"})
+	assert.Equal(t, ErrNoPool, err)
+
+	//Fifth test: the NEST config instances sharing the leases folder allocate a single address to a host applying to all of them at once
+	dir := t.TempDir() + "/"
+	var instances []*IPAM
+	for n := 0; n < 4; n++ {
+		instances = append(instances, New(config.IPAM{Pools: []string{"192.168.100.0/24"}}, store.NewFile(dir), store.NewLeases(store.NewFile(dir+".allocations/"), "nest_config")))
+	}
+	leases := make(chan Lease, len(instances))
+	for _, instance := range instances {
+		go func(instance *IPAM) {
+			lease, _ := instance.Allocate(ctx, "client3", nil)
+			leases <- lease
+		}(instance)
+	}
+	first := <-leases
+	for n := 1; n < len(instances); n++ {
+		assert.Equal(t, first.IP, (<-leases).IP)
+	}
+	all, err := instances[0].Leases(ctx)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 1, len(all))
+}
+
+func TestConflicts(t *testing.T) {
+	ctx := context.Background()
+	s := store.NewMemory()
+	allocations := store.NewLeases(store.NewMemory(), "nest_config")
+	i := New(config.IPAM{Pools: []string{"192.168.100.0/24"}}, s, allocations)
+	_, err := i.Allocate(ctx, "client1", nil)
+	assert.Equal(t, nil, err)
+
+	//First test: no conflicts
+	conflicts, err := i.Conflicts(ctx)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 0, len(conflicts))
+
+	//Second test: a static address given to two hosts, and to a leased host, is reported
+	i.SetStatic(map[string]netip.Addr{
+		"lighthouse1": netip.MustParseAddr("192.168.100.1"),
+		"lighthouse2": netip.MustParseAddr("192.168.100.1"),
+	})
+	conflicts, err = i.Conflicts(ctx)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []string{
+		"lighthouse1 and lighthouse2 have the same static address 192.168.100.1",
+		"192.168.100.1 is leased to client1 but is the static address of lighthouse1",
+	}, conflicts)
+
+	//Third test: a lease out of the pools, after they changed, is reported
+	i = New(config.IPAM{Pools: []string{"192.168.200.0/24"}}, s, allocations)
+	conflicts, err = i.Conflicts(ctx)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []string{"192.168.100.1 is leased to client1 but is out of the pools"}, conflicts)
+}
@@ -0,0 +1,159 @@
+/*
+NEST: Nebula Enrollment over Secure Transport - OpenAPI 3.0
+
+This package contains the structured logging of the NEST services and client: the log/slog setup, the redaction of sensitive fields,
+the rotation of the log files and the request IDs propagated from the NEST service to the NEST CA and NEST config services.
+API version: 0.3.1
+Contact: gianmarco.decola@studio.unibo.it
+*/
+package logging
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+
+	"github.com/m4rkdc/nebula_est/nest_service/pkg/config"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Value logged in place of the sensitive fields
+const Redacted = "[REDACTED]"
+
+// Substrings of the attribute keys whose values are never logged: secrets, private keys, TOTP tokens, HMAC keys and credentials
+var sensitive_keys = []string{"secret", "private_key", "privatekey", "token", "password", "hmac", "authorization"}
+
+// Redact replaces the value of a sensitive attribute with Redacted. It is used as the slog.HandlerOptions.ReplaceAttr of the NEST loggers
+func Redact(groups []string, a slog.Attr) slog.Attr {
+	if a.Value.Kind() == slog.KindGroup {
+		return a
+	}
+	key := strings.ToLower(a.Key)
+	if key == "key" {
+		return slog.String(a.Key, Redacted)
+	}
+	for _, s := range sensitive_keys {
+		if strings.Contains(key, s) {
+			return slog.String(a.Key, Redacted)
+		}
+	}
+	return a
+}
+
+type nopCloser struct{}
+
+func (nopCloser) Close() error { return nil }
+
+type request_id_key struct{}
+
+// WithRequestID returns a copy of ctx carrying the given request ID
+func WithRequestID(ctx context.Context, request_id string) context.Context {
+	return context.WithValue(ctx, request_id_key{}, request_id)
+}
+
+// RequestID returns the request ID carried by ctx, or an empty string
+func RequestID(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	request_id, _ := ctx.Value(request_id_key{}).(string)
+	return request_id
+}
+
+// NewRequestID returns a random request ID
+func NewRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// contextHandler adds the request ID and the trace ID carried by the context to the records logged with the *Context functions of slog
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	if request_id := RequestID(ctx); len(request_id) != 0 {
+		r.AddAttrs(slog.String("request_id", request_id))
+	}
+	if span_context := trace.SpanContextFromContext(ctx); span_context.IsValid() {
+		r.AddAttrs(slog.String("trace_id", span_context.TraceID().String()))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
+
+// Minimum level of the records logged by the default logger, changed by SetLevel
+var default_level = new(slog.LevelVar)
+
+// parseLevel returns the slog.Level with the given name (debug, info, warn, error), slog.LevelInfo if unknown
+func parseLevel(name string) slog.Level {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(name)); err != nil {
+		return slog.LevelInfo
+	}
+	return l
+}
+
+// SetLevel changes the minimum level of the records logged by the default logger, e.g., when the configuration is reloaded
+func SetLevel(name string) {
+	default_level.Set(parseLevel(name))
+}
+
+// NewHandler returns a slog.Handler writing to w the records of at least the given level, in the given format (json or text), with the sensitive fields redacted
+func NewHandler(w io.Writer, level string, format string) slog.Handler {
+	return newHandler(w, parseLevel(level), format)
+}
+
+func newHandler(w io.Writer, level slog.Leveler, format string) slog.Handler {
+	opts := &slog.HandlerOptions{Level: level, ReplaceAttr: Redact}
+	if format == "text" {
+		return contextHandler{slog.NewTextHandler(w, opts)}
+	}
+	return contextHandler{slog.NewJSONHandler(w, opts)}
+}
+
+/*
+New creates the logger of the given NEST service or client from its logging settings. The records are written to the standard output and,
+if a log file is configured, to the log file, which is rotated when it reaches its maximum size instead of being truncated at every start.
+The returned io.Closer closes the log file.
+*/
+func New(cfg config.Logging, service string) (*slog.Logger, io.Closer, error) {
+	return newLogger(cfg, service, parseLevel(cfg.Level))
+}
+
+func newLogger(cfg config.Logging, service string, level slog.Leveler) (*slog.Logger, io.Closer, error) {
+	var w io.Writer = os.Stdout
+	var closer io.Closer = nopCloser{}
+	if len(cfg.File) != 0 {
+		file, err := OpenRotatingFile(cfg.File, int64(cfg.MaxSize)*1024*1024, cfg.MaxBackups)
+		if err != nil {
+			return nil, nil, err
+		}
+		w = io.MultiWriter(os.Stdout, file)
+		closer = file
+	}
+	return slog.New(newHandler(w, level, cfg.Format)).With("service", service), closer, nil
+}
+
+// Setup creates the logger of the given NEST service or client like New and makes it the default slog logger. Its level can then be changed with SetLevel
+func Setup(cfg config.Logging, service string) (io.Closer, error) {
+	SetLevel(cfg.Level)
+	logger, closer, err := newLogger(cfg, service, default_level)
+	if err != nil {
+		return nil, err
+	}
+	slog.SetDefault(logger)
+	return closer, nil
+}
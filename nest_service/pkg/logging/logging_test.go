@@ -0,0 +1,127 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/assert/v2"
+	"github.com/m4rkdc/nebula_est/nest_service/pkg/models"
+)
+
+func TestRedact(t *testing.T) {
+	var b bytes.Buffer
+	logger := slog.New(NewHandler(&b, "info", "json"))
+
+	//First test: the sensitive fields are redacted, the others are logged
+	logger.Info("enrollment", "hostname", "host1", "secret", "s3cr3t", "NebulaPrivateKey", "k3y", "NESToken", "123456", "key", "k3y")
+	var record map[string]interface{}
+	assert.Equal(t, nil, json.Unmarshal(b.Bytes(), &record))
+	assert.Equal(t, "host1", record["hostname"])
+	assert.Equal(t, Redacted, record["secret"])
+	assert.Equal(t, Redacted, record["NebulaPrivateKey"])
+	assert.Equal(t, Redacted, record["NESToken"])
+	assert.Equal(t, Redacted, record["key"])
+
+	//Second test: the request ID carried by the context is logged
+	b.Reset()
+	logger.InfoContext(WithRequestID(context.Background(), "abc"), "request")
+	assert.Equal(t, true, strings.Contains(b.String(), `"request_id":"abc"`))
+
+	//Third test: the records below the configured level are discarded
+	b.Reset()
+	logger.Debug("debug record")
+	assert.Equal(t, 0, b.Len())
+}
+
+func TestSetLevel(t *testing.T) {
+	defer SetLevel("info")
+	var b bytes.Buffer
+	logger := slog.New(newHandler(&b, default_level, "json"))
+
+	//First test: the records below the level set are discarded
+	SetLevel("warn")
+	logger.Info("info record")
+	assert.Equal(t, 0, b.Len())
+
+	//Second test: a new level applies to the loggers already created
+	SetLevel("debug")
+	logger.Debug("debug record")
+	assert.Equal(t, true, strings.Contains(b.String(), "debug record"))
+}
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "nest_service.log")
+	os.WriteFile(path, []byte("previous\n"), 0644)
+
+	//First test: the log file is appended to, not truncated
+	f, err := OpenRotatingFile(path, 20, 2)
+	assert.Equal(t, nil, err)
+	f.Write([]byte("first\n"))
+	b, _ := os.ReadFile(path)
+	assert.Equal(t, "previous\nfirst\n", string(b))
+
+	//Second test: the log file is rotated when it would exceed the maximum size
+	f.Write([]byte("second line\n"))
+	b, _ = os.ReadFile(path)
+	assert.Equal(t, "second line\n", string(b))
+	b, _ = os.ReadFile(path + ".1")
+	assert.Equal(t, "previous\nfirst\n", string(b))
+
+	//Third test: at most max_backups rotated files are kept
+	f.Write([]byte("third line!\n"))
+	f.Write([]byte("fourth line\n"))
+	f.Close()
+	b, _ = os.ReadFile(path + ".2")
+	assert.Equal(t, "second line\n", string(b))
+	_, err = os.Stat(path + ".3")
+	assert.Equal(t, true, os.IsNotExist(err))
+}
+
+func TestMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(Middleware())
+	var request_id string
+	router.GET("/ok", func(c *gin.Context) {
+		request_id = RequestID(c.Request.Context())
+		c.JSON(http.StatusOK, "ok")
+	})
+	router.GET("/error", func(c *gin.Context) {
+		c.JSON(http.StatusNotFound, models.ApiError{Code: 404, Message: "Not found"})
+	})
+
+	//First test: a request ID is generated, put in the request context and returned in the response header
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/ok", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NotEqual(t, "", request_id)
+	assert.Equal(t, request_id, w.Header().Get(RequestIDHeader))
+
+	//Second test: a valid request ID provided by the client is kept, an invalid one is replaced
+	req := httptest.NewRequest(http.MethodGet, "/ok", nil)
+	req.Header.Set(RequestIDHeader, "client-id.1")
+	router.ServeHTTP(httptest.NewRecorder(), req)
+	assert.Equal(t, "client-id.1", request_id)
+	req.Header.Set(RequestIDHeader, "invalid id\n")
+	router.ServeHTTP(httptest.NewRecorder(), req)
+	assert.NotEqual(t, "invalid id\n", request_id)
+
+	//Third test: the request ID is echoed in the ApiError responses
+	w = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodGet, "/error", nil)
+	req.Header.Set(RequestIDHeader, "abc")
+	router.ServeHTTP(w, req)
+	var api_error models.ApiError
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.Equal(t, nil, json.Unmarshal(w.Body.Bytes(), &api_error))
+	assert.Equal(t, models.ApiError{Code: 404, Message: "Not found", RequestId: "abc"}, api_error)
+}
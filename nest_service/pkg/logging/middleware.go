@@ -0,0 +1,163 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/m4rkdc/nebula_est/nest_service/pkg/models"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// HTTP header carrying the request ID, in the requests to the NEST services and in their responses
+const RequestIDHeader = "X-Request-Id"
+
+// gRPC metadata key carrying the request ID
+const request_id_metadata = "x-request-id"
+
+// Request IDs received from a client are only accepted if they match this expression, otherwise a new one is generated
+var request_id_regexp = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// requestID returns the given request ID if it is valid, a new one otherwise
+func requestID(request_id string) string {
+	if request_id_regexp.MatchString(request_id) {
+		return request_id
+	}
+	return NewRequestID()
+}
+
+// level returns the level at which a request answered with the given HTTP status is logged
+func level(status int) slog.Level {
+	switch {
+	case status >= 500:
+		return slog.LevelError
+	case status >= 400:
+		return slog.LevelWarn
+	}
+	return slog.LevelInfo
+}
+
+/*
+apiErrorWriter holds back the JSON bodies of the error responses, so that the request ID can be added to the models.ApiError they contain
+before they are sent to the client.
+*/
+type apiErrorWriter struct {
+	gin.ResponseWriter
+	request_id string
+	body       bytes.Buffer
+}
+
+func (w *apiErrorWriter) holding() bool {
+	return w.Status() >= 400 && strings.HasPrefix(w.Header().Get("Content-Type"), "application/json")
+}
+
+func (w *apiErrorWriter) Write(b []byte) (int, error) {
+	if w.holding() {
+		return w.body.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *apiErrorWriter) WriteString(s string) (int, error) {
+	if w.holding() {
+		return w.body.WriteString(s)
+	}
+	return w.ResponseWriter.WriteString(s)
+}
+
+// flush sends the held back body, with the request ID added if it is a models.ApiError
+func (w *apiErrorWriter) flush() {
+	if w.body.Len() == 0 {
+		return
+	}
+	b := w.body.Bytes()
+	var fields map[string]json.RawMessage
+	var api_error models.ApiError
+	if json.Unmarshal(b, &fields) == nil && fields["code"] != nil && fields["message"] != nil && json.Unmarshal(b, &api_error) == nil && len(api_error.RequestId) == 0 {
+		api_error.RequestId = w.request_id
+		if with_id, err := json.Marshal(api_error); err == nil {
+			b = with_id
+		}
+	}
+	w.ResponseWriter.Write(b)
+}
+
+/*
+Middleware assigns a request ID to every request, unless the client provides a valid one in the X-Request-Id header.
+The request ID is carried by the request context, so that it is logged with the records of the request and forwarded to the NEST CA and NEST config services,
+and it is returned in the X-Request-Id header and in the models.ApiError responses. Every request is then logged, replacing the gin access log.
+*/
+func Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		request_id := requestID(c.GetHeader(RequestIDHeader))
+		ctx := WithRequestID(c.Request.Context(), request_id)
+		c.Request = c.Request.WithContext(ctx)
+		c.Header(RequestIDHeader, request_id)
+
+		w := &apiErrorWriter{ResponseWriter: c.Writer, request_id: request_id}
+		c.Writer = w
+		c.Next()
+		w.flush()
+		c.Writer = w.ResponseWriter
+
+		status_code := c.Writer.Status()
+		slog.Log(ctx, level(status_code), "request",
+			"method", c.Request.Method,
+			"path", c.Request.URL.Path,
+			"status", status_code,
+			"duration", time.Since(start),
+			"client_ip", c.ClientIP(),
+		)
+	}
+}
+
+// UnaryClientInterceptor forwards the request ID carried by the context of a gRPC call in its metadata
+func UnaryClientInterceptor(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	if request_id := RequestID(ctx); len(request_id) != 0 {
+		ctx = metadata.AppendToOutgoingContext(ctx, request_id_metadata, request_id)
+	}
+	return invoker(ctx, method, req, reply, cc, opts...)
+}
+
+/*
+UnaryServerInterceptor puts in the context of a gRPC call the request ID received in its metadata, or a new one, and returns it in the response header.
+Every call is then logged.
+*/
+func UnaryServerInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	start := time.Now()
+	var request_id string
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := md.Get(request_id_metadata); len(values) != 0 {
+			request_id = values[0]
+		}
+	}
+	request_id = requestID(request_id)
+	ctx = WithRequestID(ctx, request_id)
+	grpc.SetHeader(ctx, metadata.Pairs(request_id_metadata, request_id))
+
+	resp, err := handler(ctx, req)
+	code := status.Code(err)
+	record_level := slog.LevelInfo
+	switch code {
+	case codes.OK:
+	case codes.Internal, codes.Unknown, codes.DataLoss:
+		record_level = slog.LevelError
+	default:
+		record_level = slog.LevelWarn
+	}
+	slog.Log(ctx, record_level, "grpc request",
+		"method", info.FullMethod,
+		"code", code.String(),
+		"duration", time.Since(start),
+	)
+	return resp, err
+}
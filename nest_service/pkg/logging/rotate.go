@@ -0,0 +1,90 @@
+package logging
+
+import (
+	"os"
+	"strconv"
+	"sync"
+)
+
+/*
+RotatingFile is a log file that is appended to and rotated when it would grow beyond max_size bytes: the file is renamed to <path>.1,
+the previous <path>.1 to <path>.2 and so on, keeping at most max_backups rotated files. A max_size of 0 disables the rotation.
+*/
+type RotatingFile struct {
+	path        string
+	max_size    int64
+	max_backups int
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+// OpenRotatingFile opens, or creates, the log file at path, appending to it
+func OpenRotatingFile(path string, max_size int64, max_backups int) (*RotatingFile, error) {
+	f := &RotatingFile{path: path, max_size: max_size, max_backups: max_backups}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *RotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file = file
+	f.size = info.Size()
+	return nil
+}
+
+// backup returns the path of the i-th rotated file
+func (f *RotatingFile) backup(i int) string {
+	return f.path + "." + strconv.Itoa(i)
+}
+
+// rotate closes the log file, shifts the rotated files and opens a new, empty, log file
+func (f *RotatingFile) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+	if f.max_backups == 0 {
+		os.Remove(f.path)
+	} else {
+		os.Remove(f.backup(f.max_backups))
+		for i := f.max_backups - 1; i > 0; i-- {
+			os.Rename(f.backup(i), f.backup(i+1))
+		}
+		if err := os.Rename(f.path, f.backup(1)); err != nil {
+			return err
+		}
+	}
+	return f.open()
+}
+
+// Write appends p to the log file, rotating it first if it would exceed the maximum size
+func (f *RotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.max_size > 0 && f.size > 0 && f.size+int64(len(p)) > f.max_size {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// Close closes the log file
+func (f *RotatingFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.file.Close()
+}
@@ -1,40 +1,20 @@
 package nest_service
 
 import (
-	"encoding/json"
-	"io"
+	"context"
 	"net/http"
 	"os"
 
 	"github.com/gin-gonic/gin"
 	"github.com/m4rkdc/nebula_est/nest_service/pkg/models"
-	"github.com/m4rkdc/nebula_est/nest_service/pkg/utils"
 )
 
 /*
 The GetCaCerts function sends a request to the Nebula CA service for the Nebula CA certificates.
-The function retries to send the request after waiting Retry-After seconds
+Failed requests are retried by the client.Ca client
 */
-func getCaCerts() ([]byte, error) {
-	//TODO: add retry
-	resp, err := http.Get("http://" + utils.Ca_service_ip + ":" + utils.Ca_service_port + "/cacerts")
-	if err != nil {
-		return nil, err
-	}
-
-	b, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, err
-	}
-
-	var error_response *models.ApiError
-	if json.Unmarshal(b, error_response) != nil {
-		if error_response != nil {
-			return nil, error_response
-		}
-	}
-	var ca_certs []byte
-	err = json.Unmarshal(b, &ca_certs)
+func (s *Service) getCaCerts() ([]byte, error) {
+	ca_certs, err := s.Ca.CaCerts(context.Background())
 	if err != nil {
 		return nil, err
 	}
@@ -48,8 +28,8 @@ func getCaCerts() ([]byte, error) {
 }
 
 // This function gets the Nebula CA certs from the Ca_cert_file and returns them.
-func getCaCertFromFile() ([]byte, error) {
-	b, err := os.ReadFile(utils.Ca_cert_file)
+func (s *Service) getCaCertFromFile() ([]byte, error) {
+	b, err := os.ReadFile(s.Config.CaCertFile)
 	if err != nil {
 		return nil, err
 	}
@@ -76,15 +56,15 @@ func getCaCertFromFile() ([]byte, error) {
 The CheckCaCertFile function checks if the nest.Ca_cert_file exists.
 If not, sends a request to the CA service and creates it by filling it with the returned Nebula CA certificates.
 */
-func CheckCaCertFile() error {
-	if _, err := os.Stat(utils.Ca_cert_file); err != nil {
-		ca_certs, err := getCaCerts()
+func (s *Service) CheckCaCertFile() error {
+	if _, err := os.Stat(s.Config.CaCertFile); err != nil {
+		ca_certs, err := s.getCaCerts()
 		if err != nil {
 			return err
 		}
-		os.WriteFile(utils.Ca_cert_file, ca_certs, 0600)
+		os.WriteFile(s.Config.CaCertFile, ca_certs, 0600)
 		/*
-			file, err := os.OpenFile(utils.Ca_cert_file, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+			file, err := os.OpenFile(s.Config.CaCertFile, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
 			if err != nil {
 				return err
 			}
@@ -103,19 +83,42 @@ func CheckCaCertFile() error {
 	return nil
 }
 
+/*
+getSigningKeys returns the PEM public keys with which the NEST config service signs the Nebula configuration files.
+A NEST config service older than the configuration signatures has none.
+*/
+func (s *Service) getSigningKeys(ctx context.Context) ([]byte, error) {
+	keys, err := s.Conf.SigningKeys(ctx)
+	if api_error, ok := err.(*models.ApiError); ok && (api_error.Code == http.StatusNotFound || api_error.Code == http.StatusNotImplemented) {
+		return nil, nil
+	}
+	return keys, err
+}
+
 /*
 The Cacerts REST endpoint contacts the nest_ca service to get the Nebula CA(s) certificate(s).
-It returns an array of cert.NebulaCertificate to the client.
+It returns an array of cert.NebulaCertificate to the client. The clients accepting application/json get a CaCertsDocument instead,
+with the public keys with which the NEST config service signs the Nebula configuration files.
 */
-func Cacerts(c *gin.Context) {
-	/*if err := CheckCaCertFile(); err != nil {
+func (s *Service) Cacerts(c *gin.Context) {
+	/*if err := s.CheckCaCertFile(); err != nil {
 		c.JSON(http.StatusInternalServerError, models.ApiError{Code: 500, Message: "Internal server error: " + err.Error()})
 		return
 	}*/
-	ca_certs, err := getCaCertFromFile()
+	ca_certs, err := s.getCaCertFromFile()
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, models.ApiError{Code: 500, Message: "Internal server error: " + err.Error()})
+		return
 	}
 
-	c.JSON(http.StatusOK, ca_certs)
+	if csrResponseFormat(c) != models.MIME_JSON {
+		c.JSON(http.StatusOK, ca_certs)
+		return
+	}
+	keys, err := s.getSigningKeys(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ApiError{Code: 500, Message: "Internal server error: could not get the configuration signing keys: " + err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, models.CaCertsDocument{NebulaCaCerts: string(ca_certs), ConfigSigningKeys: string(keys)})
 }
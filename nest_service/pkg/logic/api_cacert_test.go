@@ -2,20 +2,23 @@ package nest_service
 
 import (
 	"encoding/json"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 
 	"github.com/go-playground/assert/v2"
-	"github.com/m4rkdc/nebula_est/nest_service/pkg/utils"
+	"github.com/m4rkdc/nebula_est/nest_service/pkg/models"
 	nest_test "github.com/m4rkdc/nebula_est/nest_service/test"
 )
 
 func TestCacerts(t *testing.T) {
-	var endpoint = Service_routes[0]
+	s := newTestService()
+	var endpoint = s.Routes()[0]
 	r := nest_test.MockRouterForEndpoint(&endpoint)
-	utils.Ca_cert_file = "../../test/config/ca.crt"
-	certs, _ := getCaCertFromFile()
+	s.Config.CaCertFile = "../../test/config/ca.crt"
+	certs, _ := s.getCaCertFromFile()
 	reqOk, _ := http.NewRequest(endpoint.Method, endpoint.Pattern, nil)
 	resp := httptest.NewRecorder()
 	r.ServeHTTP(resp, reqOk)
@@ -23,7 +26,25 @@ func TestCacerts(t *testing.T) {
 	certsBytes, _ := json.Marshal(certs)
 	assert.Equal(t, certsBytes, resp.Body.Bytes())
 
-	utils.Ca_cert_file = "./"
+	//The clients accepting application/json also get the configuration signing keys
+	keys := []byte("-----BEGIN PUBLIC KEY-----\nMCowBQYDK2VwAyEAGb9ECWmEzf6FQbrBZ9w7lshQhqowtrbLDFw4rXAxZuE=\n-----END PUBLIC KEY-----\n")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(keys)
+	}))
+	defer server.Close()
+	s.Config.Conf.IP, s.Config.Conf.Port, _ = net.SplitHostPort(strings.TrimPrefix(server.URL, "http://"))
+	reconnect(s)
+	reqJSON, _ := http.NewRequest(endpoint.Method, endpoint.Pattern, nil)
+	reqJSON.Header.Set("Accept", models.MIME_JSON)
+	resp = httptest.NewRecorder()
+	r.ServeHTTP(resp, reqJSON)
+	assert.Equal(t, http.StatusOK, resp.Code)
+	var document models.CaCertsDocument
+	assert.Equal(t, nil, json.Unmarshal(resp.Body.Bytes(), &document))
+	assert.Equal(t, string(certs), document.NebulaCaCerts)
+	assert.Equal(t, string(keys), document.ConfigSigningKeys)
+
+	s.Config.CaCertFile = "./"
 	reqError, _ := http.NewRequest(endpoint.Method, endpoint.Pattern, nil)
 	resp = httptest.NewRecorder()
 	r.ServeHTTP(resp, reqError)
@@ -1,33 +1,37 @@
 package nest_service
 
 import (
-	"bufio"
-	"bytes"
+	"context"
 	"crypto/hmac"
 	"crypto/sha256"
+	"crypto/tls"
 	"encoding/base32"
-	"encoding/json"
-	"fmt"
-	"io"
+	"encoding/base64"
+	"errors"
+	"log/slog"
 	"net/http"
 	"os"
-	"regexp"
 	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/m4rkdc/nebula_est/nest_service/pkg/client"
+	"github.com/m4rkdc/nebula_est/nest_service/pkg/config"
+	"github.com/m4rkdc/nebula_est/nest_service/pkg/events"
+	"github.com/m4rkdc/nebula_est/nest_service/pkg/metrics"
 	"github.com/m4rkdc/nebula_est/nest_service/pkg/models"
-	"github.com/m4rkdc/nebula_est/nest_service/pkg/utils"
+	"github.com/m4rkdc/nebula_est/nest_service/pkg/store"
+	"github.com/m4rkdc/nebula_est/nest_service/pkg/tracing"
 	"github.com/pquerna/otp"
 	"github.com/pquerna/otp/totp"
 	"github.com/slackhq/nebula/cert"
-	"google.golang.org/protobuf/encoding/protojson"
+	"go.opentelemetry.io/otel/attribute"
 	"google.golang.org/protobuf/proto"
 )
 
 // The Sign function returns an HMAC of the given hostname
-func sign(hostname string, rand []byte) []byte {
-	key, err := os.ReadFile(utils.HMAC_key)
+func (s *Service) sign(hostname string, rand []byte) []byte {
+	key, err := os.ReadFile(s.Config.HMACKey)
 	if err != nil {
 		return nil
 	}
@@ -38,8 +42,8 @@ func sign(hostname string, rand []byte) []byte {
 }
 
 // The Verify function verifies if the given client_authenticator corresponds to the HMAC of the client hostname
-func verify(hostname string, client_authenticator []byte) (bool, error) {
-	key, err := os.ReadFile(utils.HMAC_key)
+func (s *Service) verify(hostname string, client_authenticator []byte) (bool, error) {
+	key, err := os.ReadFile(s.Config.HMACKey)
 	if err != nil {
 		return false, &models.ApiError{Code: 500, Message: "Internal server error: " + err.Error()}
 	}
@@ -48,67 +52,169 @@ func verify(hostname string, client_authenticator []byte) (bool, error) {
 	return hmac.Equal(client_authenticator, mac.Sum(nil)), nil
 }
 
-// models.Service_routes contains the routes considered by the nest_service router
-var Service_routes = [6]models.Route{
-
-	{
-		Name:        "Cacerts",
-		Method:      "GET",
-		Pattern:     "/cacerts",
-		HandlerFunc: Cacerts,
-	},
-	{
-		Name:        "NcsrApplication",
-		Method:      "POST",
-		Pattern:     "/ncsr",
-		HandlerFunc: NcsrApplication,
-	},
-	{
-		Name:        "Enroll",
-		Method:      "POST",
-		Pattern:     "/ncsr/:hostname/enroll",
-		HandlerFunc: Enroll,
-	},
-	{
-		Name:        "NcsrStatus",
-		Method:      "GET",
-		Pattern:     "/ncsr/:hostname",
-		HandlerFunc: NcsrStatus,
-	},
-	{
-		Name:        "Reenroll",
-		Method:      "POST",
-		Pattern:     "/ncsr/:hostname/reenroll",
-		HandlerFunc: Reenroll,
-	},
-	{
-		Name:        "Serverkeygen",
-		Method:      "POST",
-		Pattern:     "/ncsr/:hostname/serverkeygen",
-		HandlerFunc: Serverkeygen,
-	},
+/*
+Service is an instance of the NEST service, holding its configuration and its clients of the NEST CA and NEST CONFIG services.
+Several instances can run in the same process, e.g. in tests, or to serve the Nebula networks of a multi-tenant deployment, one instance per network.
+*/
+type Service struct {
+	Config *config.Service
+	Ca     *client.CaClient
+	Conf   *client.ConfClient
+	// Dispatcher of the enrollment lifecycle events. If nil, events are discarded
+	Events *events.Dispatcher
+
+	hostnames *hostnameSet
+	//Stores of the NCSR statuses and of the leases with the memory store backend
+	ncsrs, lease_store store.Store
+	//Identity of this replica in the leases
+	replica string
 }
 
-// isValideHostname checks if the provided hostname is present in the Hostnames file
-func isValidHostname(hostname string) (bool, error) {
+// New creates a NEST service instance with the given configuration. transport is the TLS configuration of the calls to the downstream services in mtls transport mode, nil otherwise
+func New(cfg *config.Service, transport *tls.Config) *Service {
+	settings := client.SettingsFrom(cfg.Downstream)
+	settings.TLS = transport
+	settings.Network = cfg.Network
+	replica := cfg.Store.ReplicaID
+	if len(replica) == 0 {
+		replica, _ = os.Hostname()
+	}
+	return &Service{
+		Config:      cfg,
+		Ca:          client.NewCaClient(cfg.Ca, settings),
+		Conf:        client.NewConfClient(cfg.Conf, settings),
+		hostnames:   &hostnameSet{},
+		ncsrs:       store.NewMemory(),
+		lease_store: store.NewMemory(),
+		replica:     replica,
+	}
+}
 
-	b, err := os.ReadFile(utils.Hostnames_file)
-	if err != nil {
-		return false, err
+/*
+leases returns the leases shared by the replicas of the service. With the file backend, they are kept in the .leases folder of the NCSR folder,
+so that the replicas sharing the NCSR folder share the leases too.
+*/
+func (s *Service) leases() *store.Leases {
+	if s.Config.Store.Backend == config.STORE_MEMORY {
+		return store.NewLeases(s.lease_store, s.replica)
 	}
+	return store.NewLeases(store.NewFile(s.Config.NcsrFolder+".leases/"), s.replica)
+}
 
-	isValid, err := regexp.Match(hostname, b)
+/*
+leaseEnrollment acquires the lease on the enrollment of the given hostname, so that a single replica at a time issues a certificate for it:
+concurrent enrollments of the same hostname are rejected with a 409 error. The lease is renewed every third of its TTL while the enrollment is in progress,
+however long the NEST CA and NEST config services take. The returned function stops the renewals and releases the lease.
+*/
+func (s *Service) leaseEnrollment(ctx context.Context, hostname string) (func(), error) {
+	leases := s.leases()
+	ttl := time.Duration(s.Config.Store.LeaseTTL)
+	lease, err := leases.Acquire(ctx, "ncsr-"+hostname, ttl)
+	if errors.Is(err, store.ErrLeased) {
+		return nil, &models.ApiError{Code: 409, Message: "Conflict. An enrollment for this hostname is in progress"}
+	}
 	if err != nil {
-		return false, err
+		slog.ErrorContext(ctx, "Could not acquire the enrollment lease", "hostname", hostname, "error", err)
+		return nil, &models.ApiError{Code: 500, Message: "Internal server error: " + err.Error()}
+	}
+
+	done, renewing := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(renewing)
+		ticker := time.NewTicker(ttl / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+			if err := leases.Renew(context.WithoutCancel(ctx), lease, ttl); err != nil {
+				slog.WarnContext(ctx, "Could not renew the enrollment lease", "hostname", hostname, "error", err)
+				if errors.Is(err, store.ErrLeased) {
+					return
+				}
+			}
+		}
+	}()
+	return func() {
+		//A renewal in progress would replace the lease being released
+		close(done)
+		<-renewing
+		if err := leases.Release(context.WithoutCancel(ctx), lease); err != nil {
+			slog.WarnContext(ctx, "Could not release the enrollment lease", "hostname", hostname, "error", err)
+		}
+	}, nil
+}
+
+// networkPath returns the path under which the routes of the instance are served, empty in single network deployments
+func (s *Service) networkPath() string {
+	return models.NetworkPath(s.Config.Network)
+}
+
+// Routes returns the routes considered by the nest_service router
+func (s *Service) Routes() []models.Route {
+	return []models.Route{
+		{
+			Name:        "Cacerts",
+			Method:      "GET",
+			Pattern:     "/cacerts",
+			HandlerFunc: s.Cacerts,
+		},
+		{
+			Name:        "NcsrApplication",
+			Method:      "POST",
+			Pattern:     "/ncsr",
+			HandlerFunc: s.NcsrApplication,
+		},
+		{
+			Name:        "Enroll",
+			Method:      "POST",
+			Pattern:     "/ncsr/:hostname/enroll",
+			HandlerFunc: s.Enroll,
+		},
+		{
+			Name:        "NcsrStatus",
+			Method:      "GET",
+			Pattern:     "/ncsr/:hostname",
+			HandlerFunc: s.NcsrStatus,
+		},
+		{
+			Name:        "Reenroll",
+			Method:      "POST",
+			Pattern:     "/ncsr/:hostname/reenroll",
+			HandlerFunc: s.Reenroll,
+		},
+		{
+			Name:        "Serverkeygen",
+			Method:      "POST",
+			Pattern:     "/ncsr/:hostname/serverkeygen",
+			HandlerFunc: s.Serverkeygen,
+		},
+		{
+			Name:        "NebulaConfig",
+			Method:      "GET",
+			Pattern:     "/ncsr/:hostname/config",
+			HandlerFunc: s.NebulaConfig,
+		},
+	}
+}
+
+// emit queues an event of the given type for the given hostname. It does nothing if no webhook is configured.
+func (s *Service) emit(event_type models.EventType, hostname string, data map[string]string) {
+	if s.Events == nil {
+		return
+	}
+	if err := s.Events.Emit(models.Event{Type: event_type, Network: s.Config.Network, Hostname: hostname, Data: data}); err != nil {
+		slog.Warn("Could not queue the event", "event", event_type, "hostname", hostname, "error", err)
 	}
-	return isValid, nil
 }
 
 /*
 verifyCsr checks that all the fields of the given Nebula Certificate Signing Request are congruent to the request done by the client.
 The type of request is discriminated by the option field (i.e., ENROLL, REENROLL, SERVERKEYGEN)
 */
-func verifyCsr(csr models.NebulaCsr, hostname string, option int) (int, error) {
+func (s *Service) verifyCsr(csr models.NebulaCsr, hostname string, option int) (int, error) {
 	if csr.Hostname != hostname {
 		return http.StatusForbidden, &models.ApiError{Code: 403, Message: "Forbidden. The hostname in the URL and the one in the Nebula CSR are different."}
 	}
@@ -119,11 +225,11 @@ func verifyCsr(csr models.NebulaCsr, hostname string, option int) (int, error) {
 	switch option {
 	case models.ENROLL:
 		if csr.ServerKeygen {
-			return http.StatusBadRequest, &models.ApiError{Code: 400, Message: "Bad Request. ServerKeygen is true. If you wanted to enroll with a server keygen, please visit https://" + utils.Service_ip + ":" + utils.Service_port + "/" + "/ncsr/" + hostname + "/serverkeygen"}
+			return http.StatusBadRequest, &models.ApiError{Code: 400, Message: "Bad Request. ServerKeygen is true. If you wanted to enroll with a server keygen, please visit https://" + s.Config.ServiceIP + ":" + s.Config.ServicePort + s.networkPath() + "/" + "/ncsr/" + hostname + "/serverkeygen"}
 		}
 	case models.SERVERKEYGEN:
 		if !csr.ServerKeygen {
-			return http.StatusBadRequest, &models.ApiError{Code: 400, Message: "Bad Request. ServerKeygen is false. If you wanted to enroll with a client-generated nebula public key, please visit https://" + utils.Service_ip + ":" + utils.Service_port + "/" + "/ncsr/" + hostname + "/enroll"}
+			return http.StatusBadRequest, &models.ApiError{Code: 400, Message: "Bad Request. ServerKeygen is false. If you wanted to enroll with a client-generated nebula public key, please visit https://" + s.Config.ServiceIP + ":" + s.Config.ServicePort + s.networkPath() + "/" + "/ncsr/" + hostname + "/enroll"}
 		}
 		return 0, nil
 	case models.RENROLL:
@@ -145,29 +251,55 @@ func verifyCsr(csr models.NebulaCsr, hostname string, option int) (int, error) {
 	return 0, nil
 }
 
-func updateStatus(raw_ca_response *models.RawCaResponse, hostname string) error {
+// updateStatus marks the enrollment of the given hostname as completed, recording the newly issued certificate and how it was obtained, and returns the new status
+func (s *Service) updateStatus(ctx context.Context, raw_ca_response *models.RawCaResponse, hostname string, mode models.EnrollmentMode) (*models.NcsrStatus, error) {
 	raw_cert_bytes, err := proto.Marshal(raw_ca_response.NebulaCert)
 	if err != nil {
-		fmt.Println("There was an error marshalling raw_csr_response.NebulaCert" + err.Error())
-		return &models.ApiError{Code: 500, Message: "There was an error unmarshalling json response"}
+		slog.ErrorContext(ctx, "Could not marshal the Nebula certificate", "hostname", hostname, "error", err)
+		return nil, &models.ApiError{Code: 500, Message: "There was an error unmarshalling json response"}
 	}
 
 	crt, err := cert.UnmarshalNebulaCertificate(raw_cert_bytes)
 	if err != nil {
-		fmt.Println("There was an error unmarshalling raw_cert_bytes" + err.Error())
-		return &models.ApiError{Code: 500, Message: "There was an error unmarshalling raw_cert_bytes"}
+		slog.ErrorContext(ctx, "Could not unmarshal the Nebula certificate", "hostname", hostname, "error", err)
+		return nil, &models.ApiError{Code: 500, Message: "There was an error unmarshalling raw_cert_bytes"}
 	}
 
-	file, err := os.OpenFile(utils.Ncsr_folder+hostname, os.O_WRONLY|os.O_TRUNC, 0600)
-	if err != nil {
-		fmt.Printf("Could not write to file: %v\n", err)
-		return &models.ApiError{Code: 500, Message: "Internal Server Error: " + err.Error()}
+	//Read-modify-write of the status, retried if it was modified meanwhile (e.g., its pending actions)
+	var status *models.NcsrStatus
+	for {
+		previous, version, _ := s.readNcsrStatus(ctx, hostname)
+		status, err = completedNcsrStatus(previous, crt, mode, time.Now())
+		if err != nil {
+			slog.ErrorContext(ctx, "Could not compute the certificate fingerprint", "hostname", hostname, "error", err)
+			return nil, &models.ApiError{Code: 500, Message: "Internal Server Error: " + err.Error()}
+		}
+		err = s.writeNcsrStatus(ctx, hostname, status, version)
+		if !errors.Is(err, store.ErrConflict) {
+			break
+		}
 	}
-	defer file.Close()
-
-	file.WriteString(string(models.COMPLETED) + "\n")
-	file.WriteString(crt.Details.NotAfter.String())
-	return nil
+	if err != nil {
+		slog.ErrorContext(ctx, "Could not write the NCSR status", "hostname", hostname, "error", err)
+		return nil, &models.ApiError{Code: 500, Message: "Internal Server Error: " + err.Error()}
+	}
+
+	metrics.Enrollments.WithLabelValues(string(mode)).Inc()
+	metrics.CertificateExpiry.WithLabelValues(s.Config.Network, hostname).Set(float64(status.NotAfter.Unix()))
+
+	event_type := models.HOST_ENROLLED
+	switch mode {
+	case models.RENROLL_MODE:
+		event_type = models.HOST_REENROLLED
+	case models.REKEY_MODE:
+		event_type = models.HOST_REKEYED
+	}
+	s.emit(event_type, hostname, map[string]string{
+		"enrollmentMode": string(mode),
+		"fingerprint":    status.Fingerprint,
+		"notAfter":       status.NotAfter.Format(time.RFC3339),
+	})
+	return status, nil
 }
 
 /*
@@ -175,19 +307,19 @@ getCSRResponse contacts the nest_ca and nest_config services to get the client's
 It calls sendCSR and requestConf to do so.
 It returns the Nebula CSR Response if both requests are successful, an error otherwise.
 */
-func getRawCSRResponse(hostname string, csr *models.NebulaCsr, option int) (*models.RawNebulaCsrResponse, error) {
+func (s *Service) getRawCSRResponse(ctx context.Context, hostname string, csr *models.NebulaCsr, option int) (*models.RawNebulaCsrResponse, error) {
 	var conf_resp *models.ConfResponse
 	var raw_ca_response *models.RawCaResponse
 	var err error
 
-	conf_resp, err = requestConf(hostname)
+	conf_resp, err = s.requestConf(ctx, hostname)
 	if err != nil {
 		return nil, err
 	}
 	csr.Groups = conf_resp.Groups
 	csr.Ip = conf_resp.Ip
 
-	raw_ca_response, err = sendCSR(csr, option)
+	raw_ca_response, err = s.sendCSR(ctx, csr, option)
 	if err != nil {
 		return nil, err
 	}
@@ -200,10 +332,18 @@ func getRawCSRResponse(hostname string, csr *models.NebulaCsr, option int) (*mod
 
 	raw_csr_resp.NebulaConf = conf_resp.NebulaConf
 	raw_csr_resp.NebulaPath = &conf_resp.NebulaPath
+	if len(conf_resp.Signature) != 0 {
+		raw_csr_resp.ConfSignature = conf_resp.Signature
+	}
 
-	if err = updateStatus(raw_ca_response, hostname); err != nil {
+	status, err := s.updateStatus(ctx, raw_ca_response, hostname, enrollmentMode(csr, option))
+	if err != nil {
 		return nil, err
 	}
+	if renew_after, renew_before := renewalWindow(status); !renew_after.IsZero() {
+		raw_csr_resp.RenewAfter = proto.Int64(renew_after.Unix())
+		raw_csr_resp.RenewBefore = proto.Int64(renew_before.Unix())
+	}
 	return &raw_csr_resp, nil
 }
 
@@ -211,20 +351,10 @@ func getRawCSRResponse(hostname string, csr *models.NebulaCsr, option int) (*mod
 sendCSR sends the client provide Nebula CSR to the nebula_ca service and returns the nebula_ca generated Nebula certificate to the client.
 The Nebula private key is also returned if the option field is SERVERKEYGEN
 */
-func sendCSR(csr *models.NebulaCsr, option int) (*models.RawCaResponse, error) {
-	var path string
-	switch option {
-	case models.ENROLL:
-		path = "/ncsr/sign"
-	case models.RENROLL:
-		if csr.ServerKeygen {
-			path = "/ncsr/generate"
-		} else {
-			path = "/ncsr/sign"
-		}
-	case models.SERVERKEYGEN:
-		path = "/ncsr/generate"
-	}
+func (s *Service) sendCSR(ctx context.Context, csr *models.NebulaCsr, option int) (raw_ca_response *models.RawCaResponse, err error) {
+	generate := option == models.SERVERKEYGEN || (option == models.RENROLL && csr.ServerKeygen)
+	ctx, span := tracing.Start(ctx, "sendCSR", attribute.String("hostname", csr.Hostname), attribute.Bool("serverkeygen", generate))
+	defer func() { tracing.End(span, err) }()
 
 	raw_csr := models.RawNebulaCsr{
 		ServerKeygen: &csr.ServerKeygen,
@@ -236,76 +366,34 @@ func sendCSR(csr *models.NebulaCsr, option int) (*models.RawCaResponse, error) {
 		Ip:     &csr.Ip,
 	}
 
-	b, err := protojson.Marshal(&raw_csr)
-	if err != nil {
-		return nil, err
-	}
-	resp, err := http.Post("http://"+utils.Ca_service_ip+":"+utils.Ca_service_port+path, "application/json", bytes.NewReader(b))
-	if err != nil {
-		return nil, err
-	}
-
-	b, err = io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, err
-	}
-
-	raw_ca_response := &models.RawCaResponse{}
-	var raw_ca_response_bytes []byte
-	switch {
-	case resp.StatusCode == 200:
-		if err = json.Unmarshal(b, &raw_ca_response_bytes); err != nil {
-			return nil, err
-		}
-		if err = proto.Unmarshal(raw_ca_response_bytes, raw_ca_response); err != nil {
-			return nil, err
-		}
-	case resp.StatusCode >= 400:
-		var error_response models.ApiError
-		if json.Unmarshal(b, &error_response) == nil {
-			if error_response.Code != 0 {
-				return nil, &error_response
-			}
-		}
-	}
-	return raw_ca_response, nil
+	return s.Ca.Sign(ctx, &raw_csr, generate)
 }
 
 /*
 requestConf sends a request to the nest_config service to generate a Nebula configuration file for the given hostname
 It returns the nest_config service response if successful or an error.
 */
-func requestConf(hostname string) (*models.ConfResponse, error) {
-	resp, err := http.Get("http://" + utils.Conf_service_ip + ":" + utils.Conf_service_port + "/configs/" + hostname)
-	if err != nil {
-		return nil, err
-	}
-
-	b, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, err
-	}
-
-	var error_response models.ApiError
-	if json.Unmarshal(b, &error_response) != nil {
-		if error_response.Code == 0 {
-			return nil, &error_response
-		}
-	}
-	var response models.ConfResponse
-	if err = json.Unmarshal(b, &response); err != nil {
-		return nil, err
-	}
+func (s *Service) requestConf(ctx context.Context, hostname string) (conf_response *models.ConfResponse, err error) {
+	ctx, span := tracing.Start(ctx, "requestConf", attribute.String("hostname", hostname))
+	defer func() { tracing.End(span, err) }()
+	return s.Conf.GetConfig(ctx, hostname)
+}
 
-	return &response, nil
+// authenticationFailed records a failed client authentication, in the metrics and as an authentication.failed event
+func (s *Service) authenticationFailed(hostname string, reason string) {
+	metrics.AuthFailures.WithLabelValues(reason).Inc()
+	s.emit(models.AUTHENTICATION_FAILED, hostname, map[string]string{"reason": reason})
 }
 
-func checkClientToken(client_token string, hostname string) error {
-	ok, err := totp.ValidateCustom(client_token, base32.StdEncoding.EncodeToString(sign(hostname, nil)), time.Now(),
+// checkClientToken verifies the TOTP token sent by the client in the NESToken header. Failed verifications are notified as authentication.failed events
+func (s *Service) checkClientToken(client_token string, hostname string) error {
+	ok, err := totp.ValidateCustom(client_token, base32.StdEncoding.EncodeToString(s.sign(hostname, nil)), time.Now(),
 		totp.ValidateOpts{Digits: 10, Period: 2, Skew: 1, Algorithm: otp.AlgorithmSHA256})
 	if err != nil {
+		s.authenticationFailed(hostname, "malformed token")
 		return &models.ApiError{Code: 401, Message: "Unhautorized: " + err.Error()}
 	} else if !ok {
+		s.authenticationFailed(hostname, "invalid token")
 		return &models.ApiError{Code: 401, Message: "Unhautorized: your token is invalid"}
 	}
 	return nil
@@ -314,8 +402,9 @@ func checkClientToken(client_token string, hostname string) error {
 /*
 The NcsrApplication REST endpoint starts the procedure of enrollment of a NEST client to the system. It authenticates the client to the system before it can continue.
 It creates NCSR status file for this client and returns to the client the base url to use for the future actions.
+A hostname matching the pattern of a host template is registered as one of its instances first: if the template requires an approval, a 202 is returned until it is approved.
 */
-func NcsrApplication(c *gin.Context) {
+func (s *Service) NcsrApplication(c *gin.Context) {
 
 	var auth = models.NestAuth{}
 	if err := c.ShouldBindJSON(&auth); err != nil || len(auth.Hostname) == 0 || len(auth.Secret) == 0 {
@@ -323,65 +412,83 @@ func NcsrApplication(c *gin.Context) {
 		return
 	}
 
-	if ok, err := verify(auth.Hostname, auth.Secret); !ok {
+	if ok, err := s.verify(auth.Hostname, auth.Secret); !ok {
 		if err != nil {
-			fmt.Println("Internal server Error: " + err.Error())
+			slog.ErrorContext(c.Request.Context(), "Internal server error", "error", err)
 			c.JSON(http.StatusInternalServerError, models.ApiError{Code: 500, Message: err.Error()})
 			return
 		}
 
+		s.authenticationFailed(auth.Hostname, "invalid secret")
 		c.JSON(http.StatusBadRequest, models.ApiError{Code: 400, Message: "Bad Request. Could not succesfully verify the provided secret"})
 		return
 	}
 
-	if _, err := os.Stat(utils.Ncsr_folder + auth.Hostname); err == nil {
-		c.JSON(http.StatusConflict, models.ApiError{Code: 409, Message: "Conflict. A Nebula CSR for the hostname you provided already exists. If you want to re-enroll, please visit https://" + utils.Service_ip + ":" + utils.Service_port + "/ncsr/" + auth.Hostname + "/reenroll"})
+	if _, _, err := s.readNcsrStatus(c.Request.Context(), auth.Hostname); !errors.Is(err, store.ErrNotFound) {
+		c.JSON(http.StatusConflict, models.ApiError{Code: 409, Message: "Conflict. A Nebula CSR for the hostname you provided already exists. If you want to re-enroll, please visit https://" + s.Config.ServiceIP + ":" + s.Config.ServicePort + s.networkPath() + "/ncsr/" + auth.Hostname + "/reenroll"})
 		return
 	}
 
-	isValid, err := isValidHostname(auth.Hostname)
+	isValid, err := s.isValidHostname(auth.Hostname)
 	if err != nil {
-		fmt.Println("Internal server Error: " + err.Error())
+		slog.ErrorContext(c.Request.Context(), "Internal server error", "error", err)
 		c.JSON(http.StatusInternalServerError, models.ApiError{Code: 500, Message: "Internal server error: " + err.Error()})
 		return
 	}
 	if !isValid {
-		c.JSON(http.StatusBadRequest, models.ApiError{Code: 400, Message: "Bad request: The hostname you provided was not found in the Configuration service list"})
-		return
+		instance, err := s.registerInstance(c.Request.Context(), auth.Hostname)
+		if err != nil {
+			api_error, ok := err.(*models.ApiError)
+			if !ok {
+				api_error = &models.ApiError{Code: 500, Message: "Internal server error: " + err.Error()}
+			}
+			slog.ErrorContext(c.Request.Context(), "Could not register the host template instance", "hostname", auth.Hostname, "error", err)
+			c.JSON(api_error.Code, api_error)
+			return
+		}
+		if instance == nil {
+			c.JSON(http.StatusBadRequest, models.ApiError{Code: 400, Message: "Bad request: The hostname you provided was not found in the Configuration service list"})
+			return
+		}
+		if !instance.Approved {
+			s.emit(models.APPROVAL_REQUESTED, auth.Hostname, map[string]string{"template": instance.Template})
+			c.JSON(http.StatusAccepted, models.ApiError{Code: 202, Message: "Accepted: the hostname you provided is an instance of the " + instance.Template + " host template and is waiting for the approval of an administrator. Please apply again later"})
+			return
+		}
 	}
 
 	/*token, err := createNESToken(auth.Hostname)
 	if err != nil {
-		fmt.Println("Internal server Error: " + err.Error())
+		slog.ErrorContext(c.Request.Context(), "Internal server error", "error", err)
 		c.JSON(http.StatusInternalServerError, models.ApiError{Code: 500, Message: "Internal server error: " + err.Error()})
 		return
 	}*/
 
-	applicationFile, err := os.OpenFile(utils.Ncsr_folder+auth.Hostname, os.O_CREATE|os.O_WRONLY, 0600)
-	if err != nil {
-		fmt.Println("Internal server Error: " + err.Error())
-		c.JSON(http.StatusInternalServerError, models.ApiError{Code: 500, Message: "Internal server error: " + err.Error()})
+	now := time.Now()
+	err = s.writeNcsrStatus(c.Request.Context(), auth.Hostname, &models.NcsrStatus{Status: models.PENDING, Created: &now}, "")
+	if errors.Is(err, store.ErrConflict) {
+		//Another replica created it meanwhile
+		c.JSON(http.StatusConflict, models.ApiError{Code: 409, Message: "Conflict. A Nebula CSR for the hostname you provided already exists. If you want to re-enroll, please visit https://" + s.Config.ServiceIP + ":" + s.Config.ServicePort + s.networkPath() + "/ncsr/" + auth.Hostname + "/reenroll"})
 		return
 	}
-	defer applicationFile.Close()
-	if _, err = applicationFile.WriteString(string(models.PENDING) + "\n"); err != nil {
-		fmt.Println("Internal server Error: " + err.Error())
+	if err != nil {
+		slog.ErrorContext(c.Request.Context(), "Internal server error", "error", err)
 		c.JSON(http.StatusInternalServerError, models.ApiError{Code: 500, Message: "Internal server error: " + err.Error()})
 		return
 	}
-	/*if _, err = applicationFile.WriteString(string(token) + "\n"); err != nil {
-		fmt.Println("Internal server Error: " + err.Error())
-		c.JSON(http.StatusInternalServerError, models.ApiError{Code: 500, Message: "Internal server error: " + err.Error()})
-		return
-	}*/
 
-	c.Header("Location", "http://"+utils.Service_ip+":"+utils.Service_port+"/ncsr/"+auth.Hostname)
+	s.emit(models.APPLICATION_CREATED, auth.Hostname, nil)
+	c.Header("Location", "http://"+s.Config.ServiceIP+":"+s.Config.ServicePort+s.networkPath()+"/ncsr/"+auth.Hostname)
 	c.Status(http.StatusCreated)
 	/*c.JSON(http.StatusOK, token)*/
 }
 
-// NcsrStatus REST endpoint returns the state of the enrollment request by the client specified by the hostname parameter (PENDING, COMPLETED, EXPIRED)
-func NcsrStatus(c *gin.Context) {
+/*
+The NcsrStatus REST endpoint returns the state of the enrollment request by the client specified by the hostname parameter.
+Besides the status (PENDING, COMPLETED, EXPIRED), it returns the fingerprint and validity of the current certificate, the last enrollment time and mode,
+the recommended renewal time and the actions still pending on an administrator. The expiration is computed on the fly: the NCSR file is never modified.
+*/
+func (s *Service) NcsrStatus(c *gin.Context) {
 	hostname := c.Param("hostname")
 	if len(strings.TrimSpace(hostname)) == 0 {
 		c.JSON(http.StatusBadRequest, models.ApiError{Code: 400, Message: "Bad request: no hostname provided"})
@@ -393,65 +500,38 @@ func NcsrStatus(c *gin.Context) {
 		c.JSON(http.StatusUnauthorized, models.ApiError{Code: 401, Message: "Unhautorized: please provide a valid token before accessing this endpoint"})
 		return
 	}
-	if err := checkClientToken(client_token, hostname); err != nil {
+	if err := s.checkClientToken(client_token, hostname); err != nil {
 		c.JSON(http.StatusUnauthorized, models.ApiError{Code: 401, Message: "Unhautorized: please provide a valid token before accessing this endpoint"})
 		return
 	}
 
-	file, err := os.Open(utils.Ncsr_folder + hostname)
+	status, _, err := s.readNcsrStatus(c.Request.Context(), hostname)
 	if err != nil {
-		c.JSON(http.StatusNotFound, models.ApiError{Code: 404, Message: "Not found. Could not find an open Nebula CSR application for the specified hostname. If you want to enroll, provide your hostname to http:" + utils.Service_ip + ":" + utils.Service_port + "/ncsr"})
-		return
-	}
-
-	fileScanner := bufio.NewScanner(file)
-
-	fileScanner.Split(bufio.ScanLines)
-	var fileLines []string
-	for fileScanner.Scan() {
-		fileLines = append(fileLines, fileScanner.Text())
-	}
-	file.Close()
-	if len(fileLines) == 2 {
-		notAfter, err := time.Parse("2006-01-02 15:04:05.999999999 -0700 MST", fileLines[1])
-		if err != nil {
-			fmt.Println("Internal server Error: " + err.Error())
-			c.JSON(http.StatusInternalServerError, models.ApiError{Code: 500, Message: "Internal server error: " + err.Error()})
+		if api_error, ok := err.(*models.ApiError); ok {
+			slog.ErrorContext(c.Request.Context(), "Internal server error", "error", err)
+			c.JSON(api_error.Code, api_error)
 			return
 		}
-		if time.Until(notAfter) < 0 {
-			fileLines[0] = string(models.EXPIRED)
-			file, err := os.OpenFile(utils.Ncsr_folder+hostname, os.O_WRONLY|os.O_TRUNC, 0600)
-			if err != nil {
-				c.JSON(http.StatusNotFound, models.ApiError{Code: 404, Message: "Not found. Could not find an open Nebula CSR application for the specified hostname. If you want to enroll, provide your hostname to http:" + utils.Service_ip + ":" + utils.Service_port + "/ncsr"})
-				return
-			}
-			for _, s := range fileLines {
-				file.WriteString(s + "\n")
-			}
-			file.Close()
-		}
-	}
-	if len(fileLines) == 0 {
-		c.JSON(http.StatusInternalServerError, models.ApiError{Code: 500, Message: "Internal server error: there was an error in reading this hostname's ncsr status"})
+		c.JSON(http.StatusNotFound, models.ApiError{Code: 404, Message: "Not found. Could not find an open Nebula CSR application for the specified hostname. If you want to enroll, provide your hostname to http:" + s.Config.ServiceIP + ":" + s.Config.ServicePort + s.networkPath() + "/ncsr"})
 		return
 	}
-	c.JSON(http.StatusOK, fileLines[0])
+
+	c.JSON(http.StatusOK, effectiveNcsrStatus(*status, time.Now()))
 }
 
 /*
 The Enroll REST endpoint performs the actual enrollment of the client to the system and ends with the client being provided its Nebula certificate and configuration file.
 The NCSR status file will also be modified to COMPLETED.
 */
-func Enroll(c *gin.Context) {
+func (s *Service) Enroll(c *gin.Context) {
 	hostname := c.Param("hostname")
 	if len(strings.TrimSpace(hostname)) == 0 {
 		c.JSON(http.StatusBadRequest, models.ApiError{Code: 400, Message: "Bad request: no hostname provided"})
 		return
 	}
-	b, err := os.ReadFile(utils.Ncsr_folder + hostname)
+	status, _, err := s.readNcsrStatus(c.Request.Context(), hostname)
 	if err != nil {
-		c.JSON(http.StatusUnauthorized, models.ApiError{Code: 401, Message: "Unhautorized: please authenticate yourself to https://" + utils.Service_ip + ":" + utils.Service_port + "/ncsr providing your hostname and secret, before accessing this endpoint"})
+		c.JSON(http.StatusUnauthorized, models.ApiError{Code: 401, Message: "Unhautorized: please authenticate yourself to https://" + s.Config.ServiceIP + ":" + s.Config.ServicePort + s.networkPath() + "/ncsr providing your hostname and secret, before accessing this endpoint"})
 		return
 	}
 
@@ -460,13 +540,31 @@ func Enroll(c *gin.Context) {
 		c.JSON(http.StatusUnauthorized, models.ApiError{Code: 401, Message: "Unhautorized: please provide a valid token before accessing this endpoint"})
 		return
 	}
-	if err := checkClientToken(client_token, hostname); err != nil {
+	if err := s.checkClientToken(client_token, hostname); err != nil {
 		c.JSON(http.StatusUnauthorized, models.ApiError{Code: 401, Message: "Unhautorized: please provide a valid token before accessing this endpoint"})
 		return
 	}
 
-	if isPending, _ := regexp.Match(string(models.PENDING), b); !isPending {
-		c.JSON(http.StatusConflict, models.ApiError{Code: 409, Message: "Conflict. This hostname has already enrolled. If you want to re-enroll, please visit https://" + utils.Service_ip + ":" + utils.Service_port + "/ncsr/" + hostname + "/reenroll"})
+	if isValid, err := s.isValidHostname(hostname); err != nil || !isValid {
+		c.JSON(http.StatusForbidden, models.ApiError{Code: 403, Message: "Forbidden: the hostname you provided is no longer part of the Nebula network"})
+		return
+	}
+
+	release, err := s.leaseEnrollment(c.Request.Context(), hostname)
+	if err != nil {
+		api_error := err.(*models.ApiError)
+		c.JSON(api_error.Code, api_error)
+		return
+	}
+	defer release()
+	//The status may have changed since it was first read, before the lease was acquired
+	if status, _, err = s.readNcsrStatus(c.Request.Context(), hostname); err != nil {
+		c.JSON(http.StatusInternalServerError, models.ApiError{Code: 500, Message: "Internal Server Error: " + err.Error()})
+		return
+	}
+
+	if status.Status != models.PENDING {
+		c.JSON(http.StatusConflict, models.ApiError{Code: 409, Message: "Conflict. This hostname has already enrolled. If you want to re-enroll, please visit https://" + s.Config.ServiceIP + ":" + s.Config.ServicePort + s.networkPath() + "/ncsr/" + hostname + "/reenroll"})
 		return
 	}
 
@@ -477,26 +575,20 @@ func Enroll(c *gin.Context) {
 		return
 	}
 
-	status_code, api_error := verifyCsr(csr, hostname, models.ENROLL)
+	status_code, api_error := s.verifyCsr(csr, hostname, models.ENROLL)
 	if api_error != nil {
 		c.JSON(status_code, api_error)
 		return
 	}
 
-	raw_csr_resp, err := getRawCSRResponse(hostname, &csr, models.ENROLL)
+	raw_csr_resp, err := s.getRawCSRResponse(c.Request.Context(), hostname, &csr, models.ENROLL)
 	if err != nil {
-		fmt.Printf("Internal server Error: %v\n", err)
+		slog.ErrorContext(c.Request.Context(), "Internal server error", "hostname", hostname, "error", err)
 		c.JSON(http.StatusInternalServerError, models.ApiError{Code: 500, Message: "Internal Server Error: " + err.Error()})
 		return
 	}
 
-	b, err = proto.Marshal(raw_csr_resp)
-	if err != nil {
-		fmt.Printf("Internal server Error%v\n", err)
-		c.JSON(http.StatusInternalServerError, models.ApiError{Code: 500, Message: "Internal Server Error: " + err.Error()})
-		return
-	}
-	c.JSON(http.StatusOK, b)
+	s.respondCsrResponse(c, hostname, raw_csr_resp)
 }
 
 /*
@@ -506,16 +598,16 @@ The process can be initiated if the client's keys have been compromised and ther
 It ends with the client being provided its new Nebula certificate.
 The NCSR status file will also be modified to COMPLETED.
 */
-func Reenroll(c *gin.Context) {
+func (s *Service) Reenroll(c *gin.Context) {
 	hostname := c.Param("hostname")
 	if len(strings.TrimSpace(hostname)) == 0 {
 		c.JSON(http.StatusBadRequest, models.ApiError{Code: 400, Message: "Bad request: no hostname provided"})
 		return
 	}
 
-	b, err := os.ReadFile(utils.Ncsr_folder + hostname)
+	status, _, err := s.readNcsrStatus(c.Request.Context(), hostname)
 	if err != nil {
-		c.JSON(http.StatusUnauthorized, models.ApiError{Code: 401, Message: "Unhautorized: please authenticate yourself to https://" + utils.Service_ip + ":" + utils.Service_port + "/ncsr providing your hostname and secret, before accessing this endpoint"})
+		c.JSON(http.StatusUnauthorized, models.ApiError{Code: 401, Message: "Unhautorized: please authenticate yourself to https://" + s.Config.ServiceIP + ":" + s.Config.ServicePort + s.networkPath() + "/ncsr providing your hostname and secret, before accessing this endpoint"})
 		return
 	}
 
@@ -524,13 +616,31 @@ func Reenroll(c *gin.Context) {
 		c.JSON(http.StatusUnauthorized, models.ApiError{Code: 401, Message: "Unhautorized: please provide a valid token before accessing this endpoint"})
 		return
 	}
-	if err := checkClientToken(client_token, hostname); err != nil {
+	if err := s.checkClientToken(client_token, hostname); err != nil {
 		c.JSON(http.StatusUnauthorized, models.ApiError{Code: 401, Message: "Unhautorized: please provide a valid token before accessing this endpoint"})
 		return
 	}
 
-	if isPending, _ := regexp.Match(string(models.PENDING), b); isPending {
-		c.JSON(http.StatusConflict, models.ApiError{Code: 409, Message: "Conflict. This hostname has not yet finished enrolling. If you want to do so, please visit https://" + utils.Service_ip + ":" + utils.Service_port + "/ncsr/" + hostname + "/enroll"})
+	if isValid, err := s.isValidHostname(hostname); err != nil || !isValid {
+		c.JSON(http.StatusForbidden, models.ApiError{Code: 403, Message: "Forbidden: the hostname you provided is no longer part of the Nebula network"})
+		return
+	}
+
+	release, err := s.leaseEnrollment(c.Request.Context(), hostname)
+	if err != nil {
+		api_error := err.(*models.ApiError)
+		c.JSON(api_error.Code, api_error)
+		return
+	}
+	defer release()
+	//The status may have changed since it was first read, before the lease was acquired
+	if status, _, err = s.readNcsrStatus(c.Request.Context(), hostname); err != nil {
+		c.JSON(http.StatusInternalServerError, models.ApiError{Code: 500, Message: "Internal Server Error: " + err.Error()})
+		return
+	}
+
+	if status.Status == models.PENDING {
+		c.JSON(http.StatusConflict, models.ApiError{Code: 409, Message: "Conflict. This hostname has not yet finished enrolling. If you want to do so, please visit https://" + s.Config.ServiceIP + ":" + s.Config.ServicePort + s.networkPath() + "/ncsr/" + hostname + "/enroll"})
 		return
 	}
 
@@ -541,43 +651,38 @@ func Reenroll(c *gin.Context) {
 		return
 	}
 
-	status_code, api_error := verifyCsr(csr, hostname, models.RENROLL)
+	status_code, api_error := s.verifyCsr(csr, hostname, models.RENROLL)
 	if api_error != nil {
 		c.JSON(status_code, api_error)
 		return
 	}
 
-	raw_csr_resp, err := getRawCSRResponse(hostname, &csr, models.RENROLL)
+	raw_csr_resp, err := s.getRawCSRResponse(c.Request.Context(), hostname, &csr, models.RENROLL)
 	if err != nil {
 		if api_error, ok := err.(*models.ApiError); ok {
 			c.JSON(api_error.Code, api_error)
+			return
 		}
 		c.JSON(http.StatusInternalServerError, models.ApiError{Code: 500, Message: "Internal Server Error: " + err.Error()})
 		return
 	}
 
-	b, err = proto.Marshal(raw_csr_resp)
-	if err != nil {
-		fmt.Printf("Internal server Error%v\n", err)
-		c.JSON(http.StatusInternalServerError, models.ApiError{Code: 500, Message: "Internal Server Error: " + err.Error()})
-		return
-	}
-	c.JSON(http.StatusOK, b)
+	s.respondCsrResponse(c, hostname, raw_csr_resp)
 }
 
 /*
 The Serverkeygen REST enpoint performs the enrollment of a client to the system by requesting the nest_ca to generate the Nebula key pairs in stead of the client.
 The function return conditions are the same as the Enroll endpoint
 */
-func Serverkeygen(c *gin.Context) {
+func (s *Service) Serverkeygen(c *gin.Context) {
 	hostname := c.Param("hostname")
 	if len(strings.TrimSpace(hostname)) == 0 {
 		c.JSON(http.StatusBadRequest, models.ApiError{Code: 400, Message: "Bad request: no hostname provided"})
 		return
 	}
-	b, err := os.ReadFile(utils.Ncsr_folder + hostname)
+	status, _, err := s.readNcsrStatus(c.Request.Context(), hostname)
 	if err != nil {
-		c.JSON(http.StatusUnauthorized, models.ApiError{Code: 401, Message: "Unhautorized: please authenticate yourself to https://" + utils.Service_ip + ":" + utils.Service_port + "/ncsr providing your hostname and secret, before accessing this endpoint"})
+		c.JSON(http.StatusUnauthorized, models.ApiError{Code: 401, Message: "Unhautorized: please authenticate yourself to https://" + s.Config.ServiceIP + ":" + s.Config.ServicePort + s.networkPath() + "/ncsr providing your hostname and secret, before accessing this endpoint"})
 		return
 	}
 
@@ -586,13 +691,31 @@ func Serverkeygen(c *gin.Context) {
 		c.JSON(http.StatusUnauthorized, models.ApiError{Code: 401, Message: "Unhautorized: please provide a valid token before accessing this endpoint"})
 		return
 	}
-	if err := checkClientToken(client_token, hostname); err != nil {
+	if err := s.checkClientToken(client_token, hostname); err != nil {
 		c.JSON(http.StatusUnauthorized, models.ApiError{Code: 401, Message: "Unhautorized: please provide a valid token before accessing this endpoint"})
 		return
 	}
 
-	if isPending, _ := regexp.Match(string(models.PENDING), b); !isPending {
-		c.JSON(http.StatusConflict, models.ApiError{Code: 409, Message: "Conflict. This hostname has already enrolled. If you want to re-enroll, please visit https:https://" + utils.Service_ip + ":" + utils.Service_port + "/ncsr/" + hostname + "/reenroll"})
+	if isValid, err := s.isValidHostname(hostname); err != nil || !isValid {
+		c.JSON(http.StatusForbidden, models.ApiError{Code: 403, Message: "Forbidden: the hostname you provided is no longer part of the Nebula network"})
+		return
+	}
+
+	release, err := s.leaseEnrollment(c.Request.Context(), hostname)
+	if err != nil {
+		api_error := err.(*models.ApiError)
+		c.JSON(api_error.Code, api_error)
+		return
+	}
+	defer release()
+	//The status may have changed since it was first read, before the lease was acquired
+	if status, _, err = s.readNcsrStatus(c.Request.Context(), hostname); err != nil {
+		c.JSON(http.StatusInternalServerError, models.ApiError{Code: 500, Message: "Internal Server Error: " + err.Error()})
+		return
+	}
+
+	if status.Status != models.PENDING {
+		c.JSON(http.StatusConflict, models.ApiError{Code: 409, Message: "Conflict. This hostname has already enrolled. If you want to re-enroll, please visit https:https://" + s.Config.ServiceIP + ":" + s.Config.ServicePort + s.networkPath() + "/ncsr/" + hostname + "/reenroll"})
 		return
 	}
 
@@ -603,24 +726,78 @@ func Serverkeygen(c *gin.Context) {
 		return
 	}
 
-	status_code, api_error := verifyCsr(csr, hostname, models.SERVERKEYGEN)
+	status_code, api_error := s.verifyCsr(csr, hostname, models.SERVERKEYGEN)
 	if api_error != nil {
 		c.JSON(status_code, api_error)
 		return
 	}
 
-	raw_csr_resp, err := getRawCSRResponse(hostname, &csr, models.SERVERKEYGEN)
+	raw_csr_resp, err := s.getRawCSRResponse(c.Request.Context(), hostname, &csr, models.SERVERKEYGEN)
 	if err != nil {
-		fmt.Printf("Internal server Error: %v\n", err)
+		slog.ErrorContext(c.Request.Context(), "Internal server error", "hostname", hostname, "error", err)
 		c.JSON(http.StatusInternalServerError, models.ApiError{Code: 500, Message: "Internal Server Error: " + err.Error()})
 		return
 	}
 
-	b, err = proto.Marshal(raw_csr_resp)
+	s.respondCsrResponse(c, hostname, raw_csr_resp)
+}
+
+/*
+The NebulaConfig REST endpoint returns the current Nebula configuration file of an enrolled client, so that configuration changes reach it without a re-enrollment.
+The version of the configuration file is sent as ETag: if the If-None-Match header of the request holds it, a 304 with no content is returned.
+The signature of the configuration file by the NEST config service, if signed, is sent in the NEST-Config-Signature header.
+*/
+func (s *Service) NebulaConfig(c *gin.Context) {
+	hostname := c.Param("hostname")
+	if len(strings.TrimSpace(hostname)) == 0 {
+		c.JSON(http.StatusBadRequest, models.ApiError{Code: 400, Message: "Bad request: no hostname provided"})
+		return
+	}
+	status, _, err := s.readNcsrStatus(c.Request.Context(), hostname)
 	if err != nil {
-		fmt.Printf("Internal server Error%v\n", err)
+		c.JSON(http.StatusUnauthorized, models.ApiError{Code: 401, Message: "Unhautorized: please authenticate yourself to https://" + s.Config.ServiceIP + ":" + s.Config.ServicePort + s.networkPath() + "/ncsr providing your hostname and secret, before accessing this endpoint"})
+		return
+	}
+
+	client_token := c.Request.Header.Get("NESToken")
+	if len(strings.TrimSpace(client_token)) == 0 {
+		c.JSON(http.StatusUnauthorized, models.ApiError{Code: 401, Message: "Unhautorized: please provide a valid token before accessing this endpoint"})
+		return
+	}
+	if err := s.checkClientToken(client_token, hostname); err != nil {
+		c.JSON(http.StatusUnauthorized, models.ApiError{Code: 401, Message: "Unhautorized: please provide a valid token before accessing this endpoint"})
+		return
+	}
+
+	if isValid, err := s.isValidHostname(hostname); err != nil || !isValid {
+		c.JSON(http.StatusForbidden, models.ApiError{Code: 403, Message: "Forbidden: the hostname you provided is no longer part of the Nebula network"})
+		return
+	}
+
+	if status.Status != models.COMPLETED {
+		c.JSON(http.StatusConflict, models.ApiError{Code: 409, Message: "Conflict. This hostname has not yet finished enrolling. If you want to do so, please visit https://" + s.Config.ServiceIP + ":" + s.Config.ServicePort + s.networkPath() + "/ncsr/" + hostname + "/enroll"})
+		return
+	}
+
+	conf_resp, err := s.requestConf(c.Request.Context(), hostname)
+	if err != nil {
+		slog.ErrorContext(c.Request.Context(), "Could not get the Nebula configuration file", "hostname", hostname, "error", err)
 		c.JSON(http.StatusInternalServerError, models.ApiError{Code: 500, Message: "Internal Server Error: " + err.Error()})
 		return
 	}
-	c.JSON(http.StatusOK, b)
+	//Older nest_config services do not send the version of the configuration file
+	if len(conf_resp.Version) == 0 {
+		conf_resp.Version = models.ConfVersion(conf_resp.NebulaConf)
+	}
+
+	etag := "\"" + conf_resp.Version + "\""
+	c.Header("ETag", etag)
+	if len(conf_resp.Signature) != 0 {
+		c.Header(models.CONF_SIGNATURE_HEADER, base64.StdEncoding.EncodeToString(conf_resp.Signature))
+	}
+	if if_none_match := c.GetHeader("If-None-Match"); if_none_match == etag || if_none_match == "*" {
+		c.Status(http.StatusNotModified)
+		return
+	}
+	c.Data(http.StatusOK, "application/x-yaml", conf_resp.NebulaConf)
 }
@@ -2,24 +2,45 @@ package nest_service
 
 import (
 	"bytes"
+	"context"
+	"encoding/base32"
 	"encoding/json"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/go-playground/assert/v2"
 	nest_ca "github.com/m4rkdc/nebula_est/nest_ca/pkg/logic"
 	nest_config "github.com/m4rkdc/nebula_est/nest_config/pkg/logic"
+	"github.com/m4rkdc/nebula_est/nest_service/pkg/client"
+	"github.com/m4rkdc/nebula_est/nest_service/pkg/config"
 	"github.com/m4rkdc/nebula_est/nest_service/pkg/models"
-	"github.com/m4rkdc/nebula_est/nest_service/pkg/utils"
 	nest_test "github.com/m4rkdc/nebula_est/nest_service/test"
+	"github.com/pquerna/otp"
+	"github.com/pquerna/otp/totp"
 	"github.com/slackhq/nebula/cert"
 	"google.golang.org/protobuf/encoding/protojson"
 )
 
+// newTestService creates a NEST service instance contacting the NEST CA and NEST config services in compatibility mode, as they are run with their REST routes
+func newTestService() *Service {
+	cfg := config.DefaultService()
+	cfg.Downstream.Protocol = client.REST
+	return New(&cfg, nil)
+}
+
+// reconnect recreates the clients of the NEST CA and NEST config services after their endpoints have changed
+func reconnect(s *Service) {
+	settings := client.SettingsFrom(s.Config.Downstream)
+	s.Ca = client.NewCaClient(s.Config.Ca, settings)
+	s.Conf = client.NewConfClient(s.Config.Conf, settings)
+}
+
 func sendNcsrApplication(t *testing.T, r *gin.Engine, endpoint models.Route, auth models.NestAuth) *httptest.ResponseRecorder {
 	authBytes, _ := json.Marshal(auth)
 	req, _ := http.NewRequest(endpoint.Method, endpoint.Pattern, bytes.NewReader(authBytes))
@@ -61,8 +82,9 @@ func sendNcsrStatus(t *testing.T, r *gin.Engine, endpoint models.Route, hostname
 }*/
 
 func TestNcsrApplication(t *testing.T) {
+	s := newTestService()
 	var (
-		endpoint models.Route = Service_routes[1]
+		endpoint models.Route = s.Routes()[1]
 		auth     models.NestAuth
 		err      models.ApiError
 	)
@@ -78,10 +100,10 @@ func TestNcsrApplication(t *testing.T) {
 	assert.Equal(t, errBytes, resp.Body.Bytes())
 
 	//Second test: hostname already enrolled
-	utils.Ncsr_folder = "../../test/ncsr/"
+	s.Config.NcsrFolder = "../../test/ncsr/"
 
 	auth.Hostname = "abc"
-	err = models.ApiError{Code: 409, Message: "Conflict. A Nebula CSR for the hostname you provided already exists. If you want to re-enroll, please visit https://" + utils.Service_ip + ":" + utils.Service_port + "/ncsr/" + auth.Hostname + "/reenroll"}
+	err = models.ApiError{Code: 409, Message: "Conflict. A Nebula CSR for the hostname you provided already exists. If you want to re-enroll, please visit https://" + s.Config.ServiceIP + ":" + s.Config.ServicePort + "/ncsr/" + auth.Hostname + "/reenroll"}
 	errBytes, _ = json.Marshal(err)
 	resp = sendNcsrApplication(t, r, endpoint, auth)
 	assert.Equal(t, http.StatusConflict, resp.Code)
@@ -93,7 +115,7 @@ func TestNcsrApplication(t *testing.T) {
 	assert.Equal(t, http.StatusInternalServerError, resp.Code)
 
 	//Fourth test: hostname is not valid
-	utils.Hostnames_file = "../../test/config/hostnames"
+	s.Config.HostnamesFile = "../../test/config/hostnames"
 	err = models.ApiError{Code: 400, Message: "Bad request: The hostname you provided was not found in the Configuration service list"}
 	errBytes, _ = json.Marshal(err)
 	resp = sendNcsrApplication(t, r, endpoint, auth)
@@ -101,15 +123,15 @@ func TestNcsrApplication(t *testing.T) {
 	assert.Equal(t, errBytes, resp.Body.Bytes())
 
 	//Fifth test: cannot find key
-	os.Remove(utils.Ncsr_folder + "lighthouse")
+	os.Remove(s.Config.NcsrFolder + "lighthouse")
 	auth.Hostname = "lighthouse"
-	auth.Secret = sign("abc", nil)
+	auth.Secret = s.sign("abc", nil)
 	resp = sendNcsrApplication(t, r, endpoint, auth)
 	assert.Equal(t, http.StatusInternalServerError, resp.Code)
 
-	utils.HMAC_key = "../../test/config/hmac.key"
+	s.Config.HMACKey = "../../test/config/hmac.key"
 	//Sixth test: secret is not valid
-	auth.Secret = sign("abc", nil)
+	auth.Secret = s.sign("abc", nil)
 	err = models.ApiError{Code: 400, Message: "Bad Request. Could not succesfully verify the provided secret"}
 	errBytes, _ = json.Marshal(err)
 	resp = sendNcsrApplication(t, r, endpoint, auth)
@@ -117,26 +139,31 @@ func TestNcsrApplication(t *testing.T) {
 	assert.Equal(t, errBytes, resp.Body.Bytes())
 
 	//Seventh test: success
-	auth.Secret = sign(auth.Hostname, nil)
+	auth.Secret = s.sign(auth.Hostname, nil)
 	resp = sendNcsrApplication(t, r, endpoint, auth)
 	assert.Equal(t, http.StatusCreated, resp.Code)
-	assert.Equal(t, "http://"+utils.Service_ip+":"+utils.Service_port+"/ncsr/"+auth.Hostname, resp.Header().Get("Location"))
+	assert.Equal(t, "http://"+s.Config.ServiceIP+":"+s.Config.ServicePort+"/ncsr/"+auth.Hostname, resp.Header().Get("Location"))
 }
 
 func TestEnroll(t *testing.T) {
+	s := newTestService()
+	ca_cfg := config.DefaultCa()
+	ca := nest_ca.New(&ca_cfg)
+	conf_cfg := config.DefaultConf()
+	conf := nest_config.New(&conf_cfg)
 	var (
 		csr             = &models.NebulaCsr{}
-		endpoint        = Service_routes[2]
-		ca_endpoint     = nest_ca.Ca_routes[1]
-		config_endpoint = nest_config.Conf_routes[1]
+		endpoint        = s.Routes()[2]
+		ca_endpoint     = ca.Routes()[1]
+		config_endpoint = conf.Routes()[1]
 		err             models.ApiError
 		hostname        string
 		errTest         models.ApiError
 	)
 
 	r := nest_test.MockRouterForEndpoint(&endpoint)
-	utils.Ncsr_folder = "../../test/ncsr/"
-	applicationFile, _ := os.OpenFile(utils.Ncsr_folder+"lighthouse", os.O_CREATE|os.O_WRONLY, 0600)
+	s.Config.NcsrFolder = "../../test/ncsr/"
+	applicationFile, _ := os.OpenFile(s.Config.NcsrFolder+"lighthouse", os.O_CREATE|os.O_WRONLY, 0600)
 	applicationFile.WriteString(string(models.PENDING))
 	//First test: empty hostname
 	hostname = " "
@@ -148,7 +175,7 @@ func TestEnroll(t *testing.T) {
 
 	//Second test: not authorized
 	hostname = "prova"
-	err = models.ApiError{Code: 401, Message: "Unhautorized: please authenticate yourself to https://" + utils.Service_ip + ":" + utils.Service_port + "/ncsr providing your hostname and secret, before accessing this endpoint"}
+	err = models.ApiError{Code: 401, Message: "Unhautorized: please authenticate yourself to https://" + s.Config.ServiceIP + ":" + s.Config.ServicePort + "/ncsr providing your hostname and secret, before accessing this endpoint"}
 	errBytes, _ = json.Marshal(err)
 	resp = sendEnroll(t, r, endpoint, hostname, csr)
 	assert.Equal(t, http.StatusUnauthorized, resp.Code)
@@ -156,7 +183,7 @@ func TestEnroll(t *testing.T) {
 
 	//Third test: hostname already enrolled
 	hostname = "abc"
-	err = models.ApiError{Code: 409, Message: "Conflict. This hostname has already enrolled. If you want to re-enroll, please visit https://" + utils.Service_ip + ":" + utils.Service_port + "/ncsr/" + hostname + "/reenroll"}
+	err = models.ApiError{Code: 409, Message: "Conflict. This hostname has already enrolled. If you want to re-enroll, please visit https://" + s.Config.ServiceIP + ":" + s.Config.ServicePort + "/ncsr/" + hostname + "/reenroll"}
 	errBytes, _ = json.Marshal(err)
 	resp = sendEnroll(t, r, endpoint, hostname, csr)
 	assert.Equal(t, http.StatusConflict, resp.Code)
@@ -164,7 +191,7 @@ func TestEnroll(t *testing.T) {
 
 	//Fourth test: no Nebula CSR
 	hostname = "lighthouse"
-	utils.Hostnames_file = "../../test/config/hostnames"
+	s.Config.HostnamesFile = "../../test/config/hostnames"
 	err = models.ApiError{Code: 400, Message: "Bad request: no Nebula Certificate Signing Request provided"}
 	resp = sendEnroll(t, r, endpoint, hostname, nil)
 	assert.Equal(t, http.StatusBadRequest, resp.Code)
@@ -190,7 +217,7 @@ func TestEnroll(t *testing.T) {
 	assert.Equal(t, errBytes, resp.Body.Bytes())
 
 	//Seventh test: simple enroll but serverkeygen is true
-	err = models.ApiError{Code: 400, Message: "Bad Request. ServerKeygen is true. If you wanted to enroll with a server keygen, please visit https://" + utils.Service_ip + ":" + utils.Service_port + "/" + "/ncsr/" + hostname + "/serverkeygen"}
+	err = models.ApiError{Code: 400, Message: "Bad Request. ServerKeygen is true. If you wanted to enroll with a server keygen, please visit https://" + s.Config.ServiceIP + ":" + s.Config.ServicePort + "/" + "/ncsr/" + hostname + "/serverkeygen"}
 	errBytes, _ = json.Marshal(err)
 	csr.Rekey = false
 	csr.ServerKeygen = true
@@ -209,19 +236,21 @@ func TestEnroll(t *testing.T) {
 	//Ninth test: success
 
 	r2 := nest_test.MockRouterForEndpoint(&ca_endpoint)
-	utils.Certificates_path = "../../../nest_ca/test/certificates/"
-	os.Remove(utils.Certificates_path + csr.Hostname + ".crt")
-	utils.Ca_bin = "../../../nest_ca/test/config/bin/nebula-cert"
-	utils.Ca_keys_path = "../../../nest_ca/test/config/keys/"
-	utils.Ca_service_ip = "localhost"
-	utils.Ca_service_port = "9000"
-	go r2.Run(utils.Ca_service_ip + ":" + utils.Ca_service_port)
+	ca_cfg.CertificatesPath = "../../../nest_ca/test/certificates/"
+	os.Remove(ca_cfg.CertificatesPath + csr.Hostname + ".crt")
+	ca_cfg.CaBin = "../../../nest_ca/test/config/bin/nebula-cert"
+	ca_cfg.CaKeysPath = "../../../nest_ca/test/config/keys/"
+	s.Config.Ca.IP = "localhost"
+	s.Config.Ca.Port = "9000"
+	go r2.Run(s.Config.Ca.IP + ":" + s.Config.Ca.Port)
+	reconnect(s)
 	r3 := nest_test.MockRouterForEndpoint(&config_endpoint)
-	utils.Dhall_dir = "../../../nest_config/test/dhall/"
-	utils.Dhall_configuration = utils.Dhall_dir + "nebula/nebula_conf.dhall"
-	utils.Conf_service_ip = "localhost"
-	utils.Conf_service_port = "9001"
-	go r3.Run(utils.Conf_service_ip + ":" + utils.Conf_service_port)
+	conf_cfg.DhallDir = "../../../nest_config/test/dhall/"
+	conf_cfg.DhallConfiguration = conf_cfg.DhallDir + "nebula/nebula_conf.dhall"
+	s.Config.Conf.IP = "localhost"
+	s.Config.Conf.Port = "9001"
+	go r3.Run(s.Config.Conf.IP + ":" + s.Config.Conf.Port)
+	reconnect(s)
 
 	b, _ := os.ReadFile("../../test/lighthouse.pub")
 	csr.PublicKey, _, _ = cert.UnmarshalX25519PublicKey(b)
@@ -232,10 +261,13 @@ func TestEnroll(t *testing.T) {
 func TestNcsrStatus(t *testing.T) {
 }
 func TestReenroll(t *testing.T) {
+	s := newTestService()
+	ca_cfg := config.DefaultCa()
+	ca := nest_ca.New(&ca_cfg)
 	var (
 		csr                      = &models.NebulaCsr{}
-		endpoint    models.Route = Service_routes[4]
-		ca_endpoint models.Route = nest_ca.Ca_routes[2]
+		endpoint    models.Route = s.Routes()[4]
+		ca_endpoint models.Route = ca.Routes()[2]
 		err         models.ApiError
 		hostname    string
 		errTest     models.ApiError
@@ -253,8 +285,8 @@ func TestReenroll(t *testing.T) {
 
 	//Second test: not authorized
 	hostname = "prova"
-	utils.Ncsr_folder = "../../test/ncsr/"
-	err = models.ApiError{Code: 401, Message: "Unhautorized: please authenticate yourself to https://" + utils.Service_ip + ":" + utils.Service_port + "/ncsr providing your hostname and secret, before accessing this endpoint"}
+	s.Config.NcsrFolder = "../../test/ncsr/"
+	err = models.ApiError{Code: 401, Message: "Unhautorized: please authenticate yourself to https://" + s.Config.ServiceIP + ":" + s.Config.ServicePort + "/ncsr providing your hostname and secret, before accessing this endpoint"}
 	errBytes, _ = json.Marshal(err)
 	resp = sendEnroll(t, r, endpoint, hostname, csr)
 	assert.Equal(t, http.StatusUnauthorized, resp.Code)
@@ -262,7 +294,7 @@ func TestReenroll(t *testing.T) {
 
 	//Third test: hostname not finished enrolling
 	hostname = "pending"
-	err = models.ApiError{Code: 409, Message: "Conflict. This hostname has not yet finished enrolling. If you want to do so, please visit https://" + utils.Service_ip + ":" + utils.Service_port + "/ncsr/" + hostname + "/enroll"}
+	err = models.ApiError{Code: 409, Message: "Conflict. This hostname has not yet finished enrolling. If you want to do so, please visit https://" + s.Config.ServiceIP + ":" + s.Config.ServicePort + "/ncsr/" + hostname + "/enroll"}
 	errBytes, _ = json.Marshal(err)
 	resp = sendEnroll(t, r, endpoint, hostname, csr)
 	assert.Equal(t, http.StatusConflict, resp.Code)
@@ -270,7 +302,7 @@ func TestReenroll(t *testing.T) {
 
 	//Fourth test: no Nebula CSR
 	hostname = "lighthouse"
-	utils.Hostnames_file = "../../test/config/hostnames"
+	s.Config.HostnamesFile = "../../test/config/hostnames"
 	err = models.ApiError{Code: 400, Message: "Bad request: no Nebula Certificate Signing Request provided"}
 	resp = sendEnroll(t, r, endpoint, hostname, nil)
 	assert.Equal(t, http.StatusBadRequest, resp.Code)
@@ -297,24 +329,26 @@ func TestReenroll(t *testing.T) {
 
 	//Eigth test: success with serverkeygen
 	r2 := nest_test.MockRouterForEndpoint(&ca_endpoint)
-	utils.Certificates_path = "../../../nest_ca/test/certificates/"
-	utils.Ca_bin = "../../../nest_ca/test/config/bin/nebula-cert"
-	utils.Ca_keys_path = "../../../nest_ca/test/config/keys/"
-	utils.Ca_service_ip = "localhost"
-	utils.Ca_service_port = "9002"
-	go r2.Run(utils.Ca_service_ip + ":" + utils.Ca_service_port)
+	ca_cfg.CertificatesPath = "../../../nest_ca/test/certificates/"
+	ca_cfg.CaBin = "../../../nest_ca/test/config/bin/nebula-cert"
+	ca_cfg.CaKeysPath = "../../../nest_ca/test/config/keys/"
+	s.Config.Ca.IP = "localhost"
+	s.Config.Ca.Port = "9002"
+	go r2.Run(s.Config.Ca.IP + ":" + s.Config.Ca.Port)
+	reconnect(s)
 	csr.ServerKeygen = true
 	resp = sendEnroll(t, r, endpoint, hostname, csr)
 	assert.Equal(t, http.StatusOK, resp.Code)
 
 	//Eigth test: success with simple reenroll
-	ca_endpoint = nest_ca.Ca_routes[1]
-	utils.Ca_service_port = "9003"
+	ca_endpoint = ca.Routes()[1]
+	s.Config.Ca.Port = "9003"
 	r2 = nest_test.MockRouterForEndpoint(&ca_endpoint)
-	utils.Certificates_path = "../../../nest_ca/test/certificates/"
-	utils.Ca_bin = "../../../nest_ca/test/config/bin/nebula-cert"
-	utils.Ca_keys_path = "../../../nest_ca/test/config/keys/"
-	go r2.Run(utils.Ca_service_ip + ":" + utils.Ca_service_port)
+	ca_cfg.CertificatesPath = "../../../nest_ca/test/certificates/"
+	ca_cfg.CaBin = "../../../nest_ca/test/config/bin/nebula-cert"
+	ca_cfg.CaKeysPath = "../../../nest_ca/test/config/keys/"
+	go r2.Run(s.Config.Ca.IP + ":" + s.Config.Ca.Port)
+	reconnect(s)
 
 	csr.Rekey = true
 	csr.ServerKeygen = false
@@ -328,18 +362,23 @@ func TestReenroll(t *testing.T) {
 
 }
 func TestServerkeygen(t *testing.T) {
+	s := newTestService()
+	ca_cfg := config.DefaultCa()
+	ca := nest_ca.New(&ca_cfg)
+	conf_cfg := config.DefaultConf()
+	conf := nest_config.New(&conf_cfg)
 	var (
 		csr                          = &models.NebulaCsr{}
-		endpoint        models.Route = Service_routes[5]
-		ca_endpoint     models.Route = nest_ca.Ca_routes[2]
-		config_endpoint models.Route = nest_config.Conf_routes[1]
+		endpoint        models.Route = s.Routes()[5]
+		ca_endpoint     models.Route = ca.Routes()[2]
+		config_endpoint models.Route = conf.Routes()[1]
 		err             models.ApiError
 		hostname        string
 		errTest         models.ApiError
 	)
-	utils.Ncsr_folder = "../../test/ncsr/"
+	s.Config.NcsrFolder = "../../test/ncsr/"
 	r := nest_test.MockRouterForEndpoint(&endpoint)
-	os.WriteFile(utils.Ncsr_folder+"lighthouse", []byte("Pending"), 0600)
+	os.WriteFile(s.Config.NcsrFolder+"lighthouse", []byte("Pending"), 0600)
 
 	//First test: empty hostname
 	hostname = " "
@@ -351,8 +390,8 @@ func TestServerkeygen(t *testing.T) {
 
 	//Second test: not authorized
 	hostname = "prova"
-	utils.Ncsr_folder = "../../test/ncsr/"
-	err = models.ApiError{Code: 401, Message: "Unhautorized: please authenticate yourself to https://" + utils.Service_ip + ":" + utils.Service_port + "/ncsr providing your hostname and secret, before accessing this endpoint"}
+	s.Config.NcsrFolder = "../../test/ncsr/"
+	err = models.ApiError{Code: 401, Message: "Unhautorized: please authenticate yourself to https://" + s.Config.ServiceIP + ":" + s.Config.ServicePort + "/ncsr providing your hostname and secret, before accessing this endpoint"}
 	errBytes, _ = json.Marshal(err)
 	resp = sendEnroll(t, r, endpoint, hostname, csr)
 	assert.Equal(t, http.StatusUnauthorized, resp.Code)
@@ -360,7 +399,7 @@ func TestServerkeygen(t *testing.T) {
 
 	//Third test: hostname already enrolled
 	hostname = "abc"
-	err = models.ApiError{Code: 409, Message: "Conflict. This hostname has already enrolled. If you want to re-enroll, please visit https:https://" + utils.Service_ip + ":" + utils.Service_port + "/ncsr/" + hostname + "/reenroll"}
+	err = models.ApiError{Code: 409, Message: "Conflict. This hostname has already enrolled. If you want to re-enroll, please visit https:https://" + s.Config.ServiceIP + ":" + s.Config.ServicePort + "/ncsr/" + hostname + "/reenroll"}
 	errBytes, _ = json.Marshal(err)
 	resp = sendEnroll(t, r, endpoint, hostname, csr)
 	assert.Equal(t, http.StatusConflict, resp.Code)
@@ -368,7 +407,7 @@ func TestServerkeygen(t *testing.T) {
 
 	//Fourth test: no Nebula CSR
 	hostname = "lighthouse"
-	utils.Hostnames_file = "../../test/config/hostnames"
+	s.Config.HostnamesFile = "../../test/config/hostnames"
 	err = models.ApiError{Code: 400, Message: "Bad request: no Nebula Certificate Signing Request provided"}
 	resp = sendEnroll(t, r, endpoint, hostname, nil)
 	assert.Equal(t, http.StatusBadRequest, resp.Code)
@@ -394,7 +433,7 @@ func TestServerkeygen(t *testing.T) {
 	assert.Equal(t, errBytes, resp.Body.Bytes())
 
 	//Seventh test: serverkeygen enroll but serverkeygen is false
-	err = models.ApiError{Code: 400, Message: "Bad Request. ServerKeygen is false. If you wanted to enroll with a client-generated nebula public key, please visit https://" + utils.Service_ip + ":" + utils.Service_port + "/" + "/ncsr/" + hostname + "/enroll"}
+	err = models.ApiError{Code: 400, Message: "Bad Request. ServerKeygen is false. If you wanted to enroll with a client-generated nebula public key, please visit https://" + s.Config.ServiceIP + ":" + s.Config.ServicePort + "/" + "/ncsr/" + hostname + "/enroll"}
 	errBytes, _ = json.Marshal(err)
 	csr.Rekey = false
 	resp = sendEnroll(t, r, endpoint, hostname, csr)
@@ -403,21 +442,87 @@ func TestServerkeygen(t *testing.T) {
 
 	//Eighth test: success
 	r2 := nest_test.MockRouterForEndpoint(&ca_endpoint)
-	utils.Certificates_path = "../../../nest_ca/test/certificates/"
-	os.Remove(utils.Certificates_path + csr.Hostname + ".crt")
-	utils.Ca_bin = "../../../nest_ca/test/config/bin/nebula-cert"
-	utils.Ca_keys_path = "../../../nest_ca/test/config/keys/"
-	utils.Ca_service_ip = "localhost"
-	utils.Ca_service_port = "9005"
-	go r2.Run(utils.Ca_service_ip + ":" + utils.Ca_service_port)
+	ca_cfg.CertificatesPath = "../../../nest_ca/test/certificates/"
+	os.Remove(ca_cfg.CertificatesPath + csr.Hostname + ".crt")
+	ca_cfg.CaBin = "../../../nest_ca/test/config/bin/nebula-cert"
+	ca_cfg.CaKeysPath = "../../../nest_ca/test/config/keys/"
+	s.Config.Ca.IP = "localhost"
+	s.Config.Ca.Port = "9005"
+	go r2.Run(s.Config.Ca.IP + ":" + s.Config.Ca.Port)
+	reconnect(s)
 	r3 := nest_test.MockRouterForEndpoint(&config_endpoint)
-	utils.Dhall_dir = "../../../nest_config/test/dhall/"
-	utils.Dhall_configuration = utils.Dhall_dir + "nebula/nebula_conf.dhall"
-	utils.Conf_service_ip = "localhost"
-	utils.Conf_service_port = "9006"
-	go r3.Run(utils.Conf_service_ip + ":" + utils.Conf_service_port)
+	conf_cfg.DhallDir = "../../../nest_config/test/dhall/"
+	conf_cfg.DhallConfiguration = conf_cfg.DhallDir + "nebula/nebula_conf.dhall"
+	s.Config.Conf.IP = "localhost"
+	s.Config.Conf.Port = "9006"
+	go r3.Run(s.Config.Conf.IP + ":" + s.Config.Conf.Port)
+	reconnect(s)
 
 	csr.ServerKeygen = true
 	resp = sendEnroll(t, r, endpoint, hostname, csr)
 	assert.Equal(t, http.StatusOK, resp.Code)
 }
+
+func TestLeaseEnrollment(t *testing.T) {
+	s := newTestService()
+	s.Config.NcsrFolder = t.TempDir() + "/"
+	s.Config.Store.LeaseTTL = config.Duration(60 * time.Millisecond)
+	ctx := context.Background()
+
+	//First test: the lease is renewed while the enrollment outlasts its TTL
+	release, err := s.leaseEnrollment(ctx, "lighthouse")
+	assert.Equal(t, nil, err)
+	time.Sleep(200 * time.Millisecond)
+	_, err = s.leaseEnrollment(ctx, "lighthouse")
+	assert.Equal(t, 409, err.(*models.ApiError).Code)
+
+	//Second test: once released, the lease is no longer renewed and the hostname can enroll again
+	release()
+	release, err = s.leaseEnrollment(ctx, "lighthouse")
+	assert.Equal(t, nil, err)
+	release()
+}
+
+func TestNebulaConfig(t *testing.T) {
+	s := newTestService()
+	conf := []byte("pki:\n  ca: /etc/nebula/ca.crt\n")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(models.ConfResponse{NebulaConf: conf, Ip: "192.168.100.2/24", NebulaPath: "/etc/nebula/"})
+	}))
+	defer server.Close()
+	s.Config.Conf.IP, s.Config.Conf.Port, _ = net.SplitHostPort(strings.TrimPrefix(server.URL, "http://"))
+	reconnect(s)
+	s.Config.NcsrFolder = t.TempDir() + "/"
+	s.hostnames.replace([]string{"lighthouse", "pending"})
+	s.writeNcsrStatus(context.Background(), "lighthouse", &models.NcsrStatus{Status: models.COMPLETED, Fingerprint: "a"}, "")
+	s.writeNcsrStatus(context.Background(), "pending", &models.NcsrStatus{Status: models.PENDING}, "")
+
+	endpoint := s.Routes()[6]
+	r := nest_test.MockRouterForEndpoint(&endpoint)
+	send := func(hostname string, if_none_match string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(endpoint.Method, strings.ReplaceAll(endpoint.Pattern, ":hostname", hostname), http.NoBody)
+		token, _ := totp.GenerateCodeCustom(base32.StdEncoding.EncodeToString(s.sign(hostname, nil)), time.Now(), totp.ValidateOpts{Digits: 10, Period: 2, Skew: 1, Algorithm: otp.AlgorithmSHA256})
+		req.Header.Set("NESToken", token)
+		if len(if_none_match) != 0 {
+			req.Header.Set("If-None-Match", if_none_match)
+		}
+		resp := httptest.NewRecorder()
+		r.ServeHTTP(resp, req)
+		return resp
+	}
+
+	//First test: the hostname has not finished enrolling
+	assert.Equal(t, http.StatusConflict, send("pending", "").Code)
+
+	//Second test: the configuration file is returned with its version as ETag
+	resp := send("lighthouse", "")
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, conf, resp.Body.Bytes())
+	etag := "\"" + models.ConfVersion(conf) + "\""
+	assert.Equal(t, etag, resp.Header().Get("ETag"))
+
+	//Third test: the client already has the current version
+	resp = send("lighthouse", etag)
+	assert.Equal(t, http.StatusNotModified, resp.Code)
+	assert.Equal(t, 0, resp.Body.Len())
+}
@@ -0,0 +1,81 @@
+package nest_service
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/m4rkdc/nebula_est/nest_service/pkg/metrics"
+	"github.com/m4rkdc/nebula_est/nest_service/pkg/models"
+	"github.com/m4rkdc/nebula_est/nest_service/pkg/store"
+)
+
+/*
+checkExpiringCertificates inspects the NCSR statuses and emits a certificate.expiring event for every client whose certificate expires within warning.
+notified keeps the fingerprints of the certificates already notified, so that each certificate is reported only once.
+The certificate expiry metric of every enrolled client is refreshed along the way, and deleted for the hosts revoked from the Nebula network.
+*/
+func (s *Service) checkExpiringCertificates(ctx context.Context, now time.Time, warning time.Duration, notified map[string]string) error {
+	hostnames, err := s.ncsrStore().List(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, hostname := range hostnames {
+		status, _, err := s.readNcsrStatus(ctx, hostname)
+		if err != nil || status.Status != models.COMPLETED || status.NotAfter == nil {
+			continue
+		}
+		if s.hostnames.revoked(hostname) {
+			metrics.CertificateExpiry.DeleteLabelValues(s.Config.Network, hostname)
+			continue
+		}
+		metrics.CertificateExpiry.WithLabelValues(s.Config.Network, hostname).Set(float64(status.NotAfter.Unix()))
+		if now.After(*status.NotAfter) || status.NotAfter.Sub(now) > warning {
+			continue
+		}
+		if notified[hostname] == status.Fingerprint {
+			continue
+		}
+		notified[hostname] = status.Fingerprint
+		s.emit(models.CERTIFICATE_EXPIRING, hostname, map[string]string{
+			"fingerprint": status.Fingerprint,
+			"notAfter":    status.NotAfter.Format(time.RFC3339),
+		})
+	}
+	return nil
+}
+
+/*
+WatchCertificatesExpiry checks every interval for client certificates expiring within warning, until stop is closed.
+When several replicas share the NCSR store, only the one holding the certificates-expiry lease checks them, so that every certificate is notified once:
+another replica takes over if it stops renewing the lease.
+*/
+func (s *Service) WatchCertificatesExpiry(warning, interval time.Duration, stop <-chan struct{}) {
+	ctx := context.Background()
+	notified := make(map[string]string)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var lease *store.Lease
+	for {
+		if lease != nil && s.leases().Renew(ctx, lease, 2*interval) != nil {
+			lease = nil
+		}
+		if lease == nil {
+			lease, _ = s.leases().Acquire(ctx, "certificates-expiry", 2*interval)
+		}
+		if lease != nil {
+			if err := s.checkExpiringCertificates(ctx, time.Now(), warning, notified); err != nil {
+				slog.Warn("Could not check the client certificates expiration", "error", err)
+			}
+		}
+		select {
+		case <-stop:
+			if lease != nil {
+				s.leases().Release(ctx, lease)
+			}
+			return
+		case <-ticker.C:
+		}
+	}
+}
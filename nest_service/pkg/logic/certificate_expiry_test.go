@@ -0,0 +1,50 @@
+package nest_service
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/go-playground/assert/v2"
+	"github.com/m4rkdc/nebula_est/nest_service/pkg/events"
+	"github.com/m4rkdc/nebula_est/nest_service/pkg/metrics"
+	"github.com/m4rkdc/nebula_est/nest_service/pkg/models"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestCheckExpiringCertificates(t *testing.T) {
+	s := newTestService()
+	s.Config.NcsrFolder = t.TempDir() + "/"
+	queue := t.TempDir()
+	d, err := events.NewDispatcher([]string{"http://localhost:0"}, []byte("secret"), queue, 1)
+	assert.Equal(t, nil, err)
+	s.Events = d
+
+	ctx := context.Background()
+	now := time.Now()
+	soon := now.Add(time.Hour)
+	later := now.Add(30 * 24 * time.Hour)
+	s.writeNcsrStatus(ctx, "pending", &models.NcsrStatus{Status: models.PENDING}, "")
+	s.writeNcsrStatus(ctx, "expiring", &models.NcsrStatus{Status: models.COMPLETED, Fingerprint: "a", NotAfter: &soon}, "")
+	s.writeNcsrStatus(ctx, "valid", &models.NcsrStatus{Status: models.COMPLETED, Fingerprint: "b", NotAfter: &later}, "")
+
+	//First test: only the expiring certificate is notified
+	notified := make(map[string]string)
+	assert.Equal(t, nil, s.checkExpiringCertificates(ctx, now, 72*time.Hour, notified))
+	assert.Equal(t, map[string]string{"expiring": "a"}, notified)
+	entries, _ := os.ReadDir(queue)
+	assert.Equal(t, 2, len(entries))
+
+	//Second test: the same certificate is not notified twice
+	assert.Equal(t, nil, s.checkExpiringCertificates(ctx, now, 72*time.Hour, notified))
+	entries, _ = os.ReadDir(queue)
+	assert.Equal(t, 2, len(entries))
+
+	//Third test: the certificate expiry metric of a revoked host is deleted, and its certificate no longer checked
+	assert.Equal(t, float64(later.Unix()), testutil.ToFloat64(metrics.CertificateExpiry.WithLabelValues("", "valid")))
+	s.hostnames.replace([]string{"expiring"})
+	assert.Equal(t, nil, s.checkExpiringCertificates(ctx, now, 72*time.Hour, make(map[string]string)))
+	assert.Equal(t, false, metrics.CertificateExpiry.DeleteLabelValues("", "valid"))
+	assert.Equal(t, float64(soon.Unix()), testutil.ToFloat64(metrics.CertificateExpiry.WithLabelValues("", "expiring")))
+}
@@ -0,0 +1,226 @@
+package nest_service
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/m4rkdc/nebula_est/nest_service/pkg/metrics"
+	"github.com/m4rkdc/nebula_est/nest_service/pkg/models"
+)
+
+// Minimum time between two refreshes of the valid hostnames triggered by an unknown hostname
+const hostnames_min_refresh = 10 * time.Second
+
+// hostnameSet is the in-memory set of the valid hostnames of the Nebula network, kept in sync with the nest_config service
+type hostnameSet struct {
+	mu        sync.RWMutex
+	hostnames map[string]bool
+	//Hostname patterns of the host templates (e.g., sensor-*), whose matching hostnames can register as instances
+	patterns     []string
+	loaded       bool
+	syncing      bool
+	last_refresh time.Time
+}
+
+// contains tells if hostname is exactly one of the valid hostnames
+func (s *hostnameSet) contains(hostname string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.hostnames[hostname]
+}
+
+// revoked tells if hostname has been removed from the valid hostnames, once they are loaded
+func (s *hostnameSet) revoked(hostname string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.loaded && !s.hostnames[hostname]
+}
+
+// matches tells if hostname matches the hostname pattern of a host template
+func (s *hostnameSet) matches(hostname string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, p := range s.patterns {
+		if matched, _ := path.Match(p, hostname); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// add adds hostname to the valid hostnames, e.g. after its registration as an instance of a host template
+func (s *hostnameSet) add(hostname string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.hostnames == nil {
+		s.hostnames = make(map[string]bool)
+	}
+	s.hostnames[hostname] = true
+}
+
+/*
+replace sets the valid hostnames and returns the previously valid ones that have been removed, sorted.
+The entries containing the special characters of a shell pattern (*?[) are the hostname patterns of the host templates.
+*/
+func (s *hostnameSet) replace(hostnames []string) []string {
+	set := make(map[string]bool, len(hostnames))
+	var patterns []string
+	for _, h := range hostnames {
+		if h = strings.TrimSpace(h); len(h) == 0 {
+			continue
+		}
+		if strings.ContainsAny(h, "*?[") {
+			patterns = append(patterns, h)
+		} else {
+			set[h] = true
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var removed []string
+	for h := range s.hostnames {
+		if !set[h] {
+			removed = append(removed, h)
+		}
+	}
+	sort.Strings(removed)
+	s.hostnames = set
+	s.patterns = patterns
+	s.loaded = true
+	return removed
+}
+
+// LoadHostnames loads the valid hostnames stored in the Hostnames file
+func (s *Service) LoadHostnames() error {
+	b, err := os.ReadFile(s.Config.HostnamesFile)
+	if err != nil {
+		return err
+	}
+	s.hostnames.replace(strings.Split(string(b), "\n"))
+	return nil
+}
+
+// writeHostnamesFile stores the valid hostnames in the Hostnames file, so that they are available at the next start even if nest_config can't be reached
+func (s *Service) writeHostnamesFile(hostnames []string) error {
+	tmp := s.Config.HostnamesFile + ".tmp"
+	if err := os.WriteFile(tmp, []byte(strings.Join(hostnames, "\n")+"\n"), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.Config.HostnamesFile)
+}
+
+/*
+RefreshHostnames requests the valid hostnames and the hostname patterns of the host templates to the nest_config service, replacing the in-memory ones and the Hostnames file.
+A host.revoked event is emitted for every hostname removed from the Nebula network description: it can no longer enroll, and its certificate expiry metric is deleted.
+*/
+func (s *Service) RefreshHostnames(ctx context.Context) error {
+	hostnames, err := s.Conf.ListHostnames(ctx)
+	if err != nil {
+		return err
+	}
+
+	s.hostnames.mu.Lock()
+	s.hostnames.last_refresh = time.Now()
+	s.hostnames.mu.Unlock()
+
+	if err := s.writeHostnamesFile(hostnames); err != nil {
+		slog.ErrorContext(ctx, "Could not write the hostnames file", "error", err)
+	}
+	for _, h := range s.hostnames.replace(hostnames) {
+		slog.InfoContext(ctx, "Hostname removed from the Nebula network", "hostname", h)
+		s.emit(models.HOST_REVOKED, h, nil)
+		metrics.CertificateExpiry.DeleteLabelValues(s.Config.Network, h)
+	}
+	return nil
+}
+
+/*
+WatchHostnames refreshes the valid hostnames from the nest_config service every interval, until stop is closed.
+While it runs, an unknown hostname also triggers a refresh, at most once every 10 seconds, so that new hosts can enroll right away.
+*/
+func (s *Service) WatchHostnames(interval time.Duration, stop <-chan struct{}) {
+	s.hostnames.mu.Lock()
+	s.hostnames.syncing = true
+	s.hostnames.mu.Unlock()
+	defer func() {
+		s.hostnames.mu.Lock()
+		s.hostnames.syncing = false
+		s.hostnames.mu.Unlock()
+	}()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := s.RefreshHostnames(context.Background()); err != nil {
+			slog.Warn("Could not refresh the valid hostnames, keeping the previous ones", "error", err)
+		}
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// refreshOnDemand refreshes the valid hostnames if they are kept in sync with nest_config and have not been refreshed in the last 10 seconds
+func (s *Service) refreshOnDemand() bool {
+	s.hostnames.mu.Lock()
+	allowed := s.hostnames.syncing && time.Since(s.hostnames.last_refresh) >= hostnames_min_refresh
+	if allowed {
+		s.hostnames.last_refresh = time.Now()
+	}
+	s.hostnames.mu.Unlock()
+	if !allowed {
+		return false
+	}
+	if err := s.RefreshHostnames(context.Background()); err != nil {
+		slog.Warn("Could not refresh the valid hostnames", "error", err)
+		return false
+	}
+	return true
+}
+
+// isValidHostname checks if the provided hostname is exactly one of the valid hostnames of the Nebula network
+func (s *Service) isValidHostname(hostname string) (bool, error) {
+	s.hostnames.mu.RLock()
+	loaded := s.hostnames.loaded
+	s.hostnames.mu.RUnlock()
+	if !loaded {
+		if err := s.LoadHostnames(); err != nil {
+			return false, err
+		}
+	}
+
+	if s.hostnames.contains(hostname) {
+		return true, nil
+	}
+	if s.refreshOnDemand() {
+		return s.hostnames.contains(hostname), nil
+	}
+	return false, nil
+}
+
+/*
+registerInstance registers hostname as an instance of the host template whose pattern it matches, returning nil if it matches none.
+An instance that does not need an approval, or was approved, is a valid hostname from then on.
+*/
+func (s *Service) registerInstance(ctx context.Context, hostname string) (*models.Instance, error) {
+	if !s.hostnames.matches(hostname) {
+		return nil, nil
+	}
+	instance, err := s.Conf.RegisterInstance(ctx, hostname)
+	if err != nil {
+		return nil, err
+	}
+	if instance.Approved {
+		s.hostnames.add(hostname)
+	}
+	return instance, nil
+}
@@ -0,0 +1,98 @@
+package nest_service
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/go-playground/assert/v2"
+	"github.com/m4rkdc/nebula_est/nest_service/pkg/events"
+	"github.com/m4rkdc/nebula_est/nest_service/pkg/metrics"
+	"github.com/m4rkdc/nebula_est/nest_service/pkg/models"
+)
+
+func TestIsValidHostname(t *testing.T) {
+	s := newTestService()
+	s.Config.HostnamesFile = t.TempDir() + "/hostnames"
+	os.WriteFile(s.Config.HostnamesFile, []byte("lighthouse\nlaptop1\n\n"), 0600)
+
+	//First test: only exact hostnames are valid, regular expressions and substrings are not
+	for hostname, valid := range map[string]bool{"laptop1": true, "lighthouse": true, "lap": false, ".*": false, "laptop": false, "": false} {
+		isValid, err := s.isValidHostname(hostname)
+		assert.Equal(t, nil, err)
+		assert.Equal(t, valid, isValid)
+	}
+
+	//Second test: replacing the hostnames returns the removed ones
+	assert.Equal(t, []string{"laptop1"}, s.hostnames.replace([]string{"lighthouse", "desktop1"}))
+	isValid, _ := s.isValidHostname("laptop1")
+	assert.Equal(t, false, isValid)
+}
+
+func TestRefreshHostnames(t *testing.T) {
+	s := newTestService()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/templates" {
+			w.Write([]byte(`[{"name":"sensor","pattern":"sensor-*","group":"sensors","approval":false}]`))
+			return
+		}
+		w.Write([]byte(`["lighthouse","desktop1"]`))
+	}))
+	defer server.Close()
+	s.Config.Conf.IP, s.Config.Conf.Port, _ = net.SplitHostPort(strings.TrimPrefix(server.URL, "http://"))
+	reconnect(s)
+	s.Config.HostnamesFile = t.TempDir() + "/hostnames"
+	s.hostnames.replace([]string{"lighthouse", "laptop1"})
+	metrics.CertificateExpiry.WithLabelValues("", "laptop1").Set(1)
+
+	queue := t.TempDir()
+	d, err := events.NewDispatcher([]string{"http://localhost:0"}, []byte("secret"), queue, 1)
+	assert.Equal(t, nil, err)
+	s.Events = d
+
+	//The hostnames and the patterns of the host templates are replaced and stored, and the removed hostname is revoked and its certificate expiry metric deleted
+	assert.Equal(t, nil, s.RefreshHostnames(context.Background()))
+	assert.Equal(t, true, s.hostnames.contains("desktop1"))
+	assert.Equal(t, false, s.hostnames.contains("laptop1"))
+	assert.Equal(t, false, s.hostnames.contains("sensor-*"))
+	assert.Equal(t, true, s.hostnames.matches("sensor-1"))
+	b, _ := os.ReadFile(s.Config.HostnamesFile)
+	assert.Equal(t, "lighthouse\ndesktop1\nsensor-*\n", string(b))
+	entries, _ := os.ReadDir(queue)
+	assert.NotEqual(t, 0, len(entries))
+	assert.Equal(t, false, metrics.CertificateExpiry.DeleteLabelValues("", "laptop1"))
+}
+
+func TestRegisterInstance(t *testing.T) {
+	s := newTestService()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var instance models.Instance
+		json.NewDecoder(r.Body).Decode(&instance)
+		w.Write([]byte(`{"hostname":"` + instance.Hostname + `","template":"sensor","approved":` + strconv.FormatBool(instance.Hostname == "sensor-1") + `}`))
+	}))
+	defer server.Close()
+	s.Config.Conf.IP, s.Config.Conf.Port, _ = net.SplitHostPort(strings.TrimPrefix(server.URL, "http://"))
+	reconnect(s)
+	s.hostnames.replace([]string{"lighthouse", "sensor-*"})
+
+	//First test: a hostname matching no pattern is not registered
+	instance, err := s.registerInstance(context.Background(), "camera-1")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, true, instance == nil)
+
+	//Second test: an approved instance is a valid hostname from then on, one waiting for an approval is not
+	instance, err = s.registerInstance(context.Background(), "sensor-1")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, true, instance.Approved)
+	assert.Equal(t, true, s.hostnames.contains("sensor-1"))
+	instance, err = s.registerInstance(context.Background(), "sensor-2")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, false, instance.Approved)
+	assert.Equal(t, false, s.hostnames.contains("sensor-2"))
+}
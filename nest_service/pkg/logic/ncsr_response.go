@@ -0,0 +1,144 @@
+package nest_service
+
+import (
+	"archive/tar"
+	"bytes"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/m4rkdc/nebula_est/nest_service/pkg/models"
+	"github.com/slackhq/nebula/cert"
+	"google.golang.org/protobuf/proto"
+)
+
+/*
+csrResponseFormat returns the media type, among the models.MIME_* ones, in which the Nebula CSR response has to be sent to the client.
+It returns an empty string when the client has to receive the legacy format (a JSON string of the base64 marshaled RawNebulaCsrResponse):
+when the request has no Accept header, accepts any media type first or accepts none of the supported ones.
+*/
+func csrResponseFormat(c *gin.Context) string {
+	accept := strings.TrimSpace(c.GetHeader("Accept"))
+	if len(accept) == 0 || strings.HasPrefix(accept, "*/*") {
+		return ""
+	}
+	return c.NegotiateFormat(models.MIME_PROTOBUF, models.MIME_JSON, models.MIME_PEM, models.MIME_TAR)
+}
+
+// csrResponseFiles returns the PEM Nebula certificate and, if present, the PEM Nebula private key of the Nebula CSR response
+func csrResponseFiles(raw_csr_resp *models.RawNebulaCsrResponse) ([]byte, []byte, error) {
+	raw_cert_bytes, err := proto.Marshal(raw_csr_resp.NebulaCert)
+	if err != nil {
+		return nil, nil, err
+	}
+	nebula_cert, err := cert.UnmarshalNebulaCertificate(raw_cert_bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	cert_pem, err := nebula_cert.MarshalToPEM()
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(raw_csr_resp.NebulaPrivateKey) == 0 {
+		return cert_pem, nil, nil
+	}
+	return cert_pem, cert.MarshalX25519PrivateKey(raw_csr_resp.NebulaPrivateKey), nil
+}
+
+// csrResponseTar archives the files of the Nebula CSR response, as they have to be installed in the client NebulaPath, the configuration file being installed unverified
+func (s *Service) csrResponseTar(hostname string, raw_csr_resp *models.RawNebulaCsrResponse, cert_pem []byte, key_pem []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	mod_time := time.Now()
+
+	write := func(name string, content []byte) error {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0600, Size: int64(len(content)), ModTime: mod_time}); err != nil {
+			return err
+		}
+		_, err := tw.Write(content)
+		return err
+	}
+
+	if err := write(hostname+".crt", cert_pem); err != nil {
+		return nil, err
+	}
+	if key_pem != nil {
+		if err := write(hostname+".key", key_pem); err != nil {
+			return nil, err
+		}
+	}
+	if len(raw_csr_resp.NebulaConf) != 0 {
+		if err := write("config.yml", models.InstallableConfig(raw_csr_resp.NebulaConf)); err != nil {
+			return nil, err
+		}
+	}
+	if ca_certs, err := os.ReadFile(s.Config.CaCertFile); err == nil {
+		if err := write("ca.crt", ca_certs); err != nil {
+			return nil, err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+/*
+respondCsrResponse sends the Nebula CSR response to the client in the format negotiated with its Accept header.
+The legacy format is kept as default for the clients not asking for a specific one.
+*/
+func (s *Service) respondCsrResponse(c *gin.Context, hostname string, raw_csr_resp *models.RawNebulaCsrResponse) {
+	format := csrResponseFormat(c)
+	if format == "" || format == models.MIME_PROTOBUF {
+		b, err := proto.Marshal(raw_csr_resp)
+		if err != nil {
+			slog.ErrorContext(c.Request.Context(), "Could not send the Nebula CSR response", "hostname", hostname, "error", err)
+			c.JSON(http.StatusInternalServerError, models.ApiError{Code: 500, Message: "Internal Server Error: " + err.Error()})
+			return
+		}
+		if format == "" {
+			c.JSON(http.StatusOK, b)
+			return
+		}
+		c.Data(http.StatusOK, models.MIME_PROTOBUF, b)
+		return
+	}
+
+	cert_pem, key_pem, err := csrResponseFiles(raw_csr_resp)
+	if err != nil {
+		slog.ErrorContext(c.Request.Context(), "Could not send the Nebula CSR response", "hostname", hostname, "error", err)
+		c.JSON(http.StatusInternalServerError, models.ApiError{Code: 500, Message: "Internal Server Error: " + err.Error()})
+		return
+	}
+
+	switch format {
+	case models.MIME_JSON:
+		document := models.NebulaCsrResponseDocument{
+			NebulaCert:       string(cert_pem),
+			NebulaPrivateKey: raw_csr_resp.NebulaPrivateKey,
+			NebulaConf:       string(raw_csr_resp.NebulaConf),
+			NebulaPath:       raw_csr_resp.GetNebulaPath(),
+			ConfSignature:    raw_csr_resp.ConfSignature,
+		}
+		if raw_csr_resp.RenewAfter != nil && raw_csr_resp.RenewBefore != nil {
+			renew_after, renew_before := time.Unix(*raw_csr_resp.RenewAfter, 0).UTC(), time.Unix(*raw_csr_resp.RenewBefore, 0).UTC()
+			document.RenewAfter, document.RenewBefore = &renew_after, &renew_before
+		}
+		c.JSON(http.StatusOK, document)
+	case models.MIME_PEM:
+		c.Header("Content-Disposition", "attachment; filename=\""+hostname+".pem\"")
+		c.Data(http.StatusOK, models.MIME_PEM, append(cert_pem, key_pem...))
+	case models.MIME_TAR:
+		b, err := s.csrResponseTar(hostname, raw_csr_resp, cert_pem, key_pem)
+		if err != nil {
+			slog.ErrorContext(c.Request.Context(), "Could not send the Nebula CSR response", "hostname", hostname, "error", err)
+			c.JSON(http.StatusInternalServerError, models.ApiError{Code: 500, Message: "Internal Server Error: " + err.Error()})
+			return
+		}
+		c.Header("Content-Disposition", "attachment; filename=\""+hostname+".tar\"")
+		c.Data(http.StatusOK, models.MIME_TAR, b)
+	}
+}
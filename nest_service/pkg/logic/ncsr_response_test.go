@@ -0,0 +1,100 @@
+package nest_service
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/assert/v2"
+	"github.com/m4rkdc/nebula_est/nest_service/pkg/models"
+	"github.com/slackhq/nebula/cert"
+	"google.golang.org/protobuf/proto"
+)
+
+func testCsrResponse(t *testing.T) (*models.RawNebulaCsrResponse, []byte) {
+	nebula_cert := cert.NebulaCertificate{Details: cert.NebulaCertificateDetails{Name: "client1", NotBefore: time.Unix(1700000000, 0), NotAfter: time.Unix(1800000000, 0), PublicKey: make([]byte, 32)}}
+	raw_cert_bytes, err := nebula_cert.Marshal()
+	assert.Equal(t, nil, err)
+	var raw_cert cert.RawNebulaCertificate
+	assert.Equal(t, nil, proto.Unmarshal(raw_cert_bytes, &raw_cert))
+	cert_pem, _ := nebula_cert.MarshalToPEM()
+
+	nebula_path := "/etc/nebula/"
+	return &models.RawNebulaCsrResponse{
+		NebulaCert:       &raw_cert,
+		NebulaPrivateKey: []byte("private key"),
+		NebulaConf:       []byte("pki:\n"),
+		NebulaPath:       &nebula_path,
+	}, cert_pem
+}
+
+func sendCsrResponse(s *Service, raw_csr_resp *models.RawNebulaCsrResponse, accept string) *httptest.ResponseRecorder {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/ncsr/:hostname/enroll", func(c *gin.Context) {
+		s.respondCsrResponse(c, c.Param("hostname"), raw_csr_resp)
+	})
+	req, _ := http.NewRequest(http.MethodGet, "/ncsr/client1/enroll", nil)
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	resp := httptest.NewRecorder()
+	r.ServeHTTP(resp, req)
+	return resp
+}
+
+func TestRespondCsrResponse(t *testing.T) {
+	s := newTestService()
+	raw_csr_resp, cert_pem := testCsrResponse(t)
+
+	//First test: without an Accept header the legacy format is returned
+	resp := sendCsrResponse(s, raw_csr_resp, "")
+	var b []byte
+	assert.Equal(t, nil, json.Unmarshal(resp.Body.Bytes(), &b))
+	var legacy models.RawNebulaCsrResponse
+	assert.Equal(t, nil, proto.Unmarshal(b, &legacy))
+	assert.Equal(t, "/etc/nebula/", legacy.GetNebulaPath())
+	assert.Equal(t, resp.Body.String(), sendCsrResponse(s, raw_csr_resp, "*/*").Body.String())
+
+	//Second test: raw protobuf
+	resp = sendCsrResponse(s, raw_csr_resp, models.MIME_PROTOBUF)
+	assert.Equal(t, models.MIME_PROTOBUF, resp.Header().Get("Content-Type"))
+	assert.Equal(t, b, resp.Body.Bytes())
+
+	//Third test: readable JSON
+	resp = sendCsrResponse(s, raw_csr_resp, "application/json, */*;q=0.8")
+	var document models.NebulaCsrResponseDocument
+	assert.Equal(t, nil, json.Unmarshal(resp.Body.Bytes(), &document))
+	assert.Equal(t, string(cert_pem), document.NebulaCert)
+	assert.Equal(t, []byte("private key"), document.NebulaPrivateKey)
+	assert.Equal(t, "pki:\n", document.NebulaConf)
+	assert.Equal(t, "/etc/nebula/", document.NebulaPath)
+
+	//Fourth test: PEM certificate and key
+	resp = sendCsrResponse(s, raw_csr_resp, models.MIME_PEM)
+	assert.Equal(t, append(cert_pem, cert.MarshalX25519PrivateKey([]byte("private key"))...), resp.Body.Bytes())
+
+	//Fifth test: tar bundle
+	resp = sendCsrResponse(s, raw_csr_resp, models.MIME_TAR)
+	tr := tar.NewReader(bytes.NewReader(resp.Body.Bytes()))
+	files := map[string]string{}
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		assert.Equal(t, nil, err)
+		content, _ := io.ReadAll(tr)
+		files[header.Name] = string(content)
+	}
+	assert.Equal(t, string(cert_pem), files["client1.crt"])
+	assert.Equal(t, "pki:\n", files["config.yml"])
+	_, ok := files["client1.key"]
+	assert.Equal(t, true, ok)
+}
@@ -0,0 +1,161 @@
+package nest_service
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"math/rand"
+	"strings"
+	"time"
+
+	"github.com/m4rkdc/nebula_est/nest_service/pkg/config"
+	"github.com/m4rkdc/nebula_est/nest_service/pkg/models"
+	"github.com/m4rkdc/nebula_est/nest_service/pkg/store"
+	"github.com/slackhq/nebula/cert"
+)
+
+// Fraction of the certificate lifetime after which a client is recommended to re-enroll
+const renewal_fraction = 2.0 / 3.0
+
+// Fraction of the certificate lifetime before which a client is recommended to have re-enrolled, leaving time for retries before the certificate expires
+const renewal_deadline_fraction = 0.9
+
+// Layout of the expiration date written by the previous, line-based, NCSR file format
+const legacy_time_layout = "2006-01-02 15:04:05.999999999 -0700 MST"
+
+/*
+parseLegacyNcsrStatus parses the NCSR files written before the status was stored as JSON.
+Those files contain the status on the first line and, once the client has enrolled, the expiration date of its certificate on the second one.
+*/
+func parseLegacyNcsrStatus(b []byte) (*models.NcsrStatus, error) {
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	if len(lines[0]) == 0 {
+		return nil, &models.ApiError{Code: 500, Message: "Internal server error: there was an error in reading this hostname's ncsr status"}
+	}
+
+	status := &models.NcsrStatus{Status: models.NebulaCsrStatus(strings.TrimSpace(lines[0]))}
+	if len(lines) > 1 {
+		notAfter, err := time.Parse(legacy_time_layout, strings.TrimSpace(lines[1]))
+		if err != nil {
+			return nil, &models.ApiError{Code: 500, Message: "Internal server error: " + err.Error()}
+		}
+		status.NotAfter = &notAfter
+	}
+	return status, nil
+}
+
+/*
+ncsrStore returns the store of the NCSR statuses, keyed by hostname. With the file backend, the statuses are the NCSR files of the NCSR folder,
+which the replicas of the service can share on a shared volume.
+*/
+func (s *Service) ncsrStore() store.Store {
+	if s.Config.Store.Backend == config.STORE_MEMORY {
+		return s.ncsrs
+	}
+	return store.NewFile(s.Config.NcsrFolder)
+}
+
+/*
+readNcsrStatus reads the NCSR status of the given hostname from the NCSR store, and returns it with its version.
+It returns store.ErrNotFound if the hostname has no NCSR.
+*/
+func (s *Service) readNcsrStatus(ctx context.Context, hostname string) (*models.NcsrStatus, string, error) {
+	b, version, err := s.ncsrStore().Get(ctx, hostname)
+	if err != nil {
+		return nil, "", err
+	}
+	if !bytes.HasPrefix(bytes.TrimSpace(b), []byte("{")) {
+		status, err := parseLegacyNcsrStatus(b)
+		return status, version, err
+	}
+
+	var status models.NcsrStatus
+	if err = json.Unmarshal(b, &status); err != nil {
+		return nil, "", &models.ApiError{Code: 500, Message: "Internal server error: " + err.Error()}
+	}
+	return &status, version, nil
+}
+
+/*
+writeNcsrStatus persists the NCSR status of the given hostname in the NCSR store, replacing the status with the given version (the empty version if the hostname has no NCSR).
+It returns store.ErrConflict if the status was modified meanwhile, by this or another replica.
+*/
+func (s *Service) writeNcsrStatus(ctx context.Context, hostname string, status *models.NcsrStatus, version string) error {
+	b, err := json.Marshal(status)
+	if err != nil {
+		return err
+	}
+	_, err = s.ncsrStore().Put(ctx, hostname, b, version)
+	return err
+}
+
+// enrollmentMode returns the enrollment mode corresponding to the given request option and Nebula CSR
+func enrollmentMode(csr *models.NebulaCsr, option int) models.EnrollmentMode {
+	switch {
+	case option == models.SERVERKEYGEN:
+		return models.SERVERKEYGEN_MODE
+	case option == models.RENROLL && csr.Rekey:
+		return models.REKEY_MODE
+	case option == models.RENROLL:
+		return models.RENROLL_MODE
+	}
+	return models.ENROLL_MODE
+}
+
+// completedNcsrStatus returns the NCSR status of a client that has just been issued the given Nebula certificate.
+func completedNcsrStatus(previous *models.NcsrStatus, crt *cert.NebulaCertificate, mode models.EnrollmentMode, now time.Time) (*models.NcsrStatus, error) {
+	fingerprint, err := crt.Sha256Sum()
+	if err != nil {
+		return nil, err
+	}
+	notBefore := crt.Details.NotBefore
+	notAfter := crt.Details.NotAfter
+	renewAt := notBefore.Add(time.Duration(float64(notAfter.Sub(notBefore)) * renewal_fraction))
+	renewBefore := notBefore.Add(time.Duration(float64(notAfter.Sub(notBefore)) * renewal_deadline_fraction))
+
+	status := &models.NcsrStatus{
+		Status:         models.COMPLETED,
+		Fingerprint:    fingerprint,
+		NotBefore:      &notBefore,
+		NotAfter:       &notAfter,
+		LastEnrollment: &now,
+		EnrollmentMode: mode,
+		RenewAt:        &renewAt,
+		RenewBefore:    &renewBefore,
+	}
+	if previous != nil {
+		//A host that enrolls again is no longer stale
+		for _, action := range previous.PendingActions {
+			if action != models.REVIEW_STALE_HOST {
+				status.PendingActions = append(status.PendingActions, action)
+			}
+		}
+	}
+	return status, nil
+}
+
+/*
+renewalWindow returns the renewal window sent to the client with its certificate. Its start is the recommended renewal time of the status,
+delayed by a random jitter of up to half the window, so that the clients enrolled together don't all renew at the same time.
+*/
+func renewalWindow(status *models.NcsrStatus) (time.Time, time.Time) {
+	if status.RenewAt == nil || status.RenewBefore == nil {
+		return time.Time{}, time.Time{}
+	}
+	renew_after := *status.RenewAt
+	if width := status.RenewBefore.Sub(renew_after); width > 1 {
+		renew_after = renew_after.Add(time.Duration(rand.Int63n(int64(width / 2))))
+	}
+	return renew_after, *status.RenewBefore
+}
+
+/*
+effectiveNcsrStatus returns the status the client is in at the given time.
+A completed enrollment whose certificate is no longer valid is reported as Expired, without modifying the persisted status.
+*/
+func effectiveNcsrStatus(status models.NcsrStatus, now time.Time) models.NcsrStatus {
+	if status.Status != models.PENDING && status.NotAfter != nil && now.After(*status.NotAfter) {
+		status.Status = models.EXPIRED
+	}
+	return status
+}
@@ -0,0 +1,100 @@
+package nest_service
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/go-playground/assert/v2"
+	"github.com/m4rkdc/nebula_est/nest_service/pkg/models"
+	"github.com/m4rkdc/nebula_est/nest_service/pkg/store"
+	"github.com/slackhq/nebula/cert"
+)
+
+func TestReadNcsrStatus(t *testing.T) {
+	s := newTestService()
+	s.Config.NcsrFolder = t.TempDir() + "/"
+	ctx := context.Background()
+
+	//First test: missing NCSR file
+	_, _, err := s.readNcsrStatus(ctx, "missing")
+	assert.Equal(t, store.ErrNotFound, err)
+
+	//Second test: legacy pending NCSR file
+	os.WriteFile(s.Config.NcsrFolder+"pending", []byte("Pending\n"), 0600)
+	status, _, err := s.readNcsrStatus(ctx, "pending")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, models.PENDING, status.Status)
+
+	//Third test: legacy completed NCSR file
+	os.WriteFile(s.Config.NcsrFolder+"lighthouse", []byte("Completed\n2023-11-27 03:11:28 +0100 CET"), 0600)
+	status, _, err = s.readNcsrStatus(ctx, "lighthouse")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, models.COMPLETED, status.Status)
+	assert.Equal(t, 2023, status.NotAfter.Year())
+
+	//Fourth test: corrupted NCSR file
+	os.WriteFile(s.Config.NcsrFolder+"corrupted", []byte("Completed\nyesterday"), 0600)
+	_, _, err = s.readNcsrStatus(ctx, "corrupted")
+	assert.NotEqual(t, nil, err)
+
+	//Fifth test: written status is read back
+	now := time.Now().Round(0)
+	written := &models.NcsrStatus{Status: models.COMPLETED, Fingerprint: "abc", LastEnrollment: &now, EnrollmentMode: models.REKEY_MODE}
+	assert.Equal(t, nil, s.writeNcsrStatus(ctx, "client", written, ""))
+	status, version, err := s.readNcsrStatus(ctx, "client")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "abc", status.Fingerprint)
+	assert.Equal(t, models.REKEY_MODE, status.EnrollmentMode)
+	assert.Equal(t, true, now.Equal(*status.LastEnrollment))
+
+	//Sixth test: a status modified meanwhile is not overwritten
+	assert.Equal(t, nil, s.writeNcsrStatus(ctx, "client", &models.NcsrStatus{Status: models.COMPLETED, Fingerprint: "def"}, version))
+	assert.Equal(t, store.ErrConflict, s.writeNcsrStatus(ctx, "client", &models.NcsrStatus{Status: models.PENDING}, version))
+}
+
+func TestEffectiveNcsrStatus(t *testing.T) {
+	var (
+		now       = time.Now()
+		notBefore = now.Add(-3 * time.Hour)
+		notAfter  = now.Add(time.Hour)
+		crt       = cert.NebulaCertificate{Details: cert.NebulaCertificateDetails{Name: "client", NotBefore: notBefore, NotAfter: notAfter}}
+	)
+
+	status, err := completedNcsrStatus(&models.NcsrStatus{Status: models.PENDING, PendingActions: []string{"Approve"}}, &crt, models.ENROLL_MODE, now)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, models.COMPLETED, status.Status)
+	assert.Equal(t, []string{"Approve"}, status.PendingActions)
+	assert.Equal(t, 64, len(status.Fingerprint))
+	assert.Equal(t, true, status.RenewAt.Equal(notBefore.Add(160*time.Minute)))
+	assert.Equal(t, true, status.RenewBefore.Equal(notBefore.Add(216*time.Minute)))
+
+	//First test: certificate still valid
+	assert.Equal(t, models.COMPLETED, effectiveNcsrStatus(*status, now).Status)
+
+	//Second test: certificate expired, the persisted status is not modified
+	assert.Equal(t, models.EXPIRED, effectiveNcsrStatus(*status, now.Add(2*time.Hour)).Status)
+	assert.Equal(t, models.COMPLETED, status.Status)
+
+	//Third test: pending applications never expire
+	assert.Equal(t, models.PENDING, effectiveNcsrStatus(models.NcsrStatus{Status: models.PENDING}, now).Status)
+}
+
+func TestRenewalWindow(t *testing.T) {
+	var (
+		renewAt     = time.Now()
+		renewBefore = renewAt.Add(time.Hour)
+	)
+
+	//First test: the start of the window is jittered within its first half
+	for n := 0; n < 10; n++ {
+		renew_after, renew_before := renewalWindow(&models.NcsrStatus{RenewAt: &renewAt, RenewBefore: &renewBefore})
+		assert.Equal(t, true, !renew_after.Before(renewAt) && renew_after.Before(renewAt.Add(30*time.Minute)))
+		assert.Equal(t, renewBefore, renew_before)
+	}
+
+	//Second test: no window for the statuses written without one
+	renew_after, _ := renewalWindow(&models.NcsrStatus{RenewAt: &renewAt})
+	assert.Equal(t, true, renew_after.IsZero())
+}
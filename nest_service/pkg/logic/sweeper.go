@@ -0,0 +1,96 @@
+package nest_service
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"slices"
+	"time"
+
+	"github.com/m4rkdc/nebula_est/nest_service/pkg/metrics"
+	"github.com/m4rkdc/nebula_est/nest_service/pkg/models"
+	"github.com/m4rkdc/nebula_est/nest_service/pkg/store"
+)
+
+/*
+sweep inspects the NCSR statuses: the applications pending for longer than the pending TTL are deleted, so that their hostname can apply again,
+and an application.expired event is emitted for each of them. The pending applications written before their creation time was recorded are given the current one.
+The hosts whose certificate expired more than stale_after ago are flagged as stale, with a pending action for an administrator and a host.stale event.
+*/
+func (s *Service) sweep(ctx context.Context, now time.Time) error {
+	hostnames, err := s.ncsrStore().List(ctx)
+	if err != nil {
+		return err
+	}
+
+	pending_ttl := time.Duration(s.Config.Sweeper.PendingTTL)
+	stale_after := time.Duration(s.Config.Sweeper.StaleAfter)
+	stale := 0
+	for _, hostname := range hostnames {
+		status, version, err := s.readNcsrStatus(ctx, hostname)
+		if err != nil {
+			continue
+		}
+		switch {
+		case status.Status == models.PENDING && status.Created == nil:
+			status.Created = &now
+			err = s.writeNcsrStatus(ctx, hostname, status, version)
+		case status.Status == models.PENDING && now.Sub(*status.Created) > pending_ttl:
+			err = s.ncsrStore().Delete(ctx, hostname, version)
+			if err == nil {
+				slog.InfoContext(ctx, "Enrollment application expired", "hostname", hostname, "created", status.Created)
+				metrics.ExpiredApplications.Inc()
+				s.emit(models.APPLICATION_EXPIRED, hostname, map[string]string{"created": status.Created.Format(time.RFC3339)})
+			}
+		case status.Status == models.COMPLETED && stale_after > 0 && status.NotAfter != nil && now.Sub(*status.NotAfter) > stale_after:
+			stale++
+			if slices.Contains(status.PendingActions, models.REVIEW_STALE_HOST) {
+				continue
+			}
+			status.PendingActions = append(status.PendingActions, models.REVIEW_STALE_HOST)
+			err = s.writeNcsrStatus(ctx, hostname, status, version)
+			if err == nil {
+				slog.InfoContext(ctx, "Host flagged as stale", "hostname", hostname, "notAfter", status.NotAfter)
+				s.emit(models.HOST_STALE, hostname, map[string]string{"notAfter": status.NotAfter.Format(time.RFC3339)})
+			}
+		}
+		//A status modified meanwhile by an enrollment is swept again next time
+		if err != nil && !errors.Is(err, store.ErrConflict) && !errors.Is(err, store.ErrNotFound) {
+			slog.WarnContext(ctx, "Could not sweep the enrollment application", "hostname", hostname, "error", err)
+		}
+	}
+	metrics.StaleHosts.WithLabelValues(s.Config.Network).Set(float64(stale))
+	return nil
+}
+
+/*
+WatchApplications sweeps the enrollment applications every interval, until stop is closed.
+When several replicas share the NCSR store, only the one holding the sweeper lease sweeps them, so that every event is emitted once.
+*/
+func (s *Service) WatchApplications(interval time.Duration, stop <-chan struct{}) {
+	ctx := context.Background()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var lease *store.Lease
+	for {
+		if lease != nil && s.leases().Renew(ctx, lease, 2*interval) != nil {
+			lease = nil
+		}
+		if lease == nil {
+			lease, _ = s.leases().Acquire(ctx, "sweeper", 2*interval)
+		}
+		if lease != nil {
+			if err := s.sweep(ctx, time.Now()); err != nil {
+				slog.Warn("Could not sweep the enrollment applications", "error", err)
+			}
+		}
+		select {
+		case <-stop:
+			if lease != nil {
+				s.leases().Release(ctx, lease)
+			}
+			return
+		case <-ticker.C:
+		}
+	}
+}
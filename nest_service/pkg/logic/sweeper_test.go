@@ -0,0 +1,62 @@
+package nest_service
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/go-playground/assert/v2"
+	"github.com/m4rkdc/nebula_est/nest_service/pkg/events"
+	"github.com/m4rkdc/nebula_est/nest_service/pkg/metrics"
+	"github.com/m4rkdc/nebula_est/nest_service/pkg/models"
+	"github.com/m4rkdc/nebula_est/nest_service/pkg/store"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestSweep(t *testing.T) {
+	s := newTestService()
+	s.Config.NcsrFolder = t.TempDir() + "/"
+	s.Config.Network = "corp"
+	queue := t.TempDir()
+	d, err := events.NewDispatcher([]string{"http://localhost:0"}, []byte("secret"), queue, 1)
+	assert.Equal(t, nil, err)
+	s.Events = d
+
+	ctx := context.Background()
+	now := time.Now()
+	abandoned := now.Add(-8 * 24 * time.Hour)
+	recent := now.Add(-time.Hour)
+	expired := now.Add(-60 * 24 * time.Hour)
+	s.writeNcsrStatus(ctx, "abandoned", &models.NcsrStatus{Status: models.PENDING, Created: &abandoned}, "")
+	s.writeNcsrStatus(ctx, "recent", &models.NcsrStatus{Status: models.PENDING, Created: &recent}, "")
+	s.writeNcsrStatus(ctx, "legacy", &models.NcsrStatus{Status: models.PENDING}, "")
+	s.writeNcsrStatus(ctx, "stale", &models.NcsrStatus{Status: models.COMPLETED, Fingerprint: "a", NotAfter: &expired}, "")
+	s.writeNcsrStatus(ctx, "expired", &models.NcsrStatus{Status: models.COMPLETED, Fingerprint: "b", NotAfter: &recent}, "")
+
+	//First test: the abandoned application is deleted, the legacy one gets a creation time and the host whose certificate expired long ago is flagged
+	assert.Equal(t, nil, s.sweep(ctx, now))
+	_, _, err = s.readNcsrStatus(ctx, "abandoned")
+	assert.Equal(t, true, errors.Is(err, store.ErrNotFound))
+	status, _, _ := s.readNcsrStatus(ctx, "recent")
+	assert.Equal(t, models.PENDING, status.Status)
+	status, _, _ = s.readNcsrStatus(ctx, "legacy")
+	assert.Equal(t, true, status.Created != nil)
+	status, _, _ = s.readNcsrStatus(ctx, "stale")
+	assert.Equal(t, []string{models.REVIEW_STALE_HOST}, status.PendingActions)
+	status, _, _ = s.readNcsrStatus(ctx, "expired")
+	assert.Equal(t, 0, len(status.PendingActions))
+	entries, _ := os.ReadDir(queue)
+	assert.Equal(t, 3, len(entries))
+	assert.Equal(t, float64(1), testutil.ToFloat64(metrics.StaleHosts.WithLabelValues("corp")))
+
+	//Second test: a stale host is flagged once, and the legacy application expires after the pending TTL
+	assert.Equal(t, nil, s.sweep(ctx, now.Add(8*24*time.Hour)))
+	status, _, _ = s.readNcsrStatus(ctx, "stale")
+	assert.Equal(t, 1, len(status.PendingActions))
+	_, _, err = s.readNcsrStatus(ctx, "legacy")
+	assert.Equal(t, true, errors.Is(err, store.ErrNotFound))
+	_, _, err = s.readNcsrStatus(ctx, "recent")
+	assert.Equal(t, true, errors.Is(err, store.ErrNotFound))
+}
@@ -0,0 +1,124 @@
+/*
+NEST: Nebula Enrollment over Secure Transport - OpenAPI 3.0
+
+This package contains the Prometheus metrics exposed by the NEST services on their /metrics endpoint.
+API version: 0.3.1
+Contact: gianmarco.decola@studio.unibo.it
+*/
+package metrics
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "nest"
+
+var (
+	//HTTP requests served, by route, method and status code
+	Requests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "http_requests_total",
+		Help:      "HTTP requests served, by route, method and status code.",
+	}, []string{"route", "method", "status"})
+	//HTTP requests latency, by route, method and status code
+	RequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "HTTP requests latency, by route, method and status code.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route", "method", "status"})
+	//Successful enrollments, by enrollment mode (Enroll, Serverkeygen, Reenroll, Rekey)
+	Enrollments = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "enrollments_total",
+		Help:      "Successful enrollments, by enrollment mode.",
+	}, []string{"mode"})
+	//Failed client authentications, by reason
+	AuthFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "auth_failures_total",
+		Help:      "Failed client authentications, by reason.",
+	}, []string{"reason"})
+	//Time spent by the NEST CA creating a Nebula certificate, by operation (sign, generate) and result (success, error)
+	CaSigningDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "ca_signing_duration_seconds",
+		Help:      "Time spent creating a Nebula certificate, by operation and result.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"operation", "result"})
+	//Time spent by the NEST config service regenerating the Nebula configuration files
+	ConfigRegenerationDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "config_regeneration_duration_seconds",
+		Help:      "Time spent regenerating the Nebula configuration files.",
+		Buckets:   []float64{0.5, 1, 2.5, 5, 10, 30, 60, 120},
+	})
+	//Failed regenerations of the Nebula configuration files
+	ConfigRegenerationFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "config_regeneration_failures_total",
+		Help:      "Failed regenerations of the Nebula configuration files.",
+	})
+	//Restarts of the Nebula overlay process of the service after it exited
+	NebulaRestarts = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "nebula_restarts_total",
+		Help:      "Restarts of the Nebula overlay process after it exited.",
+	})
+	//Expiration of the current Nebula certificate of every enrolled client, as a unix timestamp, by Nebula network (empty in single network deployments) and hostname
+	CertificateExpiry = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "certificate_expiry_timestamp_seconds",
+		Help:      "Expiration of the current Nebula certificate of every enrolled client, as a unix timestamp, by Nebula network and hostname.",
+	}, []string{"network", "hostname"})
+	//Pending enrollment applications expired by the sweeper
+	ExpiredApplications = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "expired_applications_total",
+		Help:      "Pending enrollment applications expired by the sweeper.",
+	})
+	//Hosts whose certificate expired long ago, flagged as stale for an administrator to review, by Nebula network (empty in single network deployments)
+	StaleHosts = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "stale_hosts",
+		Help:      "Hosts whose certificate expired long ago, flagged as stale for an administrator to review, by Nebula network.",
+	}, []string{"network"})
+)
+
+// ObserveSince records in the histogram the time elapsed since start
+func ObserveSince(o prometheus.Observer, start time.Time) {
+	o.Observe(time.Since(start).Seconds())
+}
+
+// Middleware returns a gin middleware counting the requests served by the router and measuring their latency.
+func Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		route := c.FullPath()
+		if len(route) == 0 {
+			route = "unmatched"
+		}
+		status := strconv.Itoa(c.Writer.Status())
+		Requests.WithLabelValues(route, c.Request.Method, status).Inc()
+		RequestDuration.WithLabelValues(route, c.Request.Method, status).Observe(time.Since(start).Seconds())
+	}
+}
+
+// Setup instruments the given router and exposes the metrics on its /metrics endpoint. It has to be called before the routes are registered
+func Setup(router *gin.Engine) {
+	router.Use(Middleware())
+	Expose(router)
+}
+
+// Expose exposes the metrics on the /metrics endpoint of the given router, e.g. of an internal listener apart from the instrumented one
+func Expose(router *gin.Engine) {
+	router.GET("/metrics", gin.WrapH(promhttp.Handler()))
+}
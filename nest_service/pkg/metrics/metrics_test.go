@@ -0,0 +1,36 @@
+package metrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/assert/v2"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMiddleware(t *testing.T) {
+	router := gin.New()
+	Setup(router)
+	router.GET("/ncsr/:hostname", func(c *gin.Context) {
+		c.Status(http.StatusNotFound)
+	})
+
+	for _, url := range []string{"/ncsr/client1", "/ncsr/client2", "/unknown"} {
+		req, _ := http.NewRequest(http.MethodGet, url, nil)
+		router.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	//First test: requests are counted by route pattern, not by URL
+	assert.Equal(t, float64(2), testutil.ToFloat64(Requests.WithLabelValues("/ncsr/:hostname", "GET", "404")))
+	assert.Equal(t, float64(1), testutil.ToFloat64(Requests.WithLabelValues("unmatched", "GET", "404")))
+
+	//Second test: the metrics are exposed
+	req, _ := http.NewRequest(http.MethodGet, "/metrics", nil)
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, true, strings.Contains(resp.Body.String(), "nest_http_request_duration_seconds"))
+}
@@ -15,6 +15,8 @@ type ApiError struct {
 	Code int `json:"code"`
 	//Error message
 	Message string `json:"message"`
+	//ID of the request that failed, to be quoted when reporting the error
+	RequestId string `json:"requestId,omitempty"`
 }
 
 func (m *ApiError) Error() string {
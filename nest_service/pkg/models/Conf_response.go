@@ -8,6 +8,12 @@
  */
 package models
 
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+)
+
 // Response returned by the Nebula config service to the NEST service
 type ConfResponse struct {
 	//The newly generated Nebula configuration file.
@@ -18,4 +24,26 @@ type ConfResponse struct {
 	Ip string `json:"ip"`
 	//The client-local path in which the configuration file and nebula certificate has to be installed
 	NebulaPath string `json:"NebulaPath"`
+	//Version of the configuration file: the hex encoded SHA256 of NebulaConf, used as its ETag
+	Version string `json:"version,omitempty"`
+	//Signature of NebulaConf, NebulaPath, Ip and Groups by the NEST config service, see SignConfig
+	Signature []byte `json:"signature,omitempty"`
+}
+
+// ConfVersion returns the version of the Nebula configuration file conf, the hex encoded SHA256 of its content
+func ConfVersion(conf []byte) string {
+	sum := sha256.Sum256(conf)
+	return hex.EncodeToString(sum[:])
+}
+
+/*
+InstallableConfig returns the Nebula configuration file conf, as generated by dhall-nebula, as it has to be installed on the client:
+the configuration files with Windows paths have their / separators replaced by escaped \ ones.
+The configuration files are signed and versioned as generated, and rewritten only once verified.
+*/
+func InstallableConfig(conf []byte) []byte {
+	if bytes.Contains(conf, []byte("\\")) {
+		return bytes.ReplaceAll(conf, []byte("/"), []byte("\\\\"))
+	}
+	return conf
 }
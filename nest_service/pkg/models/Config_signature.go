@@ -0,0 +1,93 @@
+/*
+ * Nebula Configuration service for NEST (Nebula Enrollment over Secure Transport) - OpenAPI 3.0
+ *
+ * This is a simple Nebula Configuration service that generates Nebula configuration files from Dhall configuration files on behalf of the NEST service
+ *
+ * API version: 0.3.1
+ * Contact: gianmarco.decola@studio.unibo.it
+ */
+package models
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"slices"
+	"strconv"
+)
+
+// HTTP header in which the NEST service sends the signature of a Nebula configuration file, base64 encoded
+const CONF_SIGNATURE_HEADER = "NEST-Config-Signature"
+
+// Response of the NEST service to the NEST clients asking for the Nebula CA certificates as application/json
+type CaCertsDocument struct {
+	//The PEM Nebula CA certificates
+	NebulaCaCerts string `json:"nebulaCaCerts"`
+	//The PEM public keys with which the NEST config service signs the Nebula configuration files. Omitted if it signs none
+	ConfigSigningKeys string `json:"configSigningKeys,omitempty"`
+}
+
+/*
+configSignedMessage returns the message signed for the Nebula configuration file of hostname in conf_resp: the file as generated by dhall-nebula, the path in which it is installed,
+and the IP address and security groups of hostname, so that the configuration file of a host can't be installed by another one, nor in another folder or with other addresses and groups.
+*/
+func configSignedMessage(hostname string, conf_resp *ConfResponse) []byte {
+	groups := slices.Clone(conf_resp.Groups)
+	slices.Sort(groups)
+	message := []byte("NEST config signature v1\x00" + hostname + "\x00" + conf_resp.NebulaPath + "\x00" + conf_resp.Ip + "\x00" + strconv.Itoa(len(groups)) + "\x00")
+	for _, group := range groups {
+		message = append(message, group+"\x00"...)
+	}
+	return append(message, conf_resp.NebulaConf...)
+}
+
+// SignConfig returns the ed25519 signature of the Nebula configuration file of hostname in conf_resp, with its installation path, IP address and security groups
+func SignConfig(key ed25519.PrivateKey, hostname string, conf_resp *ConfResponse) []byte {
+	return ed25519.Sign(key, configSignedMessage(hostname, conf_resp))
+}
+
+// VerifyConfig tells if signature is a signature of the Nebula configuration file of hostname in conf_resp, with its installation path, IP address and security groups, by one of the given keys
+func VerifyConfig(keys []ed25519.PublicKey, hostname string, conf_resp *ConfResponse, signature []byte) bool {
+	message := configSignedMessage(hostname, conf_resp)
+	for _, key := range keys {
+		if ed25519.Verify(key, message, signature) {
+			return true
+		}
+	}
+	return false
+}
+
+// MarshalConfigSigningKey returns the PEM encoded PKIX public key
+func MarshalConfigSigningKey(key ed25519.PublicKey) ([]byte, error) {
+	b, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: b}), nil
+}
+
+// UnmarshalConfigSigningKeys returns the ed25519 public keys of the PEM encoded PKIX public keys b
+func UnmarshalConfigSigningKeys(b []byte) ([]ed25519.PublicKey, error) {
+	var keys []ed25519.PublicKey
+	for {
+		var block *pem.Block
+		block, b = pem.Decode(b)
+		if block == nil {
+			break
+		}
+		if block.Type != "PUBLIC KEY" {
+			continue
+		}
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		ed25519_key, ok := key.(ed25519.PublicKey)
+		if !ok {
+			return nil, errors.New("the configuration signing keys must be ed25519 keys")
+		}
+		keys = append(keys, ed25519_key)
+	}
+	return keys, nil
+}
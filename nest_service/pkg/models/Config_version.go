@@ -0,0 +1,39 @@
+/*
+ * Nebula Configuration service for NEST (Nebula Enrollment over Secure Transport) - OpenAPI 3.0
+ *
+ * This is a simple Nebula Configuration service that generates Nebula configuration files from Dhall configuration files on behalf of the NEST service
+ *
+ * API version: 0.3.1
+ * Contact: gianmarco.decola@studio.unibo.it
+ */
+package models
+
+import "time"
+
+// A version of the Nebula configuration files of the network, recorded by the NEST config service at every regeneration changing them
+type ConfigVersion struct {
+	//Identifier of the version: the hex encoded SHA256 of the hostnames and of the versions of their configuration files
+	Id string `json:"id"`
+	//Version that was current when this one was recorded, empty for the first one
+	Parent string `json:"parent,omitempty"`
+	//Revision of the network description that produced the version: the hex encoded SHA256 of its Dhall files
+	Revision string `json:"revision"`
+	//When the version was recorded
+	Created time.Time `json:"created"`
+	//Versions of the Nebula configuration files (see ConfVersion), by hostname
+	Hosts map[string]string `json:"hosts"`
+	//Hostnames whose configuration file was added, changed or removed since the parent version
+	Changed []string `json:"changed,omitempty"`
+	//Whether this is the current version of the configuration files
+	Current bool `json:"current"`
+}
+
+// The change of the Nebula configuration file of a host between two versions
+type ConfigDiff struct {
+	Hostname string `json:"hostname"`
+	//Versions of the configuration file before and after the change, empty if the host was added or removed
+	From string `json:"from,omitempty"`
+	To   string `json:"to,omitempty"`
+	//The change, as unified diff
+	Diff string `json:"diff"`
+}
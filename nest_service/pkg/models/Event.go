@@ -0,0 +1,43 @@
+/*
+ * Nebula Enrollment over Secure Transport - OpenAPI 3.0
+ *
+ * This is a simple Public Key Infrastructure Management Server based on the RFC7030 Enrollment over Secure Transport Protocol for a Nebula Mesh Network. The Service accepts requests from TLS connections to create Nebula Certificates for the client (which will be authenticated by providing a secret). The certificate creation is done either by signing client-generated Nebula Public Keys or by generating Nebula key pairs and signing the server-generated Nebula public key and to create Nebula configuration files for the specific client. This Service acts as a Facade for the Nebula CA service (actually signign or creating the Nebula keys) and the Nebula Config service (actually creating the nebula Config. files).
+ *
+ * API version: 0.3.1
+ * Contact: gianmarco.decola@studio.unibo.it
+ */
+package models
+
+import "time"
+
+type EventType string
+
+// List of EventType
+const (
+	APPLICATION_CREATED   EventType = "application.created"
+	HOST_ENROLLED         EventType = "host.enrolled"
+	HOST_REENROLLED       EventType = "host.reenrolled"
+	HOST_REKEYED          EventType = "host.rekeyed"
+	AUTHENTICATION_FAILED EventType = "authentication.failed"
+	CERTIFICATE_EXPIRING  EventType = "certificate.expiring"
+	HOST_REVOKED          EventType = "host.revoked"
+	APPROVAL_REQUESTED    EventType = "approval.requested"
+	APPLICATION_EXPIRED   EventType = "application.expired"
+	HOST_STALE            EventType = "host.stale"
+)
+
+// An enrollment lifecycle event, delivered by the NEST service to the configured webhooks
+type Event struct {
+	//Unique identifier of the event
+	Id string `json:"id"`
+	//The kind of lifecycle event
+	Type EventType `json:"type"`
+	//The Nebula network of the NEST client, in multi-tenant deployments
+	Network string `json:"network,omitempty"`
+	//The hostname of the NEST client the event refers to
+	Hostname string `json:"hostname"`
+	//When the event happened
+	Time time.Time `json:"time"`
+	//Event-specific details (e.g., enrollment mode, certificate fingerprint and expiration)
+	Data map[string]string `json:"data,omitempty"`
+}
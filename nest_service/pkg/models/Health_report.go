@@ -0,0 +1,37 @@
+/*
+ * Nebula Enrollment over Secure Transport - OpenAPI 3.0
+ *
+ * This is a simple Public Key Infrastructure Management Server based on the RFC7030 Enrollment over Secure Transport Protocol for a Nebula Mesh Network. The Service accepts requests from TLS connections to create Nebula Certificates for the client (which will be authenticated by providing a secret). The certificate creation is done either by signing client-generated Nebula Public Keys or by generating Nebula key pairs and signing the server-generated Nebula public key and to create Nebula configuration files for the specific client. This Service acts as a Facade for the Nebula CA service (actually signign or creating the Nebula keys) and the Nebula Config service (actually creating the nebula Config. files).
+ *
+ * API version: 0.3.1
+ * Contact: gianmarco.decola@studio.unibo.it
+ */
+package models
+
+type HealthStatus string
+
+// List of HealthStatus
+const (
+	HEALTH_PASS HealthStatus = "pass"
+	HEALTH_FAIL HealthStatus = "fail"
+)
+
+// The result of a single dependency check of a NEST service
+type HealthCheck struct {
+	//The name of the checked dependency
+	Name string `json:"name"`
+	//Whether the check passed or failed
+	Status HealthStatus `json:"status"`
+	//Why the check failed
+	Error string `json:"error,omitempty"`
+	//How long the check took, in milliseconds
+	DurationMs int64 `json:"durationMs"`
+}
+
+// The health (or readiness) of a NEST service, returned by its /healthz and /readyz endpoints
+type HealthReport struct {
+	//fail if any of the checks failed, pass otherwise
+	Status HealthStatus `json:"status"`
+	//The result of each check
+	Checks []HealthCheck `json:"checks"`
+}
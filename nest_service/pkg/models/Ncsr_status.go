@@ -0,0 +1,59 @@
+/*
+ * Nebula Enrollment over Secure Transport - OpenAPI 3.0
+ *
+ * This is a simple Public Key Infrastructure Management Server based on the RFC7030 Enrollment over Secure Transport Protocol for a Nebula Mesh Network. The Service accepts requests from TLS connections to create Nebula Certificates for the client (which will be authenticated by providing a secret). The certificate creation is done either by signing client-generated Nebula Public Keys or by generating Nebula key pairs and signing the server-generated Nebula public key and to create Nebula configuration files for the specific client. This Service acts as a Facade for the Nebula CA service (actually signign or creating the Nebula keys) and the Nebula Config service (actually creating the nebula Config. files).
+ *
+ * API version: 0.3.1
+ * Contact: gianmarco.decola@studio.unibo.it
+ */
+package models
+
+import "time"
+
+type EnrollmentMode string
+
+// List of EnrollmentMode
+const (
+	ENROLL_MODE       EnrollmentMode = "Enroll"
+	SERVERKEYGEN_MODE EnrollmentMode = "Serverkeygen"
+	RENROLL_MODE      EnrollmentMode = "Reenroll"
+	REKEY_MODE        EnrollmentMode = "Rekey"
+)
+
+/*
+*	The enrollment status of a NEST client. It is persisted by the NEST service in the client's NCSR file and returned by the NcsrStatus endpoint. Contains:
+  - status: the status of the enrollment (Pending, Completed, Expired). Expired is computed when reading the status, it is never persisted
+  - fingerprint: the SHA256 fingerprint of the current client's Nebula certificate
+  - notBefore, notAfter: the validity of the current client's Nebula certificate
+  - lastEnrollment: the time of the last successful enrollment or re-enrollment
+  - enrollmentMode: how the current certificate was obtained (Enroll, Serverkeygen, Reenroll, Rekey)
+  - renewAt: the time after which the client is recommended to re-enroll
+  - renewBefore: the time before which the client is recommended to have re-enrolled
+  - pendingActions: the actions an administrator still has to take on this client
+  - created: the time of the enrollment application, after which a pending application expires
+*/
+type NcsrStatus struct {
+	//The status of the enrollment (Pending, Completed, Expired)
+	Status NebulaCsrStatus `json:"status"`
+	//The SHA256 fingerprint of the current client's Nebula certificate
+	Fingerprint string `json:"fingerprint,omitempty"`
+	//The start of the current client's Nebula certificate validity
+	NotBefore *time.Time `json:"notBefore,omitempty"`
+	//The end of the current client's Nebula certificate validity
+	NotAfter *time.Time `json:"notAfter,omitempty"`
+	//The time of the last successful enrollment or re-enrollment
+	LastEnrollment *time.Time `json:"lastEnrollment,omitempty"`
+	//How the current certificate was obtained (Enroll, Serverkeygen, Reenroll, Rekey)
+	EnrollmentMode EnrollmentMode `json:"enrollmentMode,omitempty"`
+	//The time after which the client is recommended to re-enroll
+	RenewAt *time.Time `json:"renewAt,omitempty"`
+	//The time before which the client is recommended to have re-enrolled
+	RenewBefore *time.Time `json:"renewBefore,omitempty"`
+	//The actions an administrator still has to take on this client
+	PendingActions []string `json:"pendingActions,omitempty"`
+	//The time of the enrollment application, after which a pending application expires
+	Created *time.Time `json:"created,omitempty"`
+}
+
+// Pending action of a host whose certificate expired long ago, for an administrator to review if it was decommissioned
+const REVIEW_STALE_HOST = "Review the stale host: its certificate expired long ago"
@@ -9,6 +9,8 @@
 package models
 
 import (
+	"time"
+
 	"github.com/slackhq/nebula/cert"
 )
 
@@ -62,4 +64,40 @@ type NebulaCsrResponse struct {
 	NebulaConf []byte `json:"NebulaConf,omitempty"`
 	//The client-local path in which the configuration file and nebula certificate has to be installed
 	NebulaPath string `json:"NebulaPath,omitempty"`
+	//Start of the renewal window of the certificate, jittered for every client. Zero if the NEST service sent no renewal window
+	RenewAfter time.Time `json:"renewAfter,omitempty"`
+	//End of the renewal window of the certificate. Zero if the NEST service sent no renewal window
+	RenewBefore time.Time `json:"renewBefore,omitempty"`
+	//Signature of NebulaConf, NebulaPath and the IP address and security groups of NebulaCert by the NEST config service, verified with its public keys before the configuration file is installed
+	ConfSignature []byte `json:"confSignature,omitempty"`
+}
+
+// Media types in which the NEST service can return a NebulaCsrResponse, negotiated with the Accept header
+const (
+	//The marshaled RawNebulaCsrResponse
+	MIME_PROTOBUF = "application/x-protobuf"
+	//A NebulaCsrResponseDocument
+	MIME_JSON = "application/json"
+	//The PEM Nebula certificate, followed by the PEM Nebula private key if generated by the NEST CA
+	MIME_PEM = "application/x-pem-file"
+	//A tar archive of the files to install in NebulaPath: <hostname>.crt, <hostname>.key if generated by the NEST CA, config.yml and ca.crt
+	MIME_TAR = "application/x-tar"
+)
+
+// Human readable NebulaCsrResponse, returned to the NEST clients accepting application/json
+type NebulaCsrResponseDocument struct {
+	//The newly generated PEM Nebula Certificate
+	NebulaCert string `json:"NebulaCert"`
+	//The newly generated Nebula private key, base64 encoded. Omitted if serverKeygen is false on the NebulaCsr
+	NebulaPrivateKey []byte `json:"NebulaPrivateKey,omitempty"`
+	//The newly generated Nebula configuration file. Omitted for re-enrollment CSRs
+	NebulaConf string `json:"NebulaConf,omitempty"`
+	//The client-local path in which the configuration file and nebula certificate has to be installed
+	NebulaPath string `json:"NebulaPath,omitempty"`
+	//Start of the renewal window of the certificate, jittered for every client
+	RenewAfter *time.Time `json:"renewAfter,omitempty"`
+	//End of the renewal window of the certificate
+	RenewBefore *time.Time `json:"renewBefore,omitempty"`
+	//Signature of NebulaConf by the NEST config service, base64 encoded
+	ConfSignature []byte `json:"confSignature,omitempty"`
 }
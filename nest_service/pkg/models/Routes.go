@@ -17,3 +17,21 @@ type Route struct {
 	Pattern     string
 	HandlerFunc gin.HandlerFunc
 }
+
+// NetworkPath returns the path under which the routes of the Nebula network are served, empty in single network deployments
+func NetworkPath(network string) string {
+	if len(network) == 0 {
+		return ""
+	}
+	return "/networks/" + network
+}
+
+// NetworkRoutes returns the routes of the service instance serving the Nebula network, under its network path
+func NetworkRoutes(network string, routes []Route) []Route {
+	prefixed := make([]Route, 0, len(routes))
+	for _, r := range routes {
+		r.Pattern = NetworkPath(network) + r.Pattern
+		prefixed = append(prefixed, r)
+	}
+	return prefixed
+}
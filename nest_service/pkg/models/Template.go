@@ -0,0 +1,36 @@
+/*
+ * Nebula Configuration service for NEST (Nebula Enrollment over Secure Transport) - OpenAPI 3.0
+ *
+ * This is a simple Nebula Configuration service that generates Nebula configuration files from Dhall configuration files on behalf of the NEST service
+ *
+ * API version: 0.3.1
+ * Contact: gianmarco.decola@studio.unibo.it
+ */
+package models
+
+import "time"
+
+// A host template of the Nebula network description, whose instances are the hosts with a hostname matching its pattern
+type Template struct {
+	//Name of the template, and of its Dhall function nebula/templates/<name>.dhall
+	Name string `yaml:"name" json:"name"`
+	//Shell pattern of the hostnames of the instances (e.g., sensor-*)
+	Pattern string `yaml:"pattern" json:"pattern"`
+	//Security group of the instances, from whose address pool they get their Nebula IP address
+	Group string `yaml:"group" json:"group"`
+	//Maximum number of instances, pending approval or not. Unlimited if 0
+	MaxInstances int `yaml:"max_instances" json:"maxInstances,omitempty"`
+	//Whether an administrator has to approve every instance before it can enroll
+	Approval bool `yaml:"approval" json:"approval"`
+}
+
+// An instance of a host template, registered at its first enrollment application
+type Instance struct {
+	Hostname string `json:"hostname"`
+	//Name of the template of the instance
+	Template string `json:"template"`
+	//Whether the instance can enroll, or is waiting for the approval of an administrator
+	Approved bool `json:"approved"`
+	//When the instance was registered
+	Registered time.Time `json:"registered"`
+}
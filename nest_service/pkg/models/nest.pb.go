@@ -172,6 +172,10 @@ type RawConfResponse struct {
 	Groups     []string `protobuf:"bytes,2,rep,name=Groups,proto3" json:"Groups,omitempty"`
 	Ip         string   `protobuf:"bytes,3,opt,name=Ip,proto3" json:"Ip,omitempty"`
 	NebulaPath string   `protobuf:"bytes,4,opt,name=NebulaPath,proto3" json:"NebulaPath,omitempty"`
+	//Version of the configuration file: the hex encoded SHA256 of NebulaConf
+	Version string `protobuf:"bytes,5,opt,name=Version,proto3" json:"Version,omitempty"`
+	//Ed25519 signature of NebulaConf, NebulaPath, Ip and Groups by the NEST config service, see SignConfig
+	Signature []byte `protobuf:"bytes,6,opt,name=Signature,proto3" json:"Signature,omitempty"`
 }
 
 func (x *RawConfResponse) Reset() {
@@ -234,6 +238,20 @@ func (x *RawConfResponse) GetNebulaPath() string {
 	return ""
 }
 
+func (x *RawConfResponse) GetVersion() string {
+	if x != nil {
+		return x.Version
+	}
+	return ""
+}
+
+func (x *RawConfResponse) GetSignature() []byte {
+	if x != nil {
+		return x.Signature
+	}
+	return nil
+}
+
 type RawNebulaCsrResponse struct {
 	state         protoimpl.MessageState
 	sizeCache     protoimpl.SizeCache
@@ -243,6 +261,11 @@ type RawNebulaCsrResponse struct {
 	NebulaPrivateKey []byte                     `protobuf:"bytes,2,opt,name=NebulaPrivateKey,proto3,oneof" json:"NebulaPrivateKey,omitempty"`
 	NebulaConf       []byte                     `protobuf:"bytes,3,opt,name=NebulaConf,proto3,oneof" json:"NebulaConf,omitempty"`
 	NebulaPath       *string                    `protobuf:"bytes,4,opt,name=NebulaPath,proto3,oneof" json:"NebulaPath,omitempty"`
+	//Renewal window of the certificate, as unix timestamps: the client renews it after RenewAfter, jittered by the NEST service, and before RenewBefore
+	RenewAfter  *int64 `protobuf:"varint,5,opt,name=RenewAfter,proto3,oneof" json:"RenewAfter,omitempty"`
+	RenewBefore *int64 `protobuf:"varint,6,opt,name=RenewBefore,proto3,oneof" json:"RenewBefore,omitempty"`
+	//Ed25519 signature of NebulaConf, NebulaPath and the IP address and security groups of NebulaCert by the NEST config service, see SignConfig
+	ConfSignature []byte `protobuf:"bytes,7,opt,name=ConfSignature,proto3,oneof" json:"ConfSignature,omitempty"`
 }
 
 func (x *RawNebulaCsrResponse) Reset() {
@@ -305,6 +328,27 @@ func (x *RawNebulaCsrResponse) GetNebulaPath() string {
 	return ""
 }
 
+func (x *RawNebulaCsrResponse) GetRenewAfter() int64 {
+	if x != nil && x.RenewAfter != nil {
+		return *x.RenewAfter
+	}
+	return 0
+}
+
+func (x *RawNebulaCsrResponse) GetRenewBefore() int64 {
+	if x != nil && x.RenewBefore != nil {
+		return *x.RenewBefore
+	}
+	return 0
+}
+
+func (x *RawNebulaCsrResponse) GetConfSignature() []byte {
+	if x != nil {
+		return x.ConfSignature
+	}
+	return nil
+}
+
 var File_nest_proto protoreflect.FileDescriptor
 
 var file_nest_proto_rawDesc = []byte{
@@ -335,34 +379,48 @@ var file_nest_proto_rawDesc = []byte{
 	0x02, 0x20, 0x01, 0x28, 0x0c, 0x48, 0x00, 0x52, 0x10, 0x4e, 0x65, 0x62, 0x75, 0x6c, 0x61, 0x50,
 	0x72, 0x69, 0x76, 0x61, 0x74, 0x65, 0x4b, 0x65, 0x79, 0x88, 0x01, 0x01, 0x42, 0x13, 0x0a, 0x11,
 	0x5f, 0x4e, 0x65, 0x62, 0x75, 0x6c, 0x61, 0x50, 0x72, 0x69, 0x76, 0x61, 0x74, 0x65, 0x4b, 0x65,
-	0x79, 0x22, 0x79, 0x0a, 0x0f, 0x52, 0x61, 0x77, 0x43, 0x6f, 0x6e, 0x66, 0x52, 0x65, 0x73, 0x70,
-	0x6f, 0x6e, 0x73, 0x65, 0x12, 0x1e, 0x0a, 0x0a, 0x4e, 0x65, 0x62, 0x75, 0x6c, 0x61, 0x43, 0x6f,
-	0x6e, 0x66, 0x18, 0x01, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x0a, 0x4e, 0x65, 0x62, 0x75, 0x6c, 0x61,
-	0x43, 0x6f, 0x6e, 0x66, 0x12, 0x16, 0x0a, 0x06, 0x47, 0x72, 0x6f, 0x75, 0x70, 0x73, 0x18, 0x02,
-	0x20, 0x03, 0x28, 0x09, 0x52, 0x06, 0x47, 0x72, 0x6f, 0x75, 0x70, 0x73, 0x12, 0x0e, 0x0a, 0x02,
-	0x49, 0x70, 0x18, 0x03, 0x20, 0x01, 0x28, 0x09, 0x52, 0x02, 0x49, 0x70, 0x12, 0x1e, 0x0a, 0x0a,
-	0x4e, 0x65, 0x62, 0x75, 0x6c, 0x61, 0x50, 0x61, 0x74, 0x68, 0x18, 0x04, 0x20, 0x01, 0x28, 0x09,
-	0x52, 0x0a, 0x4e, 0x65, 0x62, 0x75, 0x6c, 0x61, 0x50, 0x61, 0x74, 0x68, 0x22, 0x80, 0x02, 0x0a,
-	0x14, 0x52, 0x61, 0x77, 0x4e, 0x65, 0x62, 0x75, 0x6c, 0x61, 0x43, 0x73, 0x72, 0x52, 0x65, 0x73,
-	0x70, 0x6f, 0x6e, 0x73, 0x65, 0x12, 0x3a, 0x0a, 0x0a, 0x4e, 0x65, 0x62, 0x75, 0x6c, 0x61, 0x43,
-	0x65, 0x72, 0x74, 0x18, 0x01, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x1a, 0x2e, 0x63, 0x65, 0x72, 0x74,
-	0x2e, 0x52, 0x61, 0x77, 0x4e, 0x65, 0x62, 0x75, 0x6c, 0x61, 0x43, 0x65, 0x72, 0x74, 0x69, 0x66,
-	0x69, 0x63, 0x61, 0x74, 0x65, 0x52, 0x0a, 0x4e, 0x65, 0x62, 0x75, 0x6c, 0x61, 0x43, 0x65, 0x72,
-	0x74, 0x12, 0x2f, 0x0a, 0x10, 0x4e, 0x65, 0x62, 0x75, 0x6c, 0x61, 0x50, 0x72, 0x69, 0x76, 0x61,
-	0x74, 0x65, 0x4b, 0x65, 0x79, 0x18, 0x02, 0x20, 0x01, 0x28, 0x0c, 0x48, 0x00, 0x52, 0x10, 0x4e,
-	0x65, 0x62, 0x75, 0x6c, 0x61, 0x50, 0x72, 0x69, 0x76, 0x61, 0x74, 0x65, 0x4b, 0x65, 0x79, 0x88,
-	0x01, 0x01, 0x12, 0x23, 0x0a, 0x0a, 0x4e, 0x65, 0x62, 0x75, 0x6c, 0x61, 0x43, 0x6f, 0x6e, 0x66,
-	0x18, 0x03, 0x20, 0x01, 0x28, 0x0c, 0x48, 0x01, 0x52, 0x0a, 0x4e, 0x65, 0x62, 0x75, 0x6c, 0x61,
-	0x43, 0x6f, 0x6e, 0x66, 0x88, 0x01, 0x01, 0x12, 0x23, 0x0a, 0x0a, 0x4e, 0x65, 0x62, 0x75, 0x6c,
-	0x61, 0x50, 0x61, 0x74, 0x68, 0x18, 0x04, 0x20, 0x01, 0x28, 0x09, 0x48, 0x02, 0x52, 0x0a, 0x4e,
-	0x65, 0x62, 0x75, 0x6c, 0x61, 0x50, 0x61, 0x74, 0x68, 0x88, 0x01, 0x01, 0x42, 0x13, 0x0a, 0x11,
+	0x79, 0x22, 0xb1, 0x01, 0x0a, 0x0f, 0x52, 0x61, 0x77, 0x43, 0x6f, 0x6e, 0x66, 0x52, 0x65, 0x73,
+	0x70, 0x6f, 0x6e, 0x73, 0x65, 0x12, 0x1e, 0x0a, 0x0a, 0x4e, 0x65, 0x62, 0x75, 0x6c, 0x61, 0x43,
+	0x6f, 0x6e, 0x66, 0x18, 0x01, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x0a, 0x4e, 0x65, 0x62, 0x75, 0x6c,
+	0x61, 0x43, 0x6f, 0x6e, 0x66, 0x12, 0x16, 0x0a, 0x06, 0x47, 0x72, 0x6f, 0x75, 0x70, 0x73, 0x18,
+	0x02, 0x20, 0x03, 0x28, 0x09, 0x52, 0x06, 0x47, 0x72, 0x6f, 0x75, 0x70, 0x73, 0x12, 0x0e, 0x0a,
+	0x02, 0x49, 0x70, 0x18, 0x03, 0x20, 0x01, 0x28, 0x09, 0x52, 0x02, 0x49, 0x70, 0x12, 0x1e, 0x0a,
+	0x0a, 0x4e, 0x65, 0x62, 0x75, 0x6c, 0x61, 0x50, 0x61, 0x74, 0x68, 0x18, 0x04, 0x20, 0x01, 0x28,
+	0x09, 0x52, 0x0a, 0x4e, 0x65, 0x62, 0x75, 0x6c, 0x61, 0x50, 0x61, 0x74, 0x68, 0x12, 0x18, 0x0a,
+	0x07, 0x56, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x18, 0x05, 0x20, 0x01, 0x28, 0x09, 0x52, 0x07,
+	0x56, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x12, 0x1c, 0x0a, 0x09, 0x53, 0x69, 0x67, 0x6e, 0x61,
+	0x74, 0x75, 0x72, 0x65, 0x18, 0x06, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x09, 0x53, 0x69, 0x67, 0x6e,
+	0x61, 0x74, 0x75, 0x72, 0x65, 0x22, 0xa8, 0x03, 0x0a, 0x14, 0x52, 0x61, 0x77, 0x4e, 0x65, 0x62,
+	0x75, 0x6c, 0x61, 0x43, 0x73, 0x72, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x12, 0x3a,
+	0x0a, 0x0a, 0x4e, 0x65, 0x62, 0x75, 0x6c, 0x61, 0x43, 0x65, 0x72, 0x74, 0x18, 0x01, 0x20, 0x01,
+	0x28, 0x0b, 0x32, 0x1a, 0x2e, 0x63, 0x65, 0x72, 0x74, 0x2e, 0x52, 0x61, 0x77, 0x4e, 0x65, 0x62,
+	0x75, 0x6c, 0x61, 0x43, 0x65, 0x72, 0x74, 0x69, 0x66, 0x69, 0x63, 0x61, 0x74, 0x65, 0x52, 0x0a,
+	0x4e, 0x65, 0x62, 0x75, 0x6c, 0x61, 0x43, 0x65, 0x72, 0x74, 0x12, 0x2f, 0x0a, 0x10, 0x4e, 0x65,
+	0x62, 0x75, 0x6c, 0x61, 0x50, 0x72, 0x69, 0x76, 0x61, 0x74, 0x65, 0x4b, 0x65, 0x79, 0x18, 0x02,
+	0x20, 0x01, 0x28, 0x0c, 0x48, 0x00, 0x52, 0x10, 0x4e, 0x65, 0x62, 0x75, 0x6c, 0x61, 0x50, 0x72,
+	0x69, 0x76, 0x61, 0x74, 0x65, 0x4b, 0x65, 0x79, 0x88, 0x01, 0x01, 0x12, 0x23, 0x0a, 0x0a, 0x4e,
+	0x65, 0x62, 0x75, 0x6c, 0x61, 0x43, 0x6f, 0x6e, 0x66, 0x18, 0x03, 0x20, 0x01, 0x28, 0x0c, 0x48,
+	0x01, 0x52, 0x0a, 0x4e, 0x65, 0x62, 0x75, 0x6c, 0x61, 0x43, 0x6f, 0x6e, 0x66, 0x88, 0x01, 0x01,
+	0x12, 0x23, 0x0a, 0x0a, 0x4e, 0x65, 0x62, 0x75, 0x6c, 0x61, 0x50, 0x61, 0x74, 0x68, 0x18, 0x04,
+	0x20, 0x01, 0x28, 0x09, 0x48, 0x02, 0x52, 0x0a, 0x4e, 0x65, 0x62, 0x75, 0x6c, 0x61, 0x50, 0x61,
+	0x74, 0x68, 0x88, 0x01, 0x01, 0x12, 0x23, 0x0a, 0x0a, 0x52, 0x65, 0x6e, 0x65, 0x77, 0x41, 0x66,
+	0x74, 0x65, 0x72, 0x18, 0x05, 0x20, 0x01, 0x28, 0x03, 0x48, 0x03, 0x52, 0x0a, 0x52, 0x65, 0x6e,
+	0x65, 0x77, 0x41, 0x66, 0x74, 0x65, 0x72, 0x88, 0x01, 0x01, 0x12, 0x25, 0x0a, 0x0b, 0x52, 0x65,
+	0x6e, 0x65, 0x77, 0x42, 0x65, 0x66, 0x6f, 0x72, 0x65, 0x18, 0x06, 0x20, 0x01, 0x28, 0x03, 0x48,
+	0x04, 0x52, 0x0b, 0x52, 0x65, 0x6e, 0x65, 0x77, 0x42, 0x65, 0x66, 0x6f, 0x72, 0x65, 0x88, 0x01,
+	0x01, 0x12, 0x29, 0x0a, 0x0d, 0x43, 0x6f, 0x6e, 0x66, 0x53, 0x69, 0x67, 0x6e, 0x61, 0x74, 0x75,
+	0x72, 0x65, 0x18, 0x07, 0x20, 0x01, 0x28, 0x0c, 0x48, 0x05, 0x52, 0x0d, 0x43, 0x6f, 0x6e, 0x66,
+	0x53, 0x69, 0x67, 0x6e, 0x61, 0x74, 0x75, 0x72, 0x65, 0x88, 0x01, 0x01, 0x42, 0x13, 0x0a, 0x11,
 	0x5f, 0x4e, 0x65, 0x62, 0x75, 0x6c, 0x61, 0x50, 0x72, 0x69, 0x76, 0x61, 0x74, 0x65, 0x4b, 0x65,
 	0x79, 0x42, 0x0d, 0x0a, 0x0b, 0x5f, 0x4e, 0x65, 0x62, 0x75, 0x6c, 0x61, 0x43, 0x6f, 0x6e, 0x66,
 	0x42, 0x0d, 0x0a, 0x0b, 0x5f, 0x4e, 0x65, 0x62, 0x75, 0x6c, 0x61, 0x50, 0x61, 0x74, 0x68, 0x42,
-	0x29, 0x5a, 0x27, 0x67, 0x69, 0x74, 0x68, 0x75, 0x62, 0x2e, 0x63, 0x6f, 0x6d, 0x2f, 0x6d, 0x34,
-	0x72, 0x6b, 0x64, 0x63, 0x2f, 0x6e, 0x65, 0x62, 0x75, 0x6c, 0x61, 0x5f, 0x65, 0x73, 0x74, 0x2f,
-	0x70, 0x6b, 0x67, 0x2f, 0x6d, 0x6f, 0x64, 0x65, 0x6c, 0x73, 0x62, 0x06, 0x70, 0x72, 0x6f, 0x74,
-	0x6f, 0x33,
+	0x0d, 0x0a, 0x0b, 0x5f, 0x52, 0x65, 0x6e, 0x65, 0x77, 0x41, 0x66, 0x74, 0x65, 0x72, 0x42, 0x0e,
+	0x0a, 0x0c, 0x5f, 0x52, 0x65, 0x6e, 0x65, 0x77, 0x42, 0x65, 0x66, 0x6f, 0x72, 0x65, 0x42, 0x10,
+	0x0a, 0x0e, 0x5f, 0x43, 0x6f, 0x6e, 0x66, 0x53, 0x69, 0x67, 0x6e, 0x61, 0x74, 0x75, 0x72, 0x65,
+	0x42, 0x29, 0x5a, 0x27, 0x67, 0x69, 0x74, 0x68, 0x75, 0x62, 0x2e, 0x63, 0x6f, 0x6d, 0x2f, 0x6d,
+	0x34, 0x72, 0x6b, 0x64, 0x63, 0x2f, 0x6e, 0x65, 0x62, 0x75, 0x6c, 0x61, 0x5f, 0x65, 0x73, 0x74,
+	0x2f, 0x70, 0x6b, 0x67, 0x2f, 0x6d, 0x6f, 0x64, 0x65, 0x6c, 0x73, 0x62, 0x06, 0x70, 0x72, 0x6f,
+	0x74, 0x6f, 0x33,
 }
 
 var (
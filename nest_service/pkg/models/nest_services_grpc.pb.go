@@ -0,0 +1,385 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.2.0
+// - protoc             v3.21.12
+// source: nest_services.proto
+
+package models
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+// CaServiceClient is the client API for CaService service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type CaServiceClient interface {
+	// Sign the client-generated Nebula public key of the Nebula CSR
+	Sign(ctx context.Context, in *RawNebulaCsr, opts ...grpc.CallOption) (*RawCaResponse, error)
+	// Generate a Nebula key pair for the client of the Nebula CSR and sign its public key
+	Generate(ctx context.Context, in *RawNebulaCsr, opts ...grpc.CallOption) (*RawCaResponse, error)
+	// Get the Nebula CA certificates
+	CaCerts(ctx context.Context, in *CaCertsRequest, opts ...grpc.CallOption) (*CaCertsResponse, error)
+}
+
+type caServiceClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewCaServiceClient(cc grpc.ClientConnInterface) CaServiceClient {
+	return &caServiceClient{cc}
+}
+
+func (c *caServiceClient) Sign(ctx context.Context, in *RawNebulaCsr, opts ...grpc.CallOption) (*RawCaResponse, error) {
+	out := new(RawCaResponse)
+	err := c.cc.Invoke(ctx, "/models.CaService/Sign", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *caServiceClient) Generate(ctx context.Context, in *RawNebulaCsr, opts ...grpc.CallOption) (*RawCaResponse, error) {
+	out := new(RawCaResponse)
+	err := c.cc.Invoke(ctx, "/models.CaService/Generate", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *caServiceClient) CaCerts(ctx context.Context, in *CaCertsRequest, opts ...grpc.CallOption) (*CaCertsResponse, error) {
+	out := new(CaCertsResponse)
+	err := c.cc.Invoke(ctx, "/models.CaService/CaCerts", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// CaServiceServer is the server API for CaService service.
+// All implementations must embed UnimplementedCaServiceServer
+// for forward compatibility
+type CaServiceServer interface {
+	// Sign the client-generated Nebula public key of the Nebula CSR
+	Sign(context.Context, *RawNebulaCsr) (*RawCaResponse, error)
+	// Generate a Nebula key pair for the client of the Nebula CSR and sign its public key
+	Generate(context.Context, *RawNebulaCsr) (*RawCaResponse, error)
+	// Get the Nebula CA certificates
+	CaCerts(context.Context, *CaCertsRequest) (*CaCertsResponse, error)
+	mustEmbedUnimplementedCaServiceServer()
+}
+
+// UnimplementedCaServiceServer must be embedded to have forward compatible implementations.
+type UnimplementedCaServiceServer struct {
+}
+
+func (UnimplementedCaServiceServer) Sign(context.Context, *RawNebulaCsr) (*RawCaResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Sign not implemented")
+}
+func (UnimplementedCaServiceServer) Generate(context.Context, *RawNebulaCsr) (*RawCaResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Generate not implemented")
+}
+func (UnimplementedCaServiceServer) CaCerts(context.Context, *CaCertsRequest) (*CaCertsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method CaCerts not implemented")
+}
+func (UnimplementedCaServiceServer) mustEmbedUnimplementedCaServiceServer() {}
+
+// UnsafeCaServiceServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to CaServiceServer will
+// result in compilation errors.
+type UnsafeCaServiceServer interface {
+	mustEmbedUnimplementedCaServiceServer()
+}
+
+func RegisterCaServiceServer(s grpc.ServiceRegistrar, srv CaServiceServer) {
+	s.RegisterService(&CaService_ServiceDesc, srv)
+}
+
+func _CaService_Sign_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RawNebulaCsr)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(CaServiceServer).Sign(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/models.CaService/Sign",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(CaServiceServer).Sign(ctx, req.(*RawNebulaCsr))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _CaService_Generate_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RawNebulaCsr)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(CaServiceServer).Generate(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/models.CaService/Generate",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(CaServiceServer).Generate(ctx, req.(*RawNebulaCsr))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _CaService_CaCerts_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CaCertsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(CaServiceServer).CaCerts(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/models.CaService/CaCerts",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(CaServiceServer).CaCerts(ctx, req.(*CaCertsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// CaService_ServiceDesc is the grpc.ServiceDesc for CaService service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var CaService_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "models.CaService",
+	HandlerType: (*CaServiceServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Sign",
+			Handler:    _CaService_Sign_Handler,
+		},
+		{
+			MethodName: "Generate",
+			Handler:    _CaService_Generate_Handler,
+		},
+		{
+			MethodName: "CaCerts",
+			Handler:    _CaService_CaCerts_Handler,
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "nest_services.proto",
+}
+
+// ConfigServiceClient is the client API for ConfigService service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type ConfigServiceClient interface {
+	// Get the Nebula configuration file, IP, groups and installation path of a client
+	GetConfig(ctx context.Context, in *ConfigRequest, opts ...grpc.CallOption) (*RawConfResponse, error)
+	// List the valid hostnames of the Nebula network
+	ListHostnames(ctx context.Context, in *HostnamesRequest, opts ...grpc.CallOption) (*HostnamesResponse, error)
+	// Register the hostname as an instance of the host template it matches, at its first enrollment application
+	RegisterInstance(ctx context.Context, in *InstanceRequest, opts ...grpc.CallOption) (*InstanceResponse, error)
+	// Get the public keys with which the Nebula configuration files are signed
+	SigningKeys(ctx context.Context, in *SigningKeysRequest, opts ...grpc.CallOption) (*SigningKeysResponse, error)
+}
+
+type configServiceClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewConfigServiceClient(cc grpc.ClientConnInterface) ConfigServiceClient {
+	return &configServiceClient{cc}
+}
+
+func (c *configServiceClient) GetConfig(ctx context.Context, in *ConfigRequest, opts ...grpc.CallOption) (*RawConfResponse, error) {
+	out := new(RawConfResponse)
+	err := c.cc.Invoke(ctx, "/models.ConfigService/GetConfig", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *configServiceClient) ListHostnames(ctx context.Context, in *HostnamesRequest, opts ...grpc.CallOption) (*HostnamesResponse, error) {
+	out := new(HostnamesResponse)
+	err := c.cc.Invoke(ctx, "/models.ConfigService/ListHostnames", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *configServiceClient) RegisterInstance(ctx context.Context, in *InstanceRequest, opts ...grpc.CallOption) (*InstanceResponse, error) {
+	out := new(InstanceResponse)
+	err := c.cc.Invoke(ctx, "/models.ConfigService/RegisterInstance", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *configServiceClient) SigningKeys(ctx context.Context, in *SigningKeysRequest, opts ...grpc.CallOption) (*SigningKeysResponse, error) {
+	out := new(SigningKeysResponse)
+	err := c.cc.Invoke(ctx, "/models.ConfigService/SigningKeys", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// ConfigServiceServer is the server API for ConfigService service.
+// All implementations must embed UnimplementedConfigServiceServer
+// for forward compatibility
+type ConfigServiceServer interface {
+	// Get the Nebula configuration file, IP, groups and installation path of a client
+	GetConfig(context.Context, *ConfigRequest) (*RawConfResponse, error)
+	// List the valid hostnames of the Nebula network
+	ListHostnames(context.Context, *HostnamesRequest) (*HostnamesResponse, error)
+	// Register the hostname as an instance of the host template it matches, at its first enrollment application
+	RegisterInstance(context.Context, *InstanceRequest) (*InstanceResponse, error)
+	// Get the public keys with which the Nebula configuration files are signed
+	SigningKeys(context.Context, *SigningKeysRequest) (*SigningKeysResponse, error)
+	mustEmbedUnimplementedConfigServiceServer()
+}
+
+// UnimplementedConfigServiceServer must be embedded to have forward compatible implementations.
+type UnimplementedConfigServiceServer struct {
+}
+
+func (UnimplementedConfigServiceServer) GetConfig(context.Context, *ConfigRequest) (*RawConfResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetConfig not implemented")
+}
+func (UnimplementedConfigServiceServer) ListHostnames(context.Context, *HostnamesRequest) (*HostnamesResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListHostnames not implemented")
+}
+func (UnimplementedConfigServiceServer) RegisterInstance(context.Context, *InstanceRequest) (*InstanceResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method RegisterInstance not implemented")
+}
+func (UnimplementedConfigServiceServer) SigningKeys(context.Context, *SigningKeysRequest) (*SigningKeysResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method SigningKeys not implemented")
+}
+func (UnimplementedConfigServiceServer) mustEmbedUnimplementedConfigServiceServer() {}
+
+// UnsafeConfigServiceServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to ConfigServiceServer will
+// result in compilation errors.
+type UnsafeConfigServiceServer interface {
+	mustEmbedUnimplementedConfigServiceServer()
+}
+
+func RegisterConfigServiceServer(s grpc.ServiceRegistrar, srv ConfigServiceServer) {
+	s.RegisterService(&ConfigService_ServiceDesc, srv)
+}
+
+func _ConfigService_GetConfig_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ConfigRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ConfigServiceServer).GetConfig(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/models.ConfigService/GetConfig",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ConfigServiceServer).GetConfig(ctx, req.(*ConfigRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ConfigService_ListHostnames_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(HostnamesRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ConfigServiceServer).ListHostnames(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/models.ConfigService/ListHostnames",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ConfigServiceServer).ListHostnames(ctx, req.(*HostnamesRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ConfigService_RegisterInstance_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(InstanceRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ConfigServiceServer).RegisterInstance(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/models.ConfigService/RegisterInstance",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ConfigServiceServer).RegisterInstance(ctx, req.(*InstanceRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ConfigService_SigningKeys_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SigningKeysRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ConfigServiceServer).SigningKeys(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/models.ConfigService/SigningKeys",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ConfigServiceServer).SigningKeys(ctx, req.(*SigningKeysRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// ConfigService_ServiceDesc is the grpc.ServiceDesc for ConfigService service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var ConfigService_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "models.ConfigService",
+	HandlerType: (*ConfigServiceServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "GetConfig",
+			Handler:    _ConfigService_GetConfig_Handler,
+		},
+		{
+			MethodName: "ListHostnames",
+			Handler:    _ConfigService_ListHostnames_Handler,
+		},
+		{
+			MethodName: "RegisterInstance",
+			Handler:    _ConfigService_RegisterInstance_Handler,
+		},
+		{
+			MethodName: "SigningKeys",
+			Handler:    _ConfigService_SigningKeys_Handler,
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "nest_services.proto",
+}
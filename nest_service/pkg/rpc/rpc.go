@@ -0,0 +1,156 @@
+/*
+NEST: Nebula Enrollment over Secure Transport - OpenAPI 3.0
+
+This package contains the gRPC utilities shared by the NEST services: the gRPC server setup and the conversions between models.ApiError and gRPC statuses.
+API version: 0.3.1
+Contact: gianmarco.decola@studio.unibo.it
+*/
+package rpc
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/m4rkdc/nebula_est/nest_service/pkg/logging"
+	"github.com/m4rkdc/nebula_est/nest_service/pkg/metrics"
+	"github.com/m4rkdc/nebula_est/nest_service/pkg/models"
+	"github.com/m4rkdc/nebula_est/nest_service/pkg/tracing"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// HTTP status codes of the models.ApiError and their gRPC equivalents
+var http_codes = map[int]codes.Code{
+	http.StatusBadRequest:          codes.InvalidArgument,
+	http.StatusUnauthorized:        codes.Unauthenticated,
+	http.StatusForbidden:           codes.PermissionDenied,
+	http.StatusNotFound:            codes.NotFound,
+	http.StatusConflict:            codes.AlreadyExists,
+	http.StatusPreconditionFailed:  codes.FailedPrecondition,
+	http.StatusTooManyRequests:     codes.ResourceExhausted,
+	http.StatusInternalServerError: codes.Internal,
+	http.StatusNotImplemented:      codes.Unimplemented,
+	http.StatusServiceUnavailable:  codes.Unavailable,
+	http.StatusGatewayTimeout:      codes.DeadlineExceeded,
+}
+
+// Metadata key of the Nebula network of a call, in multi-tenant deployments
+const network_key = "nest-network"
+
+// WithNetwork returns a copy of ctx whose outgoing calls are for the Nebula network. ctx is returned as is in single network deployments
+func WithNetwork(ctx context.Context, network string) context.Context {
+	if len(network) == 0 {
+		return ctx
+	}
+	return metadata.AppendToOutgoingContext(ctx, network_key, network)
+}
+
+// Network returns the Nebula network of the incoming call, empty if the caller did not give one
+func Network(ctx context.Context) string {
+	md, _ := metadata.FromIncomingContext(ctx)
+	if networks := md.Get(network_key); len(networks) != 0 {
+		return networks[0]
+	}
+	return ""
+}
+
+/*
+Instance returns the service instance serving the Nebula network of the incoming call: single in single network deployments, where networks is nil,
+the instance of the network in networks otherwise. The calls for other networks are rejected with a NotFound status, so that the networks stay isolated.
+*/
+func Instance[T any](ctx context.Context, single T, networks map[string]T) (T, error) {
+	network := Network(ctx)
+	if networks == nil && len(network) == 0 {
+		return single, nil
+	}
+	instance, ok := networks[network]
+	if !ok {
+		var none T
+		return none, status.Error(codes.NotFound, "Not found: unknown Nebula network \""+network+"\"")
+	}
+	return instance, nil
+}
+
+// ToStatus converts the error returned by a NEST service function to a gRPC status error. Errors other than *models.ApiError are internal errors
+func ToStatus(err error) error {
+	if err == nil {
+		return nil
+	}
+	var api_error *models.ApiError
+	if !errors.As(err, &api_error) {
+		return status.Error(codes.Internal, "Internal Server Error: "+err.Error())
+	}
+	code, ok := http_codes[api_error.Code]
+	if !ok {
+		code = codes.Unknown
+	}
+	return status.Error(code, api_error.Message)
+}
+
+// FromStatus converts the error returned by a gRPC call to a *models.ApiError
+func FromStatus(err error) *models.ApiError {
+	if err == nil {
+		return nil
+	}
+	s := status.Convert(err)
+	for http_code, code := range http_codes {
+		if code == s.Code() {
+			return &models.ApiError{Code: http_code, Message: s.Message()}
+		}
+	}
+	switch s.Code() {
+	case codes.Canceled:
+		return &models.ApiError{Code: 499, Message: s.Message()}
+	case codes.Aborted:
+		return &models.ApiError{Code: http.StatusConflict, Message: s.Message()}
+	}
+	return &models.ApiError{Code: http.StatusInternalServerError, Message: s.Message()}
+}
+
+/*
+metricsInterceptor records the gRPC calls served in the same metrics of the REST requests,
+using the full gRPC method as route, "GRPC" as method and the gRPC status code as status.
+*/
+func metricsInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	start := time.Now()
+	resp, err := handler(ctx, req)
+	code := status.Code(err).String()
+	metrics.Requests.WithLabelValues(info.FullMethod, "GRPC", code).Inc()
+	metrics.RequestDuration.WithLabelValues(info.FullMethod, "GRPC", code).Observe(time.Since(start).Seconds())
+	return resp, err
+}
+
+/*
+NewServer creates a gRPC server for a NEST service. If tls_config is nil, it is served without TLS, since the NEST services communicate over the NEST system Nebula network.
+Otherwise, in mtls transport mode, it is served with tls_config.
+The calls are traced as children of the NEST service spans, logged with the request ID forwarded by the NEST service, and recorded in the metrics.
+*/
+func NewServer(tls_config *tls.Config) *grpc.Server {
+	opts := []grpc.ServerOption{grpc.ChainUnaryInterceptor(tracing.UnaryServerInterceptor, logging.UnaryServerInterceptor, metricsInterceptor)}
+	if tls_config != nil {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(tls_config)))
+	}
+	return grpc.NewServer(opts...)
+}
+
+// Shutdown stops server from accepting new calls and waits for the calls in progress to complete. If they do not complete before ctx is done, they are canceled
+func Shutdown(ctx context.Context, server *grpc.Server) error {
+	done := make(chan struct{})
+	go func() {
+		server.GracefulStop()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		server.Stop()
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,52 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/go-playground/assert/v2"
+	"github.com/m4rkdc/nebula_est/nest_service/pkg/models"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func TestStatus(t *testing.T) {
+	//First test: an ApiError survives the conversion to a gRPC status and back
+	err := ToStatus(&models.ApiError{Code: 400, Message: "Bad request: no hostname provided"})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	assert.Equal(t, &models.ApiError{Code: 400, Message: "Bad request: no hostname provided"}, FromStatus(err))
+
+	//Second test: other errors are internal errors
+	err = ToStatus(errors.New("dhall-nebula failed"))
+	assert.Equal(t, codes.Internal, status.Code(err))
+	assert.Equal(t, 500, FromStatus(err).Code)
+
+	assert.Equal(t, nil, ToStatus(nil))
+}
+
+func TestInstance(t *testing.T) {
+	networks := map[string]string{"ot": "ot instance", "it": "it instance"}
+	ot := metadata.NewIncomingContext(context.Background(), metadata.Pairs(network_key, "ot"))
+
+	//First test: single network deployments serve the calls without network
+	instance, err := Instance(context.Background(), "single", nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "single", instance)
+
+	//Second test: the calls are served by the instance of their network
+	instance, err = Instance(ot, "", networks)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "ot instance", instance)
+
+	//Third test: the calls for another network, or without network, are rejected
+	_, err = Instance(ot, "single", nil)
+	assert.Equal(t, codes.NotFound, status.Code(err))
+	_, err = Instance(context.Background(), "", networks)
+	assert.Equal(t, codes.NotFound, status.Code(err))
+
+	//Fourth test: the network sent by the caller is received
+	outgoing, _ := metadata.FromOutgoingContext(WithNetwork(context.Background(), "it"))
+	assert.Equal(t, "it", Network(metadata.NewIncomingContext(context.Background(), outgoing)))
+}
@@ -0,0 +1,164 @@
+package store
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Age after which the lock of a key, left by a replica that crashed while writing it, is removed
+var Stale_lock = 10 * time.Second
+
+/*
+File is a Store keeping every key in a file of its folder, named after the key. The folder can be shared by several replicas on a shared volume (e.g., NFS):
+the writes of a key are serialized by a lock file created exclusively, and the version of a value is its SHA-256 hash, so that writing back
+the same value yields the same version. A value changed and then restored between the read and the write of another replica is thus not a conflict:
+the write, computed from the same value, replaces it.
+The files starting with a dot are reserved to the store.
+*/
+type File struct {
+	folder string
+}
+
+// NewFile creates a File store in folder, which must end with a path separator. The folder is created by the first write if it does not exist
+func NewFile(folder string) *File {
+	return &File{folder: folder}
+}
+
+// valueVersion returns the version of a stored value
+func valueVersion(value []byte) string {
+	sum := sha256.Sum256(value)
+	return hex.EncodeToString(sum[:8])
+}
+
+func (f *File) Get(ctx context.Context, key string) ([]byte, string, error) {
+	if err := checkKey(key); err != nil {
+		return nil, "", err
+	}
+	b, err := os.ReadFile(f.folder + key)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, "", ErrNotFound
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	return b, valueVersion(b), nil
+}
+
+// lock acquires the lock of key, waiting while another writer holds it. The returned function releases it
+func (f *File) lock(ctx context.Context, key string) (func(), error) {
+	path := f.folder + "." + key + ".lock"
+	for {
+		lock_file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err == nil {
+			lock_file.Close()
+			return func() { os.Remove(path) }, nil
+		}
+		if errors.Is(err, os.ErrNotExist) {
+			if err = os.MkdirAll(f.folder, 0700); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if !errors.Is(err, os.ErrExist) {
+			return nil, err
+		}
+		if info, err := os.Stat(path); err == nil && time.Since(info.ModTime()) > Stale_lock {
+			os.Remove(path)
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+// current returns the version of the value of key, the empty version if key does not exist. The caller holds the lock of key
+func (f *File) current(key string) (string, error) {
+	b, err := os.ReadFile(f.folder + key)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return valueVersion(b), nil
+}
+
+/*
+Put writes value to key if its current version is version.
+The value is first written to a temporary file which then replaces the file of key, so that readers never see a partially written value.
+*/
+func (f *File) Put(ctx context.Context, key string, value []byte, version string) (string, error) {
+	if err := checkKey(key); err != nil {
+		return "", err
+	}
+	unlock, err := f.lock(ctx, key)
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+
+	current, err := f.current(key)
+	if err != nil {
+		return "", err
+	}
+	if current != version {
+		return "", ErrConflict
+	}
+	tmp := f.folder + "." + key + ".tmp"
+	if err = os.WriteFile(tmp, value, 0600); err != nil {
+		return "", err
+	}
+	if err = os.Rename(tmp, f.folder+key); err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	return valueVersion(value), nil
+}
+
+func (f *File) Delete(ctx context.Context, key string, version string) error {
+	if err := checkKey(key); err != nil {
+		return err
+	}
+	unlock, err := f.lock(ctx, key)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	current, err := f.current(key)
+	if err != nil {
+		return err
+	}
+	if len(current) == 0 || current != version {
+		return ErrConflict
+	}
+	return os.Remove(f.folder + key)
+}
+
+func (f *File) List(ctx context.Context) ([]string, error) {
+	entries, err := os.ReadDir(f.folder)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var keys []string
+	for _, e := range entries {
+		if e.IsDir() || strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+		keys = append(keys, e.Name())
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
@@ -0,0 +1,124 @@
+package store
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// ErrLeased is returned when a lease is held by another owner
+var ErrLeased = errors.New("lease held by another owner")
+
+// A time-limited exclusive lease on a name
+type Lease struct {
+	Name string `json:"name"`
+	//Replica holding the lease, followed by a token unique to the acquisition
+	Owner   string    `json:"owner"`
+	Expires time.Time `json:"expires"`
+}
+
+/*
+Leases grants time-limited exclusive leases on names, kept in a Store shared by the replicas: a name is leased by at most one
+acquisition at a time, across all the replicas, until the lease is released or expires.
+*/
+type Leases struct {
+	store   Store
+	replica string
+}
+
+// NewLeases creates the leases of the given replica, kept in store
+func NewLeases(store Store, replica string) *Leases {
+	return &Leases{store: store, replica: replica}
+}
+
+// newOwner returns a new owner of a lease of the replica
+func (l *Leases) newOwner() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return l.replica + "/" + hex.EncodeToString(b)
+}
+
+// read returns the lease on name and its version, nil if name is not leased
+func (l *Leases) read(ctx context.Context, name string) (*Lease, string, error) {
+	b, version, err := l.store.Get(ctx, name)
+	if errors.Is(err, ErrNotFound) {
+		return nil, "", nil
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	var lease Lease
+	if err = json.Unmarshal(b, &lease); err != nil {
+		return nil, "", err
+	}
+	return &lease, version, nil
+}
+
+// write writes lease, replacing the one with the given version
+func (l *Leases) write(ctx context.Context, lease *Lease, version string) error {
+	b, err := json.Marshal(lease)
+	if err != nil {
+		return err
+	}
+	_, err = l.store.Put(ctx, lease.Name, b, version)
+	return err
+}
+
+// Acquire acquires the lease on name for ttl. It returns ErrLeased if the lease is held, and not expired, by another acquisition
+func (l *Leases) Acquire(ctx context.Context, name string, ttl time.Duration) (*Lease, error) {
+	for {
+		current, version, err := l.read(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		if current != nil && time.Now().Before(current.Expires) {
+			return nil, ErrLeased
+		}
+		lease := &Lease{Name: name, Owner: l.newOwner(), Expires: time.Now().Add(ttl)}
+		err = l.write(ctx, lease, version)
+		if errors.Is(err, ErrConflict) {
+			//Another replica acquired or released the lease meanwhile
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return lease, nil
+	}
+}
+
+// Renew extends lease for ttl from now. It returns ErrLeased if lease expired and was acquired by another owner meanwhile
+func (l *Leases) Renew(ctx context.Context, lease *Lease, ttl time.Duration) error {
+	current, version, err := l.read(ctx, lease.Name)
+	if err != nil {
+		return err
+	}
+	if current == nil || current.Owner != lease.Owner {
+		return ErrLeased
+	}
+	renewed := *lease
+	renewed.Expires = time.Now().Add(ttl)
+	if err = l.write(ctx, &renewed, version); err != nil {
+		if errors.Is(err, ErrConflict) {
+			return ErrLeased
+		}
+		return err
+	}
+	lease.Expires = renewed.Expires
+	return nil
+}
+
+// Release releases lease. It does nothing if lease expired and was acquired by another owner meanwhile
+func (l *Leases) Release(ctx context.Context, lease *Lease) error {
+	current, version, err := l.read(ctx, lease.Name)
+	if err != nil || current == nil || current.Owner != lease.Owner {
+		return err
+	}
+	if err = l.store.Delete(ctx, lease.Name, version); errors.Is(err, ErrConflict) {
+		return nil
+	}
+	return err
+}
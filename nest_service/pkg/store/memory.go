@@ -0,0 +1,71 @@
+package store
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+type memoryEntry struct {
+	value   []byte
+	version string
+}
+
+// Memory is a Store kept in memory. It can't be shared by several replicas and is lost when the service stops
+type Memory struct {
+	mu      sync.Mutex
+	entries map[string]memoryEntry
+	writes  int
+}
+
+// NewMemory creates an empty Memory store
+func NewMemory() *Memory {
+	return &Memory{entries: make(map[string]memoryEntry)}
+}
+
+func (m *Memory) Get(ctx context.Context, key string) ([]byte, string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e, ok := m.entries[key]
+	if !ok {
+		return nil, "", ErrNotFound
+	}
+	return append([]byte(nil), e.value...), e.version, nil
+}
+
+func (m *Memory) Put(ctx context.Context, key string, value []byte, version string) (string, error) {
+	if err := checkKey(key); err != nil {
+		return "", err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.entries[key].version != version {
+		return "", ErrConflict
+	}
+	m.writes++
+	e := memoryEntry{value: append([]byte(nil), value...), version: strconv.Itoa(m.writes)}
+	m.entries[key] = e
+	return e.version, nil
+}
+
+func (m *Memory) Delete(ctx context.Context, key string, version string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if e, ok := m.entries[key]; !ok || e.version != version {
+		return ErrConflict
+	}
+	delete(m.entries, key)
+	return nil
+}
+
+func (m *Memory) List(ctx context.Context) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	keys := make([]string, 0, len(m.entries))
+	for key := range m.entries {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
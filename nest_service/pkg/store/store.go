@@ -0,0 +1,47 @@
+/*
+NEST: Nebula Enrollment over Secure Transport - OpenAPI 3.0
+
+This package contains the stores in which the NEST service replicas share their enrollment state, with optimistic concurrency, and the leases built on them.
+API version: 0.3.1
+Contact: gianmarco.decola@studio.unibo.it
+*/
+package store
+
+import (
+	"context"
+	"errors"
+	"strings"
+)
+
+var (
+	// ErrNotFound is returned when a key is not in the store
+	ErrNotFound = errors.New("not found")
+	// ErrConflict is returned when a key is written or deleted with a version that is no longer its current one
+	ErrConflict = errors.New("version conflict: the value was modified concurrently")
+)
+
+/*
+Store is a key-value store shared by the NEST service replicas. Every value has a version, an opaque string changed by every write of a different value:
+a write or a delete succeeds only if the version given is still the current one (optimistic concurrency), so that concurrent updates are never lost.
+Depending on the store, writing back a value identical to an earlier one may yield its earlier version again (e.g., File): a value changed and then restored
+meanwhile is then not detected. The callers only write values computed from the whole value they read, so that such a write is still correct.
+The empty version stands for a key that does not exist.
+*/
+type Store interface {
+	// Get returns the value of key and its version, ErrNotFound if key does not exist
+	Get(ctx context.Context, key string) ([]byte, string, error)
+	// Put writes value to key if its current version is version, and returns the new version. It returns ErrConflict otherwise
+	Put(ctx context.Context, key string, value []byte, version string) (string, error)
+	// Delete removes key if its current version is version. It returns ErrConflict otherwise
+	Delete(ctx context.Context, key string, version string) error
+	// List returns the keys of the store
+	List(ctx context.Context) ([]string, error)
+}
+
+// checkKey returns an error if key can't be stored: keys can't be empty, start with a dot or contain path separators
+func checkKey(key string) error {
+	if len(key) == 0 || strings.HasPrefix(key, ".") || strings.ContainsAny(key, "/\\") {
+		return errors.New("invalid key \"" + key + "\"")
+	}
+	return nil
+}
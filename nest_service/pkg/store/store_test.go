@@ -0,0 +1,129 @@
+package store
+
+import (
+	"context"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-playground/assert/v2"
+)
+
+// testStore checks the optimistic concurrency of a Store implementation
+func testStore(t *testing.T, s Store) {
+	ctx := context.Background()
+
+	//First test: a missing key is not found and can only be created with the empty version
+	_, _, err := s.Get(ctx, "host1")
+	assert.Equal(t, ErrNotFound, err)
+	_, err = s.Put(ctx, "host1", []byte("pending"), "v0")
+	assert.Equal(t, ErrConflict, err)
+	v1, err := s.Put(ctx, "host1", []byte("pending"), "")
+	assert.Equal(t, nil, err)
+
+	//Second test: a write succeeds only with the current version
+	v2, err := s.Put(ctx, "host1", []byte("completed"), v1)
+	assert.Equal(t, nil, err)
+	_, err = s.Put(ctx, "host1", []byte("expired"), v1)
+	assert.Equal(t, ErrConflict, err)
+	b, version, err := s.Get(ctx, "host1")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "completed", string(b))
+	assert.Equal(t, v2, version)
+
+	//Third test: the keys are listed, the invalid keys are rejected
+	_, err = s.Put(ctx, "host2", []byte("applied"), "")
+	assert.Equal(t, nil, err)
+	keys, err := s.List(ctx)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []string{"host1", "host2"}, keys)
+	_, err = s.Put(ctx, "../host3", []byte("pending"), "")
+	assert.NotEqual(t, nil, err)
+
+	//Fourth test: a delete succeeds only with the current version
+	assert.Equal(t, ErrConflict, s.Delete(ctx, "host2", v1))
+	_, version, _ = s.Get(ctx, "host2")
+	assert.Equal(t, nil, s.Delete(ctx, "host2", version))
+	_, _, err = s.Get(ctx, "host2")
+	assert.Equal(t, ErrNotFound, err)
+
+	//Fifth test: among concurrent creations of the same key, only one succeeds
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	created := 0
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := s.Put(ctx, "host4", []byte("pending"), ""); err == nil {
+				mu.Lock()
+				created++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, 1, created)
+}
+
+func TestMemory(t *testing.T) {
+	testStore(t, NewMemory())
+}
+
+func TestFile(t *testing.T) {
+	folder := t.TempDir() + "/"
+	testStore(t, NewFile(folder))
+
+	//First test: the values are stored as files, the legacy files are readable
+	os.WriteFile(folder+"legacy", []byte("Completed\n"), 0600)
+	b, _, err := NewFile(folder).Get(context.Background(), "legacy")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "Completed\n", string(b))
+
+	//Second test: the folder is created by the first write
+	_, err = NewFile(folder+"leases/").Put(context.Background(), "host1", []byte("pending"), "")
+	assert.Equal(t, nil, err)
+
+	//Third test: a stale lock left by a crashed replica is removed
+	Stale_lock = 50 * time.Millisecond
+	defer func() { Stale_lock = 10 * time.Second }()
+	os.WriteFile(folder+".host1.lock", nil, 0600)
+	os.Chtimes(folder+".host1.lock", time.Now().Add(-time.Second), time.Now().Add(-time.Second))
+	_, version, _ := NewFile(folder).Get(context.Background(), "host1")
+	_, err = NewFile(folder).Put(context.Background(), "host1", []byte("expired"), version)
+	assert.Equal(t, nil, err)
+}
+
+func TestLeases(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemory()
+	replica1, replica2 := NewLeases(s, "replica1"), NewLeases(s, "replica2")
+
+	//First test: a lease is exclusive, even within the same replica
+	lease, err := replica1.Acquire(ctx, "ncsr-host1", time.Minute)
+	assert.Equal(t, nil, err)
+	_, err = replica2.Acquire(ctx, "ncsr-host1", time.Minute)
+	assert.Equal(t, ErrLeased, err)
+	_, err = replica1.Acquire(ctx, "ncsr-host1", time.Minute)
+	assert.Equal(t, ErrLeased, err)
+
+	//Second test: a released lease can be acquired again
+	assert.Equal(t, nil, replica1.Release(ctx, lease))
+	lease, err = replica2.Acquire(ctx, "ncsr-host1", 10*time.Millisecond)
+	assert.Equal(t, nil, err)
+
+	//Third test: an expired lease can be acquired by another owner, and can no longer be renewed or released by its previous owner
+	time.Sleep(20 * time.Millisecond)
+	taken, err := replica1.Acquire(ctx, "ncsr-host1", time.Minute)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, ErrLeased, replica2.Renew(ctx, lease, time.Minute))
+	assert.Equal(t, nil, replica2.Release(ctx, lease))
+	_, err = replica2.Acquire(ctx, "ncsr-host1", time.Minute)
+	assert.Equal(t, ErrLeased, err)
+
+	//Fourth test: a renewed lease does not expire
+	taken.Expires = time.Now()
+	assert.Equal(t, nil, replica1.Renew(ctx, taken, time.Minute))
+	assert.Equal(t, true, taken.Expires.After(time.Now()))
+}
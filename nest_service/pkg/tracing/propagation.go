@@ -0,0 +1,112 @@
+package tracing
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	grpc_codes "google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+/*
+Middleware starts a server span for every REST request, child of the span whose W3C trace context is received in the request headers.
+The span is carried by the request context, so that the spans of the request handling and of the calls to the other NEST services are its children.
+*/
+func Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := otel.GetTextMapPropagator().Extract(c.Request.Context(), propagation.HeaderCarrier(c.Request.Header))
+		route := c.FullPath()
+		if len(route) == 0 {
+			route = "unmatched"
+		}
+		ctx, span := tracer().Start(ctx, c.Request.Method+" "+route,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(attribute.String("http.method", c.Request.Method), attribute.String("http.route", route)),
+		)
+		defer span.End()
+		c.Request = c.Request.WithContext(ctx)
+		c.Next()
+
+		status_code := c.Writer.Status()
+		span.SetAttributes(attribute.Int("http.status_code", status_code))
+		if status_code >= 500 {
+			span.SetStatus(codes.Error, strconv.Itoa(status_code)+" "+http.StatusText(status_code))
+		}
+	}
+}
+
+// InjectHTTP starts a client span for a REST request to another NEST service and sends its W3C trace context in the request headers
+func InjectHTTP(req *http.Request) (*http.Request, trace.Span) {
+	ctx, span := tracer().Start(req.Context(), req.Method+" "+req.URL.Path,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("http.method", req.Method), attribute.String("http.url", req.URL.String())),
+	)
+	req = req.WithContext(ctx)
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+	return req, span
+}
+
+// metadataCarrier adapts the gRPC metadata to the propagation.TextMapCarrier interface
+type metadataCarrier metadata.MD
+
+func (m metadataCarrier) Get(key string) string {
+	if values := metadata.MD(m).Get(key); len(values) != 0 {
+		return values[0]
+	}
+	return ""
+}
+
+func (m metadataCarrier) Set(key string, value string) {
+	metadata.MD(m).Set(key, value)
+}
+
+func (m metadataCarrier) Keys() []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// UnaryClientInterceptor starts a client span for every gRPC call to another NEST service and sends its W3C trace context in the call metadata
+func UnaryClientInterceptor(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	ctx, span := tracer().Start(ctx, method, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attribute.String("rpc.method", method)))
+	md, ok := metadata.FromOutgoingContext(ctx)
+	if ok {
+		md = md.Copy()
+	} else {
+		md = metadata.MD{}
+	}
+	otel.GetTextMapPropagator().Inject(ctx, metadataCarrier(md))
+	err := invoker(metadata.NewOutgoingContext(ctx, md), method, req, reply, cc, opts...)
+	span.SetAttributes(attribute.String("rpc.grpc.status_code", status.Code(err).String()))
+	End(span, err)
+	return err
+}
+
+// UnaryServerInterceptor starts a server span for every gRPC call, child of the span whose W3C trace context is received in the call metadata
+func UnaryServerInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		ctx = otel.GetTextMapPropagator().Extract(ctx, metadataCarrier(md))
+	}
+	ctx, span := tracer().Start(ctx, info.FullMethod, trace.WithSpanKind(trace.SpanKindServer), trace.WithAttributes(attribute.String("rpc.method", info.FullMethod)))
+	resp, err := handler(ctx, req)
+	code := status.Code(err)
+	span.SetAttributes(attribute.String("rpc.grpc.status_code", code.String()))
+	switch code {
+	case grpc_codes.Internal, grpc_codes.Unknown, grpc_codes.DataLoss:
+		End(span, err)
+	default:
+		span.End()
+	}
+	return resp, err
+}
@@ -0,0 +1,119 @@
+/*
+NEST: Nebula Enrollment over Secure Transport - OpenAPI 3.0
+
+This package contains the OpenTelemetry tracing of the NEST services: the tracer provider setup and its exporters, the spans of the REST requests,
+of the gRPC calls and of the executed tools, and the W3C trace context propagation between the NEST service and the NEST CA and NEST config services.
+API version: 0.3.1
+Contact: gianmarco.decola@studio.unibo.it
+*/
+package tracing
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+
+	"github.com/m4rkdc/nebula_est/nest_service/pkg/config"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Name of the tracer of the NEST spans
+const tracer_name = "github.com/m4rkdc/nebula_est"
+
+func tracer() trace.Tracer {
+	return otel.Tracer(tracer_name)
+}
+
+// newExporter creates the span exporter selected in the tracing settings. The returned io.Closer closes the file of the file exporter
+func newExporter(cfg config.Tracing) (sdktrace.SpanExporter, io.Closer, error) {
+	switch cfg.Exporter {
+	case "stdout":
+		exporter, err := stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+		return exporter, nil, err
+	case "file":
+		file, err := os.OpenFile(cfg.File, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, nil, err
+		}
+		exporter, err := stdouttrace.New(stdouttrace.WithWriter(file))
+		if err != nil {
+			file.Close()
+			return nil, nil, err
+		}
+		return exporter, file, nil
+	case "otlp":
+		opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(cfg.Endpoint)}
+		if cfg.Insecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+		exporter, err := otlptracehttp.New(context.Background(), opts...)
+		return exporter, nil, err
+	}
+	return nil, nil, errors.New("unknown tracing exporter \"" + cfg.Exporter + "\"")
+}
+
+/*
+Setup sets up the tracing of the given NEST service from its tracing settings and the W3C trace context propagation.
+The spans are sampled, unless the caller's span was sampled, with the configured percentage, and exported in batches.
+The returned function flushes the pending spans and stops the exporter: it must be called before the service exits.
+With the none exporter the spans are not recorded, but the trace context received is still propagated.
+*/
+func Setup(cfg config.Tracing, service string) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	if cfg.Exporter == "none" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	exporter, file, err := newExporter(cfg)
+	if err != nil {
+		return nil, err
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", service))),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(float64(cfg.SamplePercent)/100))),
+	)
+	otel.SetTracerProvider(provider)
+	return func(ctx context.Context) error {
+		err := provider.Shutdown(ctx)
+		if file != nil {
+			file.Close()
+		}
+		return err
+	}, nil
+}
+
+// Start starts a span with the given name and attributes, child of the span carried by ctx
+func Start(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return tracer().Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// End ends span, recording err as the span status if not nil
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// CombinedOutput runs cmd in a span with the given name, child of the span carried by ctx, and returns its combined standard output and standard error
+func CombinedOutput(ctx context.Context, name string, cmd *exec.Cmd) ([]byte, error) {
+	_, span := Start(ctx, name, attribute.String("exec.command", cmd.Path))
+	out, err := cmd.CombinedOutput()
+	if cmd.ProcessState != nil {
+		span.SetAttributes(attribute.Int("exec.exit_code", cmd.ProcessState.ExitCode()))
+	}
+	End(span, err)
+	return out, err
+}
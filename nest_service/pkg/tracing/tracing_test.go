@@ -0,0 +1,129 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/assert/v2"
+	"github.com/m4rkdc/nebula_est/nest_service/pkg/config"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// recordSpans makes the spans recorded in memory for the duration of the test
+func recordSpans(t *testing.T) *tracetest.InMemoryExporter {
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() { provider.Shutdown(context.Background()) })
+	return exporter
+}
+
+func TestMiddleware(t *testing.T) {
+	exporter := recordSpans(t)
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(Middleware())
+	router.POST("/ncsr/:hostname/enroll", func(c *gin.Context) {
+		_, span := Start(c.Request.Context(), "sendCSR")
+		End(span, errors.New("nest_ca unavailable"))
+		c.Status(http.StatusServiceUnavailable)
+	})
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	//First test: the trace context of the client span is propagated to the server span, parent of the spans of the request handling
+	req, _ := http.NewRequest(http.MethodPost, server.URL+"/ncsr/host1/enroll", nil)
+	req, span := InjectHTTP(req)
+	resp, err := http.DefaultClient.Do(req)
+	assert.Equal(t, nil, err)
+	resp.Body.Close()
+	End(span, nil)
+
+	spans := exporter.GetSpans()
+	assert.Equal(t, 3, len(spans))
+	send_csr, server_span, client_span := spans[0], spans[1], spans[2]
+	assert.Equal(t, "POST /ncsr/:hostname/enroll", server_span.Name)
+	assert.Equal(t, client_span.SpanContext.TraceID(), server_span.SpanContext.TraceID())
+	assert.Equal(t, client_span.SpanContext.SpanID(), server_span.Parent.SpanID())
+	assert.Equal(t, server_span.SpanContext.SpanID(), send_csr.Parent.SpanID())
+
+	//Second test: the errors are recorded in the spans status
+	assert.Equal(t, codes.Error, send_csr.Status.Code)
+	assert.Equal(t, "nest_ca unavailable", send_csr.Status.Description)
+	assert.Equal(t, codes.Error, server_span.Status.Code)
+	assert.Equal(t, codes.Unset, client_span.Status.Code)
+}
+
+func TestGRPCPropagation(t *testing.T) {
+	exporter := recordSpans(t)
+
+	//First test: the trace context of the client span is sent in the call metadata and the server span is its child
+	invoker := func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+		md, _ := metadata.FromOutgoingContext(ctx)
+		server_ctx := metadata.NewIncomingContext(context.Background(), md)
+		_, err := UnaryServerInterceptor(server_ctx, req, &grpc.UnaryServerInfo{FullMethod: method}, func(ctx context.Context, req interface{}) (interface{}, error) {
+			return nil, nil
+		})
+		return err
+	}
+	err := UnaryClientInterceptor(context.Background(), "/nest.CaService/Sign", nil, nil, nil, invoker)
+	assert.Equal(t, nil, err)
+
+	spans := exporter.GetSpans()
+	assert.Equal(t, 2, len(spans))
+	assert.Equal(t, "/nest.CaService/Sign", spans[0].Name)
+	assert.Equal(t, spans[1].SpanContext.TraceID(), spans[0].SpanContext.TraceID())
+	assert.Equal(t, spans[1].SpanContext.SpanID(), spans[0].Parent.SpanID())
+}
+
+func TestCombinedOutput(t *testing.T) {
+	exporter := recordSpans(t)
+
+	//First test: a successful run is traced in a span with the given name
+	out, err := CombinedOutput(context.Background(), "go version", exec.Command("go", "version"))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, true, strings.HasPrefix(string(out), "go version"))
+	spans := exporter.GetSpans()
+	assert.Equal(t, "go version", spans[0].Name)
+	assert.Equal(t, codes.Unset, spans[0].Status.Code)
+
+	//Second test: a failed run is recorded in the span status
+	_, err = CombinedOutput(context.Background(), "go unknown", exec.Command("go", "unknown"))
+	assert.NotEqual(t, nil, err)
+	spans = exporter.GetSpans()
+	assert.Equal(t, codes.Error, spans[1].Status.Code)
+}
+
+func TestSetup(t *testing.T) {
+	defer otel.SetTracerProvider(otel.GetTracerProvider())
+	file := filepath.Join(t.TempDir(), "traces.json")
+
+	//First test: the file exporter writes the spans to the file when the tracing is shut down
+	shutdown, err := Setup(config.Tracing{Exporter: "file", File: file, SamplePercent: 100}, "nest_service")
+	assert.Equal(t, nil, err)
+	_, span := Start(context.Background(), "requestConf")
+	End(span, nil)
+	assert.Equal(t, nil, shutdown(context.Background()))
+	b, _ := os.ReadFile(file)
+	assert.Equal(t, true, strings.Contains(string(b), `"Name":"requestConf"`))
+	assert.Equal(t, true, strings.Contains(string(b), `"nest_service"`))
+
+	//Second test: an unknown exporter is an error
+	_, err = Setup(config.Tracing{Exporter: "jaeger"}, "nest_service")
+	assert.NotEqual(t, nil, err)
+}
@@ -0,0 +1,76 @@
+package utils
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"os"
+	"strings"
+)
+
+// loadMutualTLS loads the key pair (name.crt, name.key) of the NEST service name and the internal x509 CA certificate (ca.crt) found in folder
+func loadMutualTLS(folder string, name string) (tls.Certificate, *x509.CertPool, error) {
+	cert, err := tls.LoadX509KeyPair(folder+name+".crt", folder+name+".key")
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+	ca, err := os.ReadFile(folder + "ca.crt")
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return tls.Certificate{}, nil, errors.New("no valid PEM certificate found in " + folder + "ca.crt")
+	}
+	return cert, pool, nil
+}
+
+/*
+MutualTLSServerConfig returns the TLS configuration of the servers of the NEST service name in mtls transport mode. The service presents its certificate
+and only accepts the clients with a certificate issued by the internal x509 CA whose identity, a DNS name of the certificate (e.g., nest_service), is one of peers.
+*/
+func MutualTLSServerConfig(folder string, name string, peers []string) (*tls.Config, error) {
+	cert, pool, err := loadMutualTLS(folder, name)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		MinVersion:   tls.VersionTLS13,
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		VerifyConnection: func(cs tls.ConnectionState) error {
+			return verifyPeer(cs, peers)
+		},
+	}, nil
+}
+
+/*
+MutualTLSClientConfig returns the TLS configuration with which the NEST service name calls the other NEST services in mtls transport mode.
+The service presents its certificate and only accepts the servers with a certificate issued by the internal x509 CA whose identity is the ServerName
+of the configuration, to be set to the name of the service called (e.g., nest_ca).
+*/
+func MutualTLSClientConfig(folder string, name string) (*tls.Config, error) {
+	cert, pool, err := loadMutualTLS(folder, name)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		MinVersion:   tls.VersionTLS13,
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      pool,
+	}, nil
+}
+
+// verifyPeer returns an error if the identity of the peer certificate is not one of peers
+func verifyPeer(cs tls.ConnectionState, peers []string) error {
+	if len(cs.PeerCertificates) == 0 {
+		return errors.New("no peer certificate")
+	}
+	for _, peer := range peers {
+		if cs.PeerCertificates[0].VerifyHostname(peer) == nil {
+			return nil
+		}
+	}
+	return errors.New("peer " + strings.Join(cs.PeerCertificates[0].DNSNames, ",") + " is not allowed: expected one of " + strings.Join(peers, ","))
+}
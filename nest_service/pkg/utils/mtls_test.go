@@ -0,0 +1,86 @@
+package utils
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/go-playground/assert/v2"
+)
+
+// writeCert writes to folder the PEM certificate (name.crt) and key (name.key) of name, signed by the parent certificate and key, self-signed if nil
+func writeCert(t *testing.T, folder string, name string, parent *x509.Certificate, parent_key *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage = x509.KeyUsageCertSign
+		parent, parent_key = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parent_key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key_der, _ := x509.MarshalECPrivateKey(key)
+	os.WriteFile(folder+name+".crt", pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	os.WriteFile(folder+name+".key", pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: key_der}), 0600)
+	cert, _ := x509.ParseCertificate(der)
+	return cert, key
+}
+
+func TestMutualTLS(t *testing.T) {
+	folder := t.TempDir() + "/"
+	ca, ca_key := writeCert(t, folder, "ca", nil, nil)
+	for _, name := range []string{"nest_service", "nest_ca", "nest_client"} {
+		writeCert(t, folder, name, ca, ca_key)
+	}
+
+	server_config, err := MutualTLSServerConfig(folder, "nest_ca", []string{"nest_service"})
+	assert.Equal(t, nil, err)
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.TLS = server_config
+	server.StartTLS()
+	defer server.Close()
+
+	get := func(client_name string, server_name string) error {
+		client_config, err := MutualTLSClientConfig(folder, client_name)
+		assert.Equal(t, nil, err)
+		client_config.ServerName = server_name
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: client_config}}
+		resp, err := client.Get(server.URL)
+		if err == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+
+	//First test: nest_service calls nest_ca
+	assert.Equal(t, nil, get("nest_service", "nest_ca"))
+
+	//Second test: a client whose identity is not a peer of nest_ca is rejected
+	assert.NotEqual(t, nil, get("nest_client", "nest_ca"))
+
+	//Third test: a server without the expected identity is rejected
+	assert.NotEqual(t, nil, get("nest_service", "nest_config"))
+
+	//Fourth test: a missing key pair is an error
+	_, err = MutualTLSServerConfig(folder, "nest_config", []string{"nest_service"})
+	assert.NotEqual(t, nil, err)
+}
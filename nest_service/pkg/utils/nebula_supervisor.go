@@ -0,0 +1,273 @@
+package utils
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/m4rkdc/nebula_est/nest_service/pkg/metrics"
+)
+
+// State of the Nebula process run by a NebulaSupervisor
+type NebulaState string
+
+const (
+	NEBULA_STARTING   NebulaState = "starting"
+	NEBULA_RUNNING    NebulaState = "running"
+	NEBULA_RESTARTING NebulaState = "restarting"
+	NEBULA_STOPPED    NebulaState = "stopped"
+)
+
+// Status of the Nebula process run by a NebulaSupervisor
+type NebulaStatus struct {
+	State NebulaState
+	//PID of the running Nebula process, 0 if not running
+	Pid int
+	//Number of times Nebula has been restarted after exiting
+	Restarts int
+	//Why Nebula last exited or could not be started
+	LastError string
+}
+
+/*
+NebulaSupervisor runs the Nebula overlay of a NEST service (nebula -config config.yml, from the Nebula folder of the service) and watches it:
+if Nebula exits, it is restarted after a backoff that doubles at every consecutive failure, from MinBackoff up to MaxBackoff.
+*/
+type NebulaSupervisor struct {
+	//Backoff before the first restart of a failing Nebula process, reset when Nebula runs for more than MaxBackoff
+	MinBackoff time.Duration
+	//Maximum backoff between two restarts
+	MaxBackoff time.Duration
+	//Maximum time given to Nebula to bring up its interface at startup
+	StartTimeout time.Duration
+	//Maximum time given to Nebula to exit after a SIGTERM, before it is killed
+	StopTimeout time.Duration
+
+	bin          string
+	config       string
+	nebula_log   io.Writer
+	interface_up func() (bool, error)
+
+	mu         sync.Mutex
+	cmd        *exec.Cmd
+	state      NebulaState
+	restarts   int
+	last_error string
+	stopping   bool
+	stop       chan struct{}
+	done       chan struct{}
+}
+
+// NewNebulaSupervisor creates the supervisor of the Nebula binary and configuration found in nebula_folder. The Nebula output is written to nebula_log
+func NewNebulaSupervisor(nebula_folder string, nebula_log io.Writer) *NebulaSupervisor {
+	return &NebulaSupervisor{
+		MinBackoff:   time.Second,
+		MaxBackoff:   time.Minute,
+		StartTimeout: 10 * time.Second,
+		StopTimeout:  5 * time.Second,
+		bin:          nebula_folder + "nebula",
+		config:       nebula_folder + "config.yml",
+		nebula_log:   nebula_log,
+		interface_up: NebulaInterfaceUp,
+		state:        NEBULA_STOPPED,
+	}
+}
+
+// spawn starts a new Nebula process and returns a channel receiving its exit error. The caller holds s.mu
+func (s *NebulaSupervisor) spawn() (<-chan error, error) {
+	cmd := exec.Command(s.bin, "-config", s.config)
+	cmd.Stdout = s.nebula_log
+	cmd.Stderr = s.nebula_log
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	s.cmd = cmd
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+	return exited, nil
+}
+
+// waitInterface waits for the Nebula interface to be up, for at most StartTimeout
+func (s *NebulaSupervisor) waitInterface(exited <-chan error) error {
+	deadline := time.After(s.StartTimeout)
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		up, err := s.interface_up()
+		if err != nil {
+			return err
+		}
+		if up {
+			return nil
+		}
+		select {
+		case err := <-exited:
+			return errors.New("nebula exited at startup: " + exitReason(err))
+		case <-deadline:
+			return errors.New("could not setup a nebula tunnel: no Nebula interface is up")
+		case <-ticker.C:
+		}
+	}
+}
+
+/*
+Start checks that the Nebula binary is present and executable, starts Nebula and waits for its interface to be up.
+Nebula is then supervised until Stop is called. If the interface is not up within StartTimeout, Nebula is killed and an error is returned.
+*/
+func (s *NebulaSupervisor) Start() error {
+	info, err := os.Stat(s.bin)
+	if err != nil {
+		slog.Error("The nebula binary doesn't exist. Please provide it to the service before starting it", "path", s.bin)
+		return err
+	}
+	if !IsExecOwner(info.Mode()) {
+		os.Chmod(s.bin, 0700)
+	}
+
+	s.mu.Lock()
+	s.state = NEBULA_STARTING
+	exited, err := s.spawn()
+	if err != nil {
+		s.state = NEBULA_STOPPED
+		s.last_error = err.Error()
+		s.mu.Unlock()
+		return err
+	}
+	cmd := s.cmd
+	s.mu.Unlock()
+
+	if err := s.waitInterface(exited); err != nil {
+		cmd.Process.Kill()
+		s.mu.Lock()
+		s.state = NEBULA_STOPPED
+		s.last_error = err.Error()
+		s.mu.Unlock()
+		return err
+	}
+
+	s.mu.Lock()
+	s.state = NEBULA_RUNNING
+	s.stop = make(chan struct{})
+	s.done = make(chan struct{})
+	s.mu.Unlock()
+	go s.supervise(exited)
+	return nil
+}
+
+// exitReason describes why a Nebula process exited
+func exitReason(err error) string {
+	if err == nil {
+		return "exited with status 0"
+	}
+	return err.Error()
+}
+
+// supervise restarts Nebula, with backoff, every time it exits, until Stop is called
+func (s *NebulaSupervisor) supervise(exited <-chan error) {
+	defer close(s.done)
+	backoff := s.MinBackoff
+	started := time.Now()
+	for {
+		err := <-exited
+		s.mu.Lock()
+		if s.stopping {
+			s.state = NEBULA_STOPPED
+			s.mu.Unlock()
+			return
+		}
+		s.state = NEBULA_RESTARTING
+		s.last_error = exitReason(err)
+		s.mu.Unlock()
+		if time.Since(started) > s.MaxBackoff {
+			backoff = s.MinBackoff
+		}
+		slog.Error("Nebula exited, restarting it", "error", exitReason(err), "backoff", backoff)
+
+		select {
+		case <-s.stop:
+			s.mu.Lock()
+			s.state = NEBULA_STOPPED
+			s.mu.Unlock()
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > s.MaxBackoff {
+			backoff = s.MaxBackoff
+		}
+
+		s.mu.Lock()
+		if s.stopping {
+			s.state = NEBULA_STOPPED
+			s.mu.Unlock()
+			return
+		}
+		s.restarts++
+		metrics.NebulaRestarts.Inc()
+		started = time.Now()
+		exited, err = s.spawn()
+		if err != nil {
+			failed := make(chan error, 1)
+			failed <- err
+			exited = failed
+		} else {
+			s.state = NEBULA_RUNNING
+			slog.Info("Nebula restarted", "pid", s.cmd.Process.Pid)
+		}
+		s.mu.Unlock()
+	}
+}
+
+// Status returns the current status of the supervised Nebula process
+func (s *NebulaSupervisor) Status() NebulaStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	status := NebulaStatus{State: s.state, Restarts: s.restarts, LastError: s.last_error}
+	if s.state == NEBULA_RUNNING && s.cmd != nil {
+		status.Pid = s.cmd.Process.Pid
+	}
+	return status
+}
+
+// Reload sends a SIGHUP to Nebula, so that it reloads its configuration. It is not supported on Windows
+func (s *NebulaSupervisor) Reload() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.state != NEBULA_RUNNING {
+		return errors.New("nebula is " + string(s.state))
+	}
+	return s.cmd.Process.Signal(syscall.SIGHUP)
+}
+
+/*
+Stop stops the supervision and shuts Nebula down: it is sent a SIGTERM (killed on Windows) and killed if it does not exit within StopTimeout.
+Stop returns once Nebula has exited.
+*/
+func (s *NebulaSupervisor) Stop() {
+	s.mu.Lock()
+	if s.stopping || s.done == nil {
+		s.mu.Unlock()
+		return
+	}
+	s.stopping = true
+	close(s.stop)
+	process := s.cmd.Process
+	s.mu.Unlock()
+
+	if err := process.Signal(syscall.SIGTERM); err != nil {
+		process.Kill()
+	}
+	select {
+	case <-s.done:
+	case <-time.After(s.StopTimeout):
+		slog.Warn("Nebula did not exit in time, killing it")
+		process.Kill()
+		<-s.done
+	}
+	slog.Info("Nebula stopped")
+}
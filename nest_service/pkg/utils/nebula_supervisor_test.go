@@ -0,0 +1,82 @@
+package utils
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-playground/assert/v2"
+)
+
+// fakeNebula creates a nebula script, in place of the Nebula binary, that counts the SIGHUPs received in the hup file until it is terminated
+func fakeNebula(t *testing.T) string {
+	folder := t.TempDir() + "/"
+	script := "#!/bin/sh\ntrap 'echo hup >> " + folder + "hup' HUP\ntrap 'exit 0' TERM\nwhile true; do sleep 0.05; done\n"
+	os.WriteFile(folder+"nebula", []byte(script), 0700)
+	os.WriteFile(folder+"config.yml", []byte{}, 0600)
+	return folder
+}
+
+// waitFor polls the status of the supervisor until it satisfies cond, failing the test after a second
+func waitFor(t *testing.T, s *NebulaSupervisor, cond func(NebulaStatus) bool) NebulaStatus {
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if status := s.Status(); cond(status) {
+			return status
+		}
+	}
+	t.Fatalf("unexpected Nebula status: %+v", s.Status())
+	return NebulaStatus{}
+}
+
+func TestNebulaSupervisor(t *testing.T) {
+	folder := fakeNebula(t)
+	s := NewNebulaSupervisor(folder, os.Stderr)
+	s.MinBackoff = 10 * time.Millisecond
+	s.interface_up = func() (bool, error) { return true, nil }
+
+	//First test: Nebula is started and running
+	assert.Equal(t, nil, s.Start())
+	status := s.Status()
+	assert.Equal(t, NEBULA_RUNNING, status.State)
+	assert.NotEqual(t, 0, status.Pid)
+
+	//Second test: Nebula is restarted after it is killed
+	p, _ := os.FindProcess(status.Pid)
+	p.Kill()
+	restarted := waitFor(t, s, func(st NebulaStatus) bool { return st.State == NEBULA_RUNNING && st.Restarts == 1 })
+	assert.NotEqual(t, status.Pid, restarted.Pid)
+	assert.Equal(t, "signal: killed", restarted.LastError)
+
+	//Third test: Reload sends a SIGHUP to Nebula
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, nil, s.Reload())
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if _, err := os.Stat(folder + "hup"); err == nil {
+			break
+		}
+	}
+	b, _ := os.ReadFile(folder + "hup")
+	assert.Equal(t, "hup\n", string(b))
+
+	//Fourth test: Stop terminates Nebula, which is not restarted
+	s.Stop()
+	assert.Equal(t, NEBULA_STOPPED, s.Status().State)
+	assert.NotEqual(t, nil, s.Reload())
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, 1, s.Status().Restarts)
+}
+
+func TestNebulaSupervisorStart(t *testing.T) {
+	//First test: the start fails if the Nebula binary is missing
+	s := NewNebulaSupervisor(filepath.Join(t.TempDir(), "missing")+"/", os.Stderr)
+	assert.NotEqual(t, nil, s.Start())
+
+	//Second test: the start fails, and Nebula is killed, if its interface is not up in time
+	s = NewNebulaSupervisor(fakeNebula(t), os.Stderr)
+	s.StartTimeout = 200 * time.Millisecond
+	s.interface_up = func() (bool, error) { return false, nil }
+	assert.NotEqual(t, nil, s.Start())
+	assert.Equal(t, NEBULA_STOPPED, s.Status().State)
+	s.Stop()
+}
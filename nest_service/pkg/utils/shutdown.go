@@ -0,0 +1,92 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+/*
+WaitForShutdown blocks until the service receives a SIGTERM or a SIGINT, returning nil, or until an error is received from failed
+(e.g., because a server stopped serving), returning it. reload is called at every SIGHUP received meanwhile, outside of the signal loop:
+the reloads run one at a time, the SIGHUPs received during a reload trigger a single other one, and their context is canceled when WaitForShutdown returns,
+so that a reload in progress never delays the shutdown.
+*/
+func WaitForShutdown(reload func(ctx context.Context), failed <-chan error) error {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
+	defer signal.Stop(signals)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	reloads := make(chan struct{}, 1)
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-reloads:
+				reload(ctx)
+			}
+		}
+	}()
+
+	for {
+		select {
+		case err := <-failed:
+			return err
+		case sig := <-signals:
+			if sig == syscall.SIGHUP {
+				select {
+				case reloads <- struct{}{}:
+				default:
+					//A reload is already pending
+				}
+				continue
+			}
+			slog.Info("Signal received, shutting down", "signal", sig.String())
+			return nil
+		}
+	}
+}
+
+// Serve runs serve, e.g. the ListenAndServe method of an http.Server or the Serve method of a grpc.Server, sending to failed the error it returns unless the server was shut down
+func Serve(serve func() error, failed chan<- error) {
+	go func() {
+		if err := serve(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			failed <- err
+		}
+	}()
+}
+
+/*
+ShutdownHTTP stops srv from accepting new requests and waits for the requests in progress to complete.
+If they do not complete before ctx is done, their connections are closed and ctx.Err() is returned.
+*/
+func ShutdownHTTP(ctx context.Context, srv *http.Server) error {
+	if err := srv.Shutdown(ctx); err != nil {
+		srv.Close()
+		return err
+	}
+	return nil
+}
+
+// WaitGroup waits for wg, or until ctx is done, returning ctx.Err() in the latter case
+func WaitGroup(ctx context.Context, wg *sync.WaitGroup) error {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,109 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/go-playground/assert/v2"
+)
+
+func TestWaitForShutdown(t *testing.T) {
+	//First test: SIGHUPs trigger a reload, a SIGTERM the shutdown
+	reloads := make(chan struct{}, 1)
+	done := make(chan error, 1)
+	go func() {
+		done <- WaitForShutdown(func(ctx context.Context) { reloads <- struct{}{} }, nil)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	self, _ := os.FindProcess(os.Getpid())
+	self.Signal(syscall.SIGHUP)
+	select {
+	case <-reloads:
+	case <-time.After(time.Second):
+		t.Fatal("SIGHUP did not trigger a reload")
+	}
+	self.Signal(syscall.SIGTERM)
+	select {
+	case err := <-done:
+		assert.Equal(t, nil, err)
+	case <-time.After(time.Second):
+		t.Fatal("SIGTERM did not trigger the shutdown")
+	}
+
+	//Second test: a SIGTERM received during a reload shuts down right away, canceling the reload
+	canceled := make(chan struct{})
+	go func() {
+		done <- WaitForShutdown(func(ctx context.Context) {
+			reloads <- struct{}{}
+			<-ctx.Done()
+			close(canceled)
+		}, nil)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	self.Signal(syscall.SIGHUP)
+	<-reloads
+	self.Signal(syscall.SIGTERM)
+	select {
+	case err := <-done:
+		assert.Equal(t, nil, err)
+	case <-time.After(time.Second):
+		t.Fatal("the reload delayed the shutdown")
+	}
+	select {
+	case <-canceled:
+	case <-time.After(time.Second):
+		t.Fatal("the reload was not canceled")
+	}
+
+	//Third test: the error of a failed server is returned
+	failed := make(chan error, 1)
+	Serve(func() error { return errors.New("address already in use") }, failed)
+	assert.Equal(t, "address already in use", WaitForShutdown(func(ctx context.Context) {}, failed).Error())
+}
+
+func TestShutdownHTTP(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		w.WriteHeader(http.StatusCreated)
+	}))
+	server.Start()
+	defer server.Close()
+
+	//First test: the request in progress completes before the shutdown returns
+	codes := make(chan int, 1)
+	go func() {
+		resp, err := http.Get(server.URL)
+		if err != nil {
+			codes <- 0
+			return
+		}
+		resp.Body.Close()
+		codes <- resp.StatusCode
+	}()
+	<-started
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		close(release)
+	}()
+	assert.Equal(t, nil, ShutdownHTTP(context.Background(), server.Config))
+	assert.Equal(t, http.StatusCreated, <-codes)
+
+	//Second test: WaitGroup gives up when the deadline expires
+	var wg sync.WaitGroup
+	wg.Add(1)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, WaitGroup(ctx, &wg))
+	wg.Done()
+	assert.Equal(t, nil, WaitGroup(context.Background(), &wg))
+}
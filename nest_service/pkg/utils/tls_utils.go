@@ -0,0 +1,254 @@
+/*
+NEST: Nebula Enrollment over Secure Transport - OpenAPI 3.0
+
+This package contains system-wide utility functions.
+API version: 0.3.1
+Contact: gianmarco.decola@studio.unibo.it
+*/
+package utils
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tls_versions maps the accepted TLS_MIN_VERSION and TLS_MAX_VERSION values to the crypto/tls constants
+var tls_versions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// tls_curves maps the accepted TLS_CURVES names to the crypto/tls curve identifiers
+var tls_curves = map[string]tls.CurveID{
+	"X25519": tls.X25519,
+	"P256":   tls.CurveP256,
+	"P384":   tls.CurveP384,
+	"P521":   tls.CurveP521,
+}
+
+// tls_client_auth maps the accepted TLS_CLIENT_AUTH values to the crypto/tls client authentication policies
+var tls_client_auth = map[string]tls.ClientAuthType{
+	"none":            tls.NoClientCert,
+	"request":         tls.RequestClientCert,
+	"require":         tls.RequireAnyClientCert,
+	"verify_if_given": tls.VerifyClientCertIfGiven,
+	"require_verify":  tls.RequireAndVerifyClientCert,
+}
+
+// splitList splits a comma separated configuration value, dropping empty entries
+func splitList(list string) []string {
+	var values []string
+	for _, v := range strings.Split(list, ",") {
+		if v = strings.TrimSpace(v); len(v) != 0 {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+// ParseTLSVersion converts a TLS version in the "1.x" form to its crypto/tls constant
+func ParseTLSVersion(version string) (uint16, error) {
+	v, ok := tls_versions[strings.TrimSpace(version)]
+	if !ok {
+		return 0, fmt.Errorf("unknown TLS version %q", version)
+	}
+	return v, nil
+}
+
+/*
+ParseCipherSuites converts a comma separated list of IANA cipher suite names to their crypto/tls identifiers.
+Only the suites considered secure by crypto/tls are accepted. TLS 1.3 suites are accepted too, even though Go does not allow to configure them.
+*/
+func ParseCipherSuites(suites string) ([]uint16, error) {
+	known := make(map[string]uint16)
+	for _, s := range tls.CipherSuites() {
+		known[s.Name] = s.ID
+	}
+
+	var ids []uint16
+	for _, name := range splitList(suites) {
+		id, ok := known[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown or insecure cipher suite %q", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// ParseCurves converts a comma separated list of curve names (X25519, P256, P384, P521) to their crypto/tls identifiers
+func ParseCurves(curves string) ([]tls.CurveID, error) {
+	var ids []tls.CurveID
+	for _, name := range splitList(curves) {
+		id, ok := tls_curves[strings.ToUpper(name)]
+		if !ok {
+			return nil, fmt.Errorf("unknown curve %q", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// ParseClientAuth converts a TLS_CLIENT_AUTH value to its crypto/tls client authentication policy
+func ParseClientAuth(client_auth string) (tls.ClientAuthType, error) {
+	v, ok := tls_client_auth[strings.ToLower(strings.TrimSpace(client_auth))]
+	if !ok {
+		return tls.NoClientCert, fmt.Errorf("unknown client authentication policy %q", client_auth)
+	}
+	return v, nil
+}
+
+/*
+BuildTLSConfig creates the tls.Config of the nest_service server from the TLS_* settings.
+If client_cas is not empty, the PEM certificates it contains are used to verify the client certificates, following the client_auth policy
+(verify_if_given if empty). The server certificate is not loaded here: it has to be provided through GetCertificate.
+*/
+func BuildTLSConfig(min_version, max_version, cipher_suites, curves, client_cas, client_auth string) (*tls.Config, error) {
+	var (
+		tls_config = tls.Config{PreferServerCipherSuites: true}
+		err        error
+	)
+
+	if tls_config.MinVersion, err = ParseTLSVersion(min_version); err != nil {
+		return nil, err
+	}
+	if tls_config.MaxVersion, err = ParseTLSVersion(max_version); err != nil {
+		return nil, err
+	}
+	if tls_config.MinVersion > tls_config.MaxVersion {
+		return nil, errors.New("the minimum TLS version is greater than the maximum TLS version")
+	}
+	if tls_config.CipherSuites, err = ParseCipherSuites(cipher_suites); err != nil {
+		return nil, err
+	}
+	if tls_config.CurvePreferences, err = ParseCurves(curves); err != nil {
+		return nil, err
+	}
+
+	if len(client_cas) != 0 {
+		b, err := os.ReadFile(client_cas)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("no valid PEM certificate found in %s", client_cas)
+		}
+		tls_config.ClientCAs = pool
+		if len(client_auth) == 0 {
+			client_auth = "verify_if_given"
+		}
+	}
+	if len(client_auth) != 0 {
+		if tls_config.ClientAuth, err = ParseClientAuth(client_auth); err != nil {
+			return nil, err
+		}
+	}
+
+	return &tls_config, nil
+}
+
+/*
+CertReloader keeps the TLS key pair of a server in memory and reloads it from disk when asked to, or when the files change.
+Its GetCertificate method is meant to be used as tls.Config.GetCertificate: a reload only affects new handshakes,
+so the connections (and enrollments) already in progress are not dropped.
+*/
+type CertReloader struct {
+	certFile string
+	keyFile  string
+
+	mu       sync.RWMutex
+	cert     *tls.Certificate
+	modTimes [2]time.Time
+}
+
+// NewCertReloader loads the given key pair and returns a CertReloader serving it
+func NewCertReloader(cert_file, key_file string) (*CertReloader, error) {
+	r := &CertReloader{certFile: cert_file, keyFile: key_file}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// currentModTimes returns the last modification times of the certificate and key files
+func (r *CertReloader) currentModTimes() ([2]time.Time, error) {
+	var mod_times [2]time.Time
+	for i, f := range []string{r.certFile, r.keyFile} {
+		info, err := os.Stat(f)
+		if err != nil {
+			return mod_times, err
+		}
+		mod_times[i] = info.ModTime()
+	}
+	return mod_times, nil
+}
+
+/*
+Reload reads the key pair from disk and, if it is valid, replaces the one currently served.
+If the new key pair can't be loaded (e.g., the certificate has been renewed but the key not yet), the old one keeps being served.
+*/
+func (r *CertReloader) Reload() error {
+	mod_times, err := r.currentModTimes()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cert = &cert
+	r.modTimes = mod_times
+	return nil
+}
+
+// Changed reports if the certificate or the key files have been modified since the last successful reload
+func (r *CertReloader) Changed() bool {
+	mod_times, err := r.currentModTimes()
+	if err != nil {
+		return false
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return mod_times != r.modTimes
+}
+
+// GetCertificate returns the key pair currently served. It implements the tls.Config.GetCertificate callback
+func (r *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
+
+// Watch checks every interval if the key pair files have changed and reloads them if so, until stop is closed
+func (r *CertReloader) Watch(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if !r.Changed() {
+				continue
+			}
+			if err := r.Reload(); err != nil {
+				slog.Warn("Could not reload the TLS key pair, keeping the previous one", "error", err)
+				continue
+			}
+			slog.Info("TLS key pair reloaded", "file", r.certFile)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package utils
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-playground/assert/v2"
+)
+
+// writeKeyPair writes a self-signed ECDSA key pair for common_name to cert_file and key_file
+func writeKeyPair(t *testing.T, cert_file, key_file, common_name string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: common_name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key_der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(cert_file, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	os.WriteFile(key_file, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: key_der}), 0600)
+}
+
+func TestBuildTLSConfig(t *testing.T) {
+	//First test: default settings
+	tls_config, err := BuildTLSConfig("1.2", "1.3", "TLS_AES_256_GCM_SHA384,TLS_CHACHA20_POLY1305_SHA256,TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256", "", "", "")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, uint16(tls.VersionTLS12), tls_config.MinVersion)
+	assert.Equal(t, uint16(tls.VersionTLS13), tls_config.MaxVersion)
+	assert.Equal(t, 3, len(tls_config.CipherSuites))
+	assert.Equal(t, tls.NoClientCert, tls_config.ClientAuth)
+
+	//Second test: curves
+	tls_config, err = BuildTLSConfig("1.3", "1.3", "", "x25519, P256", "", "")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []tls.CurveID{tls.X25519, tls.CurveP256}, tls_config.CurvePreferences)
+
+	//Third test: invalid settings
+	_, err = BuildTLSConfig("1.3", "1.2", "", "", "", "")
+	assert.NotEqual(t, nil, err)
+	_, err = BuildTLSConfig("1.2", "1.3", "TLS_RSA_WITH_RC4_128_SHA", "", "", "")
+	assert.NotEqual(t, nil, err)
+	_, err = BuildTLSConfig("1.2", "1.3", "", "P224", "", "")
+	assert.NotEqual(t, nil, err)
+
+	//Fourth test: client CAs
+	dir := t.TempDir()
+	writeKeyPair(t, filepath.Join(dir, "ca.pem"), filepath.Join(dir, "ca-key.pem"), "client ca")
+	tls_config, err = BuildTLSConfig("1.2", "1.3", "", "", filepath.Join(dir, "ca.pem"), "")
+	assert.Equal(t, nil, err)
+	assert.NotEqual(t, nil, tls_config.ClientCAs)
+	assert.Equal(t, tls.VerifyClientCertIfGiven, tls_config.ClientAuth)
+}
+
+func TestCertReloader(t *testing.T) {
+	dir := t.TempDir()
+	cert_file := filepath.Join(dir, "crt.pem")
+	key_file := filepath.Join(dir, "key.pem")
+
+	//First test: missing key pair
+	_, err := NewCertReloader(cert_file, key_file)
+	assert.NotEqual(t, nil, err)
+
+	//Second test: key pair loaded
+	writeKeyPair(t, cert_file, key_file, "first")
+	r, err := NewCertReloader(cert_file, key_file)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, false, r.Changed())
+	first, _ := r.GetCertificate(nil)
+
+	//Third test: invalid key pair on disk, the previous one is still served
+	os.WriteFile(key_file, []byte("not a key"), 0600)
+	os.Chtimes(key_file, time.Now().Add(time.Minute), time.Now().Add(time.Minute))
+	assert.Equal(t, true, r.Changed())
+	assert.NotEqual(t, nil, r.Reload())
+	served, _ := r.GetCertificate(nil)
+	assert.Equal(t, first, served)
+
+	//Fourth test: renewed key pair is served after the reload
+	writeKeyPair(t, cert_file, key_file, "second")
+	os.Chtimes(cert_file, time.Now().Add(2*time.Minute), time.Now().Add(2*time.Minute))
+	assert.Equal(t, nil, r.Reload())
+	assert.Equal(t, false, r.Changed())
+	served, _ = r.GetCertificate(nil)
+	leaf, _ := x509.ParseCertificate(served.Certificate[0])
+	assert.Equal(t, "second", leaf.Subject.CommonName)
+}